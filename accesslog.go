@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/anaminus/rbxark/server"
+)
+
+// An access log contains each request answered by serve as JSON lines, each
+// encoding one server.Access. The log is rotated once it reaches its maximum
+// size, so that older requests are in numbered backups next to it.
+
+// accessLog appends the requests answered by serve to an access log.
+type accessLog struct {
+	mu sync.Mutex
+	rotatingFile
+}
+
+// accessLogFile returns the access log configured by config, which is not yet
+// opened.
+func accessLogFile(config Serve) rotatingFile {
+	f := rotatingFile{
+		path:    config.AccessLog,
+		maxSize: config.AccessLogMaxSize,
+		backups: config.AccessLogBackups,
+	}
+	switch {
+	case f.maxSize == 0:
+		f.maxSize = DefaultServeAccessLogMaxSize
+	case f.maxSize < 0:
+		f.maxSize = 0
+	}
+	switch {
+	case f.backups == 0:
+		f.backups = DefaultServeAccessLogBackups
+	case f.backups < 0:
+		f.backups = 0
+	}
+	return f
+}
+
+// openAccessLog opens the access log configured by config. Returns nil if the
+// config has no access log.
+func openAccessLog(config Serve) (*accessLog, error) {
+	if config.AccessLog == "" {
+		return nil, nil
+	}
+	l := &accessLog{rotatingFile: accessLogFile(config)}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return l, nil
+}
+
+// record appends a request to the log. Because the request has already been
+// answered, an error is logged rather than returned.
+func (l *accessLog) record(a server.Access) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("encode access: %s", err)
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.full(len(b)) {
+		if err := l.rotate(); err != nil {
+			log.Printf("rotate access log: %s", err)
+		}
+		if l.file == nil {
+			return
+		}
+	}
+	if _, err := l.write(b); err != nil {
+		log.Printf("write access log: %s", err)
+	}
+}
+
+// Close closes the log.
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rotatingFile.Close()
+}
+
+// readAccessLog calls fn with each request of the access log configured by
+// config, from the oldest backup to the current log, stopping at the first
+// error returned by fn. Files of the log that do not exist are skipped.
+func readAccessLog(config Serve, fn func(a server.Access) error) error {
+	f := accessLogFile(config)
+	for i := f.backups; i >= 0; i-- {
+		if err := readAccessFile(f.backup(i), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAccessFile(path string, fn func(a server.Access) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var a server.Access
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			return fmt.Errorf("decode access log %s: line %d: %w", path, line, err)
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("read access log %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anaminus/rbxark/server"
+)
+
+func TestAccessLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbxark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Each record is larger than half the maximum size, so each is rotated
+	// into a backup, and the oldest are discarded.
+	config := Serve{
+		AccessLog:        filepath.Join(dir, "access.log"),
+		AccessLogMaxSize: 100,
+		AccessLogBackups: 2,
+	}
+	l, err := openAccessLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		l.record(server.Access{Time: int64(i), Path: "/objects/d41d8cd98f00b204e9800998ecf8427e", Status: 200})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var times []int64
+	err = readAccessLog(config, func(a server.Access) error {
+		times = append(times, a.Time)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{3, 4, 5}; !reflect.DeepEqual(times, want) {
+		t.Errorf("expected records %v, got %v", want, times)
+	}
+}
+
+func TestDownloadCountsTop(t *testing.T) {
+	c := downloadCounts{}
+	for _, a := range []struct {
+		name   string
+		client string
+		bytes  int64
+	}{
+		{"a", "192.0.2.1", 10},
+		{"b", "192.0.2.1", 5},
+		{"b", "192.0.2.2", 5},
+		{"c", "192.0.2.1", 20},
+		{"d", "192.0.2.1", 20},
+	} {
+		c.add(a.name, server.Access{Client: a.client, Bytes: a.bytes})
+	}
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, []string{"b", "c", "d", "a"}},
+		{2, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		var names []string
+		for _, count := range c.top(tt.n) {
+			names = append(names, count.name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("top %d: expected %v, got %v", tt.n, tt.want, names)
+		}
+	}
+	if b := c["b"]; b.downloads != 2 || b.bytes != 10 || len(b.clients) != 2 {
+		t.Errorf("b: expected 2 downloads of 10 bytes by 2 clients, got %d of %d by %d", b.downloads, b.bytes, len(b.clients))
+	}
+}
@@ -0,0 +1,121 @@
+// The assets package finds references to hash-indexed assets within archived
+// packages.
+package assets
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TextExtensions are the extensions of package entries that are scanned for
+// references. Other entries are assumed to be binary, and are skipped.
+var TextExtensions = []string{
+	".csv",
+	".ini",
+	".json",
+	".lua",
+	".rbxmx",
+	".txt",
+	".xml",
+}
+
+// MaxEntrySize is the largest size of an entry that is scanned. Larger entries
+// are skipped.
+const MaxEntrySize = 16 << 20
+
+// hashPattern matches a hash that is not part of a longer word.
+var hashPattern = regexp.MustCompile(`(?i)(?:^|[^0-9a-z])([0-9a-f]{32})(?:$|[^0-9a-z])`)
+
+// Ref is a reference to an asset within a package.
+type Ref struct {
+	// Name of the entry in which the reference was found.
+	Entry string
+	// Hash of the referenced asset, in lowercase.
+	Hash string
+}
+
+// isText returns whether the entry with the given name is scanned.
+func isText(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range TextExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the hashes referred to by b, in lowercase, sorted, and without
+// duplicates.
+func Find(b []byte) (hashes []string) {
+	seen := map[string]bool{}
+	// Matches may share a separator, so the search is continued from the end of
+	// each hash rather than the end of the match.
+	for i := 0; i < len(b); {
+		loc := hashPattern.FindSubmatchIndex(b[i:])
+		if loc == nil {
+			break
+		}
+		hash := strings.ToLower(string(b[i+loc[2] : i+loc[3]]))
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+		i += loc[3]
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// Scan returns the references found within the text entries of the zip
+// archive read from r.
+func Scan(r io.ReaderAt, size int64) (refs []Ref, err error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range z.File {
+		if file.FileInfo().IsDir() || !isText(file.Name) {
+			continue
+		}
+		if file.UncompressedSize64 > MaxEntrySize {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return refs, err
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(rc, MaxEntrySize))
+		rc.Close()
+		if err != nil {
+			return refs, err
+		}
+		for _, hash := range Find(b) {
+			refs = append(refs, Ref{Entry: file.Name, Hash: hash})
+		}
+	}
+	return refs, nil
+}
+
+// Shard returns the CDN shard from which the asset with the given hash is
+// served, such as "t3".
+func Shard(hash string) string {
+	i := 31
+	for _, c := range []byte(hash) {
+		i ^= int(c)
+	}
+	return "t" + strconv.Itoa(i%8)
+}
+
+// URL returns the location of the asset with the given hash, according to a
+// template. Within the template, "{hash}" is replaced with the hash, and
+// "{shard}" is replaced with the shard of the hash.
+func URL(template, hash string) string {
+	return strings.NewReplacer("{hash}", hash, "{shard}", Shard(hash)).Replace(template)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The benchmarks measure the throughput of generating files, selecting batches
+// of files to fetch, and committing the results of fetches, on synthetic
+// databases. No requests are made. Use the large sizes to check that changes to
+// the schema or queries do not regress on big archives:
+//
+//     RBXARK_BENCH_LARGE=1 go test -run - -bench . -benchtime 1x -timeout 0
+//
+// With -short, only a small database is used.
+
+// benchFilenames is the number of file names of a synthetic database. The
+// number of builds is the number of files divided by this.
+const benchFilenames = 100
+
+// benchBatchSize is the number of files selected and committed per batch.
+const benchBatchSize = 256
+
+// benchSizes returns the numbers of file rows of the synthetic databases.
+func benchSizes() []int {
+	if testing.Short() {
+		return []int{10000}
+	}
+	sizes := []int{1000000}
+	if os.Getenv("RBXARK_BENCH_LARGE") != "" {
+		sizes = append(sizes, 10000000, 50000000)
+	}
+	return sizes
+}
+
+// benchDB creates a synthetic database with the given number of file rows. If
+// generate is false, then the builds and file names are inserted, but not the
+// files. The returned function closes and removes the database.
+func benchDB(b *testing.B, files int, generate bool) (action Action, db *sql.DB, remove func()) {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "rbxark-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	remove = func() { os.RemoveAll(dir) }
+	if db, err = OpenDatabase(filepath.Join(dir, "bench.db"), ""); err != nil {
+		remove()
+		b.Fatal(err)
+	}
+	remove = func() { db.Close(); os.RemoveAll(dir) }
+	action = Action{Context: context.Background()}
+	if err := action.Init(db); err != nil {
+		remove()
+		b.Fatal(err)
+	}
+	builds := (files + benchFilenames - 1) / benchFilenames
+	if err := benchSeed(action, db, builds, benchFilenames); err != nil {
+		remove()
+		b.Fatalf("seed: %s", err)
+	}
+	if generate {
+		if _, err := action.GenerateFiles(db, 0); err != nil {
+			remove()
+			b.Fatalf("generate: %s", err)
+		}
+	}
+	return action, db, remove
+}
+
+// benchRun runs fn as a sub-benchmark for each size. Each iteration of fn
+// measures on a new database, which is created outside of the timer. The
+// throughput of fn is reported in files per second.
+func benchRun(b *testing.B, generate bool, fn func(action Action, db *sql.DB) (n int, err error)) {
+	for _, size := range benchSizes() {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			var total int
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				action, db, remove := benchDB(b, size, generate)
+				b.StartTimer()
+				start := time.Now()
+				n, err := fn(action, db)
+				elapsed += time.Since(start)
+				b.StopTimer()
+				remove()
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += n
+			}
+			b.ReportMetric(float64(total)/elapsed.Seconds(), "files/s")
+		})
+	}
+}
+
+func BenchmarkGenerateFiles(b *testing.B) {
+	benchRun(b, false, func(action Action, db *sql.DB) (int, error) {
+		return action.GenerateFiles(db, 0)
+	})
+}
+
+func BenchmarkSelectBatches(b *testing.B) {
+	benchRun(b, true, func(action Action, db *sql.DB) (int, error) {
+		return benchSelect(action, db, FetchOptions{BatchSize: benchBatchSize})
+	})
+}
+
+func BenchmarkCommitBatches(b *testing.B) {
+	benchRun(b, true, func(action Action, db *sql.DB) (int, error) {
+		return benchCommit(action, db, FetchOptions{BatchSize: benchBatchSize})
+	})
+}
+
+// benchSeed inserts a server, builds, and file names into a database.
+func benchSeed(action Action, db *sql.DB, builds, filenames int) error {
+	tx, err := db.BeginTx(action.Context, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(action.Context, `INSERT INTO servers (url) VALUES ('https://example.com')`); err != nil {
+		return err
+	}
+	for i := 0; i < filenames; i++ {
+		if _, err := tx.ExecContext(action.Context, `INSERT INTO filenames (name) VALUES (?)`, fmt.Sprintf("file-%d.zip", i)); err != nil {
+			return err
+		}
+	}
+	const insertBuild = `
+		INSERT INTO builds (hash, type, time, version) VALUES (?, 'WindowsPlayer', ?, '0.0.0.0');
+		INSERT INTO build_servers (server, build) VALUES (1, last_insert_rowid());
+	`
+	base := time.Now().Unix()
+	for i := 0; i < builds; i++ {
+		hash := fmt.Sprintf("version-%016x", i)
+		if _, err := tx.ExecContext(action.Context, insertBuild, hash, base-int64(i)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// benchSelect selects every unchecked file in batches, as FetchContent does.
+func benchSelect(action Action, db *sql.DB, opts FetchOptions) (n int, err error) {
+	query, params := opts.batchQuery()
+	stmt, err := db.PrepareContext(action.Context, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	cursor := 0
+	for {
+		rows, err := stmt.QueryContext(action.Context, append(params, cursor, opts.BatchSize)...)
+		if err != nil {
+			return n, err
+		}
+		count := 0
+		for rows.Next() {
+			var req reqEntry
+			var server, filename int
+			if err := rows.Scan(&req.id, &req.flags, &server, &req.build, &filename, &req.etag, &req.lastModified); err != nil {
+				rows.Close()
+				return n, err
+			}
+			if req.id > cursor {
+				cursor = req.id
+			}
+			count++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+		if count == 0 {
+			return n, nil
+		}
+		n += count
+	}
+}
+
+// benchCommit commits a successful fetch of headers for every file, in
+// batches, as FetchContent does.
+func benchCommit(action Action, db *sql.DB, opts FetchOptions) (n int, err error) {
+	commit, err := prepareCommit(action, db)
+	if err != nil {
+		return 0, err
+	}
+	defer commit.Close()
+	total, err := action.queryInt(db, `SELECT ifnull(max(rowid), 0) FROM files`)
+	if err != nil {
+		return 0, err
+	}
+	entry := respEntry{
+		flags:      Exists | HasHeaders,
+		qAction:    qHeaders,
+		respStatus: 200,
+	}
+	entry.contentLength = sql.NullInt64{Int64: 1024, Valid: true}
+	entry.etag = sql.NullString{String: `"d41d8cd98f00b204e9800998ecf8427e"`, Valid: true}
+	for id := 1; id <= int(total); {
+		tx, err := db.BeginTx(action.Context, nil)
+		if err != nil {
+			return n, err
+		}
+		for end := id + opts.BatchSize; id < end && id <= int(total); id++ {
+			entry.id = id
+			if err := commit.exec(action, tx, entry); err != nil {
+				tx.Rollback()
+				return n, err
+			}
+			n++
+		}
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"type": &flags.Option{
+			Description: "Compare only builds of the given type, e.g. WindowsPlayer.",
+		},
+		"neighbors": &flags.Option{
+			ShortName:   'k',
+			Description: "Number of most similar builds to list for each build.",
+			Default:     []string{"3"},
+		},
+		"matrix": &flags.Option{
+			Description: "Write the similarity of every pair of builds as CSV instead.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"affinity",
+		"Display which builds share the most objects.",
+		`Compares the objects of the files of each build, as identified by the
+		MD5 hashes in their metadata, and lists, for each build, the builds
+		sharing the most objects with it. The similarity of two builds is the
+		number of objects they share, divided by the number of distinct objects
+		in either build. Shared bytes is the total size of the shared objects.
+
+		Builds that share most of their objects are candidates for delta
+		storage, and a drop in similarity between consecutive builds indicates
+		when packages actually changed.`,
+		&CmdAffinity{},
+	))
+}
+
+type CmdAffinity struct {
+	Type      string `long:"type"`
+	Neighbors int    `long:"neighbors"`
+	Matrix    bool   `long:"matrix"`
+}
+
+func (cmd *CmdAffinity) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		builds, err := action.BuildContents(ar.DB, cmd.Type)
+		if err != nil {
+			return err
+		}
+		shared := sharedObjects(builds)
+
+		if cmd.Matrix {
+			w := csv.NewWriter(os.Stdout)
+			header := make([]string, 0, len(builds)+1)
+			header = append(header, "build")
+			for _, b := range builds {
+				header = append(header, b.Hash)
+			}
+			w.Write(header)
+			for i, b := range builds {
+				record := make([]string, 0, len(builds)+1)
+				record = append(record, b.Hash)
+				for j := range builds {
+					var s float64
+					if i == j {
+						s = 1
+					} else {
+						s = similarity(builds, i, j, shared[i][j].count)
+					}
+					record = append(record, strconv.FormatFloat(s, 'f', 4, 64))
+				}
+				w.Write(record)
+			}
+			w.Flush()
+			return w.Error()
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "build\tversion\tneighbor\tversion\tshared\tshared bytes\tsimilarity\t")
+		for i, b := range builds {
+			neighbors := make([]int, 0, len(shared[i]))
+			for j := range shared[i] {
+				neighbors = append(neighbors, j)
+			}
+			sort.Slice(neighbors, func(x, y int) bool {
+				sx := similarity(builds, i, neighbors[x], shared[i][neighbors[x]].count)
+				sy := similarity(builds, i, neighbors[y], shared[i][neighbors[y]].count)
+				if sx != sy {
+					return sx > sy
+				}
+				return neighbors[x] < neighbors[y]
+			})
+			if len(neighbors) > cmd.Neighbors {
+				neighbors = neighbors[:cmd.Neighbors]
+			}
+			for _, j := range neighbors {
+				s := shared[i][j]
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f%%\t\n",
+					b.Hash,
+					b.Version,
+					builds[j].Hash,
+					builds[j].Version,
+					s.count,
+					s.size,
+					similarity(builds, i, j, s.count)*100,
+				)
+			}
+		}
+		return w.Flush()
+	})
+}
+
+// overlap describes the objects shared by two builds.
+type overlap struct {
+	count int
+	size  int64
+}
+
+// sharedObjects returns, for each build, the objects shared with each other
+// build that shares at least one object with it.
+func sharedObjects(builds []BuildContent) []map[int]overlap {
+	// Builds containing each object.
+	index := map[string][]int{}
+	for i, b := range builds {
+		for hash := range b.Objects {
+			index[hash] = append(index[hash], i)
+		}
+	}
+	pairs := make([]map[int]overlap, len(builds))
+	for i := range pairs {
+		pairs[i] = map[int]overlap{}
+	}
+	for hash, containing := range index {
+		for _, i := range containing {
+			size := builds[i].Objects[hash]
+			for _, j := range containing {
+				if i == j {
+					continue
+				}
+				s := pairs[i][j]
+				s.count++
+				s.size += size
+				pairs[i][j] = s
+			}
+		}
+	}
+	return pairs
+}
+
+// similarity returns the Jaccard index of the objects of builds i and j, which
+// share n objects.
+func similarity(builds []BuildContent, i, j, n int) float64 {
+	union := len(builds[i].Objects) + len(builds[j].Objects) - n
+	if union == 0 {
+		return 0
+	}
+	return float64(n) / float64(union)
+}
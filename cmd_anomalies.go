@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"all": &flags.Option{
+			ShortName:   'a',
+			Description: "Include anomalies that have been reviewed.",
+		},
+		"review": &flags.Option{
+			Description: "Mark the anomalies of the given IDs as reviewed instead of listing.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"anomalies",
+		"Display oddities found in the history of servers.",
+		`Lists anomalies found by fetch-builds in the DeployHistory files of
+		servers, which are often historically interesting events:
+
+		    duplicate-version  A build has the same type and version as a build
+		                       with a different hash, such as when a version
+		                       was rebuilt or rolled back.
+		    time-backwards     A build was created before the build preceding
+		                       it in the history.
+		    disappeared        A build previously found in the history of a
+		                       server is no longer listed.
+
+		Anomalies that have been reviewed are not listed again unless --all is
+		given, in which case their IDs are marked with an asterisk. With
+		--review, the arguments are IDs of anomalies to mark as reviewed.`,
+		&CmdAnomalies{},
+	))
+}
+
+type CmdAnomalies struct {
+	All    bool `long:"all"`
+	Review bool `long:"review"`
+}
+
+func (cmd *CmdAnomalies) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(archives) > 1 && cmd.Review {
+		return fmt.Errorf("--review operates on a single archive")
+	}
+	var ids []int64
+	if cmd.Review {
+		if len(args) == 0 {
+			return fmt.Errorf("expected anomaly IDs")
+		}
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad anomaly ID %q", arg)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if cmd.Review {
+			n, err := action.ReviewAnomalies(ar.DB, ids)
+			if err != nil {
+				return fmt.Errorf("review anomalies: %w", err)
+			}
+			log.Printf("marked %d anomalies as reviewed", n)
+			return nil
+		}
+
+		anomalies, err := action.Anomalies(ar.DB, cmd.All)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "id\tkind\tbuild\ttype\tversion\tserver\tdetail\t")
+		for _, anomaly := range anomalies {
+			id := strconv.FormatInt(anomaly.ID, 10)
+			if anomaly.Reviewed {
+				id += "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+				id,
+				anomaly.Kind,
+				anomaly.Hash,
+				anomaly.Type,
+				anomaly.Version,
+				anomaly.Server,
+				anomaly.Detail,
+			)
+		}
+		return w.Flush()
+	})
+}
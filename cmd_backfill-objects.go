@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anaminus/rbxark/fetch"
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"mirror": &flags.Option{
+			Description: "Base URL of a mirror from which objects are downloaded. May be given more than once; mirrors are tried in order.",
+		},
+		"workers": &flags.Option{
+			Description: "The number of objects downloaded concurrently.",
+			Default:     []string{"4"},
+		},
+		"batch-size": &flags.Option{
+			ShortName:   'b',
+			Description: "Number of objects to download before committing them to the database.",
+			Default:     []string{"256"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"backfill-objects",
+		"Download missing content from a peer mirror.",
+		`Downloads the object of each file that has metadata but no content from
+		a peer mirror, by hash, rather than from the servers of the file. This
+		allows an archive that crawled only metadata, or that imported it from
+		another archive, to have its content filled in by another host.
+
+		A mirror serves objects under the layout of an objects path, where the
+		object of a hash is located at "<mirror>/<first two characters of
+		hash>/<hash>". Such a mirror is an objects path served over HTTP, or a
+		bucket written by push-objects. For each object, mirrors are tried in
+		order until one returns content.
+
+		Each object is verified against the MD5 hash and size of the metadata
+		before being placed, so content that does not match is never stored.
+		Verified objects mark their files as having content, and their SHA-256
+		hashes are recorded. Objects are committed in batches, so an
+		interrupted run continues where it stopped. If the archive has an
+		object storage, then each committed batch is moved to it.`,
+		&CmdBackfillObjects{},
+	))
+}
+
+type CmdBackfillObjects struct {
+	Mirrors   []string `long:"mirror"`
+	Workers   int      `long:"workers"`
+	BatchSize int      `long:"batch-size"`
+}
+
+func (cmd *CmdBackfillObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(cmd.Mirrors) == 0 {
+		return fmt.Errorf("--mirror required")
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if err := CheckObjects(action, ar, config); err != nil {
+			return err
+		}
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
+		store, err := OpenStorage(config)
+		if err != nil {
+			return err
+		}
+
+		sizes, err := action.ContentlessObjects(ar.DB)
+		if err != nil {
+			return err
+		}
+		hashes := make([]string, 0, len(sizes))
+		for hash := range sizes {
+			hashes = append(hashes, hash)
+		}
+		sort.Strings(hashes)
+		log.Printf("backfilling %d objects", len(hashes))
+
+		results := backfillObjects(fetcher, cmd.Mirrors, config, hashes, sizes, cmd.Workers)
+		var filled, failed int
+		var bytes int64
+		batch := make([]hashedObject, 0, cmd.BatchSize)
+		commit := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := commitBackfill(action, ar.DB, config.ObjectsPath, batch); err != nil {
+				return err
+			}
+			if store != nil {
+				if err := action.StoreObjects(config.ObjectsPath, store); err != nil {
+					return err
+				}
+			}
+			for _, r := range batch {
+				bytes += sizes[r.md5]
+			}
+			filled += len(batch)
+			batch = batch[:0]
+			log.Printf("backfilled %d of %d objects", filled, len(hashes))
+			return nil
+		}
+		for r := range results {
+			if r.err != nil {
+				log.Printf("object %s: %s", r.md5, r.err)
+				failed++
+				continue
+			}
+			batch = append(batch, r)
+			if len(batch) >= cmd.BatchSize {
+				if err := commit(); err != nil {
+					// Drain the workers.
+					for range results {
+					}
+					return err
+				}
+			}
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		log.Printf("backfilled %d objects (%s), %d failed", filled, formatSize(bytes), failed)
+		return nil
+	})
+}
+
+// backfillObjects downloads the objects of the given hashes from mirrors with
+// the given number of workers. Results are sent on the returned channel, which
+// is closed once every object is downloaded, or when Main is canceled.
+func backfillObjects(f *fetch.Fetcher, mirrors []string, config *Config, hashes []string, sizes map[string]int64, workers int) <-chan hashedObject {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan hashedObject)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range jobs {
+				r := hashedObject{md5: hash}
+				if objects.Exists(config.ObjectsPath, hash) {
+					// The object was placed by another file, or by a run
+					// that was interrupted before committing.
+					var valid bool
+					r.sha256, valid, r.err = objects.SHA256(config.ObjectsPath, hash)
+					if r.err == nil && !valid {
+						r.err = fmt.Errorf("damaged: content does not match hash")
+					}
+				} else {
+					r.sha256, r.err = mirrorObject(f, mirrors, config, hash, sizes[hash])
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+	loop:
+		for _, hash := range hashes {
+			select {
+			case jobs <- hash:
+			case <-Main.Done():
+				break loop
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// mirrorObject downloads the object of the given hash from the first of mirrors
+// that has it, and places it in the objects path. Returns the SHA-256 hash of
+// the object.
+func mirrorObject(f *fetch.Fetcher, mirrors []string, config *Config, hash string, size int64) (sha string, err error) {
+	var errs []string
+	for _, mirror := range mirrors {
+		url := strings.TrimRight(mirror, "/") + "/" + objects.Key(hash)
+		sha, err := downloadObject(f, url, config, hash, size)
+		if err == nil {
+			return sha, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", mirror, err))
+	}
+	return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// downloadObject downloads the content at url as the object of the given hash.
+// The content is verified against the hash and size before the object is
+// placed.
+func downloadObject(f *fetch.Fetcher, url string, config *Config, hash string, size int64) (sha string, err error) {
+	w := objects.NewWriter(config.ObjectsPath)
+	w.UseIndex(config.ObjectsIndex)
+	w.UseCompression(config.CompressObjects)
+	w.ExpectSize(size)
+	digest := md5.New()
+	status, _, _, err := f.FetchContent(Main, url, nil, nil, io.MultiWriter(w, digest))
+	if err == nil && (status < 200 || status >= 300) {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		w.Remove()
+		return "", err
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != hash {
+		w.Remove()
+		return "", fmt.Errorf("content has hash %s", sum)
+	}
+	if _, _, err := w.Close(); err != nil {
+		w.Remove()
+		return "", err
+	}
+	return w.SHA256(), nil
+}
+
+// commitBackfill marks the files of a batch of backfilled objects within
+// objpath as having content.
+func commitBackfill(action Action, db *sql.DB, objpath string, batch []hashedObject) error {
+	tx, err := db.BeginTx(action.Context, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, r := range batch {
+		if err := action.FlagObject(tx, r.md5, r.sha256); err != nil {
+			return err
+		}
+		if err := action.SetStoredSize(tx, r.md5, objects.Stat(objpath, r.md5)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"workers": &flags.Option{
+			Description: "The number of objects compressed concurrently.",
+			Default:     []string{"4"},
+		},
+		"batch-size": &flags.Option{
+			ShortName:   'b',
+			Description: "Number of objects to compress before committing their sizes to the database.",
+			Default:     []string{"256"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"compress-objects",
+		"Compress the existing objects of the objects path.",
+		`Replaces each uncompressed object of the objects path with an object
+		compressed with zstd, and records the compressed size in the metadata
+		of the files that refer to the object. Objects written while
+		compress_objects is set are already compressed, so only objects written
+		before it was set need to be compressed.
+
+		Each object is verified against its hash while it is compressed, and
+		the uncompressed object is removed only once the compressed object is
+		in place. Objects whose content does not match their hash are reported
+		and left uncompressed; such objects can be repaired with
+		verify-objects. Objects recorded in the journal are skipped, because
+		their metadata may not have been committed. Sizes are committed in
+		batches, and compressed objects are skipped, so an interrupted run
+		continues where it stopped.`,
+		&CmdCompressObjects{},
+	))
+}
+
+type CmdCompressObjects struct {
+	Workers   int `long:"workers"`
+	BatchSize int `long:"batch-size"`
+}
+
+// compressedObject is the result of compressing an object.
+type compressedObject struct {
+	md5    string
+	size   int64
+	stored int64
+	err    error
+}
+
+func (cmd *CmdCompressObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		if config.ObjectsIndex {
+			return fmt.Errorf("compress_objects: objects_index must be unset")
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		hashes, err := uncompressedObjects(config.ObjectsPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("compressing %d objects", len(hashes))
+
+		results := compressObjects(config.ObjectsPath, hashes, cmd.Workers)
+		var compressed, failed int
+		var size, stored int64
+		batch := make([]compressedObject, 0, cmd.BatchSize)
+		commit := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := commitStoredSizes(action, ar.DB, config.ObjectsPath, batch); err != nil {
+				return err
+			}
+			for _, r := range batch {
+				size += r.size
+				stored += r.stored
+			}
+			compressed += len(batch)
+			batch = batch[:0]
+			log.Printf("compressed %d of %d objects", compressed, len(hashes))
+			return nil
+		}
+		for r := range results {
+			if r.err != nil {
+				log.Printf("object %s: %s", r.md5, r.err)
+				failed++
+				continue
+			}
+			batch = append(batch, r)
+			if len(batch) >= cmd.BatchSize {
+				if err := commit(); err != nil {
+					// Drain the workers.
+					for range results {
+					}
+					return err
+				}
+			}
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		log.Printf("compressed %d objects from %s to %s, %d failed", compressed, formatSize(size), formatSize(stored), failed)
+		return nil
+	})
+}
+
+// uncompressedObjects returns the hashes of the uncompressed objects of
+// objpath, excluding those recorded in the journal.
+func uncompressedObjects(objpath string) (hashes []string, err error) {
+	entries, err := objects.ReadJournal(objpath)
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	pending := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		pending[entry.Hash] = true
+	}
+	err = objects.Walk(objpath, func(hash string, info os.FileInfo) error {
+		if !pending[hash] && !objects.IsCompressed(info) {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// compressObjects compresses the objects of the given hashes with the given
+// number of workers. Results are sent on the returned channel, which is closed
+// once every object is compressed, or when Main is canceled.
+func compressObjects(objpath string, hashes []string, workers int) <-chan compressedObject {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan compressedObject)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range jobs {
+				r := compressedObject{md5: hash}
+				if stat := objects.Stat(objpath, hash); stat != nil {
+					r.size = stat.Size()
+				}
+				r.stored, r.err = objects.Compress(objpath, hash)
+				if os.IsNotExist(r.err) {
+					r.err = fmt.Errorf("missing")
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+	loop:
+		for _, hash := range hashes {
+			select {
+			case jobs <- hash:
+			case <-Main.Done():
+				break loop
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// commitStoredSizes records the stored sizes of a batch of compressed objects
+// within objpath.
+func commitStoredSizes(action Action, db *sql.DB, objpath string, batch []compressedObject) error {
+	tx, err := db.BeginTx(action.Context, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, r := range batch {
+		if err := action.SetStoredSize(tx, r.md5, objects.Stat(objpath, r.md5)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
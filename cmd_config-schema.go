@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"json": &flags.Option{
+			Description: "Print the schema as a JSON array.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"config-schema",
+		"Describe the keys of a config file.",
+		`Prints every key that may appear in a config file, along with its type,
+		default value, and a description. Keys of objects nested within other
+		values are written as paths, such as "resolver.doh" or "tls[].server".`,
+		&CmdConfigSchema{},
+	))
+}
+
+type CmdConfigSchema struct {
+	JSON bool `long:"json"`
+}
+
+// ConfigKey describes a key of a config file.
+type ConfigKey struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+func (cmd *CmdConfigSchema) Execute(args []string) error {
+	keys := configSchema("", reflect.TypeOf(Config{}))
+	if cmd.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(keys)
+	}
+	for _, key := range keys {
+		fmt.Printf("%s (%s)\n", key.Key, key.Type)
+		if key.Description != "" {
+			fmt.Printf("\t%s\n", key.Description)
+		}
+		if key.Default != "" {
+			fmt.Printf("\tDefault: %s\n", key.Default)
+		}
+	}
+	return nil
+}
+
+// configSchema returns the keys of struct t, prefixed by prefix. Keys of
+// nested structs follow the key that contains them.
+func configSchema(prefix string, t reflect.Type) (keys []ConfigKey) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := ConfigKey{
+			Key:         prefix + name,
+			Type:        configType(field.Type),
+			Default:     field.Tag.Get("default"),
+			Description: field.Tag.Get("desc"),
+		}
+		keys = append(keys, key)
+		// Describe the fields of objects, including objects within lists.
+		elem, path := field.Type, key.Key
+		for elem.Kind() == reflect.Slice {
+			elem, path = elem.Elem(), path+"[]"
+		}
+		if elem.Kind() == reflect.Struct {
+			keys = append(keys, configSchema(path+".", elem)...)
+		}
+	}
+	return keys
+}
+
+// configType returns the name of the JSON type that decodes into t.
+func configType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "array of " + configType(t.Elem())
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return t.Kind().String()
+}
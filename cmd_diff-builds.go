@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anaminus/rbxark/pkgman"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"json": &flags.Option{
+			Description: "Write each change as a JSON line.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"diff-builds",
+		"Compare the package manifests of two builds.",
+		`Compares the rbxPkgManifest files of two builds, given by their hashes,
+		the old build first. Lists each package that was added, removed, or
+		changed, along with its old and new hashes and sizes. The manifest of
+		each build must have been downloaded. Within a workspace, the builds
+		may be in different archives.`,
+		&CmdDiffBuilds{},
+	))
+}
+
+type CmdDiffBuilds struct {
+	JSON bool `long:"json"`
+}
+
+// manifestChange is the JSON form of a pkgman.Change.
+type manifestChange struct {
+	Kind pkgman.ChangeKind `json:"kind"`
+	Name string            `json:"name"`
+	Old  *pkgman.Entry     `json:"old,omitempty"`
+	New  *pkgman.Entry     `json:"new,omitempty"`
+}
+
+func (cmd *CmdDiffBuilds) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) != 2 {
+		return fmt.Errorf("expected old and new build hashes")
+	}
+
+	manifests := make([][]pkgman.Entry, 2)
+	found := make([]bool, 2)
+	err = archives.Each(func(ar *Archive) error {
+		if found[0] && found[1] {
+			return nil
+		}
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		for i, build := range args {
+			if found[i] {
+				continue
+			}
+			hash, err := action.BuildManifest(ar.DB, build, config.ManifestFiles)
+			if err != nil {
+				return err
+			}
+			if hash == "" {
+				continue
+			}
+			entries, err := parseManifest(config.ObjectsPath, hash)
+			if err != nil {
+				return fmt.Errorf("%s: manifest %s: %w", build, hash, err)
+			}
+			manifests[i], found[i] = entries, true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, build := range args {
+		if !found[i] {
+			return fmt.Errorf("%s: no downloaded manifest", build)
+		}
+	}
+
+	changes := pkgman.Diff(manifests[0], manifests[1])
+	if cmd.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, c := range changes {
+			change := manifestChange{Kind: c.Kind, Name: c.Name}
+			if c.Kind != pkgman.Added {
+				change.Old = &c.Old
+			}
+			if c.Kind != pkgman.Removed {
+				change.New = &c.New
+			}
+			if err := enc.Encode(change); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "change\tname\told hash\tnew hash\told size\tnew size\t")
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			c.Kind,
+			c.Name,
+			c.Old.Hash,
+			c.New.Hash,
+			entrySize(c.Old),
+			entrySize(c.New),
+		)
+	}
+	return w.Flush()
+}
+
+// entrySize formats the unpacked size of a manifest entry, or nothing if the
+// entry is absent.
+func entrySize(entry pkgman.Entry) string {
+	if entry.Name == "" {
+		return ""
+	}
+	return fmt.Sprint(entry.UnpackedSize)
+}
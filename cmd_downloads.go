@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/anaminus/rbxark/server"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"count": &flags.Option{
+			ShortName:   'n',
+			Description: "Number of builds, files, and objects to display. If 0, all are displayed.",
+			Default:     []string{"10"},
+		},
+		"since": &flags.Option{
+			Description: "Count only requests made since the given Unix timestamp or RFC 3339 date.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"downloads",
+		"Display the most downloaded builds and files of serve.",
+		`Reads the access log written by serve, including its rotated backups,
+		and displays the builds, files, and objects that were downloaded the
+		most. Each table displays the number of downloads, the number of
+		client addresses that downloaded, and the amount of content sent.
+
+		A download is a GET request answered with content, including a request
+		for a range of the content. Downloads of the files of a build are
+		counted for the build and for each file. Downloads through the objects
+		endpoint are counted for each object, as the file of an object is not
+		known.
+
+		The access log is that of the serve section of the config. With a
+		workspace, the config of the first archive is used, as with serve.`,
+		&CmdDownloads{},
+	))
+}
+
+type CmdDownloads struct {
+	Count int    `long:"count"`
+	Since string `long:"since"`
+}
+
+// downloadCount is the number of downloads of a build, file, or object.
+type downloadCount struct {
+	name      string
+	downloads int
+	bytes     int64
+	clients   map[string]bool
+}
+
+// downloadCounts counts downloads by name.
+type downloadCounts map[string]*downloadCount
+
+func (c downloadCounts) add(name string, a server.Access) {
+	count, ok := c[name]
+	if !ok {
+		count = &downloadCount{name: name, clients: map[string]bool{}}
+		c[name] = count
+	}
+	count.downloads++
+	count.bytes += a.Bytes
+	count.clients[a.Client] = true
+}
+
+// top returns the n counts with the most downloads, followed by the most bytes
+// sent, then by name.
+func (c downloadCounts) top(n int) []*downloadCount {
+	counts := make([]*downloadCount, 0, len(c))
+	for _, count := range c {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		switch {
+		case a.downloads != b.downloads:
+			return a.downloads > b.downloads
+		case a.bytes != b.bytes:
+			return a.bytes > b.bytes
+		}
+		return a.name < b.name
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// display writes the top n counts as a table, with a column naming what is
+// counted.
+func (c downloadCounts) display(w io.Writer, column string, n int) {
+	fmt.Fprintf(w, "%s\tdownloads\tclients\tsent\t\n", column)
+	for _, count := range c.top(n) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n",
+			count.name,
+			count.downloads,
+			len(count.clients),
+			formatSize(count.bytes),
+		)
+	}
+}
+
+func (cmd *CmdDownloads) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	// The server is configured by the first archive.
+	config, err := LoadConfig(archives[0].ConfigPath)
+	if err != nil {
+		return err
+	}
+	if config.Serve.AccessLog == "" {
+		return fmt.Errorf("serve: access_log is not set")
+	}
+	since, err := parseSince(cmd.Since)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	if since.op != 0 {
+		return fmt.Errorf("--since: operations are not recorded by the access log")
+	}
+
+	builds := downloadCounts{}
+	files := downloadCounts{}
+	objects := downloadCounts{}
+	err = readAccessLog(config.Serve, func(a server.Access) error {
+		if a.Method != "GET" || a.Status != 200 && a.Status != 206 || a.Time < since.time {
+			return nil
+		}
+		switch {
+		case a.Build != "":
+			builds.add(a.Build, a)
+			files.add(a.Build+"-"+a.File, a)
+		case a.Object != "":
+			objects.add(a.Object, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	builds.display(w, "build", cmd.Count)
+	fmt.Fprintln(w)
+	files.display(w, "file", cmd.Count)
+	if len(objects) > 0 {
+		fmt.Fprintln(w)
+		objects.display(w, "object", cmd.Count)
+	}
+	return w.Flush()
+}
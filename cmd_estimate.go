@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"workers": &flags.Option{
+			Description: "The number of worker threads used when sampling files.",
+			Default:     []string{"32"},
+		},
+		"recheck": &flags.Option{
+			Description: "Include files with the NotFound flag.",
+		},
+		"samples": &flags.Option{
+			ShortName:   'n',
+			Description: "Number of selected files to sample.",
+			Default:     []string{"256"},
+		},
+		"headers": &flags.Option{
+			Description: "Estimate a fetch-headers run instead of a fetch-files run. Implied by a headers-only archive.",
+		},
+		"bandwidth": &flags.Option{
+			Description: "Expected download rate, in bytes per second, used to project the download time.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"estimate",
+		"Estimate the size of fetching selected files.",
+		`Selects the files that would be fetched by fetch-files, and retrieves
+		the headers of a random sample of them. The database is not modified.
+
+		For each file name, prints the number of selected files, the hit rate
+		and average size of the sample, and the projected number and total size
+		of existing files. The total time to make all requests is projected from
+		the time taken to make the sampled requests. If a bandwidth is given,
+		the time to download the projected size is also printed.`,
+		&CmdEstimate{},
+	))
+}
+
+type CmdEstimate struct {
+	Workers   int   `long:"workers"`
+	Recheck   bool  `long:"recheck"`
+	Samples   int   `long:"samples"`
+	Headers   bool  `long:"headers"`
+	Bandwidth int64 `long:"bandwidth"`
+}
+
+// formatSize formats a number of bytes in human-readable form.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (cmd *CmdEstimate) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		domain := "content"
+		objpath := config.ObjectsPath
+		if cmd.Headers || config.HeadersOnly {
+			domain = "headers"
+			objpath = ""
+		}
+		query, err := LoadFilter(config.Filters, domain)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
+
+		estimates, elapsed, err := action.EstimateContent(ar.DB, fetcher, FetchOptions{
+			ObjectsPath: objpath,
+			Query:       query,
+			Recheck:     cmd.Recheck,
+			AllVariants: config.FetchAllVariants,
+		}, cmd.Samples)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "file\tselected\tsampled\thit rate\tavg size\tproj. files\tproj. size\t")
+		var total FileEstimate
+		var projHits, projBytes int64
+		for _, e := range estimates {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%s\t%d\t%s\t\n",
+				e.Name,
+				e.Selected,
+				e.Sampled,
+				e.HitRate()*100,
+				formatSize(e.AverageSize()),
+				e.ProjectedHits(),
+				formatSize(e.ProjectedBytes()),
+			)
+			total.Selected += e.Selected
+			total.Sampled += e.Sampled
+			total.Hits += e.Hits
+			total.Bytes += e.Bytes
+			projHits += e.ProjectedHits()
+			projBytes += e.ProjectedBytes()
+		}
+		fmt.Fprintf(w, "total\t%d\t%d\t%.1f%%\t%s\t%d\t%s\t\n",
+			total.Selected,
+			total.Sampled,
+			total.HitRate()*100,
+			formatSize(total.AverageSize()),
+			projHits,
+			formatSize(projBytes),
+		)
+		w.Flush()
+
+		if total.Sampled > 0 {
+			perRequest := elapsed / time.Duration(total.Sampled)
+			fmt.Printf("projected request time: %s (%s per request with %d workers)\n",
+				(perRequest * time.Duration(total.Selected)).Round(time.Second),
+				perRequest.Round(time.Millisecond),
+				fetcher.Workers(),
+			)
+		}
+		if cmd.Bandwidth > 0 && !cmd.Headers {
+			fmt.Printf("projected download time: %s\n",
+				(time.Duration(projBytes/cmd.Bandwidth) * time.Second).Round(time.Second),
+			)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"output": &flags.Option{
+			ShortName:   'o',
+			Description: "Write the builds to the given file instead of stdout.",
+		},
+		"since": &flags.Option{
+			Description: "Export only builds discovered or archived since the given Unix timestamp, RFC 3339 date, or operation, given as op:<id>.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"export-builds",
+		"Export the list of builds as JSON.",
+		`Writes the hash, type, time, and version of every build, along with the
+		servers on which each build is present, as a JSON array. Builds of every
+		archive are combined, ordered by time and hash.
+
+		The list can be shared with new operators, who can merge it into their
+		own database with import-builds-json instead of scanning the
+		DeployHistory file of every server since the beginning.
+
+		With --since, only builds that were discovered or archived at or after
+		the given time are exported. The time is given as with export --since.`,
+		&CmdExportBuilds{},
+	))
+}
+
+type CmdExportBuilds struct {
+	Output string `long:"output"`
+	Since  string `long:"since"`
+}
+
+func (cmd *CmdExportBuilds) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	since, err := parseSince(cmd.Since)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+
+	start := time.Now()
+	var set buildSet
+	err = archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		t, err := since.resolve(action, ar.DB)
+		if err != nil {
+			return err
+		}
+		b, err := action.ExportBuilds(ar.DB, t)
+		if err != nil {
+			return fmt.Errorf("get builds: %w", err)
+		}
+		set.add(b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	builds := set.sorted()
+
+	if cmd.Output == "" {
+		if err := writeBuilds(os.Stdout, builds); err != nil {
+			return err
+		}
+		logNextSince(start)
+		return nil
+	}
+	f, err := os.Create(cmd.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeBuilds(f, builds); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logNextSince(start)
+	return nil
+}
+
+// writeBuilds writes a list of builds to w as indented JSON.
+func writeBuilds(w io.Writer, builds []SharedBuild) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(builds); err != nil {
+		return fmt.Errorf("write builds: %w", err)
+	}
+	return nil
+}
+
+// buildSet combines the builds of several archives. A build present in more
+// than one archive is combined into one, present on the servers of each.
+type buildSet struct {
+	index  map[string]int
+	builds []SharedBuild
+}
+
+// add adds builds to the set.
+func (s *buildSet) add(builds []SharedBuild) {
+	if s.index == nil {
+		s.index = map[string]int{}
+	}
+	for _, build := range builds {
+		i, ok := s.index[build.Hash]
+		if !ok {
+			s.index[build.Hash] = len(s.builds)
+			s.builds = append(s.builds, build)
+			continue
+		}
+		s.builds[i].Servers = mergeStrings(s.builds[i].Servers, build.Servers)
+	}
+}
+
+// sorted returns the builds of the set, ordered by time and hash.
+func (s *buildSet) sorted() []SharedBuild {
+	builds := append([]SharedBuild{}, s.builds...)
+	sort.SliceStable(builds, func(i, j int) bool {
+		if builds[i].Time != builds[j].Time {
+			return builds[i].Time < builds[j].Time
+		}
+		return builds[i].Hash < builds[j].Hash
+	})
+	return builds
+}
+
+// mergeStrings returns the sorted union of two sorted lists of strings.
+func mergeStrings(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] < b[0]:
+			merged = append(merged, a[0])
+			a = a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			merged = append(merged, b[0])
+			b = b[1:]
+		default:
+			merged = append(merged, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return merged
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+func init() {
+	FlagParser.AddCommand(
+		"export-db",
+		"Export a copy of the database for publication.",
+		`Writes a cleaned copy of the database to the given output file. The
+		copy contains only the tables describing servers, builds, files, headers
+		and metadata. Internal tables are left out, rows are ordered by rowid,
+		and the result is vacuumed. The output file must not already exist.`,
+		&CmdExportDB{},
+	)
+}
+
+type CmdExportDB struct{}
+
+func (cmd *CmdExportDB) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(archives) > 1 {
+		return fmt.Errorf("export-db operates on a single archive")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("expected output file")
+	}
+
+	ar := archives[0]
+	action := Action{Context: Main}
+	if err := action.Init(ar.DB); err != nil {
+		return err
+	}
+	if err := action.ExportDatabase(ar.DB, args[0]); err != nil {
+		return err
+	}
+	log.Printf("exported database to %s", args[0])
+	return nil
+}
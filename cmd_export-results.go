@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anaminus/but"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"from-selection": &flags.Option{
+			Description: "Export only the files listed in the given selection file, such as a shard written by split-work.",
+		},
+		"since": &flags.Option{
+			Description: "Export only files added or changed since the given Unix timestamp, RFC 3339 date, or operation, given as op:<id>.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"export-results",
+		"Export the results of fetched files as a bundle.",
+		`Writes the results of checked files to a bundle directory, which can be
+		merged into another database with import-results. The bundle contains
+		the flags, headers, and metadata of each file, along with the content
+		of files that have content. Results are ordered as with export, so
+		that the same files produce the same results file.
+
+		With --since, only the results of files that were added or changed at
+		or after the given time are exported, as with export --since, so that
+		another database can be kept up to date with a series of small
+		bundles.`,
+		&CmdExportResults{},
+	))
+}
+
+type CmdExportResults struct {
+	FromSelection string `long:"from-selection"`
+	Since         string `long:"since"`
+}
+
+func (cmd *CmdExportResults) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) == 0 {
+		return fmt.Errorf("expected bundle directory")
+	}
+	dir := args[0]
+	since, err := parseSince(cmd.Since)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+
+	var selection []SelectedFile
+	if cmd.FromSelection != "" {
+		if selection, err = readSelection(cmd.FromSelection); err != nil {
+			return err
+		}
+	}
+
+	objpath := filepath.Join(dir, bundleObjects)
+	if err := os.MkdirAll(objpath, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, bundleResults))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	start := time.Now()
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if err := CheckObjects(action, ar, config); err != nil {
+			return err
+		}
+
+		if selection != nil {
+			if _, err := action.LoadSelection(ar.DB, selection); err != nil {
+				return err
+			}
+		}
+
+		t, err := since.resolve(action, ar.DB)
+		if err != nil {
+			return err
+		}
+
+		var files, contents int
+		err = action.ExportResults(ar.DB, selection != nil, t, func(r FileResult) error {
+			if r.Flags&HasContent != 0 && r.Metadata != nil && config.ObjectsPath != "" {
+				if err := copyObject(objpath, config.ObjectsPath, r.Metadata.MD5, r.Metadata.Size); err != nil {
+					// Export the remaining results regardless; the
+					// receiver will not mark the file as having content.
+					but.IfError(fmt.Errorf("%s-%s: %w", r.Build, r.File, err))
+				} else {
+					contents++
+				}
+			}
+			files++
+			return enc.Encode(r)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("exported %d files, %d with content", files, contents)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	logNextSince(start)
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"format": &flags.Option{
+			Description: "Format of the output.",
+			Default:     []string{"json"},
+		},
+		"where": &flags.Option{
+			Description: "Export only files matching the given filter expression, e.g. 'progress == \"Complete\"'.",
+		},
+		"output": &flags.Option{
+			ShortName:   'o',
+			Description: "Write the manifest to the given file instead of stdout.",
+		},
+		"column": &flags.Option{
+			Description: "Add a column computed from a template, of the form name=template. May be given more than once.",
+		},
+		"only": &flags.Option{
+			Description: "Write only the computed columns.",
+		},
+		"since": &flags.Option{
+			Description: "Export only files added or changed since the given Unix timestamp, RFC 3339 date, or operation, given as op:<id>.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"export",
+		"Export a manifest of the files of the archive.",
+		`Writes an entry for every file in the database, describing the build of
+		the file, a server on which the build is present, the progress of the
+		file, and its headers and metadata, if any. Files of every archive are
+		combined. The entries can be read by other tools without access to the
+		database.
+
+		Within each archive, files are ordered by the time and hash of their
+		build, then by name, and hashes are written in lower case, so that the
+		same files produce the same output regardless of the order in which
+		they were added. For the same reason, the server of a build present on
+		several servers is the one with the lexicographically smallest URL,
+		rather than the first server that was added. Manifests of successive
+		releases of an archive can therefore be compared with a line-based
+		diff.
+
+		With --format json, each entry is written as a JSON object on its own
+		line, omitting unknown fields. With --format csv, a header row is
+		followed by a row for each entry, with unknown fields left empty. Times
+		are Unix timestamps in either format.
+
+		With --where, only files matching the expression are exported. The
+		expression has the syntax of a filter, and may refer to the same
+		variables as the content domain, such as server, channel, build, file,
+		flags, and progress.
+
+		With --column, a column computed from a template is added to each
+		entry, after the fields of the entry. Within the template, "{field}"
+		is replaced with the value of a field, and "{field|format}" with the
+		value in one of the following formats:
+
+		    bytes    A size, such as "1.5 MiB".
+		    date     A Unix timestamp, as an RFC 3339 date.
+		    unquote  A quoted value, such as an ETag, without its quotes.
+		    upper    Upper case.
+		    lower    Lower case.
+
+		The fields are those of the CSV header, and "url", the URL of the file
+		on its server. Unknown fields are empty. With --only, entries have only
+		the computed columns, so that a report of a particular shape can be
+		written directly:
+
+		    rbxark export ark.db --format csv --only \
+		        --column 'url={url}' --column 'size={size|bytes}' \
+		        --column 'built={time|date}'`,
+		&CmdExport{},
+	))
+}
+
+type CmdExport struct {
+	Format  string   `long:"format" choice:"json" choice:"csv"`
+	Where   string   `long:"where"`
+	Output  string   `long:"output"`
+	Columns []string `long:"column"`
+	Only    bool     `long:"only"`
+	Since   string   `long:"since"`
+}
+
+// sinceOption is the value of a --since option of an export command.
+type sinceOption struct {
+	// Unix timestamp, or zero if unset.
+	time int64
+	// Rowid of an operation, or zero if unset.
+	op int64
+}
+
+// parseSince parses the value of a --since option, which is a Unix timestamp,
+// an RFC 3339 date, or "op:" followed by the rowid of an operation. An empty
+// string returns the zero sinceOption, which selects everything.
+func parseSince(s string) (since sinceOption, err error) {
+	if s == "" {
+		return since, nil
+	}
+	if id := strings.TrimPrefix(s, "op:"); id != s {
+		if since.op, err = strconv.ParseInt(id, 10, 64); err != nil || since.op <= 0 {
+			return since, fmt.Errorf("invalid operation %q", id)
+		}
+		return since, nil
+	}
+	if since.time, err = strconv.ParseInt(s, 10, 64); err == nil {
+		return since, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return since, fmt.Errorf("expected Unix timestamp, RFC 3339 date, or op:<id>, got %q", s)
+	}
+	since.time = t.Unix()
+	return since, nil
+}
+
+// resolve returns the time selected by the option as a Unix timestamp, looking
+// up the time of an operation in the database of a. Operations are local to
+// each database, so the time may differ between archives.
+func (since sinceOption) resolve(a Action, e Executor) (int64, error) {
+	if since.op == 0 {
+		return since.time, nil
+	}
+	t, err := a.OperationTime(e, since.op)
+	if err != nil {
+		return 0, fmt.Errorf("--since: %w", err)
+	}
+	return t, nil
+}
+
+// logNextSince logs the value of --since with which to export the changes made
+// after an export that started at the given time.
+func logNextSince(start time.Time) {
+	log.Printf("to export later changes, use --since %d", start.Unix())
+}
+
+// manifestColumns are the columns of a manifest written as CSV.
+var manifestColumns = []string{
+	"server",
+	"build",
+	"type",
+	"time",
+	"version",
+	"file",
+	"progress",
+	"status",
+	"content_length",
+	"last_modified",
+	"content_type",
+	"etag",
+	"size",
+	"md5",
+	"sha256",
+}
+
+// fields returns the fields of e mapped by column, including the derived fields
+// that may be referred to by a computed column.
+func (e ManifestEntry) fields() map[string]string {
+	record := e.record()
+	fields := make(map[string]string, len(record)+1)
+	for i, column := range manifestColumns {
+		fields[column] = record[i]
+	}
+	fields["url"] = buildFileURL(e.Server, e.Build, e.File)
+	return fields
+}
+
+// record returns the fields of e in the order of manifestColumns.
+func (e ManifestEntry) record() []string {
+	integer := func(v *int64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatInt(*v, 10)
+	}
+	str := func(v *string) string {
+		if v == nil {
+			return ""
+		}
+		return *v
+	}
+	return []string{
+		e.Server,
+		e.Build,
+		e.Type,
+		strconv.FormatInt(e.Time, 10),
+		e.Version,
+		e.File,
+		e.Progress,
+		integer(e.Status),
+		integer(e.ContentLength),
+		integer(e.LastModified),
+		str(e.ContentType),
+		str(e.ETag),
+		integer(e.Size),
+		str(e.MD5),
+		str(e.SHA256),
+	}
+}
+
+func (cmd *CmdExport) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	var rules []string
+	if cmd.Where != "" {
+		rules = []string{"exclude content", "include content : " + cmd.Where}
+	}
+	query, err := LoadFilter(rules, "content")
+	if err != nil {
+		return fmt.Errorf("--where: %w", err)
+	}
+	columns, err := parseColumns(cmd.Columns)
+	if err != nil {
+		return fmt.Errorf("--column: %w", err)
+	}
+	if cmd.Only && len(columns) == 0 {
+		return fmt.Errorf("--only requires --column")
+	}
+	since, err := parseSince(cmd.Since)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	// values returns the values of the computed columns of e.
+	values := func(e ManifestEntry) []string {
+		if len(columns) == 0 {
+			return nil
+		}
+		fields := e.fields()
+		v := make([]string, len(columns))
+		for i, col := range columns {
+			v[i] = col.value(fields)
+		}
+		return v
+	}
+
+	path := cmd.Output
+	if path == "" {
+		path = stdio
+	}
+	f, err := createOutput(path)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	var write func(ManifestEntry) error
+	var flush func() error
+	switch cmd.Format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		var header []string
+		if !cmd.Only {
+			header = append(header, manifestColumns...)
+		}
+		for _, col := range columns {
+			header = append(header, col.name)
+		}
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		write = func(e ManifestEntry) error {
+			var record []string
+			if !cmd.Only {
+				record = e.record()
+			}
+			return cw.Write(append(record, values(e)...))
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		enc := json.NewEncoder(w)
+		write = func(e ManifestEntry) error {
+			if len(columns) == 0 {
+				return enc.Encode(e)
+			}
+			// Computed columns follow the fields of the entry.
+			b := []byte("{}")
+			if !cmd.Only {
+				var err error
+				if b, err = json.Marshal(e); err != nil {
+					return err
+				}
+			}
+			b = b[:len(b)-1]
+			for i, v := range values(e) {
+				if len(b) > 1 {
+					b = append(b, ',')
+				}
+				name, _ := json.Marshal(columns[i].name)
+				value, _ := json.Marshal(v)
+				b = append(append(append(b, name...), ':'), value...)
+			}
+			b = append(b, "}\n"...)
+			_, err := w.Write(b)
+			return err
+		}
+		flush = func() error { return nil }
+	}
+
+	start := time.Now()
+	err = archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		t, err := since.resolve(action, ar.DB)
+		if err != nil {
+			return err
+		}
+		return action.ExportManifest(ar.DB, query, t, write)
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logNextSince(start)
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anaminus/rbxark/pkgman"
+	"github.com/anaminus/rbxark/safepath"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"output": &flags.Option{
+			ShortName:   'o',
+			Description: "Directory to which the build is written. Must not exist, be empty, or hold a previous extraction.",
+		},
+		"download": &flags.Option{
+			Description: "Download packages that are not archived from the servers of the build.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"extract",
+		"Reconstruct the install of a build from its packages.",
+		`Writes the packages listed by the rbxPkgManifest of a build, given by
+		its hash, to an output directory, laid out as the install written by a
+		bootstrapper. Each zip package is unpacked into its directory, and any
+		other package is written at the root of the install. An AppSettings.xml
+		file is written at the root, as it would be by a bootstrapper.
+
+		The directory of each zip package is given by a built-in layout, over
+		which the package_dirs of the config are merged. A zip package whose
+		directory is not known is written at the root without being unpacked,
+		and is reported.
+
+		The content of each package is read from the objects path, or from the
+		object storage of the archive. With --download, packages that are not
+		archived are downloaded from the servers of the build, but are not
+		added to the archive. The manifest of the build must have been
+		downloaded. Within a workspace, the build is extracted from the first
+		archive that has it.
+
+		The output directory may hold a previous extraction, as marked by its
+		AppSettings.xml file, in which case the files of the build replace
+		those that were written before. Files of two packages of the build
+		that have the same path are an error.
+
+		The names of entries within packages are untrusted. An entry whose
+		name is absolute, refers to a parent directory, or is a symbolic link
+		stops the extraction.`,
+		&CmdExtract{},
+	))
+}
+
+type CmdExtract struct {
+	Output   string `long:"output"`
+	Download bool   `long:"download"`
+}
+
+func (cmd *CmdExtract) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) != 1 {
+		return fmt.Errorf("expected build hash")
+	}
+	build := args[0]
+	if cmd.Output == "" {
+		return fmt.Errorf("output required")
+	}
+	if err := outputDir(cmd.Output); err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+
+	for _, ar := range archives {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		servers, err := action.BuildServers(ar.DB, build)
+		if errors.Is(err, ErrUnknownBuild) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dirs, err := packageDirs(config)
+		if err != nil {
+			return err
+		}
+		store, err := OpenStorage(config)
+		if err != nil {
+			return err
+		}
+		x := &Extractor{
+			Context:     Main,
+			Root:        cmd.Output,
+			ObjectsPath: config.ObjectsPath,
+			Storage:     store,
+			Servers:     servers,
+			Build:       build,
+			Dirs:        dirs,
+		}
+		if cmd.Download {
+			client, err := NewClient(config)
+			if err != nil {
+				return err
+			}
+			x.Fetcher = NewFetcher(config, client, 1, config.RateLimit)
+		}
+
+		hash, err := action.BuildManifest(ar.DB, build, config.ManifestFiles)
+		if err != nil {
+			return err
+		}
+		if hash == "" {
+			return fmt.Errorf("%s: no downloaded manifest", build)
+		}
+		name := DefaultManifestFiles[0]
+		if len(config.ManifestFiles) > 0 {
+			name = config.ManifestFiles[0]
+		}
+		man, err := x.Open(name, hash)
+		if err != nil {
+			return fmt.Errorf("%s: manifest %s: %w", build, hash, err)
+		}
+		entries, err := pkgman.Decode(man)
+		man.Close()
+		if err != nil {
+			return fmt.Errorf("%s: manifest %s: %w", build, hash, err)
+		}
+		return cmd.extract(x, entries)
+	}
+	return fmt.Errorf("%w %s", ErrUnknownBuild, build)
+}
+
+// extract writes each package of entries with x.
+func (cmd *CmdExtract) extract(x *Extractor, entries []pkgman.Entry) error {
+	var files, unknown int
+	for _, entry := range entries {
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		n, unpacked, err := x.Extract(entry)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		files += n
+		switch {
+		case unpacked:
+			dir := x.Dirs[entry.Name]
+			if dir == "" {
+				dir = "."
+			}
+			log.Printf("unpacked %s (%d files) to %s", entry.Name, n, dir)
+		case strings.HasSuffix(strings.ToLower(entry.Name), ".zip"):
+			log.Printf("%s: no directory is known for package; written without unpacking", entry.Name)
+			unknown++
+		default:
+			log.Printf("wrote %s", entry.Name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(x.Root, appSettingsName)); os.IsNotExist(err) {
+		f, err := safepath.Create(x.Root, appSettingsName)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(appSettings)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		files++
+	}
+	log.Printf("extracted %d packages of %s (%d files) to %s; %d packages not unpacked", len(entries), x.Build, files, x.Root, unknown)
+	return nil
+}
+
+// outputDir returns an error if path exists, and is neither an empty directory
+// nor a directory holding a previous extraction.
+func outputDir(path string) error {
+	entries, err := ioutil.ReadDir(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == appSettingsName && entry.Mode().IsRegular() {
+			return nil
+		}
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", path)
+	}
+	return nil
+}
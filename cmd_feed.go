@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anaminus/rbxark/server"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"output": &flags.Option{
+			ShortName:   'o',
+			Description: "Write the feed to the given file instead of stdout. The file is replaced atomically.",
+		},
+		"limit": &flags.Option{
+			ShortName:   'n',
+			Description: "Maximum number of entries.",
+			Default:     []string{"50"},
+		},
+		"title": &flags.Option{
+			Description: "Title of the feed.",
+			Default:     []string{"rbxark"},
+		},
+		"link": &flags.Option{
+			Description: "URL at which the feed is published, used to identify the feed and its entries.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"feed",
+		"Generate an Atom feed of archive activity.",
+		`Writes an Atom feed with an entry for each build that was discovered by
+		fetch-builds, and each build whose files have all been downloaded by
+		fetch-files. Entries of every archive are combined, most recent first.
+
+		The feed can be generated periodically and published as a static file,
+		so that the activity of an archive can be followed with a feed reader.`,
+		&CmdFeed{},
+	))
+}
+
+type CmdFeed struct {
+	Output string `long:"output"`
+	Limit  int    `long:"limit"`
+	Title  string `long:"title"`
+	Link   string `long:"link"`
+}
+
+func (cmd *CmdFeed) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	var events []BuildEvent
+	err = archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		e, err := action.BuildEvents(ar.DB, cmd.Limit)
+		if err != nil {
+			return fmt.Errorf("get build events: %w", err)
+		}
+		events = append(events, e...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time > events[j].Time
+	})
+	if cmd.Limit > 0 && len(events) > cmd.Limit {
+		events = events[:cmd.Limit]
+	}
+
+	feed := buildFeed(cmd.Title, cmd.Link, events)
+	if cmd.Output == "" {
+		return feed.Encode(os.Stdout)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cmd.Output), ".feed-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := feed.Encode(f); err != nil {
+		f.Close()
+		return fmt.Errorf("write feed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write feed: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cmd.Output)
+}
+
+// buildFeed returns a feed with an entry for each of the given events. If link
+// is empty, then the feed and its entries are identified by URNs instead.
+func buildFeed(title, link string, events []BuildEvent) *server.Feed {
+	id := func(s string) string {
+		if link == "" {
+			return "urn:rbxark:" + strings.Replace(s, "/", ":", -1)
+		}
+		return link + "#" + strings.Replace(s, "/", "-", -1)
+	}
+	feed := &server.Feed{
+		ID:    id("feed"),
+		Title: title,
+		Link:  link,
+	}
+	for _, event := range events {
+		entry := server.FeedEntry{
+			ID:      id(event.Kind + "/" + event.Hash),
+			Updated: time.Unix(event.Time, 0),
+		}
+		switch event.Kind {
+		case "discovered":
+			entry.Title = fmt.Sprintf("New build: %s %s", event.Type, event.Version)
+			entry.Summary = fmt.Sprintf("%s, created %s, was found on %s.",
+				event.Hash,
+				time.Unix(event.Build.Time, 0).UTC().Format("2006-01-02 15:04:05 MST"),
+				strings.Join(event.Servers, ", "),
+			)
+		case "archived":
+			entry.Title = fmt.Sprintf("Archived: %s %s", event.Type, event.Version)
+			entry.Summary = fmt.Sprintf("All files of %s have been downloaded: %d files, %d bytes.",
+				event.Hash,
+				event.Files,
+				event.Size,
+			)
+		default:
+			entry.Title = fmt.Sprintf("%s: %s %s", event.Kind, event.Type, event.Version)
+			entry.Summary = event.Hash
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
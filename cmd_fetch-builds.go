@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/anaminus/rbxark/fetch"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -16,7 +15,16 @@ func init() {
 		"Discover new builds from each server.",
 		`Downloads and scans the DeployHistory file from each server in the
 		database. Any found builds that are new are inserted into the
-		database.`,
+		database. Builds that are already known are recorded as present on the
+		server, such as a build deployed to a channel, then to LIVE.
+
+		Each channel of a server, added by merge-servers, is scanned as a
+		server of its own, from the DeployHistory file under the channel.
+
+		If the DeployHistory file of a server that previously served builds
+		responds with 404 or 410, then an alert is logged, and the server is
+		marked as deprecated. The remaining files of deprecated servers are
+		fetched before any others by fetch-files and fetch-headers.`,
 		&CmdFetchBuilds{},
 	))
 }
@@ -26,27 +34,33 @@ type CmdFetchBuilds struct {
 }
 
 func (cmd *CmdFetchBuilds) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
 
-	config, err := LoadConfig(cfgdir)
-	if err != nil {
-		return err
-	}
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
-		return err
-	}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
 
-	fetcher := fetch.NewFetcher(nil, cmd.Workers, config.RateLimit)
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
 
-	file := config.DeployHistory
-	if file == "" {
-		file = "DeployHistory.txt"
-	}
-	return action.FetchBuilds(db, fetcher, file)
+		file := config.DeployHistory
+		if file == "" {
+			file = "DeployHistory.txt"
+		}
+		return action.FetchBuilds(ar.DB, fetcher, file, ar.Foreign)
+	})
 }
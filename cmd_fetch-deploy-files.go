@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+)
+
+func init() {
+	FlagParser.AddCommand(
+		"fetch-deploy-files",
+		"Archive files at constant locations, such as bootstrappers.",
+		`Downloads each configured deploy file from each server in the
+		database. Deploy files are located directly under a server rather
+		than under a build, such as the bootstrappers that install the
+		client, so they may change at any time. If none are configured, the
+		known bootstrappers are fetched.
+
+		Each distinct version of a file is written to the objects path and
+		recorded in the database, along with when it was first and last
+		fetched. Run regularly to capture versions before they are replaced.
+
+		If decode_text is enabled in the config, then a file compressed with
+		gzip, as indicated by a .gz extension or by the Content-Type or
+		Content-Encoding of the response, is also decoded. If the decoded
+		content is text, then it is written as an object of its own, linked
+		to the raw object in the decoded_objects table, so that the text can
+		be searched while the bytes that were served are preserved.`,
+		&CmdFetchDeployFiles{},
+	)
+}
+
+type CmdFetchDeployFiles struct{}
+
+func (cmd *CmdFetchDeployFiles) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, 1, config.RateLimit)
+
+		names := config.DeployFiles
+		if len(names) == 0 {
+			names = DefaultDeployFiles
+		}
+		results, err := action.FetchDeployFiles(ar.DB, fetcher, config.ObjectsPath, names, config.DecodeText, config.CompressObjects)
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				log.Printf("error %s/%s: %s", r.Server, r.Name, r.Err)
+			case r.Hash == "":
+				log.Printf("miss  %s/%s (%d)", r.Server, r.Name, r.Status)
+			case r.New:
+				log.Printf("new   %s/%s: %s (%d bytes)", r.Server, r.Name, r.Hash, r.Size)
+			default:
+				log.Printf("same  %s/%s: %s", r.Server, r.Name, r.Hash)
+			}
+			if r.Decoded != "" {
+				log.Printf("      decoded to %s", r.Decoded)
+			}
+		}
+		return err
+	})
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
-	"github.com/anaminus/rbxark/fetch"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -16,6 +16,9 @@ func init() {
 		"recheck": &flags.Option{
 			Description: "Include files with the NotFound flag.",
 		},
+		"revalidate": &flags.Option{
+			Description: "Include files that were found, skipping those the server reports as unchanged since they were fetched.",
+		},
 		"rate-limit": &flags.Option{
 			Description: "Allowed requests per second. A negative value means unlimited.",
 			Default:     []string{"-1"},
@@ -25,50 +28,210 @@ func init() {
 			Description: "Number of files to fetch before committing them to the database",
 			Default:     []string{"64"},
 		},
-	}.AddTo(FlagParser.AddCommand(
+		"max-error-rate": &flags.Option{
+			Description: "Fraction of files in a batch that may fail before aborting. Overrides the configured rate.",
+		},
+		"events": &flags.Option{
+			Description: "Serve progress as server-sent events at /events on the given address, e.g. localhost:8080.",
+		},
+		"no-content": &flags.Option{
+			Description: "Fetch only NoContent files, which have metadata but whose content has gone missing.",
+		},
+		"all-variants": &flags.Option{
+			Description: "Download every variant of an alias group, rather than just one per build.",
+		},
+		"queue": &flags.Option{
+			Description: "Fetch the files of the persistent fetch queue, filling it from the selection if nothing is pending.",
+		},
+	}.AddTo(selectionTags.AddTo(FlagParser.AddCommand(
 		"fetch-files",
 		"Download content of unchecked files.",
 		`Scans for Unchecked files and downloads their content to the configured
 		objects path. A hit writes the file to the objects path, and adds the
 		response's headers to the database. A miss sets the NotFound flag.
 
-		Prints the aggregation of each response status code.`,
+		With --no-content, only NoContent files are fetched. These are files
+		that have headers and metadata, but whose object has gone missing,
+		such as after being removed as damaged.
+
+		The selected files can be saved to a selection file, which can later
+		be used to fetch exactly the same files again, even after their flags
+		have changed. The selection file lists one file per line as a JSON
+		object with "server", "build", and "file" fields.
+
+		In a headers-only archive, only the headers of Unchecked files are
+		fetched, as with fetch-headers. Once that archive is configured with an
+		objects path instead, the content of every file with headers is
+		downloaded.
+
+		If the archive has an object storage, then the objects of each batch
+		are moved from the objects path to the storage once the batch is
+		committed. A file whose content is already in the storage is not
+		downloaded again.
+
+		With --revalidate, files that were found are fetched again, along with
+		Unchecked files. The request for each file that has content is made
+		conditional on the ETag and Last-Modified headers of its previous
+		response, so that content that has not changed is not downloaded
+		again. Such a file is left unmodified, and is counted under status
+		304. A file that has changed has its headers and content replaced,
+		and a file that is no longer found becomes Missing.
+
+		With --queue, the files are fetched through the fetch queue of the
+		database, which records whether each file is pending, in flight,
+		done, or failed. If no files are pending, the queue is first replaced
+		with the files selected by the flags and filters. Otherwise, the
+		pending files are fetched without selecting again, and files left in
+		flight by an interrupted run are returned to pending. A long crawl
+		resumes where it stopped by running the same command again.
+
+		Prints the aggregation of each response status code, and the number of
+		files whose content was downloaded, versus reused from an existing
+		object of the same hash.`,
 		&CmdFetchFiles{},
-	))
+	)))
 }
 
 type CmdFetchFiles struct {
-	Workers   int  `long:"workers"`
-	Recheck   bool `long:"recheck"`
-	BatchSize int  `long:"batch-size"`
+	Workers     int  `long:"workers"`
+	Recheck     bool `long:"recheck"`
+	Revalidate  bool `long:"revalidate"`
+	NoContent   bool `long:"no-content"`
+	BatchSize   int  `long:"batch-size"`
+	AllVariants bool `long:"all-variants"`
+	Queue       bool `long:"queue"`
+
+	MaxErrorRate float64 `long:"max-error-rate"`
+	Events       string  `long:"events"`
+
+	SelectionFlags
 }
 
-func (cmd *CmdFetchFiles) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
-	if err != nil {
-		return err
+// maxErrorRate returns the error rate given by a flag, or the configured rate if
+// the flag is unset.
+func maxErrorRate(flag float64, config *Config) float64 {
+	if flag > 0 {
+		return flag
 	}
-	defer db.Close()
+	return config.MaxErrorRate
+}
 
-	config, err := LoadConfig(cfgdir)
+func (cmd *CmdFetchFiles) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
+	defer archives.Close()
 
-	query, err := LoadFilter(config.Filters, "content")
+	if cmd.Queue && cmd.SaveSelection != "" {
+		return fmt.Errorf("--queue and --save-selection are mutually exclusive")
+	}
+	if cmd.Revalidate && cmd.NoContent {
+		return fmt.Errorf("--revalidate and --no-content are mutually exclusive")
+	}
+	selection, err := openSelection(&cmd.SelectionFlags)
 	if err != nil {
 		return err
 	}
+	defer selection.Close()
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
+	events, err := serveEvents(cmd.Events)
+	if err != nil {
 		return err
 	}
 
-	fetcher := fetch.NewFetcher(nil, cmd.Workers, config.RateLimit)
+	Notify("READY=1")
 
+	// Stats are aggregated across all archives.
 	stats := Stats{}
-	err = action.FetchContent(db, fetcher, config.ObjectsPath, query, cmd.Recheck, cmd.BatchSize, stats)
+	dedup := &DedupStats{}
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		domain := "content"
+		if config.HeadersOnly {
+			// Content is not archived, so only headers are fetched, as
+			// with fetch-headers.
+			if cmd.NoContent {
+				return fmt.Errorf("--no-content: %w", ErrHeadersOnly)
+			}
+			domain = "headers"
+		}
+		query, err := LoadFilter(config.Filters, domain)
+		if err != nil {
+			return err
+		}
+
+		lengthPolicy, err := ParseLengthPolicy(config.LengthMismatch)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if err := CheckObjects(action, ar, config); err != nil {
+			return err
+		}
+
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
+		store, err := OpenStorage(config)
+		if err != nil {
+			return err
+		}
+
+		run := startRun("fetch-files", config, stats)
+		opts := FetchOptions{
+			ObjectsPath:    config.ObjectsPath,
+			Storage:        store,
+			ObjectsIndex:   config.ObjectsIndex,
+			Compress:       config.CompressObjects,
+			LengthMismatch: lengthPolicy,
+			VerifySkipped:  config.VerifySkipped,
+			Query:          query,
+			Recheck:        cmd.Recheck,
+			Revalidate:     cmd.Revalidate,
+			NoContent:      cmd.NoContent,
+			BatchSize:      cmd.BatchSize,
+			AllVariants:    cmd.AllVariants || config.FetchAllVariants,
+			ExcludeServers: ar.Foreign,
+
+			ProvenanceHeaders: config.ProvenanceHeaders,
+			MaxErrorRate:      maxErrorRate(cmd.MaxErrorRate, config),
+			Progress:          run.progress(events.progress(ar)),
+			Timing:            run.Timing(),
+			Dedup:             dedup,
+			BetweenBatches:    reloadFetch(action, ar, fetcher),
+		}
+		if saved, err := selection.apply(action, ar, &opts); saved || err != nil {
+			return err
+		}
+		if cmd.Queue {
+			if err := prepareQueue(action, ar, &opts); err != nil {
+				return err
+			}
+		}
+		err = action.FetchContent(ar.DB, fetcher, opts, stats)
+		if rerr := run.finish(stats, err); rerr != nil {
+			log.Printf("run history: %s", rerr)
+		}
+		if err != nil {
+			return err
+		}
+		if cmd.Queue {
+			return finishQueue(action, ar, opts)
+		}
+		return nil
+	})
 	log.Println(stats)
+	log.Println(dedup)
 	return err
 }
@@ -3,7 +3,6 @@ package main
 import (
 	"log"
 
-	"github.com/anaminus/rbxark/fetch"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -16,6 +15,9 @@ func init() {
 		"recheck": &flags.Option{
 			Description: "Include files with the NotFound flag.",
 		},
+		"revalidate": &flags.Option{
+			Description: "Include files that were found, skipping those the server reports as unchanged since they were fetched.",
+		},
 		"rate-limit": &flags.Option{
 			Description: "Allowed requests per second. A negative value means unlimited.",
 			Default:     []string{"-1"},
@@ -25,49 +27,112 @@ func init() {
 			Description: "Number of files to fetch before committing them to the database",
 			Default:     []string{"4096"},
 		},
-	}.AddTo(FlagParser.AddCommand(
+		"max-error-rate": &flags.Option{
+			Description: "Fraction of files in a batch that may fail before aborting. Overrides the configured rate.",
+		},
+		"events": &flags.Option{
+			Description: "Serve progress as server-sent events at /events on the given address, e.g. localhost:8080.",
+		},
+	}.AddTo(selectionTags.AddTo(FlagParser.AddCommand(
 		"fetch-headers",
 		"Download headers of unchecked files.",
 		`Scans for Unchecked files and downloads their headers. A hit adds the
 		response's headers to the database. A miss sets the NotFound flag.
 
+		With --revalidate, files that were found are fetched again, along with
+		Unchecked files. Each request is made conditional on the ETag and
+		Last-Modified headers of the previous response. A file that has not
+		changed is left unmodified, and is counted under status 304.
+
+		The selected files can be saved to a selection file, which can later
+		be used to fetch exactly the same files again, even after their flags
+		have changed. The selection file lists one file per line as a JSON
+		object with "server", "build", and "file" fields.
+
 		Prints the aggregation of each response status code.`,
 		&CmdFetchHeaders{},
-	))
+	)))
 }
 
 type CmdFetchHeaders struct {
-	Workers   int  `long:"workers"`
-	Recheck   bool `long:"recheck"`
-	BatchSize int  `long:"batch-size"`
+	Workers    int  `long:"workers"`
+	Recheck    bool `long:"recheck"`
+	Revalidate bool `long:"revalidate"`
+	BatchSize  int  `long:"batch-size"`
+
+	MaxErrorRate float64 `long:"max-error-rate"`
+	Events       string  `long:"events"`
+
+	SelectionFlags
 }
 
 func (cmd *CmdFetchHeaders) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
 
-	config, err := LoadConfig(cfgdir)
+	selection, err := openSelection(&cmd.SelectionFlags)
 	if err != nil {
 		return err
 	}
+	defer selection.Close()
 
-	query, err := LoadFilter(config.Filters, "headers")
+	events, err := serveEvents(cmd.Events)
 	if err != nil {
 		return err
 	}
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
-		return err
-	}
-
-	fetcher := fetch.NewFetcher(nil, cmd.Workers, config.RateLimit)
+	Notify("READY=1")
 
+	// Stats are aggregated across all archives.
 	stats := Stats{}
-	err = action.FetchContent(db, fetcher, "", query, cmd.Recheck, cmd.BatchSize, stats)
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		query, err := LoadFilter(config.Filters, "headers")
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
+
+		run := startRun("fetch-headers", config, stats)
+		opts := FetchOptions{
+			Query:      query,
+			Recheck:    cmd.Recheck,
+			Revalidate: cmd.Revalidate,
+			BatchSize:  cmd.BatchSize,
+
+			ExcludeServers:    ar.Foreign,
+			ProvenanceHeaders: config.ProvenanceHeaders,
+			MaxErrorRate:      maxErrorRate(cmd.MaxErrorRate, config),
+			Progress:          run.progress(events.progress(ar)),
+			Timing:            run.Timing(),
+			BetweenBatches:    reloadFetch(action, ar, fetcher),
+		}
+		if saved, err := selection.apply(action, ar, &opts); saved || err != nil {
+			return err
+		}
+		err = action.FetchContent(ar.DB, fetcher, opts, stats)
+		if rerr := run.finish(stats, err); rerr != nil {
+			log.Printf("run history: %s", rerr)
+		}
+		return err
+	})
 	log.Println(stats)
 	return err
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/anaminus/but"
+	"github.com/anaminus/rbxark/assets"
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"fetch": &flags.Option{
+			Description: "Download unchecked assets to the objects path after scanning.",
+		},
+		"workers": &flags.Option{
+			Description: "The number of worker threads used when downloading assets.",
+			Default:     []string{"32"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"find-assets",
+		"Find assets referred to by archived packages.",
+		`Scans the text entries of downloaded zip files for the hashes of
+		assets. Each package is scanned once. Found assets are recorded in the
+		database, along with the entries that refer to them.
+
+		With --fetch, unchecked assets are then downloaded from the configured
+		asset servers to the objects path.`,
+		&CmdFindAssets{},
+	))
+}
+
+type CmdFindAssets struct {
+	Fetch   bool `long:"fetch"`
+	Workers int  `long:"workers"`
+}
+
+func (cmd *CmdFindAssets) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	stats := Stats{}
+	err = archives.Each(func(ar *Archive) error {
+		return cmd.run(ar, stats)
+	})
+	if cmd.Fetch {
+		log.Println(stats)
+	}
+	return err
+}
+
+func (cmd *CmdFindAssets) run(ar *Archive, stats Stats) error {
+	config, err := LoadConfig(ar.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := RequireObjects(config); err != nil {
+		return err
+	}
+
+	action := Action{Context: Main}
+	if err := action.Init(ar.DB); err != nil {
+		return err
+	}
+	if err := CheckObjects(action, ar, config); err != nil {
+		return err
+	}
+
+	packages, err := action.FindPackages(ar.DB)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, p := range packages {
+		refs, err := scanPackage(config.ObjectsPath, p.Hash)
+		if err != nil {
+			// Left unscanned, to be scanned again by a later run.
+			but.IfError(fmt.Errorf("%s-%s: %w", p.Build, p.Name, err))
+			continue
+		}
+		added, err := action.AddAssetRefs(ar.DB, p.File, refs)
+		if err != nil {
+			return err
+		}
+		if added > 0 {
+			log.Printf("%s-%s: %d new assets", p.Build, p.Name, added)
+		}
+		total += added
+	}
+	log.Printf("scanned %d packages; found %d new assets", len(packages), total)
+
+	if !cmd.Fetch {
+		return nil
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		return err
+	}
+	fetcher := NewFetcher(config, client, cmd.Workers, config.RateLimit)
+	return action.FetchAssets(ar.DB, fetcher, config.ObjectsPath, config.CompressObjects, config.AssetServers, stats)
+}
+
+// scanPackage returns the references to assets within the package object of
+// the given hash.
+func scanPackage(objpath, hash string) ([]assets.Ref, error) {
+	if !objects.IsHash(hash) {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	f, err := objects.OpenFile(objpath, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return assets.Scan(f, size)
+}
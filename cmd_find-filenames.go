@@ -1,87 +1,199 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/anaminus/but"
 	"github.com/anaminus/rbxark/objects"
 	"github.com/anaminus/rbxark/pkgman"
+	"github.com/jessevdk/go-flags"
 )
 
 func init() {
-	FlagParser.AddCommand(
+	OptionTags{
+		"json": &flags.Option{
+			Description: "Write each name to stdout as a JSON line, which can be read by merge-filenames --from.",
+		},
+		"workers": &flags.Option{
+			Description: "The number of manifests parsed concurrently.",
+			Default:     []string{"8"},
+		},
+	}.AddTo(FlagParser.AddCommand(
 		"find-filenames",
 		"Find file names from rbxPkgManifest files.",
 		`Scans downloaded rbxPkgManifest files for file names that have not been
-		added to the database. The results are printed, but are not added to the
-		database.`,
+		added to the database. The names of manifest files of other platforms
+		can be configured with manifest_files. The results are printed, along with the builds
+		whose manifests contain each name, but are not added to the database.
+		A manifest shared by several builds is parsed only once.
+
+		The builds whose manifests contain each name are recorded, so that once
+		the name is added, such as by merge-filenames --from, generate-files
+		creates its files only for those builds.
+
+		With --json, each name is written to stdout as a JSON object with a
+		"name" field, and a "builds" field listing the hashes of the builds
+		whose manifests contain the name. The output can be added to the
+		database by passing it to merge-filenames:
+
+		    rbxark find-filenames ark.db --json | rbxark merge-filenames ark.db --from - --yes`,
 		&CmdFindFilenames{},
-	)
+	))
 }
 
-type CmdFindFilenames struct{}
+type CmdFindFilenames struct {
+	JSON    bool `long:"json"`
+	Workers int  `long:"workers"`
+}
 
 func (cmd *CmdFindFilenames) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
 
-	config, err := LoadConfig(cfgdir)
+	// Names are accumulated across all archives, so that a name is reported
+	// only once, along with the builds of every archive that refer to it.
+	var found []*FoundFilename
+	byName := map[string]*FoundFilename{}
+	err = archives.Each(func(ar *Archive) error {
+		return cmd.run(ar, func(name, build string) {
+			f, ok := byName[name]
+			if !ok {
+				f = &FoundFilename{Name: name}
+				byName[name] = f
+				found = append(found, f)
+			}
+			f.Builds = append(f.Builds, build)
+		})
+	})
 	if err != nil {
 		return err
 	}
-	if config.ObjectsPath == "" {
-		return fmt.Errorf("unconfigured objects path")
+
+	if !cmd.JSON {
+		for _, f := range found {
+			log.Printf("%s\t%s\n", f.Name, strings.Join(f.Builds, " "))
+		}
+		return nil
+	}
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	for _, f := range found {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
 	}
+	return w.Flush()
+}
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
+// run calls add for each name in the manifests of the archive that is not in
+// the database, and for each build whose manifest contains the name.
+func (cmd *CmdFindFilenames) run(ar *Archive, add func(name, build string)) error {
+	config, err := LoadConfig(ar.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := RequireObjects(config); err != nil {
 		return err
 	}
 
-	names, err := action.GetFilenames(db)
-	if err != nil {
+	action := Action{Context: Main, Operation: NewOperation(config)}
+	if err := action.Init(ar.DB); err != nil {
+		return err
+	}
+	if err := CheckObjects(action, ar, config); err != nil {
 		return err
 	}
 
-	filenames := map[string]struct{}{}
+	names, err := action.GetFilenames(ar.DB)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(names))
 	for _, name := range names {
-		filenames[name] = struct{}{}
+		known[name] = struct{}{}
 	}
 
-	manifests, err := action.FindManifests(db)
+	manifests, err := action.FindManifests(ar.DB, config.ManifestFiles)
 	if err != nil {
 		return err
 	}
-
-	for _, hash := range manifests {
-		path := objects.Path(config.ObjectsPath, hash)
-		if path == "" {
-			but.IfError(fmt.Errorf("%s: file does not exist", hash))
-			continue
-		}
-		man, err := os.Open(path)
-		if err != nil {
-			but.IfError(fmt.Errorf("%s: %w", hash, err))
-			continue
-		}
-		entries, err := pkgman.Decode(man)
-		if err != nil {
-			but.IfError(fmt.Errorf("%s: %w", hash, err))
-			continue
-		}
-		for _, entry := range entries {
-			if _, ok := filenames[entry.Name]; ok {
+	entries := parseManifests(config.ObjectsPath, manifests, cmd.Workers)
+	associations := map[string][]string{}
+	for i, manifest := range manifests {
+		for _, entry := range entries[i] {
+			if _, ok := known[entry.Name]; ok {
 				continue
 			}
-			log.Println(entry.Name)
-			filenames[entry.Name] = struct{}{}
+			for _, build := range manifest.Builds {
+				add(entry.Name, build)
+			}
+			associations[entry.Name] = append(associations[entry.Name], manifest.Builds...)
+		}
+	}
+
+	tx, err := ar.DB.BeginTx(action.Context, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := action.AddManifestNames(tx, associations); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parseManifests parses the objects of the given manifests with the given
+// number of workers. Returns the entries of each manifest, in the same order.
+// A manifest that cannot be parsed is reported, and has no entries.
+func parseManifests(objpath string, manifests []Manifest, workers int) [][]pkgman.Entry {
+	if workers < 1 {
+		workers = 1
+	}
+	entries := make([][]pkgman.Entry, len(manifests))
+	errs := make([]error, len(manifests))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				entries[i], errs[i] = parseManifest(objpath, manifests[i].Hash)
+			}
+		}()
+	}
+	for i := range manifests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	// Errors are reported in order, after every manifest is parsed.
+	for i, err := range errs {
+		if err != nil {
+			but.IfError(fmt.Errorf("%s: %w", manifests[i].Hash, err))
 		}
 	}
+	return entries
+}
 
-	return nil
+// parseManifest parses the manifest object of the given hash.
+func parseManifest(objpath, hash string) ([]pkgman.Entry, error) {
+	if !objects.IsHash(hash) {
+		return nil, fmt.Errorf("file does not exist")
+	}
+	man, err := objects.Open(objpath, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer man.Close()
+	return pkgman.Decode(man)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"rebuild": &flags.Option{
+			Description: "Recompute the index of first appearances before reporting.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"first-appearance",
+		"Display the earliest build containing each object.",
+		`Displays, for each of the given MD5 hashes, the earliest build, by
+		creation time, that has a file with the hash as its content. If no
+		hashes are given, then every object is listed, in order of first
+		appearance.
+
+		The index of first appearances is maintained as metadata is added. Use
+		--rebuild to recompute it, such as after the database was modified by
+		other tools.`,
+		&CmdFirstAppearance{},
+	))
+}
+
+type CmdFirstAppearance struct {
+	Rebuild bool `long:"rebuild"`
+}
+
+func (cmd *CmdFirstAppearance) Execute(args []string) error {
+	archives, hashes, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if cmd.Rebuild {
+			if err := action.RebuildFirstAppearances(ar.DB); err != nil {
+				return fmt.Errorf("rebuild: %w", err)
+			}
+		}
+
+		results, err := action.FirstAppearances(ar.DB, hashes)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "md5\tsize\ttime\tbuild\ttype\tversion\tfile\t")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t\n",
+				r.MD5,
+				r.Size,
+				time.Unix(r.Time, 0).UTC().Format("2006-01-02 15:04:05"),
+				r.Hash,
+				r.Type,
+				r.Version,
+				r.File,
+			)
+		}
+		return w.Flush()
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"dry-run": &flags.Option{
+			ShortName:   'n',
+			Description: "Report problems without repairing them.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"fsck-objects",
+		"Check and repair the layout of the objects path.",
+		`Checks that each object is a regular file named by its lower case
+		hash, within the prefix directory named by the first two characters of
+		the hash, and that the owner has access to each file and directory.
+		The name of a compressed object is followed by .zst.
+
+		Misplaced objects are moved to their correct location, or removed if an
+		identical object is already there. Empty prefix directories are
+		removed, as are compressed objects that are also stored uncompressed,
+		and missing owner permissions are added. Conflicting objects,
+		temporary files, and unknown entries are only reported.
+
+		The content of objects is not read. Use with a database only while no
+		other command is writing to its objects path.`,
+		&CmdFsckObjects{},
+	))
+}
+
+type CmdFsckObjects struct {
+	DryRun bool `long:"dry-run"`
+}
+
+func (cmd *CmdFsckObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+
+		counts := map[string]int{}
+		repaired := 0
+		failed := 0
+		err = objects.Fsck(config.ObjectsPath, !cmd.DryRun, func(p objects.Problem) {
+			counts[p.Kind]++
+			switch {
+			case p.Err != nil:
+				failed++
+				log.Printf("%s: %s: %s: repair failed: %s", p.Kind, p.Path, p.Detail, p.Err)
+			case p.Repaired:
+				repaired++
+				log.Printf("%s: %s: %s: repaired", p.Kind, p.Path, p.Detail)
+			default:
+				log.Printf("%s: %s: %s", p.Kind, p.Path, p.Detail)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		kinds := make([]string, 0, len(counts))
+		total := 0
+		for kind, n := range counts {
+			kinds = append(kinds, kind)
+			total += n
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			log.Printf("%d %s", counts[kind], kind)
+		}
+		log.Printf("found %d problems, repaired %d", total, repaired)
+		if failed > 0 {
+			return fmt.Errorf("failed to repair %d problems", failed)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"dry-run": &flags.Option{
+			ShortName:   'n',
+			Description: "Report garbage without removing it.",
+		},
+		"quarantine": &flags.Option{
+			ValueName:   "DIR",
+			Description: "Move garbage to this directory, at the same location relative to the objects path, rather than removing it.",
+		},
+		"min-age": &flags.Option{
+			Description: "Number of minutes since a temporary file was last modified before it is considered garbage.",
+			Default:     []string{"60"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"gc",
+		"Remove objects that are not referred to by the database.",
+		`Scans the objects path for garbage, and removes it. Garbage is each
+		object, compressed or not, whose hash is not referred to by the
+		database, and each temporary file left by an interrupted write. An
+		object is referred to by the metadata of any file, whether or not the
+		file has content, by a deploy file, by a decoded copy or the object it
+		was decoded from, and by an asset.
+
+		Objects recorded in the journal are kept, because their metadata may
+		not have been committed yet. Temporary files are kept until they have
+		not been modified for --min-age minutes, because they may belong to a
+		write in progress. When several archives of a workspace share an
+		objects path, an object is kept if any of them refers to it.
+
+		With --quarantine, garbage is moved to the given directory instead, so
+		that it can be inspected, and restored by moving it back. With
+		--dry-run, garbage is only reported. Objects that are removed or
+		quarantined are also removed from the index of their directory.
+
+		Only the objects path is scanned; objects moved to an object storage
+		are not. Use with a database only while no other command is writing
+		to its objects path.`,
+		&CmdGC{},
+	))
+}
+
+type CmdGC struct {
+	DryRun     bool   `long:"dry-run"`
+	Quarantine string `long:"quarantine"`
+	MinAge     int    `long:"min-age"`
+}
+
+// gcPath is an objects path scanned by gc, along with the objects referred to
+// by the archives that use it.
+type gcPath struct {
+	path string
+	refs map[string]bool
+}
+
+func (cmd *CmdGC) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	// References are gathered from every archive before anything is removed,
+	// since archives may share an objects path.
+	var paths []*gcPath
+	byPath := map[string]*gcPath{}
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		refs, err := action.ReferencedObjects(ar.DB)
+		if err != nil {
+			return err
+		}
+		objpath := filepath.Clean(config.ObjectsPath)
+		p, ok := byPath[objpath]
+		if !ok {
+			p = &gcPath{path: objpath, refs: map[string]bool{}}
+			byPath[objpath] = p
+			paths = append(paths, p)
+		}
+		for hash := range refs {
+			p.refs[hash] = true
+		}
+		log.Printf("%d objects referred to", len(refs))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cmd.Quarantine != "" {
+		if _, ok := byPath[filepath.Clean(cmd.Quarantine)]; ok {
+			return fmt.Errorf("quarantine cannot be an objects path")
+		}
+	}
+	for _, p := range paths {
+		if err := cmd.collect(p); err != nil {
+			return fmt.Errorf("%s: %w", p.path, err)
+		}
+	}
+	return nil
+}
+
+// collect removes the garbage of an objects path.
+func (cmd *CmdGC) collect(p *gcPath) error {
+	entries, err := objects.ReadJournal(p.path)
+	if err != nil {
+		return fmt.Errorf("read journal: %w", err)
+	}
+	pending := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		pending[entry.Hash] = true
+	}
+
+	verb := "removed"
+	switch {
+	case cmd.DryRun:
+		verb = "found"
+	case cmd.Quarantine != "":
+		verb = "quarantined"
+	}
+	var orphans, temps int
+	var orphanSize, tempSize int64
+	failed := 0
+	// Hashes of disposed objects, which are removed from the indexes of their
+	// directories, and the directories from which files were disposed, which
+	// are removed if left empty.
+	var disposed []string
+	dirs := map[string]bool{}
+	// dispose removes or quarantines a file of garbage, returning whether it
+	// succeeded.
+	dispose := func(kind, path string, size int64) bool {
+		var err error
+		switch {
+		case cmd.DryRun:
+			log.Printf("%s: %s (%s)", kind, path, formatSize(size))
+			return true
+		case cmd.Quarantine != "":
+			err = objects.Quarantine(p.path, path, cmd.Quarantine)
+		default:
+			err = os.Remove(path)
+		}
+		if err != nil {
+			failed++
+			log.Printf("%s: %s: %s", kind, path, err)
+			return false
+		}
+		log.Printf("%s: %s (%s): %s", kind, path, formatSize(size), verb)
+		if dir := filepath.Dir(path); dir != p.path {
+			dirs[dir] = true
+		}
+		return true
+	}
+
+	err = objects.Walk(p.path, func(hash string, info os.FileInfo) error {
+		if p.refs[hash] || pending[hash] {
+			return Main.Err()
+		}
+		path, size := objects.Path(p.path, hash), info.Size()
+		if objects.IsCompressed(info) {
+			path, size = objects.CompressedPath(p.path, hash), objects.StoredSize(info)
+		}
+		if dispose("orphaned", path, size) {
+			orphans++
+			orphanSize += size
+			disposed = append(disposed, hash)
+		}
+		return Main.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("walk objects: %w", err)
+	}
+	cutoff := time.Now().Add(-time.Duration(cmd.MinAge) * time.Minute)
+	err = objects.WalkTemporary(p.path, func(path string, info os.FileInfo) error {
+		if info.ModTime().After(cutoff) {
+			return Main.Err()
+		}
+		if dispose("temporary", path, info.Size()) {
+			temps++
+			tempSize += info.Size()
+		}
+		return Main.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("walk temporary files: %w", err)
+	}
+	if !cmd.DryRun {
+		if err := objects.Unindex(p.path, disposed); err != nil {
+			return fmt.Errorf("update index: %w", err)
+		}
+		// Remove each prefix directory that is now empty. Fails harmlessly
+		// otherwise.
+		for dir := range dirs {
+			os.Remove(dir)
+		}
+	}
+
+	log.Printf("%s %d orphaned objects (%s) and %d temporary files (%s)",
+		verb, orphans, formatSize(orphanSize), temps, formatSize(tempSize))
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d files", failed)
+	}
+	return nil
+}
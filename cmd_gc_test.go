@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anaminus/rbxark/objects"
+)
+
+// gcContents returns the contents of three objects: two whose hashes share a
+// prefix directory, and one in a directory of its own.
+func gcContents(t *testing.T) (a, b, c string) {
+	t.Helper()
+	byPrefix := map[string][]string{}
+	for i := 0; i < 1000; i++ {
+		content := fmt.Sprintf("object %d", i)
+		sum := md5.Sum([]byte(content))
+		prefix := hex.EncodeToString(sum[:1])
+		byPrefix[prefix] = append(byPrefix[prefix], content)
+	}
+	for _, contents := range byPrefix {
+		if len(contents) >= 2 && a == "" {
+			a, b = contents[0], contents[1]
+		}
+	}
+	for _, contents := range byPrefix {
+		if len(contents) == 1 && contents[0] != a && contents[0] != b {
+			return a, b, contents[0]
+		}
+	}
+	t.Fatal("no suitable contents")
+	return
+}
+
+func TestGCIndex(t *testing.T) {
+	keep, shared, alone := gcContents(t)
+	tests := []struct {
+		name string
+		cmd  CmdGC
+	}{
+		{name: "remove"},
+		{name: "quarantine", cmd: CmdGC{Quarantine: "quarantine"}},
+		{name: "dry run", cmd: CmdGC{DryRun: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rbxark")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			objpath := filepath.Join(dir, "objects")
+			if err := os.Mkdir(objpath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cmd.Quarantine != "" {
+				tt.cmd.Quarantine = filepath.Join(dir, tt.cmd.Quarantine)
+			}
+			hashes := map[string]string{}
+			for _, content := range []string{keep, shared, alone} {
+				w := objects.NewWriter(objpath)
+				w.UseIndex(true)
+				w.Write([]byte(content))
+				_, hash, err := w.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				hashes[content] = hash
+			}
+
+			p := &gcPath{path: objpath, refs: map[string]bool{hashes[keep]: true}}
+			if err := tt.cmd.collect(p); err != nil {
+				t.Fatalf("collect: %s", err)
+			}
+
+			index := objects.NewIndex(objpath)
+			stat := objects.Stat(objpath, hashes[keep])
+			if stat == nil {
+				t.Fatalf("referenced object removed")
+			}
+			if err := index.Check(hashes[keep], stat); err != nil {
+				t.Errorf("referenced object: %s", err)
+			}
+			for _, content := range []string{shared, alone} {
+				hash := hashes[content]
+				_, indexed, err := index.Lookup(hash)
+				if err != nil {
+					t.Errorf("lookup %s: %s", hash, err)
+				}
+				exists := objects.Stat(objpath, hash) != nil
+				if tt.cmd.DryRun {
+					if !exists || !indexed {
+						t.Errorf("object %s: expected to be kept (exists %t, indexed %t)", hash, exists, indexed)
+					}
+					continue
+				}
+				if exists || indexed {
+					t.Errorf("object %s: expected to be removed (exists %t, indexed %t)", hash, exists, indexed)
+				}
+				if tt.cmd.Quarantine != "" && objects.Stat(tt.cmd.Quarantine, hash) == nil {
+					t.Errorf("object %s: expected to be quarantined", hash)
+				}
+			}
+			_, err = os.Lstat(filepath.Join(objpath, hashes[alone][:2]))
+			if removed := os.IsNotExist(err); removed == tt.cmd.DryRun {
+				t.Errorf("expected directory of %s removed %t, got %t", hashes[alone], !tt.cmd.DryRun, removed)
+			}
+		})
+	}
+}
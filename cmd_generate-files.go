@@ -2,37 +2,97 @@ package main
 
 import (
 	"log"
+	"time"
+
+	"github.com/jessevdk/go-flags"
 )
 
 func init() {
-	FlagParser.AddCommand(
+	OptionTags{
+		"file": &flags.Option{
+			ShortName:   'f',
+			Description: "Generate files of the given name, regardless of its tier. May be specified multiple times.",
+		},
+		"days": &flags.Option{
+			Description: "With --file, only generate for builds created within the given number of days.",
+		},
+	}.AddTo(FlagParser.AddCommand(
 		"generate-files",
 		"Generate combinations of possible files.",
 		`Inserts into the database combinations of build hashes and file names
-		that aren't already present.`,
+		that aren't already present.
+
+		Names of the recent tier are combined only with builds created within
+		the configured number of days, and names of the manual tier are
+		combined only with the builds whose manifests were found to list them
+		by find-filenames. If --file is specified, then only the files of the given
+		names are generated, regardless of their tier.
+
+		For each file known to exist, a companion file is generated for each
+		configured companion suffix, such as "RobloxApp.zip.sig". Companions
+		are linked to their base files.`,
 		&CmdGenerateFiles{},
-	)
+	))
+}
+
+type CmdGenerateFiles struct {
+	File []string `long:"file"`
+	Days int      `long:"days"`
 }
 
-type CmdGenerateFiles struct{}
+// daysAgo returns the Unix timestamp of the given number of days before now. A
+// non-positive number returns zero, which precedes every build.
+func daysAgo(days int) int64 {
+	if days <= 0 {
+		return 0
+	}
+	return time.Now().AddDate(0, 0, -days).Unix()
+}
 
 func (cmd *CmdGenerateFiles) Execute(args []string) error {
-	db, _, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
-		return err
-	}
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
 
-	newFiles, err := action.GenerateFiles(db)
-	if err != nil {
-		return err
-	}
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		if len(cmd.File) > 0 {
+			since := daysAgo(cmd.Days)
+			for _, name := range cmd.File {
+				newFiles, err := action.GenerateFilename(ar.DB, name, since)
+				if err != nil {
+					return err
+				}
+				log.Printf("merged %d new %s files\n", newFiles, name)
+			}
+			return nil
+		}
+
+		newFiles, err := action.GenerateFiles(ar.DB, daysAgo(config.RecentBuildDays))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("merged %d new files\n", newFiles)
 
-	log.Printf("merged %d new files\n", newFiles)
-	return nil
+		if len(config.CompanionSuffixes) > 0 {
+			newFiles, err := action.GenerateCompanions(ar.DB, config.CompanionSuffixes)
+			if err != nil {
+				return err
+			}
+			log.Printf("merged %d new companion files\n", newFiles)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"workers": &flags.Option{
+			Description: "The number of objects hashed concurrently.",
+			Default:     []string{"4"},
+		},
+		"batch-size": &flags.Option{
+			ShortName:   'b',
+			Description: "Number of objects to hash before committing them to the database.",
+			Default:     []string{"256"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"hash-objects",
+		"Compute the SHA-256 hash of existing objects.",
+		`Reads each object referred to by the metadata of a file with content
+		whose SHA-256 hash is not known, and records the SHA-256 hash of the
+		object in the metadata. Objects are downloaded with both hashes, so
+		only objects downloaded by older versions need to be hashed.
+
+		The MD5 hash of each object is checked while it is read. Objects that
+		are missing, or whose content does not match their hash, are reported
+		and left unhashed; such objects can be repaired with verify-objects.
+		Hashes are committed in batches, so an interrupted run continues where
+		it stopped.`,
+		&CmdHashObjects{},
+	))
+}
+
+type CmdHashObjects struct {
+	Workers   int `long:"workers"`
+	BatchSize int `long:"batch-size"`
+}
+
+// hashedObject is the result of hashing an object.
+type hashedObject struct {
+	md5    string
+	sha256 string
+	err    error
+}
+
+func (cmd *CmdHashObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		hashes, err := action.UnhashedObjects(ar.DB)
+		if err != nil {
+			return err
+		}
+		log.Printf("hashing %d objects", len(hashes))
+
+		results := hashObjects(config.ObjectsPath, hashes, cmd.Workers)
+		var hashed, failed int
+		batch := make([]hashedObject, 0, cmd.BatchSize)
+		commit := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := commitHashes(action, ar.DB, batch); err != nil {
+				return err
+			}
+			hashed += len(batch)
+			batch = batch[:0]
+			log.Printf("hashed %d of %d objects", hashed, len(hashes))
+			return nil
+		}
+		for r := range results {
+			if r.err != nil {
+				log.Printf("object %s: %s", r.md5, r.err)
+				failed++
+				continue
+			}
+			batch = append(batch, r)
+			if len(batch) >= cmd.BatchSize {
+				if err := commit(); err != nil {
+					// Drain the workers.
+					for range results {
+					}
+					return err
+				}
+			}
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		log.Printf("hashed %d objects, %d failed", hashed, failed)
+		return nil
+	})
+}
+
+// hashObjects hashes the objects of the given hashes with the given number of
+// workers. Results are sent on the returned channel, which is closed once every
+// object is hashed, or when Main is canceled.
+func hashObjects(objpath string, hashes []string, workers int) <-chan hashedObject {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan hashedObject)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range jobs {
+				r := hashedObject{md5: hash}
+				var valid bool
+				r.sha256, valid, r.err = objects.SHA256(objpath, hash)
+				switch {
+				case os.IsNotExist(r.err):
+					r.err = fmt.Errorf("missing")
+				case r.err == nil && !valid:
+					r.err = fmt.Errorf("damaged: content does not match hash")
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+	loop:
+		for _, hash := range hashes {
+			select {
+			case jobs <- hash:
+			case <-Main.Done():
+				break loop
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// commitHashes records the SHA-256 hashes of a batch of objects.
+func commitHashes(action Action, db *sql.DB, batch []hashedObject) error {
+	tx, err := db.BeginTx(action.Context, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, r := range batch {
+		if err := action.SetObjectSHA256(tx, r.md5, r.sha256); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+func init() {
+	FlagParser.AddCommand(
+		"import-builds-json",
+		"Merge a list of builds written by export-builds.",
+		`Reads a JSON file written by export-builds, and adds the builds that are
+		not already in the database. Each build is associated with those of its
+		servers that are in the database; servers are not added, so
+		merge-servers should be run first. Builds already in the database are
+		kept, but are associated with any additional servers.
+
+		After importing, generate-files creates the files of the new builds as
+		usual.`,
+		&CmdImportBuildsJSON{},
+	)
+}
+
+type CmdImportBuildsJSON struct{}
+
+func (cmd *CmdImportBuildsJSON) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) == 0 {
+		return fmt.Errorf("expected builds file")
+	}
+
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var builds []SharedBuild
+	if err := json.Unmarshal(b, &builds); err != nil {
+		return fmt.Errorf("decode builds: %w", err)
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		stats, err := action.ImportBuilds(ar.DB, builds)
+		if err != nil {
+			return err
+		}
+		log.Printf("imported %d builds, %d unchanged, %d without a known server", stats.Added, stats.Unchanged, stats.Unlinked)
+		return nil
+	})
+}
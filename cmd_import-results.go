@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+func init() {
+	FlagParser.AddCommand(
+		"import-results",
+		"Merge the results of fetched files from a bundle.",
+		`Reads a bundle directory written by export-results, and merges its
+		results into the database. The content of each file is copied to the
+		configured objects path, and is verified against the metadata of the
+		file. Files are marked as having content only if verification succeeds,
+		so that verified files need not be fetched again.
+
+		Data already present in the database is kept. Results for builds or file
+		names that are not in the database are skipped.`,
+		&CmdImportResults{},
+	)
+}
+
+type CmdImportResults struct{}
+
+func (cmd *CmdImportResults) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) == 0 {
+		return fmt.Errorf("expected bundle directory")
+	}
+	dir := args[0]
+
+	results, err := readResults(dir)
+	if err != nil {
+		return err
+	}
+	objpath := filepath.Join(dir, bundleObjects)
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if err := CheckObjects(action, ar, config); err != nil {
+			return err
+		}
+
+		// Objects are copied and verified before the database is modified.
+		verified := map[string]bool{}
+		if config.ObjectsPath != "" {
+			verified = copyResultObjects(config.ObjectsPath, objpath, results)
+		}
+
+		stats, err := action.ImportResults(ar.DB, results, func(r FileResult) bool {
+			return verified[r.Metadata.MD5]
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("imported %d files with %d objects, %d unchanged, %d unknown", stats.Updated, len(verified), stats.Unchanged, stats.Unknown)
+		return nil
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"objects": &flags.Option{
+			Description: "Also copy the content of files from the given objects path of the source database.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"import",
+		"Merge builds and files from another database.",
+		`Reads another rbxark database, given after the database, and merges its
+		builds, and the headers and metadata of its checked files, into the
+		database. Builds are merged as with import-builds-json, and files as
+		with import-results, so that separate archives can be consolidated
+		without fetching their files again. The config of the source database,
+		if present beside it, is used to locate its secondary database.
+
+		The source database is opened read-only, and is never initialized or
+		migrated, since it may belong to another operator. A source created by
+		an earlier version of rbxark must first be migrated by its owner, such
+		as by running any command on it.
+
+		Servers and file names are not added, so merge-servers and
+		merge-filenames should be run first. Data already present in the
+		database is kept. Files are read from the source and merged in
+		batches, so the source may be larger than memory.
+
+		With --objects, the content of each file with content is copied from
+		the given objects path to the configured objects path. Each object is
+		copied once, is skipped if already present, and is verified against
+		the metadata of its files; files are marked as having content only if
+		verification succeeds. Without --objects, imported files have metadata
+		but no content, which can be filled in later with backfill-objects.`,
+		&CmdImport{},
+	))
+}
+
+// importBatchSize is the number of files of the source database that are
+// merged at once by the import command.
+const importBatchSize = 10000
+
+type CmdImport struct {
+	Objects string `long:"objects"`
+}
+
+func (cmd *CmdImport) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(args) == 0 {
+		return fmt.Errorf("expected source database file")
+	}
+	src, err := openSource(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	action := Action{Context: Main}
+	if err := action.CheckExportSchema(src); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	builds, err := action.ExportBuilds(src, 0)
+	if err != nil {
+		return fmt.Errorf("source: get builds: %w", err)
+	}
+	log.Printf("read %d builds from %s", len(builds), args[0])
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if cmd.Objects != "" {
+			if err := RequireObjects(config); err != nil {
+				return fmt.Errorf("--objects: %w", err)
+			}
+		}
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		if err := CheckObjects(action, ar, config); err != nil {
+			return err
+		}
+
+		buildStats, err := action.ImportBuilds(ar.DB, builds)
+		if err != nil {
+			return err
+		}
+		log.Printf("imported %d builds, %d unchanged, %d without a known server", buildStats.Added, buildStats.Unchanged, buildStats.Unlinked)
+
+		// Results are streamed from the source, and merged in batches, so
+		// that the files of a large source are never held in memory at once.
+		var stats ImportStats
+		var read, copied int
+		batch := make([]FileResult, 0, importBatchSize)
+		merge := func() error {
+			// Objects are copied and verified before the files are modified.
+			verified := map[string]bool{}
+			if cmd.Objects != "" {
+				verified = copyResultObjects(config.ObjectsPath, cmd.Objects, batch)
+			}
+			s, err := action.ImportResults(ar.DB, batch, func(r FileResult) bool {
+				return verified[r.Metadata.MD5]
+			})
+			if err != nil {
+				return err
+			}
+			stats.Updated += s.Updated
+			stats.Unchanged += s.Unchanged
+			stats.Unknown += s.Unknown
+			read += len(batch)
+			copied += len(verified)
+			batch = batch[:0]
+			log.Printf("merged %d files...", read)
+			return nil
+		}
+		err = action.ExportResults(src, false, 0, func(r FileResult) error {
+			batch = append(batch, r)
+			if len(batch) < importBatchSize {
+				return nil
+			}
+			return merge()
+		})
+		if err == nil && len(batch) > 0 {
+			err = merge()
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("imported %d files with %d objects, %d unchanged, %d unknown", stats.Updated, copied, stats.Unchanged, stats.Unknown)
+		return nil
+	})
+}
+
+// openSource opens the source database at path as read-only. The config beside
+// the database, if present, locates its secondary database.
+func openSource(path string) (*sql.DB, error) {
+	path = rootPath(path)
+	var secondary string
+	if config, err := loadConfigFile(path + ".json"); err == nil {
+		secondary = config.SecondaryDatabase
+	}
+	db, err := OpenReadOnlyDatabase(path, secondary)
+	if err != nil {
+		return nil, fmt.Errorf("open source: %w", err)
+	}
+	return db, nil
+}
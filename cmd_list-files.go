@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"where": &flags.Option{
+			Description: "List only files matching the given filter expression, e.g. 'file == \"RobloxApp.zip\"'.",
+		},
+		"json": &flags.Option{
+			Description: "Write the files in the selection file format.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"list-files",
+		"List files in the database.",
+		`Lists every file in the database, along with the first server on which
+		its build is present. With --where, only files matching the expression
+		are listed. The expression has the syntax of a filter, and may refer to
+		the same variables as the content domain, such as server, build, file,
+		and flags.
+
+		With --json, the files are written in the selection file format, so
+		that they can be fetched by passing the output to the --from-selection
+		flag of fetch-files or fetch-headers:
+
+		    rbxark list-files ark.db --json --where 'file == "RobloxApp.zip"' |
+		        rbxark fetch-files ark.db --from-selection -`,
+		&CmdListFiles{},
+	))
+}
+
+type CmdListFiles struct {
+	Where string `long:"where"`
+	JSON  bool   `long:"json"`
+}
+
+func (cmd *CmdListFiles) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	var rules []string
+	if cmd.Where != "" {
+		rules = []string{"exclude content", "include content : " + cmd.Where}
+	}
+	query, err := LoadFilter(rules, "content")
+	if err != nil {
+		return fmt.Errorf("--where: %w", err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	var tw *tabwriter.Writer
+	if !cmd.JSON {
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "server\tbuild\tfile\t")
+	}
+	err = archives.Each(func(ar *Archive) error {
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		files, err := action.ListFiles(ar.DB, query)
+		if err != nil {
+			return err
+		}
+		if cmd.JSON {
+			return writeSelection(w, files)
+		}
+		for _, file := range files {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t\n", file.Server, file.Build, file.File)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if tw != nil {
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
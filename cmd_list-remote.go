@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/anaminus/rbxark/s3"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"mark-not-found": &flags.Option{
+			Description: "Mark unlisted files of builds found only on listed servers as NotFound.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"list-remote",
+		"Discover files through bucket listings.",
+		`Enumerates the files of each configured listing through the S3-style
+		bucket listing API. Each listed file of a known build receives the
+		headers reported by the listing, as though its headers were fetched.
+
+		With --mark-not-found, Unchecked files of builds that are found only on
+		listed servers, but are not themselves listed, are marked as NotFound.
+		A server whose listing is empty is not used to mark files.
+
+		Listed file names that are not in the database are printed, but are
+		not added to the database.`,
+		&CmdListRemote{},
+	))
+}
+
+type CmdListRemote struct {
+	MarkNotFound bool `long:"mark-not-found"`
+}
+
+// listingPrefix returns the key prefix of a server located within a bucket.
+func listingPrefix(server, bucket string) (prefix string, err error) {
+	su, err := url.Parse(sanitizeBaseURL(server))
+	if err != nil {
+		return "", err
+	}
+	bu, err := url.Parse(sanitizeBaseURL(bucket))
+	if err != nil {
+		return "", err
+	}
+	if su.Host != bu.Host || !strings.HasPrefix(su.Path, bu.Path) {
+		return "", fmt.Errorf("server %s is not located within bucket %s", server, bucket)
+	}
+	prefix = strings.TrimPrefix(strings.TrimPrefix(su.Path, bu.Path), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix, nil
+}
+
+func (cmd *CmdListRemote) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if len(config.Listings) == 0 {
+			return fmt.Errorf("no configured listings")
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, 1, config.RateLimit)
+
+		listings := map[string][]s3.Object{}
+		for _, listing := range config.Listings {
+			server := sanitizeBaseURL(listing.Server)
+			bucket := listing.Bucket
+			if bucket == "" {
+				bucket = server
+			}
+			prefix, err := listingPrefix(server, bucket)
+			if err != nil {
+				log.Printf("list %s: %s", server, err)
+				continue
+			}
+			creds := &s3.Credentials{
+				AccessKey: listing.AccessKey,
+				SecretKey: listing.SecretKey,
+				Region:    listing.Region,
+			}
+			if creds.AccessKey == "" {
+				creds = s3.EnvCredentials(listing.Region)
+			}
+			var objects []s3.Object
+			err = s3.List(Main, fetcher, bucket, prefix, creds, func(object s3.Object) error {
+				object.Key = strings.TrimPrefix(object.Key, prefix)
+				objects = append(objects, object)
+				return nil
+			})
+			if err != nil {
+				// An incomplete listing cannot be used to mark files as
+				// NotFound, so the server is skipped entirely.
+				log.Printf("list %s: %s", server, err)
+				continue
+			}
+			log.Printf("listed %d objects from %s", len(objects), server)
+			listings[server] = objects
+		}
+
+		result, err := action.SeedListings(ar.DB, listings, cmd.MarkNotFound)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(result.UnknownNames))
+		for name := range result.UnknownNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s (%d)\n", name, result.UnknownNames[name])
+		}
+		log.Printf("seeded %d files, marked %d files as NotFound, skipped %d files of unknown builds", result.Seeded, result.NotFound, result.UnknownBuilds)
+		return nil
+	})
+}
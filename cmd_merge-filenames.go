@@ -1,43 +1,229 @@
 package main
 
 import (
+	"fmt"
 	"log"
+
+	"github.com/jessevdk/go-flags"
 )
 
 func init() {
-	FlagParser.AddCommand(
+	OptionTags{
+		"yes": &flags.Option{
+			ShortName:   'y',
+			Description: "Apply changes without asking for confirmation.",
+		},
+		"prune": &flags.Option{
+			Description: "Disable file names in the database that are not in the config.",
+		},
+		"from": &flags.Option{
+			Description: "Merge the names listed in the given file as JSON lines instead of the configured names. If '-', the names are read from stdin.",
+		},
+	}.AddTo(FlagParser.AddCommand(
 		"merge-filenames",
 		"Merge new file names into the database.",
 		`Reads configured file names. Names that aren't present in the database
-		are inserted.`,
+		are inserted. The tier of each configured name is updated to match the
+		list in which it is configured. Configured alias groups are also merged,
+		including any names within them.
+
+		The names to be added, and the names in the database that are not
+		configured, are listed, and confirmation is requested before the changes
+		are applied. Names that were discovered or generated as companions are
+		not listed. With --prune, names that are not configured are disabled:
+		their files are kept, but are no longer generated or fetched.
+
+		With --from, names are read from a file of JSON lines, each an object
+		with a "name" field, such as the output of find-filenames --json. The
+		names are added as discovered names, which are generated only when
+		requested, or for the builds listed in the "builds" field of each name.
+		The configured names are not merged. Confirmation cannot be
+		read from stdin while names are also read from it, so --yes must be
+		given in that case.`,
 		&CmdMergeFilenames{},
-	)
+	))
 }
 
-type CmdMergeFilenames struct{}
+type CmdMergeFilenames struct {
+	Yes   bool   `long:"yes"`
+	Prune bool   `long:"prune"`
+	From  string `long:"from"`
+}
 
 func (cmd *CmdMergeFilenames) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
+
+	if cmd.From != "" {
+		if cmd.Prune {
+			return fmt.Errorf("--prune cannot be used with --from")
+		}
+		return cmd.mergeFound(archives)
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
 
-	config, err := LoadConfig(cfgdir)
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		added, extra, err := action.DiffFilenames(ar.DB, configuredFilenames(config))
+		if err != nil {
+			return err
+		}
+		ok, err := confirmMerge(ar, "file names", added, extra, cmd.Prune, cmd.Yes)
+		if !ok || err != nil {
+			return err
+		}
+
+		newFiles, newAliases, err := mergeFilenames(action, ar.DB, config)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("merged %d new files\n", newFiles)
+		log.Printf("merged %d aliases\n", newAliases)
+
+		if cmd.Prune {
+			if err := action.SetFilenameTier(ar.DB, TierDisabled, extra); err != nil {
+				return err
+			}
+			log.Printf("disabled %d file names\n", len(extra))
+		}
+		return nil
+	})
+}
+
+// mergeFound merges the names read from the file given by --from into each
+// archive.
+func (cmd *CmdMergeFilenames) mergeFound(archives Archives) error {
+	if cmd.From == stdio && !cmd.Yes {
+		return fmt.Errorf("--yes is required when reading names from stdin")
+	}
+	f, err := openInput(cmd.From)
+	if err != nil {
+		return fmt.Errorf("open file names: %w", err)
+	}
+	found, err := readFoundFilenames(f)
+	f.Close()
 	if err != nil {
 		return err
 	}
+	names := make([]string, 0, len(found))
+	builds := map[string][]string{}
+	seen := map[string]bool{}
+	for _, name := range found {
+		if !seen[name.Name] {
+			seen[name.Name] = true
+			names = append(names, name.Name)
+		}
+		if len(name.Builds) > 0 {
+			builds[name.Name] = append(builds[name.Name], name.Builds...)
+		}
+	}
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
-		return err
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		existing, err := action.GetFilenames(ar.DB)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(existing))
+		for _, name := range existing {
+			present[name] = true
+		}
+		var added []string
+		for _, name := range names {
+			if !present[name] {
+				added = append(added, name)
+			}
+		}
+		ok, err := confirmMerge(ar, "file names", added, nil, false, cmd.Yes)
+		if !ok || err != nil {
+			return err
+		}
+
+		tx, err := ar.DB.BeginTx(action.Context, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		n, err := action.AddFilenames(tx, added)
+		if err != nil {
+			return err
+		}
+		if err := action.AddManifestNames(tx, builds); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("merged %d new files\n", n)
+		return nil
+	})
+}
+
+// configuredFilenames returns every file name in the config, including the
+// names within alias groups.
+func configuredFilenames(config *Config) (names []string) {
+	names = append(names, config.BuildFiles...)
+	names = append(names, config.RecentBuildFiles...)
+	names = append(names, config.ManualBuildFiles...)
+	for _, group := range config.FilenameAliases {
+		if len(group) >= 2 {
+			names = append(names, group...)
+		}
 	}
+	return names
+}
 
-	newFiles, err := action.MergeFiles(db, config.BuildFiles)
+// mergeFilenames merges the configured file names of each tier, along with the
+// configured alias groups.
+func mergeFilenames(action Action, e Executor, config *Config) (newFiles, newAliases int, err error) {
+	for _, tier := range []struct {
+		tier  FilenameTier
+		names []string
+	}{
+		{TierAlways, config.BuildFiles},
+		{TierRecent, config.RecentBuildFiles},
+		{TierManual, config.ManualBuildFiles},
+	} {
+		n, err := action.MergeFiles(e, tier.names)
+		if err != nil {
+			return newFiles, 0, err
+		}
+		newFiles += n
+		if err := action.SetFilenameTier(e, tier.tier, tier.names); err != nil {
+			return newFiles, 0, err
+		}
+	}
+	newAliases, err = action.MergeAliases(e, config.FilenameAliases)
 	if err != nil {
-		return err
+		return newFiles, newAliases, err
 	}
-
-	log.Printf("merged %d new files\n", newFiles)
-	return nil
+	// Names that are configured only within alias groups have no tier to be
+	// set to, so they are enabled separately.
+	for _, group := range config.FilenameAliases {
+		if err := action.EnableFilenames(e, group); err != nil {
+			return newFiles, newAliases, err
+		}
+	}
+	return newFiles, newAliases, nil
 }
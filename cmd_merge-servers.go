@@ -1,43 +1,170 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
 )
 
 func init() {
-	FlagParser.AddCommand(
+	OptionTags{
+		"yes": &flags.Option{
+			ShortName:   'y',
+			Description: "Apply changes without asking for confirmation.",
+		},
+		"prune": &flags.Option{
+			Description: "Disable servers in the database that are not in the config.",
+		},
+	}.AddTo(FlagParser.AddCommand(
 		"merge-servers",
 		"Merge new servers into the database.",
 		`Reads configured server URLs. Servers that aren't present in the
-		database are inserted.`,
+		database are inserted. Configured servers that were disabled are enabled
+		again.
+
+		Each configured channel of a server is inserted as a server located at
+		"<server>/channel/<name>", and is related to its server. A server that
+		was previously configured with the URL of a channel becomes the
+		channel, keeping its builds and files.
+
+		The servers to be added, and the servers in the database that are not
+		configured, are listed, and confirmation is requested before the changes
+		are applied. With --prune, servers that are not configured are disabled:
+		their builds and files are kept, but are no longer fetched.`,
 		&CmdMergeServers{},
-	)
+	))
 }
 
-type CmdMergeServers struct{}
+type CmdMergeServers struct {
+	Yes   bool `long:"yes"`
+	Prune bool `long:"prune"`
+}
 
 func (cmd *CmdMergeServers) Execute(args []string) error {
-	db, cfgdir, err := OpenDatabase(args)
+	archives, _, err := OpenArchives(args)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer archives.Close()
 
-	config, err := LoadConfig(cfgdir)
-	if err != nil {
-		return err
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main, Operation: NewOperation(config)}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		added, extra, err := action.DiffServers(ar.DB, configuredServers(config))
+		if err != nil {
+			return err
+		}
+		ok, err := confirmMerge(ar, "servers", added, extra, cmd.Prune, cmd.Yes)
+		if !ok || err != nil {
+			return err
+		}
+
+		newServers, err := mergeServers(action, ar.DB, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("merged %d new servers\n", newServers)
+
+		if cmd.Prune {
+			if err := action.DisableServers(ar.DB, extra); err != nil {
+				return err
+			}
+			log.Printf("disabled %d servers\n", len(extra))
+		}
+		return nil
+	})
+}
+
+// configuredChannels returns the configured channels of each server, other than
+// the LIVE channel of the server itself.
+func configuredChannels(config *Config) (channels []Channel) {
+	for _, c := range config.Channels {
+		for _, name := range c.Names {
+			if strings.EqualFold(name, LiveChannel) {
+				continue
+			}
+			channels = append(channels, Channel{Server: c.Server, Name: name})
+		}
 	}
+	return channels
+}
 
-	action := Action{Context: Main}
-	if err := action.Init(db); err != nil {
-		return err
+// configuredServers returns the URLs of the configured servers, followed by the
+// URLs of their channels.
+func configuredServers(config *Config) []string {
+	servers := append([]string(nil), config.Servers...)
+	for _, c := range configuredChannels(config) {
+		servers = append(servers, c.URL())
 	}
+	return servers
+}
 
-	newServers, err := action.MergeServers(db, config.Servers)
-	if err != nil {
-		return err
+// mergeServers merges the configured servers and their channels.
+func mergeServers(action Action, e Executor, config *Config) (newServers int, err error) {
+	if newServers, err = action.MergeServers(e, configuredServers(config)); err != nil {
+		return newServers, err
+	}
+	if err := action.MergeChannels(e, configuredChannels(config)); err != nil {
+		return newServers, err
 	}
+	return newServers, nil
+}
 
-	log.Printf("merged %d new servers\n", newServers)
-	return nil
+// confirmMerge lists the entries of a kind that are to be added to an archive,
+// and the entries in the archive that are not configured. If there are changes
+// to apply, confirmation is requested from the user, unless yes is true. Extra
+// entries are changes only when prune is true. Returns whether the changes
+// should be applied.
+func confirmMerge(ar *Archive, kind string, added, extra []string, prune, yes bool) (ok bool, err error) {
+	if len(added) == 0 && len(extra) == 0 {
+		return true, nil
+	}
+	name := ar.Name
+	var b strings.Builder
+	if len(added) > 0 {
+		fmt.Fprintf(&b, "%s to add to %s:\n", kind, name)
+		for _, entry := range added {
+			fmt.Fprintf(&b, "\t+ %s\n", entry)
+		}
+	}
+	if len(extra) > 0 {
+		if prune {
+			fmt.Fprintf(&b, "%s in %s not in config, to disable:\n", kind, name)
+		} else {
+			fmt.Fprintf(&b, "%s in %s not in config (disabled with --prune):\n", kind, name)
+		}
+		for _, entry := range extra {
+			fmt.Fprintf(&b, "\t- %s\n", entry)
+		}
+	}
+	fmt.Fprint(os.Stderr, b.String())
+	if yes || len(added) == 0 && !prune {
+		return true, nil
+	}
+	fmt.Fprint(os.Stderr, "apply changes? [y/N] ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		// No input, such as when stdin is not a terminal.
+		fmt.Fprintln(os.Stderr)
+		log.Printf("%s: no confirmation; use --yes to apply changes non-interactively", name)
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	log.Printf("%s: changes not applied", name)
+	return false, nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"workers": &flags.Option{
+			Description: "The number of worker threads used when probing files.",
+			Default:     []string{"8"},
+		},
+		"rate-limit": &flags.Option{
+			Description: "Allowed requests per second. A negative value means unlimited.",
+			Default:     []string{"-1"},
+		},
+		"server": &flags.Option{
+			Description: "The server from which files are probed. Defaults to the first server on which the build is present.",
+		},
+		"names": &flags.Option{
+			Description: "Read candidate names from a file, one per line. Use '-' to read from stdin.",
+		},
+		"limit": &flags.Option{
+			ShortName:   'n',
+			Description: "Maximum number of names to probe.",
+		},
+		"reprobe": &flags.Option{
+			Description: "Probe names that were already probed against the build.",
+		},
+		"add": &flags.Option{
+			Description: "Add found names to the database, along with the file of the build.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"probe",
+		"Probe candidate file names against a single build.",
+		`Checks whether files of the given candidate names exist for a single
+		build. Candidates are taken from the remaining arguments and the names
+		file. If no candidates are given, the configured build files are used.
+
+		Names are probed in order of their historical hit rate across builds
+		of the same type, so that the most likely names are probed first when
+		the number of probes is limited. Names that already have a file for the
+		build, or that were already probed against the build, are skipped.
+
+		The result of each probe is recorded, and found names are printed. Found
+		names are added to the database only if requested. They are added with
+		the manual tier, so that only the file of the probed build is added.`,
+		&CmdProbe{},
+	))
+}
+
+type CmdProbe struct {
+	Workers   int     `long:"workers"`
+	RateLimit float64 `long:"rate-limit"`
+	Server    string  `long:"server"`
+	Names     string  `long:"names"`
+	Limit     int     `long:"limit"`
+	Reprobe   bool    `long:"reprobe"`
+	Add       bool    `long:"add"`
+}
+
+// readNames reads names from a file, one per line. Empty lines are ignored.
+func readNames(path string) (names []string, err error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if name := strings.TrimSpace(s.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, s.Err()
+}
+
+func (cmd *CmdProbe) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	if len(args) == 0 {
+		return fmt.Errorf("expected build hash")
+	}
+	build := args[0]
+	candidates := args[1:]
+	if cmd.Names != "" {
+		names, err := readNames(cmd.Names)
+		if err != nil {
+			return fmt.Errorf("read names: %w", err)
+		}
+		candidates = append(candidates, names...)
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		names := candidates
+		if len(names) == 0 {
+			names = config.BuildFiles
+		}
+
+		rateLimit := config.RateLimit
+		if cmd.RateLimit >= 0 {
+			rateLimit = cmd.RateLimit
+		}
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		fetcher := NewFetcher(config, client, cmd.Workers, rateLimit)
+
+		results, err := action.ProbeBuild(ar.DB, fetcher, build, names, ProbeOptions{
+			Server:  cmd.Server,
+			Limit:   cmd.Limit,
+			Reprobe: cmd.Reprobe,
+			AddHits: cmd.Add,
+		})
+		if err != nil {
+			if errors.Is(err, ErrUnknownBuild) && len(archives) > 1 {
+				// Within a workspace, the build is expected to be present
+				// in only some archives.
+				log.Println(err)
+				return nil
+			}
+			return err
+		}
+		var found int
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				log.Printf("probe %s: %s", r.Name, r.Err)
+			case r.Found():
+				found++
+				fmt.Println(r.Name)
+			}
+		}
+		log.Printf("found %d of %d probed names", found, len(results))
+		return nil
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/s3"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"bucket": &flags.Option{
+			Description: "URL of the S3-compatible bucket to which objects are pushed.",
+		},
+		"region": &flags.Option{
+			Description: "Region of the bucket.",
+		},
+		"part-size": &flags.Option{
+			Description: "Size of each part of a multipart upload, in MiB. At least 5.",
+			Default:     []string{"16"},
+		},
+		"retries": &flags.Option{
+			Description: "Number of times a failed request is retried.",
+			Default:     []string{"3"},
+		},
+		"workers": &flags.Option{
+			Description: "The number of objects uploaded concurrently.",
+			Default:     []string{"4"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"push-objects",
+		"Upload objects to the bucket of a peer mirror.",
+		`Uploads each object of the files with content to an S3-compatible
+		bucket, under the same layout as the objects path, so that another
+		archive can use the bucket as a source of objects. Objects already in
+		the bucket with the same size are skipped.
+
+		Objects larger than one part are uploaded in parts. Each part is sent
+		with its MD5 hash, and signed with its SHA-256 hash, so that a part
+		corrupted in transit is rejected. If an upload is interrupted, running
+		the command again resumes it, uploading only the missing parts.
+
+		Requests are signed with the credentials of the AWS_ACCESS_KEY_ID and
+		AWS_SECRET_ACCESS_KEY environment variables, if set.`,
+		&CmdPushObjects{},
+	))
+}
+
+type CmdPushObjects struct {
+	Bucket   string `long:"bucket"`
+	Region   string `long:"region"`
+	PartSize int64  `long:"part-size"`
+	Retries  int    `long:"retries"`
+	Workers  int    `long:"workers"`
+}
+
+func (cmd *CmdPushObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if cmd.Bucket == "" {
+		return fmt.Errorf("--bucket required")
+	}
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		client, err := NewClient(config)
+		if err != nil {
+			return err
+		}
+		uploader := &s3.Uploader{
+			Client:   client,
+			Bucket:   cmd.Bucket,
+			Creds:    s3.EnvCredentials(cmd.Region),
+			PartSize: cmd.PartSize << 20,
+			Retries:  cmd.Retries,
+		}
+		if client == nil {
+			uploader.Client = http.DefaultClient
+		}
+
+		sizes, err := action.ContentObjects(ar.DB)
+		if err != nil {
+			return err
+		}
+		pending, err := missingObjects(uploader, sizes)
+		if err != nil {
+			return err
+		}
+		log.Printf("pushing %d of %d objects", len(pending), len(sizes))
+
+		var mu sync.Mutex
+		var pushed, failed int
+		var bytes int64
+		workers := cmd.Workers
+		if workers < 1 {
+			workers = 1
+		}
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+		for n := 0; n < workers; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for hash := range jobs {
+					err := pushObject(uploader, config.ObjectsPath, hash, sizes[hash])
+					mu.Lock()
+					if err != nil {
+						log.Printf("push object %s: %s", hash, err)
+						failed++
+					} else {
+						pushed++
+						bytes += sizes[hash]
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	loop:
+		for _, hash := range pending {
+			select {
+			case jobs <- hash:
+			case <-Main.Done():
+				break loop
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		log.Printf("pushed %d objects (%s), %d failed", pushed, formatSize(bytes), failed)
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to push %d objects", failed)
+		}
+		return nil
+	})
+}
+
+// missingObjects returns the sorted hashes of the given objects that are not in
+// the bucket of u with the same size. The bucket is listed once for each prefix
+// directory.
+func missingObjects(u *s3.Uploader, sizes map[string]int64) (hashes []string, err error) {
+	prefixes := map[string]bool{}
+	for hash := range sizes {
+		prefixes[hash[:2]] = true
+	}
+	present := map[string]int64{}
+	for prefix := range prefixes {
+		err := s3.List(Main, u.Client, u.Bucket, prefix+"/", u.Creds, func(object s3.Object) error {
+			present[object.Key] = object.Size
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for hash, size := range sizes {
+		if remote, ok := present[objects.Key(hash)]; !ok || remote != size {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// pushObject uploads the object of the given hash from objpath.
+func pushObject(u *s3.Uploader, objpath, hash string, size int64) error {
+	if stat := objects.Stat(objpath, hash); stat == nil {
+		return fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+	} else if stat.Size() != size {
+		return fmt.Errorf("object has size %d, expected %d", stat.Size(), size)
+	}
+	f, err := objects.OpenFile(objpath, hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return u.Upload(Main, objects.Key(hash), f, size)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"objects": &flags.Option{
+			Description: "Also copy the objects of files with content to the given objects path of the standby.",
+		},
+		"interval": &flags.Option{
+			Description: "Replicate again after the given number of seconds, until interrupted. If zero, replicates once.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"replicate",
+		"Keep a standby copy of the database up to date.",
+		`Copies the changes of the database to a standby database, given after
+		the database. The standby is created if it does not exist. Only rows
+		that were added, changed, or removed since the last replication are
+		written, so a warm standby can be kept in sync without crawling again.
+		Every table describing the archive is copied, including tables located
+		in a secondary database.
+
+		With --objects, objects that are missing from the objects path of the
+		standby are copied and verified. With --interval, replication repeats
+		periodically until the command is interrupted.
+
+		The standby is updated in a single transaction, so it may be read, or
+		served, while replication is running. It must not be written by other
+		commands, because rows are matched by rowid. A standby on another host
+		can be reached through a network file system, or by running replicate
+		to a local file and shipping it with a tool such as rsync.`,
+		&CmdReplicate{},
+	))
+}
+
+type CmdReplicate struct {
+	Objects  string `long:"objects"`
+	Interval int    `long:"interval"`
+}
+
+func (cmd *CmdReplicate) Execute(args []string) error {
+	archives, args, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if len(archives) > 1 {
+		return fmt.Errorf("replicate operates on a single archive")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("expected standby database file")
+	}
+	standby := args[0]
+
+	ar := archives[0]
+	config, err := LoadConfig(ar.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if cmd.Objects != "" {
+		if err := RequireObjects(config); err != nil {
+			return fmt.Errorf("--objects: %w", err)
+		}
+	}
+	action := Action{Context: Main}
+	if err := action.Init(ar.DB); err != nil {
+		return err
+	}
+
+	Notify("READY=1")
+	for {
+		stats, err := action.Replicate(ar.DB, standby)
+		if err != nil {
+			return err
+		}
+		log.Printf("replicated to %s: %s", standby, stats)
+		if cmd.Objects != "" {
+			if err := replicateObjects(action, ar, config.ObjectsPath, cmd.Objects); err != nil {
+				return err
+			}
+		}
+		if cmd.Interval <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(time.Duration(cmd.Interval) * time.Second):
+		case <-Main.Done():
+			return nil
+		}
+	}
+}
+
+// replicateObjects copies each object of the files with content from objpath to
+// dst, if it is not already present. Objects that fail to copy are reported,
+// and do not stop the remaining objects from being copied.
+func replicateObjects(action Action, ar *Archive, objpath, dst string) error {
+	sizes, err := action.ContentObjects(ar.DB)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0, len(sizes))
+	for hash := range sizes {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	var copied, failed int
+	for _, hash := range hashes {
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		if objects.Exists(dst, hash) {
+			continue
+		}
+		if err := copyObject(dst, objpath, hash, sizes[hash]); err != nil {
+			log.Printf("copy object %s: %s", hash, err)
+			failed++
+			continue
+		}
+		copied++
+	}
+	log.Printf("replicated %d objects to %s", copied, dst)
+	if failed > 0 {
+		return fmt.Errorf("failed to copy %d objects", failed)
+	}
+	return nil
+}
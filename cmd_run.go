@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"list": &flags.Option{
+			ShortName:   'l',
+			Description: "List the configured aliases instead of running one.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"run",
+		"Run a configured sequence of commands.",
+		`Runs each command of an alias defined in the aliases section of the
+		config, in order. The first argument is the name of the alias. The
+		remaining arguments, such as the database file, are inserted after the
+		name of each command, and global flags, such as --config, are passed to
+		each command. The run stops at the first command that fails.
+
+		For example, with the alias
+
+		    "daily": [["fetch-builds"], ["generate-files"], ["fetch-files", "--recheck"]]
+
+		running "rbxark run daily ark.db" is equivalent to running
+
+		    rbxark fetch-builds ark.db
+		    rbxark generate-files ark.db
+		    rbxark fetch-files ark.db --recheck`,
+		&CmdRun{},
+	))
+}
+
+type CmdRun struct {
+	List bool `long:"list"`
+}
+
+func (cmd *CmdRun) Execute(args []string) error {
+	if !cmd.List && len(args) == 0 {
+		return fmt.Errorf("expected alias name")
+	}
+	var name string
+	if !cmd.List {
+		name, args = args[0], args[1:]
+	}
+	path := defaultsConfigPath(args)
+	if path == "" {
+		return fmt.Errorf("expected database file")
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if cmd.List {
+		names := make([]string, 0, len(config.Aliases))
+		for name := range config.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+			for _, step := range config.Aliases[name] {
+				fmt.Printf("\t%s\n", strings.Join(step, " "))
+			}
+		}
+		return nil
+	}
+
+	steps, ok := config.Aliases[name]
+	if !ok {
+		return fmt.Errorf("unknown alias %q", name)
+	}
+	for i, step := range steps {
+		if len(step) == 0 {
+			return fmt.Errorf("alias %s: command %d is empty", name, i+1)
+		}
+		if c := FlagParser.Find(step[0]); c == nil || c.Name == "run" {
+			return fmt.Errorf("alias %s: command %d: unknown command %q", name, i+1, step[0])
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	globals := globalFlags()
+	for i, step := range steps {
+		if Main.Err() != nil {
+			return Main.Err()
+		}
+		cmdArgs := make([]string, 0, len(globals)+len(args)+len(step))
+		cmdArgs = append(cmdArgs, globals...)
+		cmdArgs = append(cmdArgs, step[0])
+		cmdArgs = append(cmdArgs, args...)
+		cmdArgs = append(cmdArgs, step[1:]...)
+		log.Printf("%s: %d/%d: %s", name, i+1, len(steps), strings.Join(step, " "))
+		if err := runStep(exe, cmdArgs); err != nil {
+			return fmt.Errorf("alias %s: %s: %w", name, step[0], err)
+		}
+	}
+	return nil
+}
+
+// runStep runs the executable with the given arguments, sharing the standard
+// streams of the process. The command is interrupted when Main is canceled.
+func runStep(exe string, args []string) error {
+	c := exec.Command(exe, args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-Main.Done():
+			c.Process.Signal(os.Interrupt)
+		case <-done:
+		}
+	}()
+	return c.Wait()
+}
+
+// globalFlags returns the global flags given to the process, as arguments to
+// be passed to each command of an alias. --root is omitted, because the
+// working directory has already been changed to it, and profiling flags are
+// omitted, because each command would overwrite the profile.
+func globalFlags() (args []string) {
+	for _, opt := range FlagParser.Command.Options() {
+		switch opt.LongName {
+		case "", "root", "profile-cpu", "profile-mem":
+			continue
+		}
+		if !opt.IsSet() || opt.IsSetDefault() {
+			continue
+		}
+		switch v := opt.Value().(type) {
+		case bool:
+			if v {
+				args = append(args, "--"+opt.LongName)
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", opt.LongName, v))
+		}
+	}
+	return args
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"keep": &flags.Option{
+			Description: "Keep the directory of the test archive instead of removing it.",
+		},
+		"verbose": &flags.Option{
+			ShortName:   'v',
+			Description: "Show the output of each command, rather than only of failed commands.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"self-test",
+		"Run the archiving pipeline against a simulated server.",
+		`Serves a synthetic deployment over HTTP from within the process, with a
+		DeployHistory file, builds with rbxPkgManifest files, zip packages,
+		and files that do not exist. A new archive is created in a temporary
+		directory, configured with the simulated server, and the following
+		commands are run on it by the rbxark executable, as they would be by
+		hand:
+
+		    merge-servers, merge-filenames, fetch-builds, generate-files,
+		    fetch-files, verify-objects, extract
+
+		The resulting archive is then checked: every build must be
+		discovered, every existing file must be complete with the content
+		that was served, every other file must be not found, every object
+		must match its hash, and the extracted build must match its packages.
+		Each failed check is reported, and the command fails if any check
+		fails.
+
+		No real server is contacted, so the test can be run after installing
+		or upgrading to confirm that the pipeline works on the host. Global
+		flags such as --config and --workspace are not used.`,
+		&CmdSelfTest{},
+	))
+}
+
+type CmdSelfTest struct {
+	Keep    bool `long:"keep"`
+	Verbose bool `long:"verbose"`
+}
+
+func (cmd *CmdSelfTest) Execute(args []string) error {
+	if FlagOptions.Config != "" || FlagOptions.Workspace != "" {
+		return fmt.Errorf("self-test does not use --config or --workspace")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "rbxark-self-test-")
+	if err != nil {
+		return err
+	}
+	if cmd.Keep {
+		log.Printf("test archive is at %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	d := newSynthDeployment()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: d}
+	go srv.Serve(ln)
+	defer srv.Close()
+	server := "http://" + ln.Addr().String()
+	log.Printf("serving synthetic deployment at %s", server)
+
+	dbPath := filepath.Join(dir, "ark.db")
+	installPath := filepath.Join(dir, "install")
+	objectsPath := filepath.Join(dir, "objects")
+	if err := writeSelfTestConfig(dbPath+".json", objectsPath, server, d.FileNames()); err != nil {
+		return err
+	}
+	if err := os.Mkdir(objectsPath, 0755); err != nil {
+		return err
+	}
+
+	extracted := d.Builds[0]
+	steps := [][]string{
+		{"merge-servers", "--yes"},
+		{"merge-filenames", "--yes"},
+		{"fetch-builds"},
+		{"generate-files"},
+		{"fetch-files"},
+		{"verify-objects"},
+		{"extract", extracted.Hash, "--output", installPath},
+	}
+	for i, step := range steps {
+		if err := Main.Err(); err != nil {
+			return err
+		}
+		log.Printf("%d/%d: %s", i+1, len(steps), strings.Join(step, " "))
+		cmdArgs := append([]string{step[0], dbPath}, step[1:]...)
+		if err := cmd.runStep(exe, cmdArgs); err != nil {
+			return fmt.Errorf("%s: %w", step[0], err)
+		}
+	}
+
+	ar, err := openArchive(WorkspaceArchive{Name: dbPath, Database: dbPath, Config: dbPath + ".json"})
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+	config, err := LoadConfig(ar.ConfigPath)
+	if err != nil {
+		return err
+	}
+	check := &selfTestCheck{}
+	if err := check.builds(Action{Context: Main}, ar, d); err != nil {
+		return err
+	}
+	if err := check.files(Action{Context: Main}, ar, config, d); err != nil {
+		return err
+	}
+	check.install(installPath, extracted)
+	if check.failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", check.failed, check.total)
+	}
+	log.Printf("all %d checks passed", check.total)
+	return nil
+}
+
+// runStep runs the executable with the given arguments. The output of the
+// command is shown if it fails, or if the test is verbose.
+func (cmd *CmdSelfTest) runStep(exe string, args []string) error {
+	c := exec.CommandContext(Main, exe, args...)
+	var out bytes.Buffer
+	if cmd.Verbose {
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+	} else {
+		c.Stdout = &out
+		c.Stderr = &out
+	}
+	err := c.Run()
+	if err != nil {
+		os.Stderr.Write(out.Bytes())
+	}
+	return err
+}
+
+// writeSelfTestConfig writes the config of the test archive, which fetches the
+// given file names from server into objpath.
+func writeSelfTestConfig(path, objpath, server string, names []string) error {
+	config := map[string]interface{}{
+		"objects_path": objpath,
+		"servers":      []string{server},
+		"build_files":  names,
+	}
+	b, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// selfTestCheck counts the checks of a self-test.
+type selfTestCheck struct {
+	total  int
+	failed int
+}
+
+// expect records a check, reporting it if it failed.
+func (c *selfTestCheck) expect(ok bool, format string, args ...interface{}) {
+	c.total++
+	if !ok {
+		c.failed++
+		log.Printf("FAIL: "+format, args...)
+	}
+}
+
+// builds checks that each build of d was discovered.
+func (c *selfTestCheck) builds(a Action, ar *Archive, d *synthDeployment) error {
+	for _, b := range d.Builds {
+		var typ, version string
+		err := ar.DB.QueryRowContext(a.Context, `SELECT type, version FROM builds WHERE hash == ?`, b.Hash).Scan(&typ, &version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		c.expect(err == nil, "build %s was not discovered", b.Hash)
+		if err != nil {
+			continue
+		}
+		c.expect(typ == b.Type, "build %s has type %q, expected %q", b.Hash, typ, b.Type)
+		c.expect(version == b.Version.String(), "build %s has version %q, expected %q", b.Hash, version, b.Version)
+	}
+	return nil
+}
+
+// files checks the state of each file of the builds of d, and the object of
+// each file with content.
+func (c *selfTestCheck) files(a Action, ar *Archive, config *Config, d *synthDeployment) error {
+	const query = `
+		SELECT files.flags, ifnull(metadata.md5, ''), ifnull(metadata.size, -1)
+		FROM files, builds, filenames
+		LEFT JOIN metadata ON metadata.file == files.rowid
+		WHERE files.build == builds.rowid
+		AND files.filename == filenames.rowid
+		AND builds.hash == ?
+		AND filenames.name == ?
+	`
+	for _, b := range d.Builds {
+		for _, name := range d.FileNames() {
+			var flags FileFlags
+			var hash string
+			var size int64
+			err := ar.DB.QueryRowContext(a.Context, query, b.Hash, name).Scan(&flags, &hash, &size)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			c.expect(err == nil, "file %s-%s was not generated", b.Hash, name)
+			if err != nil {
+				continue
+			}
+			f, exists := b.Files[name]
+			if !exists {
+				c.expect(flags.Progress() == "NotFound", "file %s-%s is %s, expected NotFound", b.Hash, name, flags.Progress())
+				continue
+			}
+			c.expect(flags.Progress() == "Complete", "file %s-%s is %s, expected Complete", b.Hash, name, flags.Progress())
+			c.expect(hash == f.md5(), "file %s-%s has hash %s, expected %s", b.Hash, name, hash, f.md5())
+			c.expect(size == int64(len(f.content)), "file %s-%s has size %d, expected %d", b.Hash, name, size, len(f.content))
+			ok, err := objects.Verify(config.ObjectsPath, f.md5())
+			c.expect(err == nil && ok, "object of %s-%s does not match its hash: %v", b.Hash, name, err)
+		}
+	}
+	return nil
+}
+
+// install checks that the files of the packages of b were extracted to root.
+func (c *selfTestCheck) install(root string, b synthBuild) {
+	for name, f := range b.Files {
+		dir, ok := DefaultPackageDirs[name]
+		if !ok {
+			continue
+		}
+		for entry, content := range f.entries {
+			path := filepath.Join(root, filepath.FromSlash(dir), filepath.FromSlash(entry))
+			b, err := ioutil.ReadFile(path)
+			c.expect(err == nil && bytes.Equal(b, content), "entry %s of %s was not extracted: %v", entry, name, err)
+		}
+	}
+	_, err := os.Stat(filepath.Join(root, appSettingsName))
+	c.expect(err == nil, "%s was not written: %v", appSettingsName, err)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anaminus/rbxark/server"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"listen": &flags.Option{
+			Description: "Address on which to listen for requests.",
+			Default:     []string{"localhost:8080"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"serve",
+		"Serve the archive over a read-only HTTP API.",
+		`Serves the builds, files, and objects of the archive over HTTP, so that
+		tools can look up and download builds from the archive as from a
+		mirror. The database is only read. The following endpoints are
+		served:
+
+		    GET /builds
+		        The builds of the archive, as a JSON array, as written by
+		        export-builds.
+
+		    GET /builds/<build>/files
+		        The files of a build, as JSON lines, as written by export.
+
+		    GET /builds/<build>/files/<file>
+		        The content of a file of a build.
+
+		    GET /files?where=<expr>&since=<time>
+		        The files matching a filter expression, as JSON lines. The
+		        parameters are those of export --where and --since, and are
+		        optional.
+
+		    GET /objects/<hash>
+		        The content of the object of an MD5 hash.
+
+		Content is read from the objects path, or from the object storage of
+		the archive. The hash of an object is sent as its ETag, and ranges of
+		uncompressed content in the objects path may be requested. The server
+		runs until the command is interrupted.
+
+		With a workspace, every archive of the workspace is served together.
+		Builds and files are those of every archive, and the server is
+		configured by the first archive. An object that is not held by the
+		archive of a file is looked up in each other archive, then in each
+		peer of the serve section of the config, which is another serve API.
+		Content from a peer is verified against its hash before it is served.
+		An object served from somewhere other than the archive of its file, or
+		from a peer, is logged as a cross-archive hit, and the number of hits
+		from each archive and peer is logged when the server stops.
+
+		Requests are limited as configured by the serve section of the config,
+		such as by a rate and a number of concurrent requests for each client
+		address. A refused request is answered with a 429 status, or a 503
+		status if the server as a whole is busy. Because the API only reads,
+		requests with a body are refused.
+
+		If access_log of the serve section is set, each request that is not
+		refused is appended to the access log as a JSON line, recording the
+		path, the build, file, and object served, the status, and the number
+		of bytes sent. The log is rotated once it reaches access_log_max_size.
+		The downloads command reports the most downloaded builds and files of
+		the log.`,
+		&CmdServe{},
+	))
+}
+
+type CmdServe struct {
+	Listen string `long:"listen"`
+}
+
+func (cmd *CmdServe) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	f := &federation{}
+	names := make([]string, len(archives))
+	for i, ar := range archives {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		store, err := OpenStorage(config)
+		if err != nil {
+			return err
+		}
+		f.archives = append(f.archives, &servedArchive{Archive: ar, config: config, store: store})
+		names[i] = ar.Name
+	}
+	// The server is configured by the first archive.
+	config := f.archives[0].config
+	if f.client, err = NewClient(config); err != nil {
+		return err
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	for _, peer := range config.Serve.Peers {
+		f.peers = append(f.peers, sanitizeBaseURL(peer))
+	}
+	defer f.logHits()
+
+	ln, err := net.Listen("tcp", cmd.Listen)
+	if err != nil {
+		return err
+	}
+	handler := f.Handler(f.API())
+	access, err := openAccessLog(config.Serve)
+	if err != nil {
+		return err
+	}
+	if access != nil {
+		defer access.Close()
+		handler = server.LogAccess(handler, config.Serve.ClientHeader, access.record)
+	}
+	srv := newServer(config.Serve, handler)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	log.Printf("serving %s at http://%s/", strings.Join(names, ", "), ln.Addr())
+	Notify("READY=1")
+
+	select {
+	case err := <-done:
+		return err
+	case <-Main.Done():
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// Defaults of the serve section of the config.
+const (
+	DefaultServeBurst          = 10
+	DefaultServeMaxURLLength   = 4096
+	DefaultServeMaxHeaderBytes = 16 << 10
+	// In seconds.
+	DefaultServeWriteTimeout = 3600
+	DefaultServeIdleTimeout  = 120
+
+	DefaultServeAccessLogMaxSize = 100 << 20
+	DefaultServeAccessLogBackups = 10
+)
+
+// newServer returns the HTTP server that answers requests with handler, which
+// is limited according to config.
+func newServer(config Serve, handler http.Handler) *http.Server {
+	limits := server.Limits{
+		RateLimit:        config.RateLimit,
+		Burst:            config.Burst,
+		MaxStreams:       config.MaxStreams,
+		MaxClientStreams: config.MaxClientStreams,
+		MaxURLLength:     config.MaxURLLength,
+		ClientHeader:     config.ClientHeader,
+	}
+	if limits.Burst <= 0 {
+		limits.Burst = DefaultServeBurst
+	}
+	if limits.MaxURLLength <= 0 {
+		limits.MaxURLLength = DefaultServeMaxURLLength
+	}
+	maxHeaderBytes := config.MaxHeaderBytes
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = DefaultServeMaxHeaderBytes
+	}
+	seconds := func(v, def float64) time.Duration {
+		switch {
+		case v < 0:
+			return 0
+		case v == 0:
+			v = def
+		}
+		return time.Duration(v * float64(time.Second))
+	}
+	return &http.Server{
+		Handler:           limits.Handler(handler),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      seconds(config.WriteTimeout, DefaultServeWriteTimeout),
+		IdleTimeout:       seconds(config.IdleTimeout, DefaultServeIdleTimeout),
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
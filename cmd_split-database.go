@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"join": &flags.Option{
+			Description: "Move tables from the secondary database back into the primary database.",
+		},
+		"vacuum": &flags.Option{
+			Description: "Vacuum the source database after moving tables, reclaiming unused space.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"split-database",
+		"Move bulky tables into the secondary database.",
+		`Moves bulky, rarely-queried tables, such as headers, from the primary
+		database into the configured secondary database. This keeps the primary
+		database light for selection queries. All commands continue to operate
+		on the moved tables transparently.`,
+		&CmdSplitDatabase{},
+	))
+}
+
+type CmdSplitDatabase struct {
+	Join   bool `long:"join"`
+	Vacuum bool `long:"vacuum"`
+}
+
+func (cmd *CmdSplitDatabase) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if config.SecondaryDatabase == "" {
+			return fmt.Errorf("unconfigured secondary database")
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		moved, err := action.MoveTables(ar.DB, !cmd.Join)
+		if err != nil {
+			return err
+		}
+		for _, table := range moved {
+			log.Printf("moved table %s", table)
+		}
+		log.Printf("moved %d tables", len(moved))
+
+		if cmd.Vacuum && len(moved) > 0 {
+			schema := "main"
+			if cmd.Join {
+				schema = SecondarySchema
+			}
+			if _, err := ar.DB.ExecContext(Main, `VACUUM `+schema); err != nil {
+				return fmt.Errorf("vacuum %s: %w", schema, err)
+			}
+		}
+		return nil
+	})
+}
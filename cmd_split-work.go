@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"shards": &flags.Option{
+			ShortName:   'n',
+			Description: "Number of shards to split the selection into.",
+			Default:     []string{"2"},
+		},
+		"output": &flags.Option{
+			ShortName:   'o',
+			Description: "Prefix of the shard files. Shard i is written to <output>-<i>.jsonl.",
+			Default:     []string{"shard"},
+		},
+		"headers": &flags.Option{
+			Description: "Select files as fetch-headers would, rather than fetch-files. Implied by a headers-only archive.",
+		},
+		"recheck": &flags.Option{
+			Description: "Include files with the NotFound flag.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"split-work",
+		"Split selected files into disjoint shards.",
+		`Selects the files that would be fetched by fetch-files, and partitions
+		them into a number of disjoint shards. Each shard is written as a
+		selection file, which can be fetched with the --from-selection option
+		of fetch-files or fetch-headers.
+
+		This allows several operators to cooperate in fetching the files of an
+		archive. Files are assigned to shards by their row, so a file remains
+		in the same shard when the work is split again later.`,
+		&CmdSplitWork{},
+	))
+}
+
+type CmdSplitWork struct {
+	Shards  int    `long:"shards"`
+	Output  string `long:"output"`
+	Headers bool   `long:"headers"`
+	Recheck bool   `long:"recheck"`
+}
+
+func (cmd *CmdSplitWork) Execute(args []string) error {
+	if cmd.Shards < 1 {
+		return fmt.Errorf("expected at least 1 shard")
+	}
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	shards := make([]*bufio.Writer, cmd.Shards)
+	counts := make([]int, cmd.Shards)
+	for i := range shards {
+		f, err := os.Create(fmt.Sprintf("%s-%d.jsonl", cmd.Output, i+1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		shards[i] = bufio.NewWriter(f)
+	}
+
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		domain := "content"
+		objpath := config.ObjectsPath
+		if cmd.Headers || config.HeadersOnly {
+			domain = "headers"
+			objpath = ""
+		}
+		query, err := LoadFilter(config.Filters, domain)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		files, err := action.SelectFiles(ar.DB, FetchOptions{
+			ObjectsPath: objpath,
+			Query:       query,
+			Recheck:     cmd.Recheck,
+			AllVariants: config.FetchAllVariants,
+		})
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			i := file.shard(cmd.Shards)
+			if err := writeSelection(shards[i], []SelectedFile{file}); err != nil {
+				return err
+			}
+			counts[i]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, w := range shards {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		log.Printf("shard %d: %d files", i+1, counts[i])
+	}
+	return nil
+}
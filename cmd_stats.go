@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"type": &flags.Option{
+			Description: "Count only builds of the given type, e.g. WindowsPlayer.",
+		},
+		"sort": &flags.Option{
+			Description: "Sort by name, hits, or rate.",
+			Default:     []string{"name"},
+		},
+		"runs": &flags.Option{
+			Description: "Display the statistics of each recorded run instead.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"stats",
+		"Display the history of each file name.",
+		`Displays, for each file name, the number of builds in which the file
+		exists, was not found, or has not been checked, along with the results
+		of probes made with the probe command. The hit rate is the fraction of
+		checked files and probes that were found.
+
+		Names that are configured as build files are marked with an asterisk.
+		A configured name with a low hit rate may not be worth keeping.
+
+		With a workspace, the counts of each file name are summed across the
+		archives, and displayed in a single table.
+
+		With --runs, the run history of the archive is displayed instead, with
+		a row for each run of fetch-files or fetch-headers recorded while
+		run_history was set, in the order the runs ended. The bar of each row
+		charts the content downloaded by the run relative to the other runs.`,
+		&CmdStats{},
+	))
+}
+
+type CmdStats struct {
+	Type string `long:"type"`
+	Sort string `long:"sort" choice:"name" choice:"hits" choice:"rate"`
+	Runs bool   `long:"runs"`
+}
+
+func (cmd *CmdStats) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	if cmd.Runs {
+		return archives.Each(func(ar *Archive) error {
+			config, err := LoadConfig(ar.ConfigPath)
+			if err != nil {
+				return err
+			}
+			return displayRuns(config)
+		})
+	}
+
+	// Stats are aggregated by file name across all archives.
+	var stats []FilenameStat
+	byName := map[string]int{}
+	configured := map[string]bool{}
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+
+		archiveStats, err := action.FilenameStats(ar.DB, cmd.Type)
+		if err != nil {
+			return err
+		}
+		for _, s := range archiveStats {
+			i, ok := byName[s.Name]
+			if !ok {
+				byName[s.Name] = len(stats)
+				stats = append(stats, s)
+				continue
+			}
+			stats[i].Hits += s.Hits
+			stats[i].Misses += s.Misses
+			stats[i].Unchecked += s.Unchecked
+			stats[i].ProbeHits += s.ProbeHits
+			stats[i].ProbeMisses += s.ProbeMisses
+		}
+		for _, name := range config.BuildFiles {
+			configured[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	switch cmd.Sort {
+	case "hits":
+		sort.SliceStable(stats, func(i, j int) bool {
+			return stats[i].Hits+stats[i].ProbeHits > stats[j].Hits+stats[j].ProbeHits
+		})
+	case "rate":
+		sort.SliceStable(stats, func(i, j int) bool {
+			return stats[i].HitRate() > stats[j].HitRate()
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "file\thits\tmisses\tunchecked\tprobe hits\tprobe misses\thit rate\t")
+	for _, s := range stats {
+		name := s.Name
+		if configured[name] {
+			name += " *"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t\n",
+			name,
+			s.Hits,
+			s.Misses,
+			s.Unchecked,
+			s.ProbeHits,
+			s.ProbeMisses,
+			s.HitRate()*100,
+		)
+	}
+	return w.Flush()
+}
+
+// runBarWidth is the width of the bar charting the content downloaded by a run.
+const runBarWidth = 20
+
+// displayRuns displays the run history of config.
+func displayRuns(config *Config) error {
+	if config.RunHistory == "" {
+		return fmt.Errorf("run_history is not set")
+	}
+	records, err := readRunHistory(config.RunHistory)
+	if err != nil {
+		return err
+	}
+	var max int64
+	for _, r := range records {
+		if r.Bytes > max {
+			max = r.Bytes
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "start\tcommand\tduration\tbatches\tcommitted\thits\tfailed\treused\tdownloaded\trate\t\t")
+	for _, r := range records {
+		var rate int64
+		if r.Duration > 0 {
+			rate = int64(float64(r.Bytes) / r.Duration)
+		}
+		var bar int
+		if max > 0 {
+			bar = int((r.Bytes*runBarWidth + max - 1) / max)
+		}
+		note := ""
+		if r.Error != "" {
+			note = "error: " + r.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s/s\t%-*s\t%s\n",
+			time.Unix(r.Start, 0).Format("2006-01-02 15:04"),
+			r.Command,
+			time.Duration(r.Duration*float64(time.Second)).Round(time.Second).String(),
+			r.Batches,
+			r.Committed,
+			r.Hits(),
+			r.Failed,
+			r.Reused,
+			formatSize(r.Bytes),
+			formatSize(rate),
+			runBarWidth, strings.Repeat("#", bar),
+			note,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"builds": &flags.Option{
+			Description: "List the progress of each build rather than only the total.",
+		},
+		"type": &flags.Option{
+			Description: "Include only builds of the given type, e.g. WindowsPlayer.",
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"status",
+		"Display the progress of the archive.",
+		`Displays the number of files in each progress state, the total size of
+		downloaded content, and the work remaining. With --builds, a row is
+		displayed for each build, ordered by the time of the build, followed by
+		the total.
+
+		The states are those of the progress filter variable. Files in unusual
+		states are counted under "other". The remaining files are those that
+		are unchecked, or that exist but do not have content, counting every
+		variant of an alias group. The remaining size is known only for files
+		whose headers have been fetched, so it is a lower bound while files are
+		unchecked.
+
+		In a headers-only archive, the remaining files are those that are
+		unchecked, and the size is the total size of existing files, as
+		reported by their headers.
+
+		With a workspace of several archives, the total of every archive is
+		displayed after the table of each archive.`,
+		&CmdStatus{},
+	))
+}
+
+type CmdStatus struct {
+	Builds bool   `long:"builds"`
+	Type   string `long:"type"`
+}
+
+func (cmd *CmdStatus) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	// Progress is also totaled across all archives.
+	var workspace BuildProgress
+	headersOnly := true
+	err = archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		progress, err := action.BuildProgress(ar.DB, cmd.Type)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		header := strings.Join(ProgressStates, "\t") + "\tother\tdownloaded\tremaining\trem. size\t"
+		if config.HeadersOnly {
+			header = strings.Join(ProgressStates, "\t") + "\tother\tremaining\tsize\t"
+		}
+		if cmd.Builds {
+			header = "build\ttype\t" + header
+		}
+		fmt.Fprintln(w, header)
+		var total BuildProgress
+		for _, p := range progress {
+			total.Add(p)
+			if cmd.Builds {
+				fmt.Fprintf(w, "%s\t%s\t", p.Build, p.Type)
+				writeProgress(w, p, config.HeadersOnly)
+			}
+		}
+		if cmd.Builds {
+			fmt.Fprintf(w, "total\t%d builds\t", len(progress))
+		}
+		writeProgress(w, total, config.HeadersOnly)
+		workspace.Add(total)
+		headersOnly = headersOnly && config.HeadersOnly
+		return w.Flush()
+	})
+	if err != nil || len(archives) <= 1 {
+		return err
+	}
+	log.Printf("workspace")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	if headersOnly {
+		fmt.Fprintln(w, strings.Join(ProgressStates, "\t")+"\tother\tremaining\tsize\t")
+	} else {
+		fmt.Fprintln(w, strings.Join(ProgressStates, "\t")+"\tother\tdownloaded\tremaining\trem. size\t")
+	}
+	writeProgress(w, workspace, headersOnly)
+	return w.Flush()
+}
+
+// writeProgress writes the columns of a row of the status table.
+func writeProgress(w *tabwriter.Writer, p BuildProgress, headersOnly bool) {
+	other := p.Total()
+	for _, state := range ProgressStates {
+		fmt.Fprintf(w, "%d\t", p.Files[state])
+		other -= p.Files[state]
+	}
+	if headersOnly {
+		fmt.Fprintf(w, "%d\t%d\t%s\t\n", other, p.RemainingHeaders(), formatSize(p.RemainingBytes))
+		return
+	}
+	fmt.Fprintf(w, "%d\t%s\t%d\t%s\t\n",
+		other,
+		formatSize(p.Bytes),
+		p.Remaining(),
+		formatSize(p.RemainingBytes),
+	)
+}
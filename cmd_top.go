@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"interval": &flags.Option{
+			ShortName:   'n',
+			Description: "Number of seconds between refreshes.",
+			Default:     []string{"2"},
+		},
+		"events": &flags.Option{
+			Description: "URL of the event stream of a running fetch, served with its --events flag, e.g. http://localhost:8080/events.",
+		},
+		"errors": &flags.Option{
+			Description: "Number of recent errors to display.",
+			Default:     []string{"5"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"top",
+		"Display the live progress of the archive.",
+		`Displays a dashboard of the archive that is refreshed in place until the
+		command is interrupted. The dashboard shows the number of files in each
+		progress state, as displayed by the status command, the rates at which
+		files are checked and content is downloaded since the last refresh, and
+		the most recent errors that occurred while fetching files.
+
+		The database may be used by other commands while it is displayed. With
+		--events, the dashboard also follows the event stream of a running
+		fetch-files or fetch-headers, started with its --events flag, showing
+		the current batch, the number of files being downloaded, and the
+		totals and download rate of the run. The stream is reconnected if it
+		is lost.`,
+		&CmdTop{},
+	))
+}
+
+type CmdTop struct {
+	Interval int    `long:"interval"`
+	Events   string `long:"events"`
+	Errors   int    `long:"errors"`
+}
+
+// topArchive is the state of an archive displayed by top.
+type topArchive struct {
+	ar          *Archive
+	headersOnly bool
+	// Totals of the previous refresh, from which rates are derived.
+	prev     BuildProgress
+	prevTime time.Time
+}
+
+func (cmd *CmdTop) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+	if cmd.Interval <= 0 {
+		return fmt.Errorf("interval must be greater than zero")
+	}
+
+	tops := make([]*topArchive, 0, len(archives))
+	for _, ar := range archives {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		tops = append(tops, &topArchive{ar: ar, headersOnly: config.HeadersOnly})
+	}
+	var run *runMonitor
+	if cmd.Events != "" {
+		run = &runMonitor{url: cmd.Events}
+		go run.watch(Main)
+	}
+
+	ticker := time.NewTicker(time.Duration(cmd.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		var frame bytes.Buffer
+		if err := cmd.frame(&frame, tops, run); err != nil {
+			if Main.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// Clear the screen and redraw from the top left.
+		os.Stdout.WriteString("\x1b[H\x1b[2J")
+		os.Stdout.Write(frame.Bytes())
+		select {
+		case <-ticker.C:
+		case <-Main.Done():
+			return nil
+		}
+	}
+}
+
+// frame writes one refresh of the dashboard to w.
+func (cmd *CmdTop) frame(w *bytes.Buffer, tops []*topArchive, run *runMonitor) error {
+	now := time.Now()
+	fmt.Fprintf(w, "rbxark top - %s - every %ds\n", now.Format("15:04:05"), cmd.Interval)
+	action := Action{Context: Main}
+	for _, t := range tops {
+		progress, err := action.BuildProgress(t.ar.DB, "")
+		if err != nil {
+			return err
+		}
+		var total BuildProgress
+		for _, p := range progress {
+			total.Add(p)
+		}
+		fmt.Fprintf(w, "\n%s: %d builds, %d files\n", t.ar.Name, len(progress), total.Total())
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		header := strings.Join(ProgressStates, "\t") + "\tother\tdownloaded\tremaining\trem. size\t"
+		if t.headersOnly {
+			header = strings.Join(ProgressStates, "\t") + "\tother\tremaining\tsize\t"
+		}
+		fmt.Fprintln(tw, header)
+		writeProgress(tw, total, t.headersOnly)
+		tw.Flush()
+		if !t.prevTime.IsZero() {
+			elapsed := now.Sub(t.prevTime).Seconds()
+			checked := (total.Total() - total.Files["Unchecked"]) - (t.prev.Total() - t.prev.Files["Unchecked"])
+			fmt.Fprintf(w, "checked %.1f files/s, downloaded %s/s\n",
+				float64(checked)/elapsed,
+				formatSize(int64(float64(total.Bytes-t.prev.Bytes)/elapsed)),
+			)
+		}
+		t.prev, t.prevTime = total, now
+
+		if cmd.Errors > 0 {
+			errs, err := action.RecentErrors(t.ar.DB, cmd.Errors)
+			if err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				fmt.Fprintf(w, "recent errors:\n")
+			}
+			for _, fe := range errs {
+				fmt.Fprintf(w, "  %s %s-%s: %s\n", time.Unix(fe.Time, 0).Format("2006-01-02 15:04:05"), fe.Build, fe.File, fe.Error)
+			}
+		}
+	}
+	if run != nil {
+		run.write(w, now)
+	}
+	return nil
+}
+
+// runMonitor follows the progress events of a running fetch.
+type runMonitor struct {
+	url string
+
+	mu sync.Mutex
+	// Archive and progress of the most recent event.
+	archive  string
+	progress Progress
+	received time.Time
+	// Whether the stream is connected, or the error that lost it.
+	connected bool
+	err       error
+	// Progress of the previous write, from which the rate is derived.
+	prev     Progress
+	prevTime time.Time
+}
+
+// watch reads the event stream until ctx is done, reconnecting when the stream
+// is lost.
+func (m *runMonitor) watch(ctx context.Context) {
+	for {
+		err := m.stream(ctx)
+		m.mu.Lock()
+		m.connected, m.err = false, err
+		m.mu.Unlock()
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stream reads events from a connection to the event stream.
+func (m *runMonitor) stream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	m.mu.Lock()
+	m.connected, m.err = true, nil
+	m.mu.Unlock()
+
+	var typ string
+	var data []string
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "":
+			if typ == "progress" {
+				m.receive(strings.Join(data, "\n"))
+			}
+			typ, data = "", data[:0]
+		case strings.HasPrefix(line, "event:"):
+			typ = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// receive records the data of a progress event.
+func (m *runMonitor) receive(data string) {
+	var event struct {
+		Archive string `json:"archive"`
+		Progress
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+	m.mu.Lock()
+	m.archive, m.progress, m.received = event.Archive, event.Progress, time.Now()
+	m.mu.Unlock()
+}
+
+// write writes the state of the run to w.
+func (m *runMonitor) write(w *bytes.Buffer, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "\nrun at %s: ", m.url)
+	switch {
+	case !m.connected && m.err != nil:
+		fmt.Fprintf(w, "not connected: %s\n", m.err)
+		return
+	case m.received.IsZero():
+		fmt.Fprintf(w, "waiting for events\n")
+		return
+	}
+	p := m.progress
+	fmt.Fprintf(w, "%s, batch %d of %s, %d files fetching (as of %s)\n",
+		p.Phase, p.Batch, m.archive, p.Fetching, m.received.Format("15:04:05"))
+	fmt.Fprintf(w, "committed %d, failed %d, reused %d, downloaded %s", p.Committed, p.Failed, p.Reused, formatSize(p.Bytes))
+	if !m.prevTime.IsZero() && p.Bytes >= m.prev.Bytes {
+		fmt.Fprintf(w, ", %s/s", formatSize(int64(float64(p.Bytes-m.prev.Bytes)/now.Sub(m.prevTime).Seconds())))
+	}
+	fmt.Fprintln(w)
+	m.prev, m.prevTime = p, now
+}
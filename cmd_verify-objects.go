@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/anaminus/rbxark/objects"
+	"github.com/jessevdk/go-flags"
+)
+
+func init() {
+	OptionTags{
+		"repair": &flags.Option{
+			Description: "Unset the HasContent flag of files whose object is damaged or missing, and remove damaged objects, so that a later fetch downloads them again.",
+		},
+		"workers": &flags.Option{
+			Description: "The number of objects hashed concurrently.",
+			Default:     []string{"4"},
+		},
+	}.AddTo(FlagParser.AddCommand(
+		"verify-objects",
+		"Check the content of every object against the database.",
+		`Reads every object in the objects path, and checks that the MD5 hash of
+		its content matches its name, and that its size matches the metadata of
+		the files that refer to it. The following problems are reported:
+
+		    damaged   The content of an object does not match its hash, or its
+		              size differs from the metadata.
+		    orphaned  No file with content refers to the object.
+		    missing   A file has content, but its object does not exist.
+
+		With --repair, the HasContent flag is unset from each file whose object
+		is damaged or missing, and damaged objects are removed. Orphaned
+		objects are only reported.
+
+		Unlike fsck-objects, the content of each object is read, so a full
+		check may take a long time. Objects outside of the layout checked by
+		fsck-objects are ignored.`,
+		&CmdVerifyObjects{},
+	))
+}
+
+type CmdVerifyObjects struct {
+	Repair  bool `long:"repair"`
+	Workers int  `long:"workers"`
+}
+
+// verifiedObject is the result of verifying an object.
+type verifiedObject struct {
+	hash   string
+	size   int64
+	kind   string
+	detail string
+}
+
+func (cmd *CmdVerifyObjects) Execute(args []string) error {
+	archives, _, err := OpenArchives(args)
+	if err != nil {
+		return err
+	}
+	defer archives.Close()
+
+	return archives.Each(func(ar *Archive) error {
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := RequireObjects(config); err != nil {
+			return err
+		}
+		action := Action{Context: Main}
+		if err := action.Init(ar.DB); err != nil {
+			return err
+		}
+		sizes, err := action.ContentObjects(ar.DB)
+		if err != nil {
+			return err
+		}
+
+		var objs []verifiedObject
+		err = objects.Walk(config.ObjectsPath, func(hash string, info os.FileInfo) error {
+			objs = append(objs, verifiedObject{hash: hash, size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("walk objects: %w", err)
+		}
+		if err := verifyObjects(config.ObjectsPath, objs, sizes, cmd.Workers); err != nil {
+			return err
+		}
+
+		counts := map[string]int{}
+		var damaged, unflag []string
+		found := make(map[string]bool, len(objs))
+		for _, obj := range objs {
+			found[obj.hash] = true
+			if obj.kind == "" {
+				continue
+			}
+			counts[obj.kind]++
+			log.Printf("%s: %s: %s", obj.kind, obj.hash, obj.detail)
+			if obj.kind == "damaged" {
+				damaged = append(damaged, obj.hash)
+			}
+		}
+		var missing []string
+		for hash := range sizes {
+			if !found[hash] {
+				missing = append(missing, hash)
+			}
+		}
+		sort.Strings(missing)
+		for _, hash := range missing {
+			counts["missing"]++
+			log.Printf("missing: %s: referred to by files with content", hash)
+		}
+		log.Printf("verified %d objects: %d damaged, %d orphaned, %d missing",
+			len(objs), counts["damaged"], counts["orphaned"], counts["missing"])
+
+		if !cmd.Repair {
+			return nil
+		}
+		unflag = append(unflag, damaged...)
+		unflag = append(unflag, missing...)
+		if err := action.UnflagObjects(ar.DB, unflag); err != nil {
+			return err
+		}
+		// Objects are removed only once the files no longer refer to them.
+		for _, hash := range damaged {
+			if err := objects.Remove(config.ObjectsPath, hash); err != nil {
+				return fmt.Errorf("remove object %s: %w", hash, err)
+			}
+		}
+		log.Printf("unflagged %d objects, removed %d", len(unflag), len(damaged))
+		return nil
+	})
+}
+
+// verifyObjects sets the kind and detail of each object that has a problem,
+// according to the sizes of content objects. The content of objects is hashed
+// by the given number of workers.
+func verifyObjects(objpath string, objs []verifiedObject, sizes map[string]int64, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, len(objs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				obj := &objs[i]
+				size, ok := sizes[obj.hash]
+				switch {
+				case !ok:
+					obj.kind, obj.detail = "orphaned", "no file with content refers to the object"
+					continue
+				case obj.size != size:
+					obj.kind, obj.detail = "damaged", fmt.Sprintf("size is %d, expected %d", obj.size, size)
+					continue
+				}
+				valid, err := objects.Verify(objpath, obj.hash)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				if !valid {
+					obj.kind, obj.detail = "damaged", "content does not match hash"
+				}
+			}
+		}()
+	}
+loop:
+	for i := range objs {
+		select {
+		case jobs <- i:
+		case <-Main.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := Main.Err(); err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("verify object %s: %w", objs[i].hash, err)
+		}
+	}
+	return nil
+}
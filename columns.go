@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A computed column is a column of an export whose value is derived from the
+// fields of each entry, according to a template. Within the template,
+// "{field}" is replaced with the value of a field, and "{field|format}" with
+// the value formatted by one of columnFormats. Fields that are not known are
+// empty, as are their formatted values. "{{" and "}}" produce literal braces.
+type computedColumn struct {
+	name  string
+	parts []columnPart
+}
+
+// columnPart is either literal text, or a reference to a field.
+type columnPart struct {
+	text   string
+	field  string
+	format func(string) string
+}
+
+// columnFormats are the formats that may be applied to a field.
+var columnFormats = map[string]func(string) string{
+	// Size in bytes, as a human-readable size.
+	"bytes": func(s string) string {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return s
+		}
+		return formatSize(n)
+	},
+	// Unix timestamp, as an RFC 3339 date in UTC.
+	"date": func(s string) string {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return s
+		}
+		return time.Unix(n, 0).UTC().Format(time.RFC3339)
+	},
+	// Quoted string, such as an ETag, without its quotes.
+	"unquote": func(s string) string {
+		return strings.Trim(strings.TrimPrefix(s, "W/"), `"`)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// parseColumn parses a computed column of the form "name=template".
+func parseColumn(s string) (col computedColumn, err error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return col, fmt.Errorf("column %q: expected name=template", s)
+	}
+	col.name = s[:i]
+	tmpl := s[i+1:]
+	for len(tmpl) > 0 {
+		switch {
+		case strings.HasPrefix(tmpl, "{{"):
+			col.parts = append(col.parts, columnPart{text: "{"})
+			tmpl = tmpl[2:]
+		case strings.HasPrefix(tmpl, "}}"):
+			col.parts = append(col.parts, columnPart{text: "}"})
+			tmpl = tmpl[2:]
+		case tmpl[0] == '{':
+			j := strings.IndexByte(tmpl, '}')
+			if j < 0 {
+				return col, fmt.Errorf("column %s: unclosed brace", col.name)
+			}
+			part := columnPart{field: tmpl[1:j]}
+			if k := strings.IndexByte(part.field, '|'); k >= 0 {
+				name := part.field[k+1:]
+				if part.format = columnFormats[name]; part.format == nil {
+					return col, fmt.Errorf("column %s: unknown format %q", col.name, name)
+				}
+				part.field = part.field[:k]
+			}
+			if !isManifestField(part.field) {
+				return col, fmt.Errorf("column %s: unknown field %q", col.name, part.field)
+			}
+			col.parts = append(col.parts, part)
+			tmpl = tmpl[j+1:]
+		default:
+			j := strings.IndexAny(tmpl, "{}")
+			if j < 0 {
+				j = len(tmpl)
+			} else if j == 0 {
+				return col, fmt.Errorf("column %s: unmatched brace", col.name)
+			}
+			col.parts = append(col.parts, columnPart{text: tmpl[:j]})
+			tmpl = tmpl[j:]
+		}
+	}
+	return col, nil
+}
+
+// parseColumns parses a list of computed columns.
+func parseColumns(list []string) (cols []computedColumn, err error) {
+	for _, s := range list {
+		col, err := parseColumn(s)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// isManifestField returns whether name is a field of a manifest entry that may
+// be referred to by a computed column.
+func isManifestField(name string) bool {
+	if name == "url" {
+		return true
+	}
+	for _, column := range manifestColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the value of the column for the given fields of an entry.
+func (col computedColumn) value(fields map[string]string) string {
+	var b strings.Builder
+	for _, part := range col.parts {
+		if part.field == "" {
+			b.WriteString(part.text)
+			continue
+		}
+		v := fields[part.field]
+		if v != "" && part.format != nil {
+			v = part.format(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressedExt is the extension of a database compressed with zstd. Such a
+// database is decompressed to a cache before it is opened, and is opened as
+// immutable, so only commands that read the database can operate on it.
+const CompressedExt = ".zst"
+
+// Constants of the zstd seekable format, in which content is compressed as
+// independent frames, followed by a skippable frame containing a table of the
+// size of each frame.
+const (
+	seekableMagic     = 0x8F92EAB1
+	seekTableMagic    = 0x184D2A5E
+	seekFooterSize    = 9
+	seekChecksumFlag  = 1 << 7
+	seekFrameSizeMax  = 1 << 30
+	skippableHeadSize = 8
+)
+
+// seekFrame describes a frame of a seekable zstd file.
+type seekFrame struct {
+	compressed   int64
+	decompressed int64
+}
+
+// readSeekTable reads the table of frames from a seekable zstd file of the
+// given size. Returns nil if the file is not in the seekable format.
+func readSeekTable(f io.ReaderAt, size int64) ([]seekFrame, error) {
+	if size < skippableHeadSize+seekFooterSize {
+		return nil, nil
+	}
+	var footer [seekFooterSize]byte
+	if _, err := f.ReadAt(footer[:], size-seekFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, nil
+	}
+	n := int64(binary.LittleEndian.Uint32(footer[0:]))
+	entrySize := int64(8)
+	if footer[4]&seekChecksumFlag != 0 {
+		entrySize += 4
+	}
+	tableSize := n*entrySize + seekFooterSize
+	if tableSize+skippableHeadSize > size {
+		return nil, errors.New("seek table exceeds file")
+	}
+	var head [skippableHeadSize]byte
+	if _, err := f.ReadAt(head[:], size-tableSize-skippableHeadSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(head[0:]) != seekTableMagic ||
+		int64(binary.LittleEndian.Uint32(head[4:])) != tableSize {
+		return nil, errors.New("malformed seek table")
+	}
+	b := make([]byte, n*entrySize)
+	if _, err := f.ReadAt(b, size-tableSize); err != nil {
+		return nil, err
+	}
+	frames := make([]seekFrame, n)
+	var total int64
+	for i := range frames {
+		entry := b[int64(i)*entrySize:]
+		frames[i].compressed = int64(binary.LittleEndian.Uint32(entry[0:]))
+		frames[i].decompressed = int64(binary.LittleEndian.Uint32(entry[4:]))
+		total += frames[i].compressed
+	}
+	if total+tableSize+skippableHeadSize != size {
+		return nil, errors.New("seek table does not match file size")
+	}
+	return frames, nil
+}
+
+// decompress writes the decompressed content of the zstd file f, of the given
+// size, to w. A file in the seekable format is decoded frame by frame, each
+// frame being verified against its size in the seek table. Otherwise, the file
+// is decoded as a stream.
+func decompress(w io.Writer, f *os.File, size int64) error {
+	frames, err := readSeekTable(f, size)
+	if err != nil {
+		return fmt.Errorf("read seek table: %w", err)
+	}
+	if frames == nil {
+		d, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		_, err = io.Copy(w, d)
+		return err
+	}
+	d, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	var src, dst []byte
+	var offset int64
+	for i, frame := range frames {
+		if frame.compressed > seekFrameSizeMax || frame.decompressed > seekFrameSizeMax {
+			return fmt.Errorf("frame %d: too large", i)
+		}
+		if int64(cap(src)) < frame.compressed {
+			src = make([]byte, frame.compressed)
+		}
+		src = src[:frame.compressed]
+		if _, err := f.ReadAt(src, offset); err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		offset += frame.compressed
+		if dst, err = d.DecodeAll(src, dst[:0]); err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		if int64(len(dst)) != frame.decompressed {
+			return fmt.Errorf("frame %d: expected %d bytes, got %d", i, frame.decompressed, len(dst))
+		}
+		if _, err := w.Write(dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decompressedDatabase returns the path to a decompressed copy of the
+// compressed database at path. The copy is kept in the user's cache directory,
+// and is reused until the compressed file changes.
+func decompressedDatabase(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	cache = filepath.Join(cache, "rbxark")
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", err
+	}
+	// Copies of the file are named by its location, and stamped by its size
+	// and modification time.
+	sum := sha256.Sum256([]byte(abs))
+	prefix := hex.EncodeToString(sum[:8]) + "-"
+	stamp := strconv.FormatInt(stat.Size(), 36) + "-" + strconv.FormatInt(stat.ModTime().UnixNano(), 36)
+	name := prefix + stamp + ".db"
+	target := filepath.Join(cache, name)
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+
+	// Remove outdated copies of the file.
+	if entries, err := ioutil.ReadDir(cache); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), prefix) && entry.Name() != name {
+				os.Remove(filepath.Join(cache, entry.Name()))
+			}
+		}
+	}
+
+	tmp, err := ioutil.TempFile(cache, ".decompress-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := decompress(tmp, f, stat.Size()); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("decompress %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
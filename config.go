@@ -1,18 +1,148 @@
 package main
 
+// Config is the configuration of an archive, decoded from JSON. Each field
+// is described by its desc tag, and may have a default tag describing the
+// value used when the field is unset. These are printed by the config-schema
+// command.
 type Config struct {
-	// Location of object files.
-	ObjectsPath string `json:"objects_path"`
-	// File on server from which builds are scanned.
-	DeployHistory string `json:"deploy_history"`
-	// Allowed requests per second.
-	RateLimit float64 `json:"rate_limit"`
-	// List of deployment servers.
-	Servers []string `json:"servers"`
-	// List of files on server that have a constant location.
-	DeployFiles []string `json:"deploy_files"`
-	// List of potential files per version hash.
-	BuildFiles []string `json:"build_files"`
-	// List of filters to apply when selecting files.
-	Filters []string `json:"filters"`
+	ObjectsPath       string     `json:"objects_path" desc:"Location of object files."`
+	ObjectsIndex      bool       `json:"objects_index" desc:"Whether to record objects in an index within each prefix directory."`
+	CompressObjects   bool       `json:"compress_objects" desc:"Whether objects are compressed with zstd when written to the objects path. Objects are decompressed when read. Requires objects_index to be unset."`
+	ObjectStorage     Storage    `json:"object_storage" desc:"Where objects are moved once their files are committed. If unset, objects remain in the objects path."`
+	HeadersOnly       bool       `json:"headers_only" desc:"Whether the archive records only the headers of files, without archiving their content. Requires the objects path to be unset. Commands that need content are refused."`
+	SecondaryDatabase string     `json:"secondary_database" desc:"Location of the secondary database, which holds bulky, rarely-queried tables."`
+	DeployHistory     string     `json:"deploy_history" desc:"File on server from which builds are scanned." default:"DeployHistory.txt"`
+	RateLimit         float64    `json:"rate_limit" desc:"Allowed requests per second."`
+	PerHostWorkers    bool       `json:"per_host_workers" desc:"Whether each host is fetched from by its own workers, with dedicated keep-alive connections."`
+	HostLimits        []Throttle `json:"host_limits" desc:"Rate limits and numbers of workers of individual hosts, in place of the global rate limit and number of workers."`
+	Resolver          Resolver   `json:"resolver" desc:"How host names are resolved when fetching."`
+	CircuitBreaker    Breaker    `json:"circuit_breaker" desc:"When requests to a failing host are suspended."`
+	Retry             Retry      `json:"retry" desc:"How failed requests are retried."`
+	Servers           []string   `json:"servers" desc:"List of deployment servers."`
+	Channels          []Channels `json:"channels" desc:"Deployment channels of servers, each discovered from its own DeployHistory file."`
+	NoRedirectServers []string   `json:"no_redirect_servers" desc:"Servers from which redirects are not followed."`
+	TLS               []TLS      `json:"tls" desc:"How the certificates of servers are verified."`
+	DeployFiles       []string   `json:"deploy_files" desc:"List of files on server that have a constant location."`
+	DecodeText        bool       `json:"decode_text" desc:"Whether deploy files compressed with gzip, such as .gz variants, are also stored decoded when their content is text. The raw object is kept."`
+	BuildFiles        []string   `json:"build_files" desc:"List of potential files per version hash."`
+	RecentBuildFiles  []string   `json:"recent_build_files" desc:"List of potential files generated only for recent builds."`
+	RecentBuildDays   int        `json:"recent_build_days" desc:"Number of days within which a build is considered recent. If zero, every build is considered recent."`
+	ManualBuildFiles  []string   `json:"manual_build_files" desc:"List of potential files that are generated only when requested."`
+	CompanionSuffixes []string   `json:"companion_suffixes" desc:"Suffixes of companion files, such as signatures, that are generated for each file that exists."`
+	FilenameAliases   [][]string `json:"filename_aliases" desc:"Groups of file names that are variants of the same logical file."`
+	FetchAllVariants  bool       `json:"fetch_all_variants" desc:"Whether to download every variant of an alias group."`
+	ManifestFiles     []string   `json:"manifest_files" desc:"Names of files in the rbxPkgManifest format, such as the manifests of other platforms, scanned for the names of packages." default:"rbxPkgManifest.txt"`
+	ProvenanceHeaders []string   `json:"provenance_headers" desc:"Additional headers to store for provenance."`
+	LengthMismatch    string     `json:"length_mismatch" desc:"How a mismatch between the Content-Length of a response and the content received is handled: 'reject', 'accept', or 'retry'." default:"reject"`
+	HashHeaders       []string   `json:"hash_headers" desc:"Sources of the hash of content in the headers of a response, in order of priority: 'etag', 'weak-etag', 'content-md5', or 'x-goog-hash'." default:"etag, weak-etag"`
+	VerifySkipped     int64      `json:"verify_skipped" desc:"Number of bytes at each end of content compared with an existing object when its download is skipped by hash. If zero, skipped downloads are not verified."`
+	MaxErrorRate      float64    `json:"max_error_rate" desc:"Fraction of files in a batch that may fail before a fetch is aborted."`
+	RunHistory        string     `json:"run_history" desc:"Location of a file to which the statistics of each run of fetch-files and fetch-headers are appended, as JSON lines. Relative to the config file. If unset, statistics are not recorded."`
+	Filters           []string   `json:"filters" desc:"List of filters to apply when selecting files."`
+	AssetServers      []string   `json:"asset_servers" desc:"Locations of hash-indexed assets referred to by packages."`
+	Listings          []Listing  `json:"listings" desc:"Servers whose files can be enumerated through an S3-style listing."`
+	Serve             Serve      `json:"serve" desc:"How the serve command answers requests, such as to protect a public mirror."`
+
+	// Default values of command flags, read before the rest of the config.
+	Flags map[string]map[string]interface{} `json:"flags" desc:"Default values of command flags, mapped by command name, then by the long name of the flag. Flags under '*' apply to every command that has them. Flags given on the command line take precedence."`
+	// Sequences of commands run by the run command.
+	Aliases map[string][][]string `json:"aliases" desc:"Sequences of commands run by the run command, mapped by name. Each command is a list of arguments, starting with the name of the command."`
+	// Layout of packages written by the extract command.
+	PackageDirs map[string]string `json:"package_dirs" desc:"Directories into which zip packages are unpacked by the extract command, mapped by package name, relative to the root of the install. Merged over the built-in layout. An empty directory is the root."`
+
+	// Path to the file from which the config was loaded.
+	path string
+	// SHA-256 hash of the content of the file, in hexadecimal.
+	hash string
+}
+
+// Resolver configures the resolution of host names. If both fields are empty,
+// the system's resolver is used.
+type Resolver struct {
+	Address string `json:"address" desc:"Address of a DNS server, such as '1.1.1.1:53'."`
+	DoH     string `json:"doh" desc:"URL of a DNS-over-HTTPS server that supports the JSON API, such as 'https://1.1.1.1/dns-query'."`
+}
+
+// Breaker configures the suspension of requests to a host after consecutive
+// failures. A request fails if it returns an error, or a 5xx or 429 status.
+type Breaker struct {
+	Failures int     `json:"failures" desc:"Number of consecutive failed requests to a host after which requests to the host are suspended. If zero, requests are never suspended."`
+	Cooldown float64 `json:"cooldown" desc:"Number of seconds for which requests are suspended." default:"60"`
+}
+
+// Retry configures the retrying of requests that fail transiently, with an
+// exponential backoff between attempts.
+type Retry struct {
+	Attempts      int     `json:"attempts" desc:"Total number of attempts of a request, including the first. If one or less, requests are not retried."`
+	Base          float64 `json:"base" desc:"Number of seconds to wait before the first retry. Each following retry waits twice as long." default:"1"`
+	Cap           float64 `json:"cap" desc:"Maximum number of seconds to wait before a retry." default:"30"`
+	Statuses      []int   `json:"statuses" desc:"Response statuses that cause a request to be retried." default:"429, 500, 502, 503, 504"`
+	NetworkErrors bool    `json:"network_errors" desc:"Whether requests that fail with a network error, such as a reset connection or a timeout, are retried."`
+}
+
+// Throttle configures the requests made to the host of a server. The host is
+// fetched from by workers of its own, whether or not per_host_workers is set.
+type Throttle struct {
+	Server    string  `json:"server" desc:"The server to whose host the settings apply."`
+	RateLimit float64 `json:"rate_limit" desc:"Allowed requests per second to the host. If zero, the global rate_limit applies, shared with other hosts. If negative, requests are unlimited."`
+	Workers   int     `json:"workers" desc:"Number of requests made to the host at once. If zero, the number of workers of the command is used."`
+}
+
+// TLS configures the verification of the certificates of a server. The
+// settings apply to every request made to the host of the server.
+type TLS struct {
+	Server   string   `json:"server" desc:"The server to which the settings apply."`
+	CA       []string `json:"ca" desc:"PEM files of certificate authorities trusted in addition to those of the system. Paths are relative to the config file."`
+	Pins     []string `json:"pins" desc:"Pins of the public keys of the server, each of the form 'sha256/<base64>'."`
+	Insecure bool     `json:"insecure" desc:"Whether certificates are accepted without being verified."`
+}
+
+// Channels lists the deployment channels of a server. Each channel is located
+// at "<server>/channel/<name>", and is fetched from as a server of its own,
+// while remaining related to the server.
+type Channels struct {
+	Server string   `json:"server" desc:"The server to which the channels belong. Must be one of the configured servers."`
+	Names  []string `json:"names" desc:"Names of the channels, such as 'zcanary' or 'zintegration'. The LIVE channel is the server itself, and need not be listed."`
+}
+
+// Serve configures the HTTP server of the serve command. Limits apply to each
+// address from which requests are made, so that a public mirror cannot be
+// saturated by a few clients.
+type Serve struct {
+	RateLimit        float64  `json:"rate_limit" desc:"Requests per second allowed from each client address. If zero, requests are not rate limited."`
+	Burst            int      `json:"burst" desc:"Number of requests that a client may make at once before rate_limit applies." default:"10"`
+	MaxStreams       int      `json:"max_streams" desc:"Number of requests answered at once, across all clients. If zero, the number is not limited."`
+	MaxClientStreams int      `json:"max_client_streams" desc:"Number of requests answered at once for each client address. If zero, the number is not limited."`
+	MaxURLLength     int      `json:"max_url_length" desc:"Maximum length, in bytes, of the path and query of a request." default:"4096"`
+	MaxHeaderBytes   int      `json:"max_header_bytes" desc:"Maximum size, in bytes, of the headers of a request." default:"16384"`
+	WriteTimeout     float64  `json:"write_timeout" desc:"Number of seconds within which a response, including its content, must be written. If negative, responses are not limited." default:"3600"`
+	IdleTimeout      float64  `json:"idle_timeout" desc:"Number of seconds for which an idle keep-alive connection is kept open. If negative, connections are not closed for being idle." default:"120"`
+	ClientHeader     string   `json:"client_header" desc:"Header, such as X-Forwarded-For, from which the address of a client is read when serving behind a trusted reverse proxy. The last address of the header is used. If empty, the address of the connection is used."`
+	Peers            []string `json:"peers" desc:"Base URLs of other serve APIs, from which objects held by no served archive are read, in order."`
+	AccessLog        string   `json:"access_log" desc:"Location of a file to which each answered request is appended as a JSON line, as read by the downloads command. Relative to the config file. If unset, requests are not recorded."`
+	AccessLogMaxSize int64    `json:"access_log_max_size" desc:"Size in bytes at which the access log is rotated. If negative, the log is not rotated." default:"104857600"`
+	AccessLogBackups int      `json:"access_log_backups" desc:"Number of rotated access logs to keep. If negative, none are kept." default:"10"`
+}
+
+// Listing describes how the files of a server are enumerated through an
+// S3-style bucket listing.
+type Listing struct {
+	Server    string `json:"server" desc:"The server whose files are listed."`
+	Bucket    string `json:"bucket" desc:"URL of the bucket. Defaults to the server. If the server is located under a path within the bucket, the path is used as the key prefix."`
+	Region    string `json:"region" desc:"Region of the bucket."`
+	AccessKey string `json:"access_key" desc:"Key used to sign requests. If empty, credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables. If those are also empty, requests are made anonymously."`
+	SecretKey string `json:"secret_key" desc:"Secret paired with access_key."`
+}
+
+// Storage configures where objects are kept once the files referring to them
+// have been committed. The objects path then holds only the objects of files
+// being fetched.
+type Storage struct {
+	Type      string `json:"type" desc:"Kind of storage: 'dir' for a directory, 's3' for an S3-compatible bucket, or 'gcs' for a Google Cloud Storage bucket. If empty, objects are not moved."`
+	Path      string `json:"path" desc:"For dir, the directory in which objects are stored, with the layout of an objects path. Relative to the config file."`
+	Bucket    string `json:"bucket" desc:"For s3, the URL of the bucket. For gcs, the name of the bucket."`
+	Region    string `json:"region" desc:"For s3, the region of the bucket."`
+	AccessKey string `json:"access_key" desc:"Key used to sign requests to a bucket. For gcs, this is an HMAC key. If empty, credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables."`
+	SecretKey string `json:"secret_key" desc:"Secret paired with access_key."`
+	PartSize  int64  `json:"part_size" desc:"Size of each part of a multipart upload to a bucket, in MiB. At least 5." default:"16"`
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -12,11 +15,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/anaminus/rbxark/assets"
 	"github.com/anaminus/rbxark/fetch"
 	"github.com/anaminus/rbxark/filters"
 	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/s3"
 	"github.com/mattn/go-sqlite3"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/robloxapi/rbxdump/histlog"
@@ -44,6 +50,18 @@ const (
 	Failed FileFlags = NotFound | HasHeaders
 )
 
+// fileFlagNames maps the name of each FileFlags constant to its value.
+var fileFlagNames = map[string]FileFlags{
+	"NotFound":    NotFound,
+	"Exists":      Exists,
+	"HasHeaders":  HasHeaders,
+	"HasMetadata": HasMetadata,
+	"HasContent":  HasContent,
+	"Unchecked":   Unchecked,
+	"Missing":     Missing,
+	"Failed":      Failed,
+}
+
 func (f FileFlags) String() string {
 	if f == Unchecked {
 		return "Unchecked"
@@ -111,6 +129,40 @@ func (f FileFlags) Progress() string {
 	return f.String()
 }
 
+// channelExpr returns an SQL expression that evaluates to the name of the
+// channel of the server whose rowid is in the given column. A server that is not
+// a channel is the LIVE channel.
+func channelExpr(column string) string {
+	return fmt.Sprintf("(SELECT ifnull(channel_servers.channel, '%s') FROM servers AS channel_servers WHERE channel_servers.rowid == %s)", LiveChannel, column)
+}
+
+// progressExpr returns an SQL expression that evaluates to the result of
+// Progress for the flags in the given column.
+func progressExpr(column string) string {
+	flags := []FileFlags{NotFound, Exists, HasHeaders, HasMetadata, HasContent}
+	var s strings.Builder
+	fmt.Fprintf(&s, "CASE")
+	fmt.Fprintf(&s, " WHEN %s == %d THEN 'Unchecked'", column, Unchecked)
+	for _, f := range []FileFlags{Missing, Failed} {
+		fmt.Fprintf(&s, " WHEN %s & %d == %d THEN '%s'", column, f, f, f.Progress())
+	}
+	fmt.Fprintf(&s, " WHEN %s & %d != 0 THEN 'NotFound'", column, NotFound)
+	for _, f := range []FileFlags{
+		Exists | HasHeaders,
+		Exists | HasHeaders | HasMetadata,
+		Exists | HasHeaders | HasMetadata | HasContent,
+	} {
+		fmt.Fprintf(&s, " WHEN %s == %d THEN '%s'", column, f, f.Progress())
+	}
+	// Otherwise, the result of String.
+	s.WriteString(" ELSE substr(''")
+	for _, f := range flags {
+		fmt.Fprintf(&s, " || (CASE WHEN %s & %d != 0 THEN '|%s' ELSE '' END)", column, f, f)
+	}
+	s.WriteString(", 2) END")
+	return s.String()
+}
+
 type Executor interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
@@ -131,6 +183,9 @@ func buildFileURL(server, hash, file string) string {
 // Action contains methods that apply to Executers or Queryers.
 type Action struct {
 	Context context.Context
+	// If not nil, rows created by merges and the generation of files are
+	// recorded as created by the operation.
+	Operation *Operation
 }
 
 // Init ensures that the necessary tables exist in a database.
@@ -142,13 +197,18 @@ func (a Action) Init(e Executor) error {
 		-- filenames exist.
 		CREATE TABLE IF NOT EXISTS filenames (
 			rowid INTEGER PRIMARY KEY,
-			name  TEXT    NOT NULL UNIQUE -- Name of the file.
+			name  TEXT    NOT NULL UNIQUE, -- Name of the file.
+			tier  INTEGER NOT NULL DEFAULT 0 -- Corresponds to FilenameTier.
 		);
 
-		-- Set of URLs representing deployment servers.
+		-- Set of URLs representing deployment servers. A deployment channel of
+		-- a server is a server of its own, located under the server.
 		CREATE TABLE IF NOT EXISTS servers (
-			rowid INTEGER PRIMARY KEY,
-			url   TEXT    NOT NULL UNIQUE -- Base URL from which data is retrieved.
+			rowid    INTEGER PRIMARY KEY,
+			url      TEXT    NOT NULL UNIQUE, -- Base URL from which data is retrieved.
+			disabled INTEGER NOT NULL DEFAULT 0, -- Whether the server is excluded from fetches.
+			base     INTEGER REFERENCES servers(rowid), -- For a channel, the server under which it is located.
+			channel  TEXT -- For a channel, its name, e.g. "zcanary". NULL for the LIVE channel of a server.
 		);
 
 		-- Set of builds retrieved from deployment servers.
@@ -177,115 +237,483 @@ func (a Action) Init(e Executor) error {
 			UNIQUE (build, filename)
 		);
 
-		-- Set of file headers retrieved from deployment server.
-		CREATE TABLE IF NOT EXISTS headers (
-			rowid          INTEGER PRIMARY KEY,
-			file           INTEGER NOT NULL UNIQUE REFERENCES files(rowid) ON DELETE CASCADE,
-			status         INTEGER NOT NULL, -- Returned status code.
-			content_length INTEGER,          -- Size of the file reported by the server.
-			last_modified  INTEGER,          -- Modification time of content on the server.
-			content_type   TEXT,             -- Type of file reported by server.
-			etag           TEXT              -- MD5 hash (quoted) of the file reported by the server.
-		);
-
 		-- Set of attributes associated with each file.
 		CREATE TABLE IF NOT EXISTS metadata (
 			rowid INTEGER PRIMARY KEY,
 			file  INTEGER NOT NULL UNIQUE REFERENCES files(rowid) ON DELETE CASCADE,
-			size  INTEGER NOT NULL, -- Size of the file content.
-			md5   TEXT NOT NULL     -- MD5 hash of the file content.
+			size   INTEGER NOT NULL, -- Size of the file content.
+			md5    TEXT NOT NULL,    -- MD5 hash of the file content.
+			sha256 TEXT,             -- SHA-256 hash of the file content, if known.
+			stored_size INTEGER      -- Size of the object as stored, if it is compressed.
 		);
 
-		CREATE INDEX IF NOT EXISTS build_servers_build ON build_servers(build);
-	`
-	_, err := e.ExecContext(a.Context, query)
-	return err
-}
+		-- Groups of file names that are variants of the same logical file.
+		CREATE TABLE IF NOT EXISTS filename_aliases (
+			rowid    INTEGER PRIMARY KEY,
+			filename INTEGER NOT NULL UNIQUE REFERENCES filenames(rowid) ON DELETE CASCADE,
+			grp      INTEGER NOT NULL -- Identifies the group; the rowid of the first name in the group.
+		);
 
-// // Migrate migrates old tables to new versions.
-// func (db *Database) Migrate()
+		-- Failures that made a server unreachable as a whole, such as DNS or
+		-- TLS errors.
+		CREATE TABLE IF NOT EXISTS server_failures (
+			rowid  INTEGER PRIMARY KEY,
+			server INTEGER NOT NULL REFERENCES servers(rowid) ON DELETE CASCADE,
+			kind   TEXT    NOT NULL, -- Kind of failure, e.g. "dns" or "tls".
+			error  TEXT    NOT NULL, -- Error message.
+			time   INTEGER NOT NULL  -- When the failure occurred.
+		);
 
-type Build struct {
-	Hash    string
-	Type    string
-	Time    int64
-	Version string
-}
+		-- Results of probing candidate file names against individual builds.
+		-- Names need not be present in filenames.
+		CREATE TABLE IF NOT EXISTS probes (
+			rowid  INTEGER PRIMARY KEY,
+			build  INTEGER NOT NULL REFERENCES builds(rowid) ON DELETE CASCADE,
+			name   TEXT    NOT NULL, -- Name of the probed file.
+			status INTEGER NOT NULL, -- Response status of the probe.
+			time   INTEGER NOT NULL, -- When the probe was made.
+			UNIQUE (build, name)
+		);
 
-// MergeServers updates the list of servers in a database by appending from the
-// given list the servers that aren't already in the database.
-func (a Action) MergeServers(e Executor, servers []string) (newRows int, err error) {
-	if len(servers) == 0 {
-		return 0, nil
+		-- Names listed in the manifest of a build, recorded for names found by
+		-- find-filenames. Names need not be present in filenames. Files of a
+		-- name of the TierManual tier are generated for these builds.
+		CREATE TABLE IF NOT EXISTS manifest_names (
+			build INTEGER NOT NULL REFERENCES builds(rowid) ON DELETE CASCADE,
+			name  TEXT    NOT NULL, -- Name listed in the manifest.
+			UNIQUE (build, name)
+		);
+
+		-- Files to be fetched by a run that replays a saved selection, along
+		-- with the server from which each file is fetched.
+		CREATE TABLE IF NOT EXISTS selected_files (
+			file   INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE,
+			server INTEGER NOT NULL REFERENCES servers(rowid) ON DELETE CASCADE
+		);
+
+		-- Persistent queue of files to be fetched by a long run, filled once
+		-- by the selection, and resumed after an interruption.
+		CREATE TABLE IF NOT EXISTS fetch_queue (
+			file   INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE,
+			server INTEGER NOT NULL REFERENCES servers(rowid) ON DELETE CASCADE,
+			state  INTEGER NOT NULL DEFAULT 0, -- Corresponds to QueueState.
+			time   INTEGER NOT NULL, -- When the state last changed.
+			error  TEXT -- Error of a failed file.
+		);
+
+		-- Files whose content was accepted despite not matching the
+		-- Content-Length header of the response.
+		CREATE TABLE IF NOT EXISTS length_mismatches (
+			rowid    INTEGER PRIMARY KEY,
+			file     INTEGER NOT NULL UNIQUE REFERENCES files(rowid) ON DELETE CASCADE,
+			expected INTEGER NOT NULL, -- Length reported by the response.
+			actual   INTEGER NOT NULL, -- Length received.
+			time     INTEGER NOT NULL  -- When the content was received.
+		);
+
+		-- Distinct versions of files at constant locations on a server, such
+		-- as bootstrappers, which change without a new build.
+		CREATE TABLE IF NOT EXISTS deploy_files (
+			rowid      INTEGER PRIMARY KEY,
+			server     INTEGER NOT NULL REFERENCES servers(rowid) ON DELETE CASCADE,
+			name       TEXT    NOT NULL, -- Location of the file, relative to the server.
+			md5        TEXT    NOT NULL, -- Hash of the content, naming the object.
+			size       INTEGER NOT NULL, -- Size of the content.
+			first_seen INTEGER NOT NULL, -- When the content was first fetched.
+			last_seen  INTEGER NOT NULL, -- When the content was last fetched.
+			UNIQUE (server, name, md5)
+		);
+
+		-- Decoded copies of objects compressed with gzip whose content is text,
+		-- such as deploy files served as .gz variants. The raw object is kept
+		-- as it was served, while the decoded object can be searched.
+		CREATE TABLE IF NOT EXISTS decoded_objects (
+			md5          TEXT    NOT NULL PRIMARY KEY, -- Hash of the raw object.
+			decoded      TEXT    NOT NULL, -- Hash of the decoded object.
+			size         INTEGER NOT NULL, -- Size of the decoded object.
+			content_type TEXT    NOT NULL  -- Content type sniffed from the decoded content.
+		);
+
+		-- Assets referred to by the content of archived packages, which are
+		-- located on a CDN by hash.
+		CREATE TABLE IF NOT EXISTS assets (
+			rowid  INTEGER PRIMARY KEY,
+			hash   TEXT    NOT NULL UNIQUE, -- Hash by which the asset is located.
+			status INTEGER, -- Response status of the fetch, or NULL if unchecked.
+			md5    TEXT,    -- Hash of the content, naming the object.
+			size   INTEGER, -- Size of the content.
+			time   INTEGER  -- When the asset was fetched.
+		);
+
+		-- Locations of references to assets within packages.
+		CREATE TABLE IF NOT EXISTS asset_refs (
+			asset INTEGER NOT NULL REFERENCES assets(rowid) ON DELETE CASCADE,
+			file  INTEGER NOT NULL REFERENCES files(rowid) ON DELETE CASCADE,
+			entry TEXT    NOT NULL, -- Entry of the package containing the reference.
+			UNIQUE (asset, file, entry)
+		);
+
+		-- Packages that have been scanned for references to assets.
+		CREATE TABLE IF NOT EXISTS scanned_packages (
+			file INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE
+		);
+
+		-- Companion files, such as signatures or checksums, that are
+		-- published alongside a base file of the same build.
+		CREATE TABLE IF NOT EXISTS companions (
+			file INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE,
+			base INTEGER NOT NULL REFERENCES files(rowid) ON DELETE CASCADE
+		);
+
+		-- Servers whose history file stopped being served after having served
+		-- builds, indicating that the channel of the server is deprecated.
+		-- Files from these servers are fetched before other files.
+		CREATE TABLE IF NOT EXISTS deprecated_servers (
+			server INTEGER PRIMARY KEY REFERENCES servers(rowid) ON DELETE CASCADE,
+			status INTEGER NOT NULL, -- Response status of the history file.
+			time   INTEGER NOT NULL  -- When the deprecation was detected.
+		);
+
+		-- Activity of builds, for reporting. A build is "discovered" when it
+		-- is first added, and "archived" once none of its files remain to be
+		-- downloaded.
+		CREATE TABLE IF NOT EXISTS build_events (
+			rowid INTEGER PRIMARY KEY,
+			build INTEGER NOT NULL REFERENCES builds(rowid) ON DELETE CASCADE,
+			kind  TEXT    NOT NULL, -- Kind of event.
+			time  INTEGER NOT NULL, -- When the event occurred.
+			UNIQUE (build, kind)
+		);
+
+		-- Verifications of downloads that were skipped because the object
+		-- named by the hash of the response already existed, made by comparing
+		-- the ends of the content with the object.
+		CREATE TABLE IF NOT EXISTS skip_verifications (
+			file    INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE,
+			md5     TEXT    NOT NULL, -- Hash of the object compared with.
+			matched INTEGER NOT NULL, -- Whether the content matched the object.
+			time    INTEGER NOT NULL  -- When the verification was made.
+		);
+
+		-- Oddities in the history files of servers, such as versions that
+		-- were rolled back, recorded for review.
+		CREATE TABLE IF NOT EXISTS anomalies (
+			rowid    INTEGER PRIMARY KEY,
+			server   INTEGER NOT NULL REFERENCES servers(rowid) ON DELETE CASCADE,
+			build    INTEGER NOT NULL REFERENCES builds(rowid) ON DELETE CASCADE,
+			kind     TEXT    NOT NULL,          -- Kind of anomaly.
+			detail   TEXT    NOT NULL,          -- Description of the anomaly.
+			time     INTEGER NOT NULL,          -- When the anomaly was detected.
+			reviewed INTEGER NOT NULL DEFAULT 0, -- Whether the anomaly has been reviewed.
+			UNIQUE (server, build, kind)
+		);
+
+		-- The earliest build, by creation time, with a file of each object.
+		-- Maintained by triggers on metadata.
+		CREATE TABLE IF NOT EXISTS first_appearances (
+			md5   TEXT    NOT NULL PRIMARY KEY, -- MD5 hash of the object.
+			build INTEGER NOT NULL REFERENCES builds(rowid) ON DELETE CASCADE,
+			file  INTEGER NOT NULL REFERENCES files(rowid) ON DELETE CASCADE,
+			time  INTEGER NOT NULL -- Creation time of the build.
+		);
+
+		CREATE TRIGGER IF NOT EXISTS metadata_first_appearance_insert
+		AFTER INSERT ON metadata
+		BEGIN
+			INSERT INTO first_appearances (md5, build, file, time)
+			SELECT NEW.md5, builds.rowid, files.rowid, builds.time
+			FROM files, builds
+			WHERE files.rowid == NEW.file
+			AND builds.rowid == files.build
+			ON CONFLICT (md5) DO
+			UPDATE SET build = excluded.build, file = excluded.file, time = excluded.time
+			WHERE excluded.time < first_appearances.time;
+		END;
+
+		-- When the content of a file changes, the appearance of the previous
+		-- object is found again among the remaining files.
+		CREATE TRIGGER IF NOT EXISTS metadata_first_appearance_update
+		AFTER UPDATE OF md5 ON metadata
+		WHEN OLD.md5 != NEW.md5
+		BEGIN
+			DELETE FROM first_appearances WHERE md5 == OLD.md5 AND file == OLD.file;
+			INSERT OR IGNORE INTO first_appearances (md5, build, file, time)
+			SELECT metadata.md5, builds.rowid, files.rowid, builds.time
+			FROM metadata, files, builds
+			WHERE metadata.md5 == OLD.md5
+			AND files.rowid == metadata.file
+			AND builds.rowid == files.build
+			ORDER BY builds.time
+			LIMIT 1;
+			INSERT INTO first_appearances (md5, build, file, time)
+			SELECT NEW.md5, builds.rowid, files.rowid, builds.time
+			FROM files, builds
+			WHERE files.rowid == NEW.file
+			AND builds.rowid == files.build
+			ON CONFLICT (md5) DO
+			UPDATE SET build = excluded.build, file = excluded.file, time = excluded.time
+			WHERE excluded.time < first_appearances.time;
+		END;
+
+		-- When each file was last added or changed, for incremental exports. A
+		-- file changes when its flags or metadata change. Maintained by
+		-- triggers on files and metadata.
+		CREATE TABLE IF NOT EXISTS file_changes (
+			file INTEGER PRIMARY KEY REFERENCES files(rowid) ON DELETE CASCADE,
+			time INTEGER NOT NULL -- When the file last changed.
+		);
+
+		CREATE TRIGGER IF NOT EXISTS files_change_insert
+		AFTER INSERT ON files
+		BEGIN
+			INSERT INTO file_changes (file, time)
+			VALUES (NEW.rowid, CAST(strftime('%s', 'now') AS INTEGER))
+			ON CONFLICT (file) DO UPDATE SET time = excluded.time;
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS files_change_update
+		AFTER UPDATE OF flags ON files
+		WHEN OLD.flags != NEW.flags
+		BEGIN
+			INSERT INTO file_changes (file, time)
+			VALUES (NEW.rowid, CAST(strftime('%s', 'now') AS INTEGER))
+			ON CONFLICT (file) DO UPDATE SET time = excluded.time;
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS metadata_change_insert
+		AFTER INSERT ON metadata
+		BEGIN
+			INSERT INTO file_changes (file, time)
+			VALUES (NEW.file, CAST(strftime('%s', 'now') AS INTEGER))
+			ON CONFLICT (file) DO UPDATE SET time = excluded.time;
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS metadata_change_update
+		AFTER UPDATE ON metadata
+		WHEN OLD.size != NEW.size OR OLD.md5 != NEW.md5 OR OLD.sha256 IS NOT NEW.sha256
+		BEGIN
+			INSERT INTO file_changes (file, time)
+			VALUES (NEW.file, CAST(strftime('%s', 'now') AS INTEGER))
+			ON CONFLICT (file) DO UPDATE SET time = excluded.time;
+		END;
+
+		-- Runs of commands that created rows, such as merges and the
+		-- generation of files.
+		CREATE TABLE IF NOT EXISTS operations (
+			rowid       INTEGER PRIMARY KEY,
+			time        INTEGER NOT NULL, -- When the first row was created.
+			command     TEXT    NOT NULL, -- Command line of the run.
+			config      TEXT,             -- Path to the config file that was used.
+			config_hash TEXT              -- SHA-256 hash of the content of the config file.
+		);
+
+		-- Ranges of rows created by an operation. A row of a table was created
+		-- by the latest operation whose range of the table contains the rowid
+		-- of the row.
+		CREATE TABLE IF NOT EXISTS operation_rows (
+			operation INTEGER NOT NULL REFERENCES operations(rowid) ON DELETE CASCADE,
+			tbl       TEXT    NOT NULL, -- Name of the table.
+			first     INTEGER NOT NULL, -- First rowid of the range.
+			last      INTEGER NOT NULL  -- Last rowid of the range, inclusive.
+		);
+
+		-- Internal state, as named values.
+		CREATE TABLE IF NOT EXISTS state (
+			name  TEXT NOT NULL PRIMARY KEY,
+			value
+		);
+
+		CREATE INDEX IF NOT EXISTS build_servers_build ON build_servers(build);
+		CREATE INDEX IF NOT EXISTS filename_aliases_grp ON filename_aliases(grp);
+		CREATE INDEX IF NOT EXISTS operation_rows_tbl ON operation_rows(tbl, first);
+		CREATE INDEX IF NOT EXISTS build_events_time ON build_events(time);
+		CREATE INDEX IF NOT EXISTS metadata_md5 ON metadata(md5);
+		CREATE INDEX IF NOT EXISTS file_changes_time ON file_changes(time);
+	`
+	if _, err := e.ExecContext(a.Context, query); err != nil {
+		return err
 	}
-	query := `INSERT OR IGNORE INTO servers(url) VALUES ` + strings.Repeat(`(?),`, len(servers))
-	query = strings.TrimSuffix(query, `,`)
-	args := make([]interface{}, len(servers))
-	for i, v := range servers {
-		args[i] = v
+	if err := a.migrate(e); err != nil {
+		return fmt.Errorf("migrate: %w", err)
 	}
-	result, err := e.ExecContext(a.Context, query, args...)
+	attached, err := a.hasSchema(e, SecondarySchema)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if result != nil {
-		rows, _ := result.RowsAffected()
-		newRows = int(rows)
+	for _, table := range secondaryTables {
+		// Tables are placed in the secondary database only if they are not
+		// already present in the primary database. Moving existing tables
+		// is left to MoveTables.
+		schema, ref := "main", fileRef
+		if attached {
+			inMain, err := a.hasTable(e, "main", table.Name)
+			if err != nil {
+				return err
+			}
+			if !inMain {
+				schema, ref = SecondarySchema, ""
+			}
+		}
+		if _, err := e.ExecContext(a.Context, fmt.Sprintf(table.Def, schema, ref)); err != nil {
+			return fmt.Errorf("create %s.%s: %w", schema, table.Name, err)
+		}
 	}
-	return newRows, err
+	if err := a.migrateSecondary(e); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	return nil
 }
 
-// MergeFiles updates the list of file names in a database by appending from the
-// given list the filenames that aren't already in the database.
-func (a Action) MergeFiles(e Executor, files []string) (newRows int, err error) {
-	if len(files) == 0 {
-		return 0, nil
+// migrateSecondary adds columns to secondary tables created by earlier
+// versions, in whichever database each table is located.
+func (a Action) migrateSecondary(e Executor) error {
+	schema := a.tableSchema(e, "headers")
+	if err := a.addColumn(e, schema, "headers", "final_url", `TEXT`); err != nil {
+		return err
 	}
-	query := `INSERT OR IGNORE INTO filenames(name) VALUES ` + strings.Repeat(`(?),`, len(files))
-	query = strings.TrimSuffix(query, `,`)
-	args := make([]interface{}, len(files))
-	for i, v := range files {
-		args[i] = v
+	if err := a.addColumn(e, schema, "headers", "redirects", `INTEGER`); err != nil {
+		return err
 	}
-	result, err := e.ExecContext(a.Context, query, args...)
+	return a.migrateETagFormat(e, schema)
+}
+
+// migrateETagFormat adds the etag_format column to the headers table, filling
+// in the format of existing ETags with rules equivalent to objects.ParseETag.
+func (a Action) migrateETagFormat(e Executor, schema string) error {
+	columns, err := a.tableColumns(e, schema, "headers")
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if result != nil {
-		rows, _ := result.RowsAffected()
-		newRows = int(rows)
+	for _, c := range columns {
+		if c == "etag_format" {
+			return nil
+		}
 	}
-	return newRows, err
+	if err := a.addColumn(e, schema, "headers", "etag_format", `TEXT`); err != nil {
+		return err
+	}
+	hash := strings.Repeat(`[0-9a-f]`, 32)
+	query := fmt.Sprintf(`
+		UPDATE %[1]s.headers SET etag_format = CASE
+			WHEN lower(etag) GLOB 'w/*' THEN
+				CASE WHEN trim(substr(lower(etag), 3), '"') GLOB '%[2]s' THEN ? ELSE ? END
+			WHEN trim(lower(etag), '"') GLOB '%[2]s' THEN ?
+			WHEN trim(lower(etag), '"') GLOB '%[2]s-[0-9]*'
+				AND substr(trim(lower(etag), '"'), 34) NOT GLOB '*[^0-9]*' THEN ?
+			ELSE ?
+		END
+		WHERE etag IS NOT NULL AND etag != ''
+	`, schema, hash)
+	_, err = e.ExecContext(a.Context, query,
+		objects.ETagWeak,
+		objects.ETagOpaque,
+		objects.ETagMD5,
+		objects.ETagMultipart,
+		objects.ETagOpaque,
+	)
+	if err != nil {
+		return fmt.Errorf("fill etag_format: %w", err)
+	}
+	return nil
 }
 
-// GetServers returns a list of servers from a database.
-func (a Action) GetServers(e Executor) (servers []string, err error) {
-	const query = `SELECT url FROM servers`
-	rows, err := e.QueryContext(a.Context, query)
+// SecondarySchema is the name under which the secondary database is attached.
+const SecondarySchema = "secondary"
+
+// fileRef is the foreign key clause of a table column that refers to a file.
+const fileRef = `REFERENCES files(rowid) ON DELETE CASCADE`
+
+// secondaryTables contains the definitions of bulky, rarely-queried tables.
+// These are placed in the secondary database when one is attached, keeping the
+// primary database light for selection queries. Because tables are referred to
+// without a schema name, queries are unaffected by where a table is located.
+//
+// Each definition is formatted with the name of the schema in which the table
+// is created, followed by the foreign key clause of the column referring to a
+// file. Foreign keys cannot refer to tables in other databases, so the clause
+// is empty when the table is created in the secondary database.
+var secondaryTables = []struct {
+	Name string
+	Def  string
+}{
+	{Name: "headers", Def: `
+		-- Set of file headers retrieved from deployment server.
+		CREATE TABLE IF NOT EXISTS %[1]s.headers (
+			rowid          INTEGER PRIMARY KEY,
+			file           INTEGER NOT NULL UNIQUE %[2]s,
+			status         INTEGER NOT NULL, -- Returned status code.
+			content_length INTEGER,          -- Size of the file reported by the server.
+			last_modified  INTEGER,          -- Modification time of content on the server.
+			content_type   TEXT,             -- Type of file reported by server.
+			etag           TEXT,             -- ETag reported by the server, usually the quoted MD5 hash of the file.
+			etag_format    TEXT,             -- Corresponds to objects.ETagFormat.
+			final_url      TEXT,             -- URL of the response, if reached through redirects.
+			redirects      INTEGER           -- Number of redirects followed.
+		);
+	`},
+	{Name: "header_fields", Def: `
+		-- Additional headers retrieved from a successful fetch of a file, which
+		-- help prove the provenance of archived content.
+		CREATE TABLE IF NOT EXISTS %[1]s.header_fields (
+			rowid INTEGER PRIMARY KEY,
+			file  INTEGER NOT NULL %[2]s,
+			name  TEXT    NOT NULL, -- Name of the header, in lower case.
+			value TEXT    NOT NULL, -- Value of the header.
+			UNIQUE (file, name)
+		);
+	`},
+	{Name: "file_errors", Def: `
+		-- The last error that occurred while fetching each file. Cleared when
+		-- the file is next fetched without error.
+		CREATE TABLE IF NOT EXISTS %[1]s.file_errors (
+			rowid INTEGER PRIMARY KEY,
+			file  INTEGER NOT NULL UNIQUE %[2]s,
+			error TEXT    NOT NULL, -- Error message.
+			time  INTEGER NOT NULL  -- When the error occurred.
+		);
+	`},
+}
+
+// queryInt runs a query that returns a single integer.
+func (a Action) queryInt(e Executor, query string, args ...interface{}) (n int64, err error) {
+	rows, err := e.QueryContext(a.Context, query, args...)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer rows.Close()
-	for rows.Next() {
-		var server string
-		if err = rows.Scan(&server); err != nil {
-			return nil, err
+	if rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			return 0, err
 		}
-		servers = append(servers, server)
 	}
 	if err = rows.Close(); err != nil {
-		return nil, err
+		return 0, err
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return 0, err
 	}
-	return
+	return n, nil
 }
 
-// GetFilenames returns a list of filenames from a database.
-func (a Action) GetFilenames(e Executor) (filenames []string, err error) {
-	const query = `SELECT name FROM filenames`
-	rows, err := e.QueryContext(a.Context, query)
+// hasSchema returns whether a database with the given schema name is attached.
+func (a Action) hasSchema(e Executor, schema string) (bool, error) {
+	const query = `SELECT count(*) FROM pragma_database_list WHERE name == ?`
+	n, err := a.queryInt(e, query, schema)
+	return n > 0, err
+}
+
+// hasTable returns whether the database of a given schema contains a table.
+func (a Action) hasTable(e Executor, schema, table string) (bool, error) {
+	query := `SELECT count(*) FROM ` + schema + `.sqlite_master WHERE type == 'table' AND name == ?`
+	n, err := a.queryInt(e, query, table)
+	return n > 0, err
+}
+
+// tableColumns returns the names of the columns of a table in the database of
+// the given schema.
+func (a Action) tableColumns(e Executor, schema, table string) (columns []string, err error) {
+	query := `SELECT name FROM pragma_table_info(?, ?)`
+	rows, err := e.QueryContext(a.Context, query, table, schema)
 	if err != nil {
 		return nil, err
 	}
@@ -295,7 +723,7 @@ func (a Action) GetFilenames(e Executor) (filenames []string, err error) {
 		if err = rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		filenames = append(filenames, name)
+		columns = append(columns, name)
 	}
 	if err = rows.Close(); err != nil {
 		return nil, err
@@ -303,509 +731,5242 @@ func (a Action) GetFilenames(e Executor) (filenames []string, err error) {
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return
+	return columns, nil
 }
 
-// FindManifests returns a list of hashes for existing rbxPkgManifest files.
-func (a Action) FindManifests(e Executor) (hashes []string, err error) {
-	const query = `
-		SELECT metadata.md5 FROM files,metadata
-		WHERE metadata.file == files.rowid
-		AND files.filename == (
-			SELECT rowid FROM filenames
-			WHERE name == "rbxPkgManifest.txt"
-		)
-	`
-	rows, err := e.QueryContext(a.Context, query)
-	if err != nil {
+// MoveTables moves bulky tables between the primary and secondary databases.
+// If toSecondary is true, tables are moved from the primary database to the
+// secondary database. Otherwise, they are moved back into the primary database.
+// Returns the names of the tables that were moved.
+//
+// The secondary database must be attached. Tables already located in the
+// destination are skipped.
+func (a Action) MoveTables(db *sql.DB, toSecondary bool) (moved []string, err error) {
+	if attached, err := a.hasSchema(db, SecondarySchema); err != nil {
 		return nil, err
+	} else if !attached {
+		return nil, fmt.Errorf("secondary database is not attached")
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var hash string
-		if err = rows.Scan(&hash); err != nil {
+	src, dst, ref := "main", SecondarySchema, ""
+	if !toSecondary {
+		src, dst, ref = SecondarySchema, "main", fileRef
+	}
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, table := range secondaryTables {
+		if ok, err := a.hasTable(tx, src, table.Name); err != nil {
 			return nil, err
+		} else if !ok {
+			continue
 		}
-		hashes = append(hashes, hash)
-	}
-	if err = rows.Close(); err != nil {
-		return nil, err
+		if ok, err := a.hasTable(tx, dst, table.Name); err != nil {
+			return nil, err
+		} else if ok {
+			n, err := a.queryInt(tx, `SELECT count(*) FROM `+dst+`.`+table.Name)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				return nil, fmt.Errorf("table %s exists in both databases", table.Name)
+			}
+			if _, err := tx.ExecContext(a.Context, `DROP TABLE `+dst+`.`+table.Name); err != nil {
+				return nil, fmt.Errorf("drop %s.%s: %w", dst, table.Name, err)
+			}
+		}
+		if _, err := tx.ExecContext(a.Context, fmt.Sprintf(table.Def, dst, ref)); err != nil {
+			return nil, fmt.Errorf("create %s.%s: %w", dst, table.Name, err)
+		}
+		columns, err := a.tableColumns(tx, src, table.Name)
+		if err != nil {
+			return nil, fmt.Errorf("get columns of %s.%s: %w", src, table.Name, err)
+		}
+		list := strings.Join(columns, ", ")
+		query := `INSERT INTO ` + dst + `.` + table.Name + ` (` + list + `) SELECT ` + list + ` FROM ` + src + `.` + table.Name
+		if _, err := tx.ExecContext(a.Context, query); err != nil {
+			return nil, fmt.Errorf("copy %s: %w", table.Name, err)
+		}
+		if _, err := tx.ExecContext(a.Context, `DROP TABLE `+src+`.`+table.Name); err != nil {
+			return nil, fmt.Errorf("drop %s.%s: %w", src, table.Name, err)
+		}
+		moved = append(moved, table.Name)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
 	}
-	return
+	return moved, nil
 }
 
-// AddBuild inserts a single build into a database.
-func (a Action) AddBuild(e Executor, server string, build Build) error {
-	const query = `
-		INSERT OR ABORT INTO builds (hash, type, time, version) VALUES (?, ?, ?, ?);
-		INSERT OR ABORT INTO build_servers (server, build) VALUES ((SELECT rowid FROM servers WHERE url=?), last_insert_rowid());
-	`
-	_, err := e.ExecContext(a.Context, query,
-		build.Hash,
-		build.Type,
-		build.Time,
-		build.Version,
-		server,
-	)
-	return err
+// migrate brings tables created by older versions up to date.
+func (a Action) migrate(e Executor) error {
+	if err := a.addColumn(e, "main", "filenames", "tier", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	if err := a.addColumn(e, "main", "servers", "disabled", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	// Channels added as servers before these columns existed are related to
+	// their servers by merge-servers.
+	if err := a.addColumn(e, "main", "servers", "base", `INTEGER REFERENCES servers(rowid)`); err != nil {
+		return err
+	}
+	if err := a.addColumn(e, "main", "servers", "channel", `TEXT`); err != nil {
+		return err
+	}
+	// Existing objects are hashed by the hash-objects command.
+	if err := a.addColumn(e, "main", "metadata", "sha256", `TEXT`); err != nil {
+		return err
+	}
+	// Existing objects are compressed by the compress-objects command.
+	if err := a.addColumn(e, "main", "metadata", "stored_size", `INTEGER`); err != nil {
+		return err
+	}
+	// Metadata added before first_appearances existed is not covered by the
+	// triggers.
+	missing, err := a.queryInt(e, `
+		SELECT EXISTS (SELECT 1 FROM metadata)
+		AND NOT EXISTS (SELECT 1 FROM first_appearances)
+	`)
+	if err != nil {
+		return err
+	}
+	if missing != 0 {
+		log.Println("building index of first appearances...")
+		if err := a.RebuildFirstAppearances(e); err != nil {
+			return fmt.Errorf("build first appearances: %w", err)
+		}
+	}
+	return nil
 }
 
-// FetchBuilds downloads and scans the DeployHistory file from each server in
-// a database and inserts any new builds into the database.
-func (a Action) FetchBuilds(db *sql.DB, f *fetch.Fetcher, file string) error {
-	servers, err := a.GetServers(db)
+// addColumn adds a column to a table if the table does not already have it.
+func (a Action) addColumn(e Executor, schema, table, column, def string) error {
+	columns, err := a.tableColumns(e, schema, table)
 	if err != nil {
-		return fmt.Errorf("get servers: %w", err)
+		return err
 	}
-	for _, server := range servers {
-		tx, err := db.BeginTx(a.Context, nil)
-		if err != nil {
-			return err
+	for _, c := range columns {
+		if c == column {
+			return nil
 		}
-		stream, err := f.FetchDeployHistory(a.Context, buildFileURL(server, "", file))
-		if err != nil {
-			log.Printf("get deploy history: %s", err)
+	}
+	query := fmt.Sprintf(`ALTER TABLE %s.%s ADD COLUMN %s %s`, schema, table, column, def)
+	if _, err := e.ExecContext(a.Context, query); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+type Build struct {
+	Hash    string
+	Type    string
+	Time    int64
+	Version string
+}
+
+// FilenameTier determines the builds for which files of a name are generated.
+type FilenameTier int
+
+const (
+	TierAlways FilenameTier = iota // Generated for every build.
+	TierRecent                     // Generated only for recent builds.
+	TierManual                     // Generated only when requested.
+	TierDisabled                   // Not generated, and existing files are not fetched.
+)
+
+// SetFilenameTier sets the tier of each of the given file names that are
+// present in the database.
+func (a Action) SetFilenameTier(e Executor, tier FilenameTier, names []string) error {
+	// Stay well under the maximum number of query parameters.
+	const chunk = 512
+	for len(names) > 0 {
+		n := len(names)
+		if n > chunk {
+			n = chunk
+		}
+		query := `UPDATE filenames SET tier = ? WHERE name IN (` + strings.TrimSuffix(strings.Repeat(`?,`, n), `,`) + `)`
+		args := make([]interface{}, 0, n+1)
+		args = append(args, tier)
+		for _, name := range names[:n] {
+			args = append(args, name)
+		}
+		if _, err := e.ExecContext(a.Context, query, args...); err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+// EnableFilenames sets each of the given file names that are disabled to the
+// TierAlways tier, the tier with which names are added.
+func (a Action) EnableFilenames(e Executor, names []string) error {
+	for _, name := range names {
+		const query = `UPDATE filenames SET tier = ? WHERE tier == ? AND name == ?`
+		if _, err := e.ExecContext(a.Context, query, TierAlways, TierDisabled, name); err != nil {
+			return fmt.Errorf("enable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// MergeServers updates the list of servers in a database by appending from the
+// given list the servers that aren't already in the database. Servers in the
+// list that were disabled are enabled again, but are not counted as new.
+func (a Action) MergeServers(e Executor, servers []string) (newRows int, err error) {
+	if len(servers) == 0 {
+		return 0, nil
+	}
+	query := `INSERT OR IGNORE INTO servers(url) VALUES ` + strings.Repeat(`(?),`, len(servers))
+	query = strings.TrimSuffix(query, `,`)
+	args := make([]interface{}, len(servers))
+	for i, v := range servers {
+		args[i] = v
+	}
+	var result sql.Result
+	err = a.track(e, []string{"servers"}, func() (err error) {
+		result, err = e.ExecContext(a.Context, query, args...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result != nil {
+		rows, _ := result.RowsAffected()
+		newRows = int(rows)
+	}
+	enable := `UPDATE servers SET disabled = 0 WHERE disabled AND url IN (` + strings.TrimSuffix(strings.Repeat(`?,`, len(servers)), `,`) + `)`
+	if _, err := e.ExecContext(a.Context, enable, args...); err != nil {
+		return newRows, fmt.Errorf("enable servers: %w", err)
+	}
+	return newRows, err
+}
+
+// LiveChannel is the name of the channel from which a server itself deploys.
+const LiveChannel = "LIVE"
+
+// Channel is a deployment channel of a server, from which builds are deployed
+// separately from the server itself. The builds and files of a channel are
+// located under the URL of the channel.
+type Channel struct {
+	// URL of the server.
+	Server string
+	// Name of the channel, such as "zcanary".
+	Name string
+}
+
+// URL returns the base URL of the channel, of the form
+// "<server>/channel/<name>", with the name in lower case.
+func (c Channel) URL() string {
+	return sanitizeBaseURL(c.Server) + "/channel/" + strings.ToLower(c.Name)
+}
+
+// MergeChannels relates each of the given channels to its server. Both the
+// server and the URL of the channel must already be present in the database,
+// such as by MergeServers. A server that was previously added with the URL of
+// a channel becomes the channel, keeping its builds and files.
+func (a Action) MergeChannels(e Executor, channels []Channel) error {
+	const query = `
+		UPDATE servers
+		SET base = (SELECT rowid FROM servers WHERE url == ?), channel = ?
+		WHERE url == ?
+	`
+	for _, c := range channels {
+		if _, err := e.ExecContext(a.Context, query, c.Server, c.Name, c.URL()); err != nil {
+			return fmt.Errorf("merge channel %s: %w", c.URL(), err)
+		}
+	}
+	return nil
+}
+
+// DiffServers compares the servers in a database with the given list. added
+// contains the servers in the list that are missing from the database, or are
+// disabled. extra contains the enabled servers in the database that are not in
+// the list.
+func (a Action) DiffServers(e Executor, servers []string) (added, extra []string, err error) {
+	rows, err := e.QueryContext(a.Context, `SELECT url, disabled FROM servers`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	present := map[string]bool{}
+	for rows.Next() {
+		var url string
+		var disabled bool
+		if err := rows.Scan(&url, &disabled); err != nil {
+			return nil, nil, err
+		}
+		present[url] = !disabled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	configured := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		if !present[server] && !configured[server] {
+			added = append(added, server)
+		}
+		configured[server] = true
+	}
+	for url, enabled := range present {
+		if enabled && !configured[url] {
+			extra = append(extra, url)
+		}
+	}
+	sort.Strings(extra)
+	return added, extra, nil
+}
+
+// DisableServers disables each of the given servers. The builds and files of a
+// disabled server are kept, but are no longer fetched.
+func (a Action) DisableServers(e Executor, servers []string) error {
+	for _, server := range servers {
+		if _, err := e.ExecContext(a.Context, `UPDATE servers SET disabled = 1 WHERE url == ?`, server); err != nil {
+			return fmt.Errorf("disable %s: %w", server, err)
+		}
+	}
+	return nil
+}
+
+// DiffFilenames compares the file names in a database with the given list.
+// added contains the names in the list that are missing from the database, or
+// are disabled. extra contains the names in the database that are not in the
+// list, and have a tier that is generated for builds. Names of the TierManual
+// tier, such as discovered names and companions, are not considered extra.
+func (a Action) DiffFilenames(e Executor, names []string) (added, extra []string, err error) {
+	rows, err := e.QueryContext(a.Context, `SELECT name, tier FROM filenames`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	tiers := map[string]FilenameTier{}
+	for rows.Next() {
+		var name string
+		var tier FilenameTier
+		if err := rows.Scan(&name, &tier); err != nil {
+			return nil, nil, err
+		}
+		tiers[name] = tier
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	configured := make(map[string]bool, len(names))
+	for _, name := range names {
+		if tier, ok := tiers[name]; (!ok || tier == TierDisabled) && !configured[name] {
+			added = append(added, name)
+		}
+		configured[name] = true
+	}
+	for name, tier := range tiers {
+		if (tier == TierAlways || tier == TierRecent) && !configured[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	return added, extra, nil
+}
+
+// MergeFiles updates the list of file names in a database by appending from the
+// given list the filenames that aren't already in the database.
+func (a Action) MergeFiles(e Executor, files []string) (newRows int, err error) {
+	if len(files) == 0 {
+		return 0, nil
+	}
+	query := `INSERT OR IGNORE INTO filenames(name) VALUES ` + strings.Repeat(`(?),`, len(files))
+	query = strings.TrimSuffix(query, `,`)
+	args := make([]interface{}, len(files))
+	for i, v := range files {
+		args[i] = v
+	}
+	var result sql.Result
+	err = a.track(e, []string{"filenames"}, func() (err error) {
+		result, err = e.ExecContext(a.Context, query, args...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result != nil {
+		rows, _ := result.RowsAffected()
+		newRows = int(rows)
+	}
+	return newRows, err
+}
+
+// AddFilenames adds to a database the given file names that aren't already in
+// the database, with the TierManual tier, as for names that were discovered
+// rather than configured. Returns the number of names added.
+func (a Action) AddFilenames(e Executor, names []string) (newRows int, err error) {
+	const query = `INSERT OR IGNORE INTO filenames (name, tier) VALUES (?, ?)`
+	err = a.track(e, []string{"filenames"}, func() error {
+		for _, name := range names {
+			result, err := e.ExecContext(a.Context, query, name, TierManual)
+			if err != nil {
+				return fmt.Errorf("add %s: %w", name, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				newRows++
+			}
+		}
+		return nil
+	})
+	return newRows, err
+}
+
+// MergeAliases updates the alias groups of file names in a database. Each group
+// is a list of names that are variants of the same logical file. Names that
+// aren't already in the database are added. A name that is already in a group
+// is moved to the given group.
+func (a Action) MergeAliases(e Executor, groups [][]string) (newRows int, err error) {
+	const query = `
+		INSERT INTO filename_aliases (filename, grp)
+		SELECT rowid, (SELECT rowid FROM filenames WHERE name == ?)
+		FROM filenames WHERE name == ?
+		ON CONFLICT (filename) DO
+		UPDATE SET grp = excluded.grp
+		WHERE grp != excluded.grp
+	`
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		if _, err := a.MergeFiles(e, group); err != nil {
+			return newRows, err
+		}
+		for _, name := range group {
+			result, err := e.ExecContext(a.Context, query, group[0], name)
+			if err != nil {
+				return newRows, fmt.Errorf("merge alias %s: %w", name, err)
+			}
+			if result != nil {
+				rows, _ := result.RowsAffected()
+				newRows += int(rows)
+			}
+		}
+	}
+	return newRows, nil
+}
+
+// GetServers returns a list of enabled servers from a database.
+func (a Action) GetServers(e Executor) (servers []string, err error) {
+	const query = `SELECT url FROM servers WHERE NOT disabled`
+	rows, err := e.QueryContext(a.Context, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var server string
+		if err = rows.Scan(&server); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetFilenames returns a list of filenames from a database.
+func (a Action) GetFilenames(e Executor) (filenames []string, err error) {
+	const query = `SELECT name FROM filenames`
+	rows, err := e.QueryContext(a.Context, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, name)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// DefaultManifestFiles are the names of the files in the rbxPkgManifest format
+// used when none are configured.
+var DefaultManifestFiles = []string{"rbxPkgManifest.txt"}
+
+// manifestFilenames returns a condition matching the filenames row of any of
+// the given manifest file names, along with its parameters. If names is empty,
+// then DefaultManifestFiles is used.
+func manifestFilenames(names []string) (cond string, params []interface{}) {
+	if len(names) == 0 {
+		names = DefaultManifestFiles
+	}
+	params = make([]interface{}, len(names))
+	for i, name := range names {
+		params[i] = name
+	}
+	cond = `files.filename IN (
+		SELECT rowid FROM filenames
+		WHERE name IN (` + strings.TrimSuffix(strings.Repeat(`?,`, len(names)), `,`) + `)
+	)`
+	return cond, params
+}
+
+// Manifest is an object in the rbxPkgManifest format, along with the builds
+// that have it as their manifest.
+type Manifest struct {
+	Hash   string
+	Builds []string
+}
+
+// FindManifests returns the existing manifest objects, which are the content of
+// files of the given names. Each object is returned once, even if it is shared
+// by several builds.
+func (a Action) FindManifests(e Executor, names []string) (manifests []Manifest, err error) {
+	cond, params := manifestFilenames(names)
+	query := `
+		SELECT metadata.md5, builds.hash FROM files, metadata, builds
+		WHERE metadata.file == files.rowid
+		AND files.build == builds.rowid
+		AND ` + cond + `
+		ORDER BY files.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	index := map[string]int{}
+	for rows.Next() {
+		var hash, build string
+		if err = rows.Scan(&hash, &build); err != nil {
+			return nil, err
+		}
+		i, ok := index[hash]
+		if !ok {
+			i = len(manifests)
+			index[hash] = i
+			manifests = append(manifests, Manifest{Hash: hash})
+		}
+		manifests[i].Builds = append(manifests[i].Builds, build)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// BuildManifest returns the hash of the manifest object of the given build,
+// which is the content of a file of one of the given names. Returns an empty
+// string if the build has no manifest with content.
+func (a Action) BuildManifest(db *sql.DB, build string, names []string) (hash string, err error) {
+	cond, params := manifestFilenames(names)
+	query := `
+		SELECT metadata.md5 FROM files, metadata, builds
+		WHERE metadata.file == files.rowid
+		AND files.build == builds.rowid
+		AND builds.hash == ?
+		AND ` + cond + `
+		ORDER BY files.rowid
+		LIMIT 1
+	`
+	err = db.QueryRowContext(a.Context, query, append([]interface{}{build}, params...)...).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// BuildServers returns the servers on which the given build is present, in
+// order of rowid. Returns an error wrapping ErrUnknownBuild if the build is not
+// present on any server.
+func (a Action) BuildServers(e Executor, build string) (servers []string, err error) {
+	const query = `
+		SELECT servers.url FROM builds, build_servers, servers
+		WHERE builds.hash == ?
+		AND build_servers.build == builds.rowid
+		AND build_servers.server == servers.rowid
+		ORDER BY servers.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, build)
+	if err != nil {
+		return nil, fmt.Errorf("select servers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var server string
+		if err := rows.Scan(&server); err != nil {
+			return nil, fmt.Errorf("scan server: %w", err)
+		}
+		servers = append(servers, server)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select servers: %w", err)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%w %s", ErrUnknownBuild, build)
+	}
+	return servers, nil
+}
+
+// deprecateServer marks a server as deprecated if it has served builds
+// previously, logging an alert the first time.
+func (a Action) deprecateServer(db *sql.DB, server string, status int) error {
+	const query = `
+		INSERT OR IGNORE INTO deprecated_servers (server, status, time)
+		SELECT servers.rowid, ?, ? FROM servers
+		WHERE servers.url == ?
+		AND EXISTS (SELECT 1 FROM build_servers WHERE build_servers.server == servers.rowid)
+	`
+	result, err := db.ExecContext(a.Context, query, status, time.Now().Unix(), server)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		incomplete, err := a.queryInt(db, `
+			SELECT count(*) FROM files, build_servers, servers
+			WHERE files.build == build_servers.build
+			AND build_servers.server == servers.rowid
+			AND servers.url == ?
+			AND `+flagsUnset("files.flags", NotFound|HasContent), server)
+		if err != nil {
+			return err
+		}
+		log.Printf("ALERT: %s no longer serves its history (status %d); the channel may be deprecated. %d incomplete files will be fetched first.", server, status, incomplete)
+	}
+	return nil
+}
+
+// restoreServer removes the deprecation of a server, logging if it was
+// deprecated.
+func (a Action) restoreServer(db *sql.DB, server string) error {
+	const query = `
+		DELETE FROM deprecated_servers
+		WHERE server == (SELECT rowid FROM servers WHERE url == ?)
+	`
+	result, err := db.ExecContext(a.Context, query, server)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("%s serves its history again; no longer deprecated", server)
+	}
+	return nil
+}
+
+// AddServerFailure records a failure that made a server unreachable.
+func (a Action) AddServerFailure(e Executor, server string, kind fetch.ErrorKind, failure error) error {
+	const query = `
+		INSERT INTO server_failures (server, kind, error, time)
+		VALUES ((SELECT rowid FROM servers WHERE url == ?), ?, ?, ?)
+	`
+	_, err := e.ExecContext(a.Context, query, server, kind.String(), failure.Error(), time.Now().Unix())
+	return err
+}
+
+// SetFileError records the last error that occurred while fetching a file.
+func (a Action) SetFileError(e Executor, file int, failure error) error {
+	const query = `
+		INSERT INTO file_errors (file, error, time)
+		VALUES (?, ?, ?)
+		ON CONFLICT (file) DO
+		UPDATE SET error = excluded.error, time = excluded.time
+	`
+	_, err := e.ExecContext(a.Context, query, file, failure.Error(), time.Now().Unix())
+	return err
+}
+
+// FileError is the last error that occurred while fetching a file.
+type FileError struct {
+	Build string
+	File  string
+	Error string
+	Time  int64
+}
+
+// RecentErrors returns the n most recent errors recorded by SetFileError, most
+// recent first.
+func (a Action) RecentErrors(e Executor, n int) (errs []FileError, err error) {
+	const query = `
+		SELECT builds.hash, filenames.name, file_errors.error, file_errors.time
+		FROM file_errors
+		JOIN files ON files.rowid == file_errors.file
+		JOIN builds ON builds.rowid == files.build
+		JOIN filenames ON filenames.rowid == files.filename
+		ORDER BY file_errors.time DESC, file_errors.rowid DESC
+		LIMIT ?
+	`
+	rows, err := e.QueryContext(a.Context, query, n)
+	if err != nil {
+		return nil, fmt.Errorf("select errors: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fe FileError
+		if err := rows.Scan(&fe.Build, &fe.File, &fe.Error, &fe.Time); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		errs = append(errs, fe)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return errs, nil
+}
+
+// AddBuild inserts a single build into a database. The build is recorded as
+// discovered at the current time.
+func (a Action) AddBuild(e Executor, server string, build Build) error {
+	const query = `
+		INSERT OR ABORT INTO builds (hash, type, time, version) VALUES (?, ?, ?, ?);
+		INSERT INTO build_events (build, kind, time) VALUES (last_insert_rowid(), 'discovered', ?);
+		INSERT OR ABORT INTO build_servers (server, build) VALUES ((SELECT rowid FROM servers WHERE url=?), (SELECT rowid FROM builds WHERE hash=?));
+	`
+	_, err := e.ExecContext(a.Context, query,
+		build.Hash,
+		build.Type,
+		build.Time,
+		build.Version,
+		time.Now().Unix(),
+		server,
+		build.Hash,
+	)
+	return err
+}
+
+// LinkBuild records that an existing build is present on a server. Returns
+// whether the build was not already recorded as present on the server.
+func (a Action) LinkBuild(e Executor, server, hash string) (ok bool, err error) {
+	const query = `
+		INSERT OR IGNORE INTO build_servers (server, build)
+		SELECT servers.rowid, builds.rowid FROM servers, builds
+		WHERE servers.url == ? AND builds.hash == ?
+	`
+	result, err := e.ExecContext(a.Context, query, server, hash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// BuildEvent describes activity of a build.
+type BuildEvent struct {
+	Build
+	// Kind of event, "discovered" or "archived".
+	Kind string
+	// When the event occurred.
+	Time int64
+	// Servers on which the build is present.
+	Servers []string
+	// Number of files of the build that have content, and their total size.
+	Files int
+	Size  int64
+}
+
+// BuildEvents returns the most recent events of builds, most recent first, up
+// to the given number of events.
+func (a Action) BuildEvents(e Executor, limit int) (events []BuildEvent, err error) {
+	const query = `
+		SELECT
+			builds.hash,
+			builds.type,
+			builds.time,
+			builds.version,
+			build_events.kind,
+			build_events.time,
+			(SELECT group_concat(servers.url, ' ')
+				FROM build_servers, servers
+				WHERE build_servers.build == builds.rowid
+				AND servers.rowid == build_servers.server
+			),
+			(SELECT count(*) FROM files WHERE files.build == builds.rowid AND files.flags & ? != 0),
+			(SELECT ifnull(sum(metadata.size), 0) FROM files, metadata
+				WHERE files.build == builds.rowid
+				AND metadata.file == files.rowid
+				AND files.flags & ? != 0
+			)
+		FROM build_events, builds
+		WHERE builds.rowid == build_events.build
+		ORDER BY build_events.time DESC, build_events.rowid DESC
+		LIMIT ?
+	`
+	rows, err := e.QueryContext(a.Context, query, HasContent, HasContent, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event BuildEvent
+		var servers sql.NullString
+		if err := rows.Scan(
+			&event.Hash,
+			&event.Type,
+			&event.Build.Time,
+			&event.Version,
+			&event.Kind,
+			&event.Time,
+			&servers,
+			&event.Files,
+			&event.Size,
+		); err != nil {
+			return nil, err
+		}
+		if servers.Valid {
+			event.Servers = strings.Fields(servers.String)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+
+// SharedBuild is a build exchanged by ExportBuilds and ImportBuilds.
+type SharedBuild struct {
+	Hash    string `json:"hash"`
+	Type    string `json:"type"`
+	Time    int64  `json:"time"`
+	Version string `json:"version"`
+	// Servers on which the build is present.
+	Servers []string `json:"servers"`
+}
+
+// ExportBuilds returns every build in a database, along with the servers on
+// which each build is present. If since is greater than zero, then only builds
+// that were discovered or archived at or after since, a Unix timestamp, are
+// returned. Builds are ordered by time and hash, and servers by URL, so that
+// the output does not depend on the order in which builds were found.
+func (a Action) ExportBuilds(e Executor, since int64) (builds []SharedBuild, err error) {
+	const query = `
+		SELECT
+			builds.hash,
+			builds.type,
+			builds.time,
+			builds.version,
+			servers.url
+		FROM builds
+		LEFT JOIN build_servers ON build_servers.build == builds.rowid
+		LEFT JOIN servers ON servers.rowid == build_servers.server
+		WHERE ? <= 0 OR builds.rowid IN (SELECT build FROM build_events WHERE time >= ?)
+		ORDER BY builds.time, builds.hash, servers.url
+	`
+	rows, err := e.QueryContext(a.Context, query, since, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var build SharedBuild
+		var server sql.NullString
+		if err := rows.Scan(
+			&build.Hash,
+			&build.Type,
+			&build.Time,
+			&build.Version,
+			&server,
+		); err != nil {
+			return nil, err
+		}
+		if n := len(builds); n == 0 || builds[n-1].Hash != build.Hash {
+			build.Servers = []string{}
+			builds = append(builds, build)
+		}
+		if server.Valid {
+			last := &builds[len(builds)-1]
+			last.Servers = append(last.Servers, server.String)
+		}
+	}
+	return builds, rows.Err()
+}
+
+// ImportBuildsStats contains statistics of ImportBuilds.
+type ImportBuildsStats struct {
+	// Number of builds that were added.
+	Added int
+	// Number of builds that were already in the database.
+	Unchanged int
+	// Number of added builds not present on any server in the database. Such
+	// builds are kept, but have no files to fetch until one of their servers is
+	// merged.
+	Unlinked int
+}
+
+// ImportBuilds merges builds exported by another database. Builds already in
+// the database are kept as they are, except that they are associated with any
+// additional servers of the imported build. Servers that are not in the
+// database are ignored, rather than added. Added builds are recorded as
+// discovered at the current time, with the rows attributed to the operation of
+// a.
+func (a Action) ImportBuilds(db *sql.DB, builds []SharedBuild) (stats ImportBuildsStats, err error) {
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return stats, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const insertBuild = `INSERT OR IGNORE INTO builds (hash, type, time, version) VALUES (?, ?, ?, ?)`
+	const insertEvent = `INSERT INTO build_events (build, kind, time) VALUES (?, 'discovered', ?)`
+	const insertServer = `
+		INSERT OR IGNORE INTO build_servers (server, build)
+		SELECT servers.rowid, ? FROM servers WHERE servers.url == ?
+	`
+	now := time.Now().Unix()
+	err = a.track(tx, []string{"builds"}, func() error {
+		for _, b := range builds {
+			if b.Hash == "" {
+				continue
+			}
+			result, err := tx.ExecContext(a.Context, insertBuild, b.Hash, b.Type, b.Time, b.Version)
+			if err != nil {
+				return fmt.Errorf("add build %s: %w", b.Hash, err)
+			}
+			added, _ := result.RowsAffected()
+			id, err := a.queryInt(tx, `SELECT rowid FROM builds WHERE hash == ?`, b.Hash)
+			if err != nil {
+				return fmt.Errorf("select build %s: %w", b.Hash, err)
+			}
+			if added == 0 {
+				stats.Unchanged++
+			} else {
+				stats.Added++
+				if _, err := tx.ExecContext(a.Context, insertEvent, id, now); err != nil {
+					return fmt.Errorf("add build event %s: %w", b.Hash, err)
+				}
+			}
+			for _, server := range b.Servers {
+				if _, err := tx.ExecContext(a.Context, insertServer, id, server); err != nil {
+					return fmt.Errorf("add build server %s: %w", b.Hash, err)
+				}
+			}
+			if added != 0 {
+				n, err := a.queryInt(tx, `SELECT count(*) FROM build_servers WHERE build == ?`, id)
+				if err != nil {
+					return fmt.Errorf("count build servers %s: %w", b.Hash, err)
+				}
+				if n == 0 {
+					stats.Unlinked++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := tx.Commit(); err != nil {
+		return stats, fmt.Errorf("commit transaction: %w", err)
+	}
+	return stats, nil
+}
+// FetchBuilds downloads and scans the DeployHistory file from each server in
+// a database and inserts any new builds into the database.
+//
+// If the history file of a server that has served builds is no longer found,
+// then the server is marked as deprecated, and an alert is logged. Files from
+// deprecated servers are fetched by FetchContent before other files, while
+// they may still be available. A server whose history file is found again is
+// no longer deprecated.
+//
+// Servers whose URLs are in exclude are skipped, such as servers owned by
+// another archive of a workspace.
+func (a Action) FetchBuilds(db *sql.DB, f *fetch.Fetcher, file string, exclude []string) error {
+	servers, err := a.GetServers(db)
+	if err != nil {
+		return fmt.Errorf("get servers: %w", err)
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, server := range exclude {
+		excluded[sanitizeBaseURL(server)] = true
+	}
+	for _, server := range servers {
+		if excluded[sanitizeBaseURL(server)] {
+			continue
+		}
+		stream, err := f.FetchDeployHistory(a.Context, buildFileURL(server, "", file))
+		if err != nil {
+			if serr := (*fetch.StatusError)(nil); errors.As(err, &serr) && serr.Gone() {
+				if err := a.deprecateServer(db, server, serr.StatusCode); err != nil {
+					return fmt.Errorf("deprecate server: %w", err)
+				}
+			}
+			log.Printf("get deploy history: %s", err)
+			continue
+		}
+		if err := a.restoreServer(db, server); err != nil {
+			return fmt.Errorf("restore server: %w", err)
+		}
+		tx, err := db.BeginTx(a.Context, nil)
+		if err != nil {
+			return err
+		}
+		var history []Build
+		for _, token := range stream {
+			if job, ok := token.(*histlog.Job); ok {
+				history = append(history, Build{
+					Hash:    job.Hash,
+					Type:    job.Build,
+					Time:    job.Time.Unix(),
+					Version: job.Version.String(),
+				})
+			}
+		}
+		builds := append([]Build(nil), history...)
+		sort.Slice(builds, func(i, j int) bool {
+			return builds[i].Hash < builds[j].Hash
+		})
+		j := 0
+		for i := 1; i < len(builds); i++ {
+			if builds[j] != builds[i] {
+				j++
+				builds[j] = builds[i]
+			}
+		}
+		builds = builds[:j+1]
+		count := 0
+		linked := 0
+		for _, build := range builds {
+			if err := a.AddBuild(tx, server, build); err != nil {
+				if serr := (sqlite3.Error{}); errors.As(err, &serr) && serr.Code == sqlite3.ErrConstraint {
+					// The build is already known, such as from another
+					// channel to which it was deployed first.
+					ok, err := a.LinkBuild(tx, server, build.Hash)
+					if err != nil {
+						tx.Rollback()
+						return fmt.Errorf("link build %s: %w", build.Hash, err)
+					}
+					if ok {
+						linked++
+					}
+					continue
+				}
+				tx.Rollback()
+				return fmt.Errorf("add build %s: %w", build.Hash, err)
+			}
+			count++
+		}
+		anomalies, err := a.addAnomalies(tx, server, history)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("add anomalies: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("commit tx: %s", err)
+			continue
+		}
+		log.Printf("add %d new builds from %s", count, server)
+		if linked > 0 {
+			log.Printf("found %d known builds newly present on %s", linked, server)
+		}
+		if anomalies > 0 {
+			log.Printf("found %d new anomalies in the history of %s", anomalies, server)
+		}
+	}
+	return nil
+}
+
+// Kinds of anomalies found in the history file of a server.
+const (
+	// A build has the same type and version as a build with a different hash.
+	AnomalyDuplicateVersion = "duplicate-version"
+	// A build was created before the build preceding it in the history.
+	AnomalyTimeBackwards = "time-backwards"
+	// A build previously found in the history is no longer listed.
+	AnomalyDisappeared = "disappeared"
+)
+
+// findAnomalies returns the anomalies within a history, given as a list of
+// builds in the order they appear. Each build has at most one anomaly of each
+// kind.
+func findAnomalies(history []Build) (anomalies []Anomaly) {
+	type typeVersion struct{ typ, version string }
+	hashes := map[typeVersion][]string{}
+	for _, build := range history {
+		key := typeVersion{build.Type, build.Version}
+		if !containsString(hashes[key], build.Hash) {
+			hashes[key] = append(hashes[key], build.Hash)
+		}
+	}
+	type hashKind struct{ hash, kind string }
+	reported := map[hashKind]bool{}
+	report := func(anomaly Anomaly) {
+		key := hashKind{anomaly.Hash, anomaly.Kind}
+		if !reported[key] {
+			reported[key] = true
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	for i, build := range history {
+		if others := hashes[typeVersion{build.Type, build.Version}]; len(others) > 1 {
+			var list []string
+			for _, hash := range others {
+				if hash != build.Hash {
+					list = append(list, hash)
+				}
+			}
+			report(Anomaly{
+				Build:  build,
+				Kind:   AnomalyDuplicateVersion,
+				Detail: fmt.Sprintf("version %s is also used by %s", build.Version, strings.Join(list, ", ")),
+			})
+		}
+		if i > 0 && build.Time < history[i-1].Time {
+			prev := history[i-1]
+			report(Anomaly{
+				Build: build,
+				Kind:  AnomalyTimeBackwards,
+				Detail: fmt.Sprintf("created %s, before the preceding %s created %s",
+					time.Unix(build.Time, 0).UTC().Format("2006-01-02 15:04:05"),
+					prev.Hash,
+					time.Unix(prev.Time, 0).UTC().Format("2006-01-02 15:04:05"),
+				),
+			})
+		}
+	}
+	return anomalies
+}
+
+// containsString returns whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// addAnomalies records the anomalies found in the history of a server, along
+// with builds of the server that are no longer listed in the history. Builds
+// of the history must already be in the database. Anomalies already recorded
+// are not recorded again. Returns the number of new anomalies.
+func (a Action) addAnomalies(e Executor, server string, history []Build) (n int, err error) {
+	if len(history) == 0 {
+		// An empty history is more likely to be broken than to have lost
+		// every build.
+		return 0, nil
+	}
+	anomalies := findAnomalies(history)
+
+	listed := make(map[string]bool, len(history))
+	for _, build := range history {
+		listed[build.Hash] = true
+	}
+	const query = `
+		SELECT builds.hash FROM builds, build_servers, servers
+		WHERE builds.rowid == build_servers.build
+		AND build_servers.server == servers.rowid
+		AND servers.url == ?
+		ORDER BY builds.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, server)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !listed[hash] {
+			anomalies = append(anomalies, Anomaly{
+				Build:  Build{Hash: hash},
+				Kind:   AnomalyDisappeared,
+				Detail: "no longer listed in the history of " + server,
+			})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	const insert = `
+		INSERT OR IGNORE INTO anomalies (server, build, kind, detail, time)
+		SELECT servers.rowid, builds.rowid, ?, ?, ? FROM servers, builds
+		WHERE servers.url == ? AND builds.hash == ?
+	`
+	now := time.Now().Unix()
+	for _, anomaly := range anomalies {
+		result, err := e.ExecContext(a.Context, insert, anomaly.Kind, anomaly.Detail, now, server, anomaly.Hash)
+		if err != nil {
+			return n, fmt.Errorf("%s %s: %w", anomaly.Kind, anomaly.Hash, err)
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			log.Printf("anomaly: %s: %s: %s", anomaly.Kind, anomaly.Hash, anomaly.Detail)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Anomaly is an oddity found in the history file of a server.
+type Anomaly struct {
+	// Rowid of the anomaly.
+	ID int64
+	// Server whose history has the anomaly.
+	Server string
+	// Build having the anomaly.
+	Build
+	// Kind of anomaly, one of the Anomaly constants.
+	Kind string
+	// Description of the anomaly.
+	Detail string
+	// When the anomaly was detected.
+	Time int64
+	// Whether the anomaly has been reviewed.
+	Reviewed bool
+}
+
+// Anomalies returns the recorded anomalies, ordered by the creation time of
+// their builds. If all is false, then only anomalies that have not been
+// reviewed are returned.
+func (a Action) Anomalies(e Executor, all bool) (anomalies []Anomaly, err error) {
+	const query = `
+		SELECT
+			anomalies.rowid,
+			servers.url,
+			builds.hash,
+			builds.type,
+			builds.time,
+			builds.version,
+			anomalies.kind,
+			anomalies.detail,
+			anomalies.time,
+			anomalies.reviewed
+		FROM anomalies, servers, builds
+		WHERE servers.rowid == anomalies.server
+		AND builds.rowid == anomalies.build
+		AND (? OR NOT anomalies.reviewed)
+		ORDER BY builds.time, anomalies.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var anomaly Anomaly
+		if err := rows.Scan(
+			&anomaly.ID,
+			&anomaly.Server,
+			&anomaly.Hash,
+			&anomaly.Type,
+			&anomaly.Build.Time,
+			&anomaly.Version,
+			&anomaly.Kind,
+			&anomaly.Detail,
+			&anomaly.Time,
+			&anomaly.Reviewed,
+		); err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+	return anomalies, rows.Err()
+}
+
+// ReviewAnomalies marks the anomalies of the given rowids as reviewed. Returns
+// the number of anomalies that were marked.
+func (a Action) ReviewAnomalies(e Executor, ids []int64) (n int, err error) {
+	for _, id := range ids {
+		result, err := e.ExecContext(a.Context, `UPDATE anomalies SET reviewed = 1 WHERE rowid == ? AND NOT reviewed`, id)
+		if err != nil {
+			return n, err
+		}
+		rows, _ := result.RowsAffected()
+		n += int(rows)
+	}
+	return n, nil
+}
+
+// GenerateFiles inserts into a database combinations of build hashes and file
+// names that aren't already present. Files are added with the Unchecked flags.
+//
+// Names of the TierAlways tier are combined with every build. Names of the
+// TierRecent tier are combined only with builds created at or after
+// recentSince, a Unix timestamp. Names of the TierManual tier are combined only
+// with the builds whose manifests list them, as recorded in manifest_names.
+func (a Action) GenerateFiles(e Executor, recentSince int64) (newRows int, err error) {
+	// Insert into files all combinations of builds and filenames that aren't
+	// already in files. Slower: Cut `OR IGNORE` and append `EXCEPT SELECT
+	// build, filename FROM files`.
+	const query = `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT builds.rowid, filenames.rowid FROM filenames, builds
+		WHERE filenames.tier == ?
+		OR (filenames.tier == ? AND builds.time >= ?)
+	`
+	const manifestQuery = `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT manifest_names.build, filenames.rowid FROM manifest_names, filenames
+		WHERE manifest_names.name == filenames.name
+		AND filenames.tier == ?
+	`
+	err = a.track(e, []string{"files"}, func() (err error) {
+		result, err := e.ExecContext(a.Context, query, TierAlways, TierRecent, recentSince)
+		if err != nil {
+			return err
+		}
+		rows, _ := result.RowsAffected()
+		newRows += int(rows)
+		if result, err = e.ExecContext(a.Context, manifestQuery, TierManual); err != nil {
+			return err
+		}
+		rows, _ = result.RowsAffected()
+		newRows += int(rows)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newRows, err
+}
+
+// AddManifestNames records that the manifest of each build lists each of the
+// given names, mapped to the hashes of the builds. Builds that are not in the
+// database are ignored.
+func (a Action) AddManifestNames(e Executor, names map[string][]string) error {
+	const query = `
+		INSERT OR IGNORE INTO manifest_names (build, name)
+		SELECT rowid, ? FROM builds WHERE hash == ?
+	`
+	return a.track(e, []string{"manifest_names"}, func() error {
+		for name, builds := range names {
+			for _, build := range builds {
+				if _, err := e.ExecContext(a.Context, query, name, build); err != nil {
+					return fmt.Errorf("add manifest name %s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GenerateFilename inserts into a database the files of the given name for
+// each build created at or after since, a Unix timestamp, regardless of the
+// tier of the name. The name must already be present.
+func (a Action) GenerateFilename(e Executor, name string, since int64) (newRows int, err error) {
+	const query = `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT builds.rowid, filenames.rowid FROM filenames, builds
+		WHERE filenames.name == ?
+		AND builds.time >= ?
+	`
+	var result sql.Result
+	err = a.track(e, []string{"files"}, func() (err error) {
+		result, err = e.ExecContext(a.Context, query, name, since)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result != nil {
+		rows, _ := result.RowsAffected()
+		newRows = int(rows)
+	}
+	return newRows, err
+}
+
+// GenerateCompanions inserts into a database the companion files of each file
+// that exists. The name of a companion is the name of its base file appended
+// with one of the given suffixes, such as ".sig". Companions are linked to
+// their base files in the companions table. Names of companions are added with
+// the TierManual tier, so that they are not combined with every build.
+//
+// A companion is not itself given companions.
+func (a Action) GenerateCompanions(e Executor, suffixes []string) (newRows int, err error) {
+	// Existing files that are not companions, and whose names do not already
+	// have the suffix.
+	bases := `
+		files.filename == b.rowid
+		AND ` + flagsSet("files.flags", Exists) + `
+		AND files.rowid NOT IN (SELECT file FROM companions)
+		AND b.name NOT LIKE '%' || ?1
+	`
+	addNames := `
+		INSERT OR IGNORE INTO filenames (name, tier)
+		SELECT DISTINCT b.name || ?1, ?2
+		FROM files, filenames AS b
+		WHERE ` + bases
+	addFiles := `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT files.build, c.rowid
+		FROM files, filenames AS b, filenames AS c
+		WHERE ` + bases + `
+		AND c.name == b.name || ?1
+	`
+	link := `
+		INSERT OR IGNORE INTO companions (file, base)
+		SELECT f.rowid, files.rowid
+		FROM files, filenames AS b, filenames AS c, files AS f
+		WHERE ` + bases + `
+		AND c.name == b.name || ?1
+		AND f.filename == c.rowid
+		AND f.build == files.build
+	`
+	err = a.track(e, []string{"filenames", "files"}, func() error {
+		for _, suffix := range suffixes {
+			if suffix == "" {
+				continue
+			}
+			if _, err := e.ExecContext(a.Context, addNames, suffix, TierManual); err != nil {
+				return fmt.Errorf("add %s names: %w", suffix, err)
+			}
+			result, err := e.ExecContext(a.Context, addFiles, suffix)
+			if err != nil {
+				return fmt.Errorf("add %s files: %w", suffix, err)
+			}
+			rows, _ := result.RowsAffected()
+			newRows += int(rows)
+			if _, err := e.ExecContext(a.Context, link, suffix); err != nil {
+				return fmt.Errorf("link %s files: %w", suffix, err)
+			}
+		}
+		return nil
+	})
+	return newRows, err
+}
+
+const DefaultBatchSize = 256
+
+// DefaultMaxErrorRate is the default fraction of files in a batch that may fail
+// before FetchContent is aborted.
+const DefaultMaxErrorRate = 0.1
+
+func getHeader(headers http.Header, key string, typ int) interface{} {
+	v := headers.Get(key)
+	if v == "" {
+		return nil
+	}
+	switch typ {
+	case 0:
+		return v
+	case 1:
+		n, err := strconv.ParseInt(v, 10, 63)
+		if err != nil {
+			return nil
+		}
+		return n
+	case 2:
+		t, err := time.Parse(time.RFC1123, v)
+		if err != nil {
+			return nil
+		}
+		return t.Unix()
+	}
+	return nil
+}
+
+func isDir(path string) error {
+	if stat, err := os.Lstat(path); os.IsNotExist(err) {
+		return err
+	} else if !stat.IsDir() {
+		return fmt.Errorf("%s: not a directory", path)
+	}
+	return nil
+}
+
+type reqEntry struct {
+	id     int
+	flags  int
+	server string
+	build  string
+	file   string
+
+	// Headers of the previous response for the file, when revalidating.
+	etag         sql.NullString
+	lastModified sql.NullInt64
+}
+
+// validators returns the validators with which the request for the file is
+// made conditional. Content that must be downloaded is requested
+// unconditionally.
+func (req *reqEntry) validators(opts *FetchOptions) (v fetch.Validators) {
+	if !opts.Revalidate || FileFlags(req.flags)&(Exists|HasHeaders|NotFound) != Exists|HasHeaders {
+		return v
+	}
+	if opts.ObjectsPath != "" && FileFlags(req.flags)&HasContent == 0 {
+		return v
+	}
+	if req.etag.Valid {
+		v.ETag = req.etag.String
+	}
+	if req.lastModified.Valid {
+		v.LastModified = time.Unix(req.lastModified.Int64, 0)
+	}
+	return v
+}
+
+// Combination of extra queries to make.
+const (
+	qHeaders      = 1 << iota // Upsert all headers.
+	qHeaderStatus             // Upsert just the status header.
+	qMetadata                 // Upsert metadata.
+)
+
+// provenanceHeaders is a list of headers that are stored in the header_fields
+// table.
+var provenanceHeaders = []string{
+	"content-md5",
+	"server",
+	"via",
+	"x-amz-version-id",
+}
+
+// provenancePrefixes is a list of header prefixes. Headers with these prefixes
+// are stored in the header_fields table.
+var provenancePrefixes = []string{
+	"x-amz-meta-",
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// provenanceFields returns the provenance headers present in headers, sorted by
+// name. Headers in extra are included in addition to provenanceHeaders.
+func provenanceFields(headers http.Header, extra []string) (fields []headerField) {
+	add := func(name string, values []string) {
+		fields = append(fields, headerField{
+			name:  strings.ToLower(name),
+			value: strings.Join(values, ", "),
+		})
+	}
+	seen := map[string]bool{}
+	for _, list := range [][]string{provenanceHeaders, extra} {
+		for _, name := range list {
+			key := http.CanonicalHeaderKey(name)
+			if values := headers[key]; len(values) > 0 && !seen[key] {
+				seen[key] = true
+				add(key, values)
+			}
+		}
+	}
+	for key, values := range headers {
+		if seen[key] {
+			continue
+		}
+		for _, prefix := range provenancePrefixes {
+			if strings.HasPrefix(strings.ToLower(key), prefix) {
+				seen[key] = true
+				add(key, values)
+				break
+			}
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	return fields
+}
+
+type respEntry struct {
+	err error
+
+	// Whether the file was skipped, leaving it unmodified.
+	skip bool
+	// Whether the server reported that the content of the file has not
+	// changed since it was last fetched, leaving the file unmodified.
+	unchanged bool
+	// If not OtherError, the file was skipped because its server could not
+	// be reached.
+	failure    fetch.ErrorKind
+	failureErr error
+
+	id      int
+	flags   FileFlags
+	qAction int
+
+	// headers
+	respStatus    int
+	contentLength sql.NullInt64
+	lastModified  sql.NullInt64
+	contentType   sql.NullString
+	etag          sql.NullString
+	fields        []headerField
+	finalURL      sql.NullString
+	redirects     int
+
+	// metadata
+	hash       string
+	size       int64
+	sha256     sql.NullString
+	storedSize sql.NullInt64
+
+	// If true, then the content did not match the Content-Length of the
+	// response, and was accepted.
+	lengthMismatch bool
+
+	// If not empty, the hash of the existing object with which the content
+	// was compared instead of being downloaded, and whether it matched.
+	verified      string
+	verifiedMatch bool
+
+	// Whether the content was not downloaded, because an object of its hash
+	// already existed.
+	reused bool
+}
+
+// applyFlags returns the given flags of a file, updated according to the
+// response of the request for the file.
+func (entry *respEntry) applyFlags(flags FileFlags) FileFlags {
+	if 200 <= entry.respStatus && entry.respStatus < 300 {
+		flags |= Exists | HasHeaders
+		flags &^= NotFound
+		if entry.qAction&qMetadata != 0 {
+			flags |= HasMetadata | HasContent
+		}
+		return flags
+	}
+	flags |= NotFound
+	if entry.qAction&qHeaderStatus != 0 {
+		flags |= HasHeaders
+	}
+	return flags
+}
+
+// share returns the response of a request that was made for another row, as
+// the response for the row of req, which resolves to the same URL.
+func (entry respEntry) share(req *reqEntry) respEntry {
+	if entry.skip {
+		return entry
+	}
+	entry.id = req.id
+	if entry.unchanged {
+		return entry
+	}
+	if entry.err == nil {
+		entry.flags = entry.applyFlags(FileFlags(req.flags))
+	}
+	// The content was downloaded at most once, for the other row.
+	entry.reused = true
+	return entry
+}
+
+// verifySkipped compares the first and last n bytes of the content at url with
+// those of the object of hash within objpath, having the given size. Returns
+// whether they match.
+func verifySkipped(ctx context.Context, f *fetch.Fetcher, url, objpath, hash string, size, n int64) (match bool, err error) {
+	if size == 0 {
+		// A range cannot be requested from empty content.
+		return true, nil
+	}
+	spans := [][2]int64{{0, n}, {size - n, n}}
+	if size <= 2*n {
+		spans = [][2]int64{{0, size}}
+	}
+	file, err := objects.Open(objpath, hash)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	// A compressed object cannot be read at an offset, so it is read through
+	// to each span instead.
+	var pos int64
+	for _, span := range spans {
+		remote, err := f.FetchSpan(ctx, url, span[0], span[1])
+		if err != nil {
+			return false, err
+		}
+		local := make([]byte, span[1])
+		if ra, ok := file.(io.ReaderAt); ok {
+			_, err = ra.ReadAt(local, span[0])
+		} else if _, err = io.CopyN(ioutil.Discard, file, span[0]-pos); err == nil {
+			_, err = io.ReadFull(file, local)
+			pos = span[0] + span[1]
+		}
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(remote, local) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// etagFormat returns the format of an ETag, as stored in the headers table.
+func etagFormat(etag string) sql.NullString {
+	_, format := objects.ParseETag(etag)
+	return sql.NullString{String: string(format), Valid: format != ""}
+}
+
+func runFetchContentWorker(ctx context.Context, wg *sync.WaitGroup, f *fetch.Fetcher, opts *FetchOptions, req *reqEntry, entry *respEntry) {
+	defer wg.Done()
+	*entry = respEntry{}
+	objpath := opts.ObjectsPath
+	object := objects.NewWriter(objpath)
+	var hashes *fetch.HashStore
+	if objpath != "" {
+		hashes = &fetch.HashStore{}
+		object.UseIndex(opts.ObjectsIndex)
+		object.UseCompression(opts.Compress)
+		object.UseJournal(opts.journal)
+	}
+	// Whether the download was skipped because the object named by the hash
+	// of the response already exists, and the size of the object if it was
+	// found in opts.Storage. Content that is downloaded is always written
+	// through object, even if it is empty.
+	found := false
+	storedSize := int64(-1)
+	stored := func(hash string) bool {
+		if objects.Exists(objpath, hash) {
+			found = true
+			return true
+		}
+		if opts.Storage != nil {
+			if size, err := opts.Storage.Stat(ctx, hash); err == nil {
+				found = true
+				storedSize = size
+				return true
+			}
+		}
+		return false
+	}
+	url := buildFileURL(req.server, req.build, req.file)
+	respStatus, headers, loc, err := f.FetchChanged(ctx, url, req.validators(opts), stored, hashes, object.AsWriter())
+	if err != nil {
+		if errors.Is(err, fetch.ErrCircuitOpen) {
+			// Requests to the host are suspended, so the file is left
+			// unmodified for a later run.
+			object.Remove()
+			*entry = respEntry{skip: true, failureErr: err}
+			return
+		}
+		if kind := fetch.ClassifyError(err); kind != fetch.OtherError {
+			// The server is unreachable rather than the file missing, so the
+			// file is left unmodified.
+			object.Remove()
+			*entry = respEntry{skip: true, failure: kind, failureErr: err}
+			return
+		}
+		object.Remove()
+		*entry = respEntry{id: req.id, err: fmt.Errorf("fetch content: %w", err)}
+		return
+	}
+	entry.id = req.id
+	entry.respStatus = respStatus
+	if respStatus == http.StatusNotModified && req.validators(opts) != (fetch.Validators{}) {
+		// The stored headers and content remain current.
+		object.Remove()
+		entry.unchanged = true
+		log.Printf("fetch %-9s from %s-%s (%d)", "Unchanged", req.build, req.file, req.id)
+		return
+	}
+	skipped := false
+	if 200 <= respStatus && respStatus < 300 {
+		entry.qAction |= qHeaders
+		if v, err := strconv.ParseInt(headers.Get("content-length"), 10, 64); err == nil {
+			entry.contentLength.Valid = true
+			entry.contentLength.Int64 = v
+		}
+		if v, err := time.Parse(time.RFC1123, headers.Get("last-modified")); err == nil {
+			entry.lastModified.Valid = true
+			entry.lastModified.Int64 = v.Unix()
+		}
+		if v := headers.Get("content-type"); v != "" {
+			entry.contentType.Valid = true
+			entry.contentType.String = v
+		}
+		if v := headers.Get("etag"); v != "" {
+			entry.etag.Valid = true
+			entry.etag.String = v
+		}
+		entry.fields = provenanceFields(headers, opts.ProvenanceHeaders)
+		entry.redirects = loc.Redirects
+		if loc.Redirects > 0 {
+			entry.finalURL.Valid = true
+			entry.finalURL.String = loc.URL
+		}
+		if object != nil {
+			var size int64
+			var hash string
+			var stat os.FileInfo
+			if found {
+				stat = objects.Stat(objpath, f.ContentHash(headers))
+				if stat == nil && storedSize < 0 && opts.Storage != nil {
+					// The object may have been moved to storage by a commit
+					// after it was found in the objects path.
+					if size, err := opts.Storage.Stat(ctx, f.ContentHash(headers)); err == nil {
+						storedSize = size
+					}
+				}
+				if stat == nil && storedSize < 0 {
+					object.Remove()
+					*entry = respEntry{id: req.id, err: fmt.Errorf("object %s of %s-%s removed while fetching", f.ContentHash(headers), req.build, req.file)}
+					return
+				}
+			}
+			if stat != nil && opts.index != nil {
+				if err := opts.index.Check(stat.Name(), stat); errors.Is(err, objects.ErrMismatch) {
+					// The object is damaged. Remove it so that the file is
+					// downloaded again by the next run.
+					object.Remove()
+					objects.Remove(objpath, stat.Name())
+					*entry = respEntry{id: req.id, err: fmt.Errorf("object %s of %s-%s removed: %w", stat.Name(), req.build, req.file, err)}
+					return
+				}
+			}
+			if stat != nil && opts.VerifySkipped > 0 {
+				name := strings.ToLower(stat.Name())
+				match, err := verifySkipped(ctx, f, url, objpath, name, stat.Size(), opts.VerifySkipped)
+				if err != nil {
+					object.Remove()
+					*entry = respEntry{id: req.id, err: fmt.Errorf("verify skipped %s-%s: %w", req.build, req.file, err)}
+					return
+				}
+				entry.verified = name
+				entry.verifiedMatch = match
+				if !match {
+					// Either the hash does not identify the content, or the
+					// object is damaged. A damaged object is removed so that
+					// it is replaced by the downloaded content.
+					log.Printf("ALERT: content of %s-%s does not match object %s", req.build, req.file, name)
+					if ok, err := objects.Verify(objpath, name); err == nil && !ok {
+						log.Printf("object %s is damaged; removed to be replaced", name)
+						objects.Remove(objpath, name)
+					}
+					if _, _, _, err := f.FetchContent(ctx, url, nil, nil, object.AsWriter()); err != nil {
+						object.Remove()
+						*entry = respEntry{id: req.id, err: fmt.Errorf("fetch content: %w", err)}
+						return
+					}
+					stat, found = nil, false
+				}
+			}
+			if stat != nil {
+				// File exists. The object was not written to, so reuse metadata
+				// from the file.
+				size = stat.Size()
+				hash = strings.ToLower(stat.Name())
+				object.Remove()
+				skipped = true
+			} else if found {
+				// The object was moved to storage. Its content is not read
+				// again, so it is not verified.
+				size = storedSize
+				hash = strings.ToLower(f.ContentHash(headers))
+				object.Remove()
+				skipped = true
+			} else {
+				// The content was downloaded. Empty content resolves to
+				// EmptyHash, and an object placed by another writer in the
+				// meantime is handled by Close.
+				expected := entry.contentLength.Int64
+				if entry.contentLength.Valid {
+					if opts.LengthMismatch == RetryLength {
+						for i := 0; i < lengthRetries && object.Size() < expected; i++ {
+							if err := f.FetchRange(ctx, url, object.Size(), object); err != nil {
+								log.Printf("resume %s-%s: %s", req.build, req.file, err)
+								break
+							}
+						}
+					}
+					if opts.LengthMismatch != AcceptLength {
+						object.ExpectSize(expected)
+					}
+				}
+				if size, hash, err = object.Close(); err != nil {
+					*entry = respEntry{id: req.id, err: fmt.Errorf("close object %s-%s: %w", req.build, req.file, err)}
+					return
+				}
+				entry.sha256 = sql.NullString{String: object.SHA256(), Valid: true}
+				if entry.contentLength.Valid && size != expected {
+					log.Printf("accepted %s-%s: expected %d bytes, got %d", req.build, req.file, expected, size)
+					entry.lengthMismatch = true
+				}
+			}
+			if skipped && opts.index != nil {
+				// The content was not read, but the index of the existing
+				// object may have its SHA-256 hash.
+				if e, ok, _ := opts.index.Lookup(hash); ok && e.SHA256 != "" {
+					entry.sha256 = sql.NullString{String: e.SHA256, Valid: true}
+				}
+			}
+			if stat := objects.Stat(objpath, hash); stat != nil && objects.IsCompressed(stat) {
+				entry.storedSize = sql.NullInt64{Int64: objects.StoredSize(stat), Valid: true}
+			}
+			entry.qAction |= qMetadata
+			entry.hash = hash
+			entry.size = size
+			entry.reused = skipped
+		}
+	} else {
+		object.Remove()
+		// 403 is expected if the file is not found. Most file combinations will
+		// be this, and the status is already indicated by the NotFound flag, so
+		// avoid adding to headers table to save space.
+		if respStatus != 403 {
+			// Log unexpected status in headers for manual review.
+			entry.qAction |= qHeaderStatus
+		}
+	}
+	entry.flags = entry.applyFlags(FileFlags(req.flags))
+	if object != nil {
+		var skip string
+		if skipped {
+			skip = "S"
+		}
+		log.Printf("fetch %-9s %32s %1s from %s-%s (%d)", entry.flags.Progress(), entry.hash, skip, req.build, req.file, req.id)
+		return
+	}
+	log.Printf("fetch %-9s from %s-%s (%d)", entry.flags.Progress(), req.build, req.file, req.id)
+}
+
+type Stats map[int]int
+
+func (stats Stats) String() string {
+	list := make([]int, 0, len(stats))
+	for s := range stats {
+		if s != 0 {
+			list = append(list, s)
+		}
+	}
+	sort.Ints(list)
+	var b strings.Builder
+	for _, s := range list {
+		fmt.Fprintf(&b, "status %d returned by %d files\n", s, stats[s])
+	}
+	return b.String()
+}
+
+// FetchOptions configures the behavior of FetchContent.
+type FetchOptions struct {
+	// Location of objects. If not empty, then the entire file is downloaded to
+	// this directory. Otherwise, just the headers are retrieved.
+	ObjectsPath string
+	// Filter applied when selecting files.
+	Query filters.Query
+	// If true, then files with the NotFound flag set are also included.
+	Recheck bool
+	// If true, then files that were found are also included, and the request
+	// for each is made conditional on the headers of the previous response. A
+	// file whose content has not changed is left unmodified. Content that has
+	// not been downloaded is requested unconditionally.
+	Revalidate bool
+	// If true, then only NoContent files are selected; files that have
+	// headers and metadata, but whose content has gone missing. Variants of
+	// alias groups are not skipped. Requires ObjectsPath.
+	NoContent bool
+	// How many files are processed before committing to the database. A value
+	// of 0 or less uses DefaultBatchSize.
+	BatchSize int
+	// If true, then every variant of an alias group is downloaded, rather
+	// than just the first variant found for a build.
+	AllVariants bool
+	// Headers to store in the header_fields table, in addition to
+	// provenanceHeaders.
+	ProvenanceHeaders []string
+	// Fraction of files in a batch that may fail before the run is aborted.
+	// A value of 0 or less uses DefaultMaxErrorRate.
+	MaxErrorRate float64
+	// How a mismatch between the Content-Length of a response and the content
+	// received is handled.
+	LengthMismatch LengthPolicy
+	// If true, then objects are recorded in the index of their directory, and
+	// existing objects are checked against the index before being reused.
+	ObjectsIndex bool
+	// If true, then objects are compressed with zstd as they are written.
+	Compress bool
+	// If greater than 0, then when a download is skipped because the object
+	// named by the hash of the response exists, this many bytes at the start
+	// and end of the content are requested and compared with the object. If
+	// they differ, then the content is downloaded after all.
+	VerifySkipped int64
+	// If not nil, called as the run progresses.
+	Progress func(Progress)
+	// If not nil, the time spent in each phase of the run is added to Timing.
+	Timing *phaseTimes
+	// If not nil, then the content of committed files is counted, by whether
+	// it was downloaded or reused from an existing object.
+	Dedup *DedupStats
+	// If true, then the files in the selected_files table are fetched from
+	// their selected servers, regardless of flags and filters. See
+	// LoadSelection.
+	FromSelection bool
+	// If true, then the pending files of the fetch_queue table are fetched
+	// from their queued servers, regardless of flags and filters, and the
+	// state of each file in the queue is updated as it is fetched and
+	// committed. See FillQueue.
+	Queue bool
+	// URLs of servers from which files are not fetched, such as servers owned
+	// by another archive of a workspace. Applies to every selection.
+	ExcludeServers []string
+	// If not nil, called after each batch is committed. Files added to the
+	// database at this point are included in the remainder of the run. An
+	// error aborts the run.
+	BetweenBatches func() error
+	// If not nil, then objects are moved from ObjectsPath to Storage once
+	// each batch is committed, and a download is also skipped if the object
+	// named by the hash of the response exists in Storage. Requires
+	// ObjectsPath, which then holds only the objects of batches that have not
+	// been committed.
+	Storage objects.Storage
+
+	// Index of ObjectsPath, shared between workers.
+	index *objects.Index
+	// Journal of ObjectsPath, shared between workers.
+	journal *objects.Journal
+	// If true, only files from deprecated servers are selected.
+	deprecated bool
+}
+
+// LengthPolicy determines how a mismatch between the Content-Length header of a
+// response and the number of bytes received is handled. Some servers report
+// an incorrect length for valid content.
+type LengthPolicy int
+
+const (
+	// The file fails with an error, and is left unmodified.
+	RejectLength LengthPolicy = iota
+	// The content is accepted, and the mismatch is recorded in the
+	// length_mismatches table.
+	AcceptLength
+	// Content that ended early is requested again with Range requests. The
+	// file fails if the content remains incomplete.
+	RetryLength
+)
+
+// lengthRetries is the number of Range requests made under RetryLength.
+const lengthRetries = 3
+
+// ParseLengthPolicy parses one of "reject", "accept", or "retry". An empty
+// string returns RejectLength.
+func ParseLengthPolicy(s string) (LengthPolicy, error) {
+	switch s {
+	case "", "reject":
+		return RejectLength, nil
+	case "accept":
+		return AcceptLength, nil
+	case "retry":
+		return RetryLength, nil
+	}
+	return RejectLength, fmt.Errorf("unknown length mismatch policy %q", s)
+}
+
+// Progress describes the progress of a FetchContent run.
+type Progress struct {
+	// The stage of the run: "fetch" when a batch begins fetching, "commit"
+	// when a batch has been committed, and "done" when the run has finished.
+	Phase string `json:"phase"`
+	// The current batch, starting at 1.
+	Batch int `json:"batch"`
+	// Number of files being fetched in the current batch.
+	Fetching int `json:"fetching"`
+	// Total number of files committed.
+	Committed int `json:"committed"`
+	// Total number of files that failed.
+	Failed int `json:"failed"`
+	// Total number of bytes of content downloaded.
+	Bytes int64 `json:"bytes"`
+	// Total number of files whose content was reused from an existing object
+	// instead of being downloaded.
+	Reused int `json:"reused"`
+}
+
+// DedupStats counts the content of files committed by FetchContent, by whether
+// it was downloaded, or reused because an object with the same hash already
+// existed.
+type DedupStats struct {
+	Downloaded      int
+	DownloadedBytes int64
+	Reused          int
+	ReusedBytes     int64
+}
+
+// add counts the content of a committed file.
+func (s *DedupStats) add(entry respEntry) {
+	if entry.qAction&qMetadata == 0 {
+		return
+	}
+	if entry.reused {
+		s.Reused++
+		s.ReusedBytes += entry.size
+	} else {
+		s.Downloaded++
+		s.DownloadedBytes += entry.size
+	}
+}
+
+// merge adds the counts of t to s.
+func (s *DedupStats) merge(t DedupStats) {
+	s.Downloaded += t.Downloaded
+	s.DownloadedBytes += t.DownloadedBytes
+	s.Reused += t.Reused
+	s.ReusedBytes += t.ReusedBytes
+}
+
+func (s *DedupStats) String() string {
+	var rate float64
+	if total := s.Downloaded + s.Reused; total > 0 {
+		rate = float64(s.Reused) / float64(total) * 100
+	}
+	return fmt.Sprintf("downloaded %d files (%d bytes), reused %d existing objects (%d bytes), %.1f%% deduplicated",
+		s.Downloaded, s.DownloadedBytes, s.Reused, s.ReusedBytes, rate)
+}
+
+// selectFiles returns a query that selects from files, joined with the builds
+// and servers from which they are available. Filter variables refer to columns
+// of joined tables through aliases. The servers and filenames tables are joined
+// by joinServers and joinFilenames.
+func selectFiles() *selectQuery {
+	return (&selectQuery{}).
+		From("files").
+		From("builds").
+		From("build_servers").
+		Where("files.build == builds.rowid").
+		Where("files.build == build_servers.build")
+}
+
+// joinServers joins the servers table to a query from selectFiles.
+func joinServers(q *selectQuery) *selectQuery {
+	return q.From("servers").Where("build_servers.server == servers.rowid")
+}
+
+// joinFilenames joins the filenames table to a query from selectFiles.
+func joinFilenames(q *selectQuery) *selectQuery {
+	return q.From("filenames").Where("files.filename == filenames.rowid")
+}
+
+// selection adds to q, a query from selectFiles, the conditions that select the
+// files to be fetched according to the options.
+func (opts FetchOptions) selection(q *selectQuery) {
+	if len(opts.ExcludeServers) > 0 {
+		params := make([]interface{}, len(opts.ExcludeServers))
+		for i, server := range opts.ExcludeServers {
+			params[i] = sanitizeBaseURL(server)
+		}
+		q.Where("build_servers.server NOT IN (SELECT rowid FROM servers WHERE rtrim(url, '/') IN ("+
+			strings.TrimSuffix(strings.Repeat("?,", len(params)), ",")+"))", params...)
+	}
+	if opts.FromSelection {
+		q.Where(`EXISTS (
+			SELECT 1 FROM selected_files
+			WHERE selected_files.file == files.rowid
+			AND selected_files.server == build_servers.server
+		)`)
+		return
+	}
+	if opts.Queue {
+		q.Where(fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM fetch_queue
+			WHERE fetch_queue.file == files.rowid
+			AND fetch_queue.server == build_servers.server
+			AND fetch_queue.state == %d
+		)`, QueuePending))
+		if opts.ObjectsPath != "" && !opts.AllVariants {
+			// Variants are queued together, so the exclusion is applied as
+			// they are fetched. See SettleQueue.
+			q.Where("NOT " + variantHasContent("files"))
+		}
+		return
+	}
+	// Exclude disabled servers and file names.
+	q.Where("build_servers.server NOT IN (SELECT rowid FROM servers WHERE disabled)")
+	q.Where(fmt.Sprintf("files.filename NOT IN (SELECT rowid FROM filenames WHERE tier == %d)", TierDisabled))
+	if opts.deprecated {
+		q.Where("build_servers.server IN (SELECT server FROM deprecated_servers)")
+	}
+	if opts.NoContent {
+		// The content of these files was downloaded previously, so each is
+		// downloaded again regardless of other variants.
+		q.Where(fmt.Sprintf("files.flags == %d", Exists|HasHeaders|HasMetadata))
+		q.Where(opts.Query.Expr, opts.Query.Params...)
+		return
+	}
+	// Select Unchecked files.
+	flags := []string{"files.flags == 0"}
+	if opts.Recheck {
+		// Include files that were not found.
+		flags = append(flags, flagsSet("files.flags", NotFound))
+	}
+	if opts.ObjectsPath != "" {
+		// Include files that were found and do not have content.
+		flags = append(flags, flagsUnset("files.flags", NotFound|HasContent))
+	}
+	if opts.Revalidate {
+		// Include files that were found.
+		flags = append(flags, fmt.Sprintf("files.flags & %d == %d", Exists|HasHeaders|NotFound, Exists|HasHeaders))
+	}
+	q.Where(anyOf(flags...))
+	q.Where(opts.Query.Expr, opts.Query.Params...)
+	if opts.ObjectsPath != "" && !opts.AllVariants {
+		// Exclude files for which another variant of the same build already
+		// has content.
+		exclude := "NOT " + variantHasContent("files")
+		if opts.Revalidate {
+			// A file that has content is revalidated regardless.
+			exclude = anyOf(flagsSet("files.flags", HasContent), exclude)
+		}
+		q.Where(exclude)
+	}
+}
+
+// variantHasContent returns an expression that is true if another variant of
+// the same build as the file given by table has content.
+func variantHasContent(table string) string {
+	return `EXISTS (
+		SELECT 1 FROM filename_aliases AS a, filename_aliases AS b, files AS f
+		WHERE a.filename == ` + table + `.filename
+		AND b.grp == a.grp
+		AND f.filename == b.filename
+		AND f.build == ` + table + `.build
+		AND f.rowid != ` + table + `.rowid
+		AND ` + flagsSet("f.flags", HasContent) + `
+	)`
+}
+
+// recordArchived records as archived each build of the given files that has no
+// files remaining to be downloaded into objpath. Builds that were already
+// archived are unchanged.
+func (a Action) recordArchived(e Executor, objpath string, allVariants bool, files []int) error {
+	// Stay well under the maximum number of query parameters.
+	const chunk = 512
+	remaining := selectFiles().Column("1").Where("files.build == candidates.build")
+	FetchOptions{ObjectsPath: objpath, AllVariants: allVariants}.selection(remaining)
+	for len(files) > 0 {
+		n := len(files)
+		if n > chunk {
+			n = chunk
+		}
+		query := `
+			INSERT OR IGNORE INTO build_events (build, kind, time)
+			SELECT candidates.build, 'archived', ?
+			FROM (
+				SELECT DISTINCT build FROM files
+				WHERE rowid IN (` + strings.TrimSuffix(strings.Repeat(`?,`, n), `,`) + `)
+			) AS candidates
+			WHERE NOT EXISTS (` + remaining.String() + `)
+		`
+		args := make([]interface{}, 0, n+1+len(remaining.Params()))
+		args = append(args, time.Now().Unix())
+		for _, id := range files[:n] {
+			args = append(args, id)
+		}
+		args = append(args, remaining.Params()...)
+		if _, err := e.ExecContext(a.Context, query, args...); err != nil {
+			return err
+		}
+		files = files[n:]
+	}
+	return nil
+}
+
+// batchQuery returns the statement that selects a batch of files to be fetched,
+// along with its parameters. The statement is followed by two parameters bound
+// by the caller: the rowid after which files are selected, and the maximum
+// number of files to select. Each row contains the rowid, flags, server rowid,
+// build hash, and filename rowid of a file, followed by the stored ETag and
+// Last-Modified time of the file when revalidating, or NULL otherwise.
+func (opts FetchOptions) batchQuery() (query string, params []interface{}) {
+	// Server URLs and file names are resolved from memory rather than by
+	// joining their tables. The tables are joined only when referred to by
+	// the filter.
+	q := selectFiles().
+		Column("files.rowid AS id").
+		Column("files.flags AS flags").
+		Column("build_servers.server AS server").
+		Column("builds.hash AS _build").
+		Column("files.filename AS filename")
+	if opts.Revalidate {
+		q.Column("(SELECT etag FROM headers WHERE headers.file == files.rowid) AS etag").
+			Column("(SELECT last_modified FROM headers WHERE headers.file == files.rowid) AS last_modified")
+	} else {
+		q.Column("NULL AS etag").Column("NULL AS last_modified")
+	}
+	if opts.Query.Vars["server"] {
+		joinServers(q).Column("servers.url AS _server")
+	}
+	if opts.Query.Vars["file"] {
+		joinFilenames(q).Column("filenames.name AS _file")
+	}
+	opts.selection(q)
+	// Files are visited in order, so that files left unmodified are not
+	// selected again.
+	q.WhereBound("files.rowid > ?")
+	query = `
+		WITH temp AS (` + q.Select(`
+			ORDER BY files.rowid
+			LIMIT ?
+		`) + `) SELECT id, flags, server, _build, filename, etag, last_modified FROM temp
+		-- Collapse duplicates caused by build being available from multiple
+		-- servers.
+		GROUP BY id
+	`
+	return query, q.Params()
+}
+
+// upsertMetadata is the statement that sets the metadata of a file, given the
+// rowid, size, MD5 hash, SHA-256 hash, and stored size of the file. If the
+// SHA-256 hash is NULL, such as for content that was not downloaded, then the
+// hash recorded for another file with the same MD5 hash is used, if any. The
+// stored size is NULL unless the object is compressed.
+const upsertMetadata = `
+	INSERT INTO metadata(file, size, md5, sha256, stored_size)
+	VALUES (?1, ?2, ?3, ifnull(?4, (
+		SELECT sha256 FROM metadata
+		WHERE md5 == ?3 AND sha256 IS NOT NULL
+		LIMIT 1
+	)), ?5)
+	ON CONFLICT (file) DO
+	UPDATE SET size = excluded.size, md5 = excluded.md5, sha256 = excluded.sha256, stored_size = excluded.stored_size
+`
+
+// commitStmts contains the statements that commit the result of a fetched
+// file. The statements are prepared once, and are executed within the
+// transaction of each batch.
+type commitStmts struct {
+	updateFile     *sql.Stmt
+	deleteErrors   *sql.Stmt
+	insertMismatch *sql.Stmt
+	deleteMismatch *sql.Stmt
+	upsertHeaders  *sql.Stmt
+	upsertStatus   *sql.Stmt
+	deleteFields   *sql.Stmt
+	insertField    *sql.Stmt
+	upsertMetadata *sql.Stmt
+	upsertVerified *sql.Stmt
+}
+
+func prepareCommit(a Action, db *sql.DB) (c *commitStmts, err error) {
+	c = &commitStmts{}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&c.updateFile, `UPDATE files SET flags = ? WHERE rowid = ?`},
+		{&c.deleteErrors, `DELETE FROM file_errors WHERE file = ?`},
+		{&c.insertMismatch, `
+			INSERT INTO length_mismatches(file, expected, actual, time)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (file) DO
+			UPDATE SET
+				expected = excluded.expected,
+				actual = excluded.actual,
+				time = excluded.time
+		`},
+		{&c.deleteMismatch, `DELETE FROM length_mismatches WHERE file = ?`},
+		{&c.upsertHeaders, `
+			INSERT INTO headers(
+				file,
+				status,
+				content_length,
+				last_modified,
+				content_type,
+				etag,
+				etag_format,
+				final_url,
+				redirects
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (file) DO
+			UPDATE SET
+				status = excluded.status,
+				content_length = excluded.content_length,
+				last_modified = excluded.last_modified,
+				content_type = excluded.content_type,
+				etag = excluded.etag,
+				etag_format = excluded.etag_format,
+				final_url = excluded.final_url,
+				redirects = excluded.redirects
+		`},
+		{&c.upsertStatus, `
+			INSERT INTO headers(file, status)
+			VALUES (?, ?)
+			ON CONFLICT (file) DO
+			UPDATE SET status = excluded.status
+		`},
+		{&c.deleteFields, `DELETE FROM header_fields WHERE file = ?`},
+		{&c.insertField, `INSERT INTO header_fields(file, name, value) VALUES (?, ?, ?)`},
+		{&c.upsertMetadata, upsertMetadata},
+		{&c.upsertVerified, `
+			INSERT INTO skip_verifications(file, md5, matched, time)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (file) DO
+			UPDATE SET md5 = excluded.md5, matched = excluded.matched, time = excluded.time
+		`},
+	}
+	for _, q := range queries {
+		if *q.stmt, err = db.PrepareContext(a.Context, q.query); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes each prepared statement.
+func (c *commitStmts) Close() error {
+	for _, stmt := range []*sql.Stmt{
+		c.updateFile,
+		c.deleteErrors,
+		c.insertMismatch,
+		c.deleteMismatch,
+		c.upsertHeaders,
+		c.upsertStatus,
+		c.deleteFields,
+		c.insertField,
+		c.upsertMetadata,
+		c.upsertVerified,
+	} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// exec commits the result of a fetched file within tx.
+func (c *commitStmts) exec(a Action, tx *sql.Tx, entry respEntry) error {
+	run := func(stmt *sql.Stmt, args ...interface{}) error {
+		_, err := tx.StmtContext(a.Context, stmt).ExecContext(a.Context, args...)
+		return err
+	}
+	if err := run(c.updateFile, int(entry.flags), entry.id); err != nil {
+		return err
+	}
+	if err := run(c.deleteErrors, entry.id); err != nil {
+		return err
+	}
+	if entry.lengthMismatch {
+		if err := run(c.insertMismatch, entry.id, entry.contentLength.Int64, entry.size, time.Now().Unix()); err != nil {
+			return err
+		}
+	} else if entry.qAction&qMetadata != 0 {
+		if err := run(c.deleteMismatch, entry.id); err != nil {
+			return err
+		}
+	}
+	if entry.qAction&qHeaders != 0 {
+		err := run(c.upsertHeaders,
+			entry.id,
+			entry.respStatus,
+			entry.contentLength,
+			entry.lastModified,
+			entry.contentType,
+			entry.etag,
+			etagFormat(entry.etag.String),
+			entry.finalURL,
+			entry.redirects,
+		)
+		if err != nil {
+			return err
+		}
+		// Replace the provenance headers of the previous fetch.
+		if err := run(c.deleteFields, entry.id); err != nil {
+			return err
+		}
+		for _, field := range entry.fields {
+			if err := run(c.insertField, entry.id, field.name, field.value); err != nil {
+				return err
+			}
+		}
+	} else if entry.qAction&qHeaderStatus != 0 {
+		if err := run(c.upsertStatus, entry.id, entry.respStatus); err != nil {
+			return err
+		}
+	}
+	if entry.qAction&qMetadata != 0 {
+		if err := run(c.upsertMetadata, entry.id, entry.size, entry.hash, entry.sha256, entry.storedSize); err != nil {
+			return err
+		}
+	}
+	if entry.verified != "" {
+		if err := run(c.upsertVerified, entry.id, entry.verified, entry.verifiedMatch, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameCache holds the names of the rows of a small table, such as servers or
+// filenames, in memory.
+type nameCache struct {
+	query string
+	names map[int]string
+}
+
+// get returns the name of a row. Names are loaded on first use, and loaded
+// again when a row is not found, since rows may be added during a run.
+func (c *nameCache) get(a Action, e Executor, id int) (name string, err error) {
+	if name, ok := c.names[id]; ok {
+		return name, nil
+	}
+	rows, err := e.QueryContext(a.Context, c.query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	c.names = map[int]string{}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return "", err
+		}
+		c.names[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	name, ok := c.names[id]
+	if !ok {
+		return "", fmt.Errorf("unknown row %d", id)
+	}
+	return name, nil
+}
+
+// FetchContent scans files and downloads their content. If opts.ObjectsPath is
+// not empty then the entire file is downloaded to that directory. Otherwise,
+// just the headers are retrieved and stored in the database.
+//
+// When downloading file content, the only files considers are Unchecked files,
+// and files that have neither the NotFound flag nor the HasContent. A hit
+// writes the file to objects, adds the file's headers to the database, sets the
+// Exists, HasHeaders, HasMetadata, and HasContent flags, and unsets the
+// NotFound flag. A miss sets NotFound flag.
+//
+// When just retrieving headers, only Unchecked files are considered. A hit adds
+// the file's headers to the database, sets the Exists and HasHeaders flags, and
+// unsets the NotFound flag. A miss sets the NotFound flag.
+//
+// When downloading file content, a file that is a variant in an alias group is
+// skipped if another variant of the same build already has content, unless
+// opts.AllVariants is true. A variant is not skipped if the other variant is in
+// a batch that has not yet been committed.
+//
+// Files are selected and committed in batches of opts.BatchSize. While one
+// batch is committed, the following batches, up to fetchAhead, are selected and
+// downloaded, so that requests continue to be made while the database is
+// written. Batches are committed in the order they were selected.
+//
+// Each object written is recorded in the journal of the objects path until the
+// batch that includes it is committed. Objects remaining in the journal from an
+// interrupted run are reconciled with ReconcileJournal before fetching begins.
+//
+// Files available from servers marked as deprecated by FetchBuilds are fetched
+// before other files.
+//
+// If opts.NoContent is true, then only NoContent files are considered. A hit
+// sets the HasContent flag, and replaces the file's headers and metadata. A miss
+// sets the NotFound flag, making the file Missing.
+//
+// If a server cannot be reached because of a DNS or TLS failure, then the
+// failure is recorded in the server_failures table rather than marking the file
+// as NotFound. The remaining files from that server are skipped for the rest of
+// the run.
+//
+// If opts.Revalidate is true, then files that were found are also considered,
+// and the request for each file that has headers, and content if downloading
+// content, is made conditional on its stored ETag and Last-Modified headers. If
+// the server responds with status 304, then the file is left unmodified.
+// Otherwise, the response is handled as usual, replacing the headers, and the
+// content if it changed.
+//
+// A file that fails for any other reason is left unmodified, and the error is
+// logged and recorded in the file_errors table. Successful files in the same
+// batch are still committed. The run is aborted only if the fraction of failed
+// files in a batch exceeds opts.MaxErrorRate.
+func (a Action) FetchContent(db *sql.DB, f *fetch.Fetcher, opts FetchOptions, stats Stats) error {
+	objpath := opts.ObjectsPath
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if opts.NoContent && objpath == "" {
+		return fmt.Errorf("selecting NoContent files requires objects path")
+	}
+	if opts.Storage != nil && objpath == "" {
+		return fmt.Errorf("storage requires objects path")
+	}
+	if !opts.FromSelection && !opts.deprecated {
+		// Files from deprecated servers are fetched first, before they
+		// disappear.
+		n, err := a.queryInt(db, `SELECT count(*) FROM deprecated_servers`)
+		if err != nil {
+			return fmt.Errorf("count deprecated servers: %w", err)
+		}
+		if n > 0 {
+			log.Printf("fetching files from %d deprecated servers", n)
+			priority := opts
+			priority.deprecated = true
+			if err := a.FetchContent(db, f, priority, stats); err != nil {
+				return err
+			}
+		}
+	}
+	if objpath != "" {
+		if err := isDir(objpath); err != nil {
+			return err
+		}
+		if opts.ObjectsIndex {
+			opts.index = objects.NewIndex(objpath)
+		}
+		uncommitted, err := a.ReconcileJournal(db, objpath)
+		if err != nil {
+			return err
+		}
+		for _, hash := range uncommitted {
+			log.Printf("object %s was not committed; left for gc", hash)
+		}
+		if opts.journal, err = objects.OpenJournal(objpath); err != nil {
+			return fmt.Errorf("open journal: %w", err)
+		}
+		defer opts.journal.Close()
+	}
+	query, condParams := opts.batchQuery()
+	stmt, err := statements.Prepare(a.Context, db, query)
+	if err != nil {
+		return fmt.Errorf("select files: %w", err)
+	}
+
+	commit, err := prepareCommit(a, db)
+	if err != nil {
+		return fmt.Errorf("prepare commit: %w", err)
+	}
+	defer commit.Close()
+
+	maxErrorRate := opts.MaxErrorRate
+	if maxErrorRate <= 0 {
+		maxErrorRate = DefaultMaxErrorRate
+	}
+	totalErrors := 0
+
+	var progress Progress
+	report := func(phase string) {
+		if opts.Progress != nil {
+			progress.Phase = phase
+			opts.Progress(progress)
+		}
+	}
+
+	var timing phaseTimes
+	if opts.Timing != nil {
+		defer func() { opts.Timing.merge(&timing) }()
+	}
+
+	// Batches are selected and downloaded ahead of the batch being committed,
+	// so that downloads continue while the database is written.
+	sel := &batchSelector{
+		a:           a,
+		db:          db,
+		f:           f,
+		opts:        &opts,
+		stmt:        stmt,
+		params:      condParams,
+		batchSize:   batchSize,
+		deadServers: map[string]bool{},
+		servers:     &nameCache{query: `SELECT rowid, url FROM servers`},
+		filenames:   &nameCache{query: `SELECT rowid, name FROM filenames`},
+	}
+	ctx, cancel := context.WithCancel(a.Context)
+	batches := make(chan *fetchBatch, fetchAhead-1)
+	go sel.run(ctx, batches)
+	defer func() {
+		// Stop selecting, and wait for the requests of batches that will not
+		// be committed.
+		cancel()
+		for b := range batches {
+			b.wg.Wait()
+		}
+	}()
+	for b := range batches {
+		start := time.Now()
+		progress.Batch++
+		progress.Fetching = int(atomic.LoadInt64(&sel.fetching))
+		report("fetch")
+		b.wait()
+		start = timing.add("download", start)
+
+		suspended := 0
+		for _, entry := range b.resps {
+			if entry.skip && errors.Is(entry.failureErr, fetch.ErrCircuitOpen) {
+				suspended++
+			}
+		}
+		if suspended > 0 {
+			log.Printf("skipped %d files from suspended hosts", suspended)
+		}
+
+		sel.mu.Lock()
+		result, err := a.commitBatch(db, commit, &opts, b, sel.deadServers, stats)
+		sel.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&sel.fetching, -int64(b.n))
+		start = timing.add("commit", start)
+		if opts.Storage != nil {
+			if err := a.StoreObjects(objpath, opts.Storage); err != nil {
+				return err
+			}
+			timing.add("store", start)
+		}
+		if result.unchanged > 0 {
+			log.Printf("%d files unchanged", result.unchanged)
+		}
+		if opts.ObjectsPath != "" {
+			log.Printf("committed %d files; %s", result.committed, &result.dedup)
+		} else {
+			log.Printf("committed %d files", result.committed)
+		}
+		if opts.Dedup != nil {
+			opts.Dedup.merge(result.dedup)
+		}
+		totalErrors += result.failed
+		progress.Committed += result.committed
+		progress.Reused += result.dedup.Reused
+		progress.Failed += result.failed
+		progress.Bytes += result.bytes
+		progress.Fetching = int(atomic.LoadInt64(&sel.fetching))
+		report("commit")
+		if opts.BetweenBatches != nil {
+			sel.mu.Lock()
+			err := opts.BetweenBatches()
+			sel.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if n := b.n + len(b.shared); n > 0 {
+			if rate := float64(result.failed) / float64(n); rate > maxErrorRate {
+				return fmt.Errorf("%d of %d files in batch failed, exceeding error rate of %g", result.failed, n, maxErrorRate)
+			}
+		}
+	}
+	if sel.err != nil {
+		return sel.err
+	}
+	// Every batch has been committed, so entries that remain belong only to
+	// objects of failed files.
+	if err = opts.journal.Finalize(); err != nil {
+		return fmt.Errorf("finalize journal: %w", err)
+	}
+	timing.merge(&sel.timing)
+	if totalErrors > 0 {
+		log.Printf("%d files failed", totalErrors)
+	}
+	if len(timing.phases) > 0 {
+		log.Printf("time spent: %s", &timing)
+	}
+	report("done")
+	return nil
+}
+
+// batchResult is the outcome of committing a fetchBatch.
+type batchResult struct {
+	committed int
+	failed    int
+	unchanged int
+	// Size of the content of committed files.
+	bytes int64
+	dedup DedupStats
+}
+
+// commitBatch commits the responses of a batch whose requests are done. Servers
+// found to be unreachable are recorded, and added to deadServers. The entries
+// of committed objects are released from the journal.
+func (a Action) commitBatch(db *sql.DB, commit *commitStmts, opts *FetchOptions, b *fetchBatch, deadServers map[string]bool, stats Stats) (result batchResult, err error) {
+	reqs, resps := b.reqs, b.resps
+	for i, entry := range resps {
+		if entry.failure == fetch.OtherError || deadServers[reqs[i].server] {
+			continue
+		}
+		deadServers[reqs[i].server] = true
+		log.Printf("skipping remaining files from %s: %s failure: %s", reqs[i].server, entry.failure, entry.failureErr)
+		if err := a.AddServerFailure(db, reqs[i].server, entry.failure, entry.failureErr); err != nil {
+			return result, fmt.Errorf("add server failure: %w", err)
+		}
+	}
+
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return result, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	log.Printf("committing %d files...", len(reqs))
+	var committedIDs []int
+	var written []string
+	for i, entry := range resps {
+		if stats != nil {
+			stats[entry.respStatus]++
+		}
+		if entry.err != nil {
+			// The file is left unmodified, except for recording the
+			// error.
+			result.failed++
+			log.Printf("error: %s", entry.err)
+			if err := a.SetFileError(tx, entry.id, entry.err); err != nil {
+				return result, fmt.Errorf("set error of file %s-%s: %w", reqs[i].build, reqs[i].file, err)
+			}
+			if opts.Queue {
+				if err := a.setQueueState(tx, QueueFailed, entry.err, reqs[i].id); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+		if entry.unchanged {
+			result.unchanged++
+			if opts.Queue {
+				if err := a.setQueueState(tx, QueueDone, nil, reqs[i].id); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+		if entry.skip {
+			if opts.Queue {
+				// Left for a later run.
+				if err := a.setQueueState(tx, QueuePending, nil, reqs[i].id); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+		if err := commit.exec(a, tx, entry); err != nil {
+			return result, fmt.Errorf("update file %s-%s: %w", reqs[i].build, reqs[i].file, err)
+		}
+		if opts.Queue {
+			if err := a.setQueueState(tx, QueueDone, nil, reqs[i].id); err != nil {
+				return result, err
+			}
+		}
+		result.committed++
+		committedIDs = append(committedIDs, entry.id)
+		if entry.qAction&qMetadata != 0 {
+			result.bytes += entry.size
+			written = append(written, entry.hash)
+		}
+		result.dedup.add(entry)
+	}
+	if opts.ObjectsPath != "" {
+		if err := a.recordArchived(tx, opts.ObjectsPath, opts.AllVariants, committedIDs); err != nil {
+			return result, fmt.Errorf("record archived builds: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return result, fmt.Errorf("commit transaction: %w", err)
+	}
+	// Objects of later batches may still be in progress, so only the entries
+	// of this batch are released.
+	if err = opts.journal.Release(written); err != nil {
+		return result, fmt.Errorf("release journal entries: %w", err)
+	}
+	return result, nil
+}
+
+// distributionTables lists the tables included in a distribution database, in
+// the order they are copied.
+var distributionTables = []string{
+	"filenames",
+	"servers",
+	"builds",
+	"build_servers",
+	"files",
+	"headers",
+	"header_fields",
+	"metadata",
+}
+
+// ExportDatabase writes to path a cleaned copy of a database intended for
+// publication. Only the tables listed in distributionTables are included, rows
+// are written in order of rowid, and the result is vacuumed. Tables located in
+// an attached secondary database are included in the copy. The file at path
+// must not already exist.
+func (a Action) ExportDatabase(db *sql.DB, path string) error {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		if err == nil {
+			return fmt.Errorf("%s: file already exists", path)
+		}
+		return err
+	}
+
+	// Create the schema of the export.
+	export, err := OpenDatabase(path, "")
+	if err != nil {
+		return fmt.Errorf("open export: %w", err)
+	}
+	if err := a.Init(export); err != nil {
+		export.Close()
+		return fmt.Errorf("init export: %w", err)
+	}
+	if err := export.Close(); err != nil {
+		return fmt.Errorf("close export: %w", err)
+	}
+
+	// Attachments apply per connection, so a single connection is used for
+	// the copy.
+	conn, err := db.Conn(a.Context)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(a.Context, `ATTACH DATABASE ? AS export`, path); err != nil {
+		return fmt.Errorf("attach export: %w", err)
+	}
+	tx, err := conn.BeginTx(a.Context, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	for _, table := range distributionTables {
+		// Columns are copied by name; columns not present in both databases
+		// are left out.
+		exportColumns, err := a.tableColumns(tx, "export", table)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("get columns of %s: %w", table, err)
+		}
+		sourceColumns, err := a.tableColumns(tx, a.tableSchema(tx, table), table)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("get columns of %s: %w", table, err)
+		}
+		present := make(map[string]bool, len(sourceColumns))
+		for _, column := range sourceColumns {
+			present[column] = true
+		}
+		columns := exportColumns[:0]
+		for _, column := range exportColumns {
+			if present[column] {
+				columns = append(columns, column)
+			}
+		}
+		list := strings.Join(columns, ", ")
+		query := `INSERT INTO export.` + table + ` (` + list + `) SELECT ` + list + ` FROM ` + table + ` ORDER BY rowid`
+		if _, err := tx.ExecContext(a.Context, query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("copy %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	if _, err := conn.ExecContext(a.Context, `DETACH DATABASE export`); err != nil {
+		return fmt.Errorf("detach export: %w", err)
+	}
+
+	// Drop internal tables, then compact the result.
+	if export, err = OpenDatabase(path, ""); err != nil {
+		return fmt.Errorf("open export: %w", err)
+	}
+	defer export.Close()
+	tables, err := a.tableNames(export, "main")
+	if err != nil {
+		return fmt.Errorf("get tables: %w", err)
+	}
+	keep := make(map[string]bool, len(distributionTables))
+	for _, table := range distributionTables {
+		keep[table] = true
+	}
+	for _, table := range tables {
+		if keep[table] {
+			continue
+		}
+		if _, err := export.ExecContext(a.Context, `DROP TABLE `+table); err != nil {
+			return fmt.Errorf("drop %s: %w", table, err)
+		}
+	}
+	if _, err := export.ExecContext(a.Context, `VACUUM`); err != nil {
+		return fmt.Errorf("vacuum export: %w", err)
+	}
+	return export.Close()
+}
+
+// replicaExcluded lists tables that are not copied to a standby by Replicate,
+// because they describe the state of the local instance rather than the
+// archive.
+var replicaExcluded = map[string]bool{
+	"state": true,
+}
+
+// ReplicaStats contains the number of rows changed in a standby by Replicate.
+type ReplicaStats struct {
+	// Number of rows that were copied because they were added or changed.
+	Copied int64
+	// Number of rows that were deleted because they no longer exist.
+	Deleted int64
+}
+
+func (s ReplicaStats) String() string {
+	return fmt.Sprintf("copied %d rows, deleted %d rows", s.Copied, s.Deleted)
+}
+
+// Replicate brings the standby database at path up to date with db. The
+// standby is created if it does not exist. Each table of db, including tables
+// in an attached secondary database, is compared with the table of the same
+// name in the standby, and only the rows that were added, changed, or removed
+// are written. Rows are matched by rowid, so the standby must not be modified
+// except by Replicate.
+//
+// The standby is updated within one transaction, so a reader of the standby
+// never sees a partial update.
+func (a Action) Replicate(db *sql.DB, path string) (stats ReplicaStats, err error) {
+	// Create or migrate the schema of the standby.
+	standby, err := OpenDatabase(path, "")
+	if err != nil {
+		return stats, fmt.Errorf("open standby: %w", err)
+	}
+	if err := a.Init(standby); err != nil {
+		standby.Close()
+		return stats, fmt.Errorf("init standby: %w", err)
+	}
+	if err := standby.Close(); err != nil {
+		return stats, fmt.Errorf("close standby: %w", err)
+	}
+
+	conn, err := db.Conn(a.Context)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+	// Rows are copied in the order of tables rather than of references, so
+	// the references of the standby are consistent only once every table has
+	// been copied. The pragma cannot be changed within a transaction.
+	if _, err := conn.ExecContext(a.Context, `PRAGMA foreign_keys = OFF`); err != nil {
+		return stats, fmt.Errorf("disable foreign keys: %w", err)
+	}
+	defer conn.ExecContext(a.Context, `PRAGMA foreign_keys = ON`)
+	if _, err := conn.ExecContext(a.Context, `ATTACH DATABASE ? AS standby`, path); err != nil {
+		return stats, fmt.Errorf("attach standby: %w", err)
+	}
+	defer conn.ExecContext(a.Context, `DETACH DATABASE standby`)
+
+	tables, err := a.tableNames(conn, "main")
+	if err != nil {
+		return stats, fmt.Errorf("get tables: %w", err)
+	}
+	for _, table := range secondaryTables {
+		if a.tableSchema(conn, table.Name) == SecondarySchema {
+			tables = append(tables, table.Name)
+		}
+	}
+
+	tx, err := conn.BeginTx(a.Context, nil)
+	if err != nil {
+		return stats, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, table := range tables {
+		if replicaExcluded[table] {
+			continue
+		}
+		if ok, err := a.hasTable(tx, "standby", table); err != nil {
+			return stats, fmt.Errorf("find standby table %s: %w", table, err)
+		} else if !ok {
+			continue
+		}
+		schema := a.tableSchema(tx, table)
+		standbyColumns, err := a.tableColumns(tx, "standby", table)
+		if err != nil {
+			return stats, fmt.Errorf("get columns of %s: %w", table, err)
+		}
+		sourceColumns, err := a.tableColumns(tx, schema, table)
+		if err != nil {
+			return stats, fmt.Errorf("get columns of %s: %w", table, err)
+		}
+		present := make(map[string]bool, len(sourceColumns))
+		for _, column := range sourceColumns {
+			present[column] = true
+		}
+		// The rowid is copied even for tables that do not declare it, so that
+		// rows can be matched.
+		columns := []string{"rowid"}
+		for _, column := range standbyColumns {
+			if present[column] && column != "rowid" {
+				columns = append(columns, column)
+			}
+		}
+		list := strings.Join(columns, ", ")
+		source := schema + "." + table
+		target := "standby." + table
+
+		result, err := tx.ExecContext(a.Context, `DELETE FROM `+target+` WHERE rowid NOT IN (SELECT rowid FROM `+source+`)`)
+		if err != nil {
+			return stats, fmt.Errorf("delete from %s: %w", table, err)
+		}
+		n, _ := result.RowsAffected()
+		stats.Deleted += n
+
+		result, err = tx.ExecContext(a.Context, `
+			INSERT OR REPLACE INTO `+target+` (`+list+`)
+			SELECT `+list+` FROM `+source+`
+			EXCEPT SELECT `+list+` FROM `+target)
+		if err != nil {
+			return stats, fmt.Errorf("copy %s: %w", table, err)
+		}
+		n, _ = result.RowsAffected()
+		stats.Copied += n
+	}
+	if err := tx.Commit(); err != nil {
+		return stats, fmt.Errorf("commit transaction: %w", err)
+	}
+	return stats, nil
+}
+
+// tableSchema returns the name of the schema in which a table is located. This
+// is the schema that an unqualified reference to the table resolves to.
+func (a Action) tableSchema(e Executor, table string) string {
+	if ok, _ := a.hasTable(e, "main", table); ok {
+		return "main"
+	}
+	if ok, _ := a.hasTable(e, SecondarySchema, table); ok {
+		return SecondarySchema
+	}
+	return "main"
+}
+
+// tableNames returns the names of the tables in the database of a schema.
+func (a Action) tableNames(e Executor, schema string) (tables []string, err error) {
+	query := `SELECT name FROM ` + schema + `.sqlite_master WHERE type == 'table' AND name NOT LIKE 'sqlite_%'`
+	rows, err := e.QueryContext(a.Context, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// FileEstimate contains the results of sampling the selected files that have a
+// particular file name.
+type FileEstimate struct {
+	// Name of the file.
+	Name string
+	// Number of selected files with the name.
+	Selected int64
+	// Number of selected files that were sampled.
+	Sampled int
+	// Number of sampled files that exist.
+	Hits int
+	// Total size of sampled files that exist, as reported by the server.
+	Bytes int64
+}
+
+// HitRate returns the fraction of sampled files that exist.
+func (e FileEstimate) HitRate() float64 {
+	if e.Sampled == 0 {
+		return 0
+	}
+	return float64(e.Hits) / float64(e.Sampled)
+}
+
+// AverageSize returns the average size of sampled files that exist.
+func (e FileEstimate) AverageSize() int64 {
+	if e.Hits == 0 {
+		return 0
+	}
+	return e.Bytes / int64(e.Hits)
+}
+
+// ProjectedHits returns the projected number of selected files that exist.
+func (e FileEstimate) ProjectedHits() int64 {
+	return int64(float64(e.Selected) * e.HitRate())
+}
+
+// ProjectedBytes returns the projected total size of selected files that exist.
+func (e FileEstimate) ProjectedBytes() int64 {
+	return e.ProjectedHits() * e.AverageSize()
+}
+
+// EstimateContent retrieves the headers of a random sample of the files that
+// would be selected by FetchContent with the given options, without modifying
+// the database. Returns estimates grouped by file name, sorted by name, as well
+// as the duration taken to make the sampled requests.
+func (a Action) EstimateContent(db *sql.DB, f *fetch.Fetcher, opts FetchOptions, samples int) (estimates []FileEstimate, elapsed time.Duration, err error) {
+	q := selectFiles().
+		Column("files.rowid AS id").
+		Column("servers.url AS _server").
+		Column("builds.hash AS _build").
+		Column("filenames.name AS _file")
+	joinFilenames(joinServers(q))
+	opts.selection(q)
+	// Collapse duplicates caused by build being available from multiple
+	// servers.
+	selection := q.Select(`GROUP BY files.rowid`)
+	params := q.Params()
+
+	byName := map[string]*FileEstimate{}
+	rows, err := a.querySelection(db, `SELECT _file, count(*) FROM (`+selection+`) GROUP BY _file`, params...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("count files: %w", err)
+	}
+	for rows.Next() {
+		var e FileEstimate
+		if err := rows.Scan(&e.Name, &e.Selected); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("scan row: %w", err)
+		}
+		byName[e.Name] = &e
+	}
+	if err = rows.Close(); err != nil {
+		return nil, 0, fmt.Errorf("finish rows: %w", err)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("row error: %w", err)
+	}
+
+	var reqs []reqEntry
+	rows, err = a.querySelection(db, `SELECT * FROM (`+selection+`) ORDER BY random() LIMIT ?`, append(params[:len(params):len(params)], samples)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("sample files: %w", err)
+	}
+	for rows.Next() {
+		var req reqEntry
+		if err := rows.Scan(&req.id, &req.server, &req.build, &req.file); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("scan row: %w", err)
+		}
+		reqs = append(reqs, req)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, 0, fmt.Errorf("finish rows: %w", err)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("row error: %w", err)
+	}
+
+	type result struct {
+		status int
+		size   int64
+		err    error
+	}
+	results := make([]result, len(reqs))
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i := range reqs {
+		go func(req *reqEntry, r *result) {
+			defer wg.Done()
+			status, headers, _, err := f.FetchContent(a.Context, buildFileURL(req.server, req.build, req.file), nil, nil, nil)
+			if err != nil {
+				r.err = err
+				return
+			}
+			r.status = status
+			if v, err := strconv.ParseInt(headers.Get("content-length"), 10, 64); err == nil {
+				r.size = v
+			}
+		}(&reqs[i], &results[i])
+	}
+	wg.Wait()
+	elapsed = time.Since(start)
+
+	for i, r := range results {
+		if r.err != nil {
+			log.Printf("sample %s-%s: %s", reqs[i].build, reqs[i].file, r.err)
+			continue
+		}
+		e := byName[reqs[i].file]
+		if e == nil {
+			continue
+		}
+		e.Sampled++
+		if 200 <= r.status && r.status < 300 {
+			e.Hits++
+			e.Bytes += r.size
+		}
+	}
+	estimates = make([]FileEstimate, 0, len(byName))
+	for _, e := range byName {
+		estimates = append(estimates, *e)
+	}
+	sort.Slice(estimates, func(i, j int) bool {
+		return estimates[i].Name < estimates[j].Name
+	})
+	return estimates, elapsed, nil
+}
+
+// parseFileKey splits the name of a build file, such as
+// "version-0123456789abcdef-RobloxApp.zip", into its build hash and file name.
+func parseFileKey(key string) (build, file string, ok bool) {
+	const prefix = "version-"
+	if !strings.HasPrefix(key, prefix) {
+		return "", "", false
+	}
+	i := strings.Index(key[len(prefix):], "-")
+	if i <= 0 {
+		return "", "", false
+	}
+	i += len(prefix)
+	if i+1 >= len(key) {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// ListingResult contains the results of SeedListings.
+type ListingResult struct {
+	// Number of listed files that were seeded with headers.
+	Seeded int
+	// Number of unlisted files marked as NotFound.
+	NotFound int
+	// Number of listed files for builds not known to be on the server.
+	UnknownBuilds int
+	// Listed file names that are not in the database, with the number of
+	// times each was listed.
+	UnknownNames map[string]int
+}
+
+// SeedListings uses complete listings of the objects of servers to seed the
+// state of files. listings maps the URL of a server to its objects, with keys
+// relative to the location of the server.
+//
+// For each listed file of a known build and file name, the file is added if
+// needed. If the file is not already known to exist with headers, then the
+// headers are set from the listing, the Exists and HasHeaders flags are set,
+// and the NotFound flag is unset.
+//
+// If markNotFound is true, then, because a listing is complete, Unchecked files
+// of builds that are not listed are marked as NotFound. This applies only to
+// builds whose every server was listed, since a file missing from one server
+// may be present on another. A server whose listing is empty is not considered
+// listed, since an empty listing is more likely a response that was not a
+// listing at all.
+func (a Action) SeedListings(db *sql.DB, listings map[string][]s3.Object, markNotFound bool) (result ListingResult, err error) {
+	result.UnknownNames = map[string]int{}
+	filenames, err := a.GetFilenames(db)
+	if err != nil {
+		return result, fmt.Errorf("get filenames: %w", err)
+	}
+	known := make(map[string]bool, len(filenames))
+	for _, name := range filenames {
+		known[name] = true
+	}
+
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return result, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	const setup = `
+		CREATE TEMP TABLE IF NOT EXISTS listed_servers (server INTEGER PRIMARY KEY);
+		CREATE TEMP TABLE IF NOT EXISTS listed_files (file INTEGER PRIMARY KEY);
+		DELETE FROM temp.listed_servers;
+		DELETE FROM temp.listed_files;
+	`
+	if _, err := tx.ExecContext(a.Context, setup); err != nil {
+		return result, err
+	}
+	const insertServer = `
+		INSERT OR IGNORE INTO temp.listed_servers (server)
+		SELECT rowid FROM servers WHERE url == ?
+	`
+	const insertFile = `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT builds.rowid, filenames.rowid
+		FROM builds, filenames, build_servers, servers
+		WHERE builds.hash == ?
+		AND filenames.name == ?
+		AND build_servers.build == builds.rowid
+		AND build_servers.server == servers.rowid
+		AND servers.url == ?
+	`
+	const selectFile = `
+		SELECT files.rowid, files.flags FROM files, builds, filenames
+		WHERE files.build == builds.rowid
+		AND files.filename == filenames.rowid
+		AND builds.hash == ?
+		AND filenames.name == ?
+		AND EXISTS (
+			SELECT 1 FROM build_servers, servers
+			WHERE build_servers.build == builds.rowid
+			AND build_servers.server == servers.rowid
+			AND servers.url == ?
+		)
+	`
+	const seedFile = `
+		INSERT INTO temp.listed_files (file) VALUES (?) ON CONFLICT DO NOTHING;
+	`
+	const seedHeaders = `
+		UPDATE files SET flags = ? WHERE rowid = ?;
+		INSERT INTO headers(file, status, content_length, last_modified, etag, etag_format)
+		VALUES (?, 200, ?, ?, ?, ?)
+		ON CONFLICT (file) DO
+		UPDATE SET
+			status = 200,
+			content_length = excluded.content_length,
+			last_modified = excluded.last_modified,
+			content_type = NULL,
+			etag = excluded.etag,
+			etag_format = excluded.etag_format
+	`
+	for server, objects := range listings {
+		if len(objects) > 0 {
+			if _, err := tx.ExecContext(a.Context, insertServer, server); err != nil {
+				return result, fmt.Errorf("add listed server: %w", err)
+			}
+		}
+		for _, object := range objects {
+			build, file, ok := parseFileKey(object.Key)
+			if !ok {
+				continue
+			}
+			if !known[file] {
+				result.UnknownNames[file]++
+				continue
+			}
+			if _, err := tx.ExecContext(a.Context, insertFile, build, file, server); err != nil {
+				return result, fmt.Errorf("add file %s: %w", object.Key, err)
+			}
+			rows, err := tx.QueryContext(a.Context, selectFile, build, file, server)
+			if err != nil {
+				return result, fmt.Errorf("select file %s: %w", object.Key, err)
+			}
+			var id int
+			var flags FileFlags
+			found := rows.Next()
+			if found {
+				err = rows.Scan(&id, &flags)
+			}
+			rows.Close()
+			if err != nil {
+				return result, fmt.Errorf("scan file %s: %w", object.Key, err)
+			}
+			if !found {
+				result.UnknownBuilds++
+				continue
+			}
+			if _, err := tx.ExecContext(a.Context, seedFile, id); err != nil {
+				return result, fmt.Errorf("seed file %s: %w", object.Key, err)
+			}
+			if flags&(Exists|HasHeaders) == Exists|HasHeaders {
+				continue
+			}
+			var lastModified sql.NullInt64
+			if !object.LastModified.IsZero() {
+				lastModified.Valid = true
+				lastModified.Int64 = object.LastModified.Unix()
+			}
+			flags = (flags | Exists | HasHeaders) &^ NotFound
+			_, err = tx.ExecContext(a.Context, seedHeaders,
+				int(flags), id,
+				id, object.Size, lastModified, object.ETag, etagFormat(object.ETag),
+			)
+			if err != nil {
+				return result, fmt.Errorf("seed headers %s: %w", object.Key, err)
+			}
+			result.Seeded++
+		}
+	}
+	const markUnlisted = `
+		UPDATE files SET flags = 1 -- NotFound
+		WHERE flags == 0
+		AND rowid NOT IN (SELECT file FROM temp.listed_files)
+		AND build IN (
+			SELECT build FROM build_servers
+			WHERE server IN (SELECT server FROM temp.listed_servers)
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM build_servers
+			WHERE build_servers.build == files.build
+			AND build_servers.server NOT IN (SELECT server FROM temp.listed_servers)
+		)
+	`
+	if markNotFound {
+		r, err := tx.ExecContext(a.Context, markUnlisted)
+		if err != nil {
+			return result, fmt.Errorf("mark unlisted files: %w", err)
+		}
+		if n, err := r.RowsAffected(); err == nil {
+			result.NotFound = int(n)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("commit transaction: %w", err)
+	}
+	return result, nil
+}
+
+// ProbeOptions configures ProbeBuild.
+type ProbeOptions struct {
+	// Server from which files are probed. Defaults to the first server on
+	// which the build is present.
+	Server string
+	// Maximum number of names to probe. Zero means no limit.
+	Limit int
+	// Whether to probe names that were already probed against the build.
+	Reprobe bool
+	// Whether to add names that were found to filenames with the TierManual
+	// tier, and to add the corresponding file of the build to files.
+	AddHits bool
+}
+
+// ProbeResult is the result of probing a single file name against a build.
+type ProbeResult struct {
+	// Name of the probed file.
+	Name string
+	// Estimated probability that the file exists, derived from the history
+	// of the name across builds of the same type.
+	HitRate float64
+	// Response status of the probe.
+	Status int
+	// Error that occurred while probing, if any.
+	Err error
+}
+
+// Found returns whether the probed file exists.
+func (r ProbeResult) Found() bool {
+	return r.Err == nil && 200 <= r.Status && r.Status < 300
+}
+
+// FilenameStat contains the history of a file name across builds.
+type FilenameStat struct {
+	// Name of the file.
+	Name string
+	// Number of builds in which the file exists.
+	Hits int64
+	// Number of builds in which the file was checked but not found.
+	Misses int64
+	// Number of builds in which the file has not been checked.
+	Unchecked int64
+	// Number of probes of the name against builds that found the file.
+	ProbeHits int64
+	// Number of probes of the name against builds that did not find the file.
+	ProbeMisses int64
+}
+
+// HitRate returns the fraction of checked files that exist, including probes.
+// Returns 0 if no files have been checked.
+func (s FilenameStat) HitRate() float64 {
+	checked := s.Hits + s.Misses + s.ProbeHits + s.ProbeMisses
+	if checked == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.ProbeHits) / float64(checked)
+}
+
+// probability returns the estimated probability that a build includes the
+// file. The estimate is smoothed so that names with short histories tend
+// towards an even chance.
+func (s FilenameStat) probability() float64 {
+	hits := s.Hits + s.ProbeHits
+	checked := hits + s.Misses + s.ProbeMisses
+	return float64(hits+1) / float64(checked+2)
+}
+
+// FilenameStats returns the history of each file name across builds, including
+// names that were only probed. If buildType is not empty, then only builds of
+// that type are counted. Results are sorted by name.
+func (a Action) FilenameStats(e Executor, buildType string) (stats []FilenameStat, err error) {
+	const query = `
+		SELECT name, sum(hits), sum(misses), sum(unchecked), sum(probe_hits), sum(probe_misses)
+		FROM (
+			SELECT filenames.name AS name,
+				ifnull(sum(files.flags & 2 != 0), 0) AS hits, -- Exists
+				ifnull(sum(files.flags & 3 == 1), 0) AS misses, -- NotFound without Exists
+				ifnull(sum(files.flags == 0), 0) AS unchecked,
+				0 AS probe_hits,
+				0 AS probe_misses
+			FROM filenames
+			LEFT JOIN files ON files.filename == filenames.rowid
+			AND (? == '' OR files.build IN (SELECT rowid FROM builds WHERE type == ?))
+			GROUP BY filenames.rowid
+			UNION ALL
+			SELECT probes.name AS name, 0, 0, 0,
+				sum(200 <= probes.status AND probes.status < 300),
+				sum(probes.status < 200 OR 300 <= probes.status)
+			FROM probes, builds
+			WHERE probes.build == builds.rowid
+			AND (? == '' OR builds.type == ?)
+			GROUP BY probes.name
+		)
+		GROUP BY name
+		ORDER BY name
+	`
+	rows, err := e.QueryContext(a.Context, query, buildType, buildType, buildType, buildType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s FilenameStat
+		if err := rows.Scan(&s.Name, &s.Hits, &s.Misses, &s.Unchecked, &s.ProbeHits, &s.ProbeMisses); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ProgressStates lists the results of FileFlags.Progress for files in the usual
+// states, in the order they are displayed.
+var ProgressStates = []string{
+	"Unchecked",
+	"NotFound",
+	"Missing",
+	"Failed",
+	"Partial",
+	"NoContent",
+	"Complete",
+}
+
+// BuildProgress summarizes the progress of the files of a build.
+type BuildProgress struct {
+	// Hash of the build.
+	Build string
+	// Type of the build.
+	Type string
+	// When the build was created.
+	Time int64
+	// Number of files for each result of FileFlags.Progress.
+	Files map[string]int64
+	// Total size of files with content.
+	Bytes int64
+	// Size of files that exist but have no content, as reported by their
+	// headers.
+	RemainingBytes int64
+}
+
+// Total returns the number of files of the build.
+func (p BuildProgress) Total() (n int64) {
+	for _, c := range p.Files {
+		n += c
+	}
+	return n
+}
+
+// Remaining returns the number of files that are yet to be fetched: files that
+// are unchecked, or that exist but have no content. Every variant of an alias
+// group is counted.
+func (p BuildProgress) Remaining() int64 {
+	return p.Files["Unchecked"] + p.Files["Partial"] + p.Files["NoContent"]
+}
+
+// RemainingHeaders returns the number of files whose headers are yet to be
+// fetched, which are the remaining files of a headers-only archive.
+func (p BuildProgress) RemainingHeaders() int64 {
+	return p.Files["Unchecked"]
+}
+
+// Add adds the counts of q to p.
+func (p *BuildProgress) Add(q BuildProgress) {
+	if p.Files == nil {
+		p.Files = map[string]int64{}
+	}
+	for state, n := range q.Files {
+		p.Files[state] += n
+	}
+	p.Bytes += q.Bytes
+	p.RemainingBytes += q.RemainingBytes
+}
+
+// BuildProgress returns the progress of the files of each build, ordered by the
+// time of the build. If buildType is not empty, then only builds of that type
+// are included.
+func (a Action) BuildProgress(e Executor, buildType string) (progress []BuildProgress, err error) {
+	query := `
+		SELECT builds.hash, builds.type, builds.time,
+			` + progressExpr("files.flags") + ` AS progress,
+			count(*),
+			ifnull(sum(CASE WHEN ` + flagsSet("files.flags", HasContent) + ` THEN metadata.size END), 0),
+			ifnull(sum(CASE WHEN ` + flagsUnset("files.flags", HasContent) + `
+				AND ` + flagsSet("files.flags", Exists) + `
+				THEN headers.content_length END), 0)
+		FROM files
+		JOIN builds ON builds.rowid == files.build
+		LEFT JOIN metadata ON metadata.file == files.rowid
+		LEFT JOIN headers ON headers.file == files.rowid
+		WHERE ? == '' OR builds.type == ?
+		GROUP BY builds.rowid, progress
+		ORDER BY builds.time, builds.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, buildType, buildType)
+	if err != nil {
+		return nil, fmt.Errorf("select progress: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p BuildProgress
+		var state string
+		var n, bytes, remaining int64
+		if err := rows.Scan(&p.Build, &p.Type, &p.Time, &state, &n, &bytes, &remaining); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		if len(progress) == 0 || progress[len(progress)-1].Build != p.Build {
+			p.Files = map[string]int64{}
+			progress = append(progress, p)
+		}
+		last := &progress[len(progress)-1]
+		last.Files[state] += n
+		last.Bytes += bytes
+		last.RemainingBytes += remaining
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return progress, nil
+}
+
+// RebuildFirstAppearances recomputes the first appearance of every object from
+// the metadata of files.
+func (a Action) RebuildFirstAppearances(e Executor) error {
+	// The bare columns are taken from the row with the minimum time.
+	const query = `
+		DELETE FROM first_appearances;
+		INSERT INTO first_appearances (md5, build, file, time)
+		SELECT metadata.md5, builds.rowid, files.rowid, min(builds.time)
+		FROM metadata, files, builds
+		WHERE files.rowid == metadata.file
+		AND builds.rowid == files.build
+		GROUP BY metadata.md5;
+	`
+	_, err := e.ExecContext(a.Context, query)
+	return err
+}
+
+// FirstAppearance describes the earliest build with a file of an object.
+type FirstAppearance struct {
+	MD5  string
+	Size int64
+	Build
+	// Name of the file.
+	File string
+}
+
+// FirstAppearances returns the first appearance of each of the given objects,
+// by MD5 hash. If hashes is empty, then every object is returned. Results are
+// sorted by the creation time of the build. Objects that do not appear in any
+// build are omitted.
+func (a Action) FirstAppearances(e Executor, hashes []string) (results []FirstAppearance, err error) {
+	query := `
+		SELECT
+			first_appearances.md5,
+			metadata.size,
+			builds.hash,
+			builds.type,
+			builds.time,
+			builds.version,
+			filenames.name
+		FROM first_appearances, builds, files, filenames, metadata
+		WHERE builds.rowid == first_appearances.build
+		AND files.rowid == first_appearances.file
+		AND filenames.rowid == files.filename
+		AND metadata.file == files.rowid
+	`
+	args := make([]interface{}, len(hashes))
+	if len(hashes) > 0 {
+		query += `AND first_appearances.md5 IN (` + strings.TrimSuffix(strings.Repeat(`?,`, len(hashes)), `,`) + `)`
+		for i, hash := range hashes {
+			args[i] = strings.ToLower(hash)
+		}
+	}
+	query += `
+		ORDER BY first_appearances.time, first_appearances.md5
+	`
+	rows, err := e.QueryContext(a.Context, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r FirstAppearance
+		if err := rows.Scan(&r.MD5, &r.Size, &r.Hash, &r.Type, &r.Time, &r.Version, &r.File); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// BuildContent describes the content of the files of a build.
+type BuildContent struct {
+	Build
+	// Size of each distinct object, by MD5 hash.
+	Objects map[string]int64
+}
+
+// BuildContents returns the objects of each build that has files with
+// metadata. If buildType is not empty, then only builds of that type are
+// returned. Results are sorted by the creation time of the build.
+func (a Action) BuildContents(e Executor, buildType string) (builds []BuildContent, err error) {
+	const query = `
+		SELECT builds.hash, builds.type, builds.time, builds.version, metadata.md5, metadata.size
+		FROM builds, files, metadata
+		WHERE files.build == builds.rowid
+		AND metadata.file == files.rowid
+		AND (? == '' OR builds.type == ?)
+		ORDER BY builds.time, builds.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query, buildType, buildType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var build Build
+		var hash string
+		var size int64
+		if err := rows.Scan(&build.Hash, &build.Type, &build.Time, &build.Version, &hash, &size); err != nil {
+			return nil, err
+		}
+		if n := len(builds); n == 0 || builds[n-1].Hash != build.Hash {
+			builds = append(builds, BuildContent{Build: build, Objects: map[string]int64{}})
+		}
+		builds[len(builds)-1].Objects[hash] = size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return builds, nil
+}
+
+// ErrUnknownBuild indicates that a build is not present in the database.
+var ErrUnknownBuild = errors.New("unknown build")
+
+// ProbeBuild checks whether files of the given names exist for a single build.
+// Names are probed in order of their estimated hit rate, highest first. Names
+// that already have a file for the build are not probed.
+//
+// The result of each probe is recorded in the probes table. By default, found
+// names are not added to filenames.
+func (a Action) ProbeBuild(db *sql.DB, f *fetch.Fetcher, build string, names []string, opts ProbeOptions) (results []ProbeResult, err error) {
+	var buildID int
+	var buildType string
+	var servers []string
+	{
+		const query = `
+			SELECT builds.rowid, builds.type, servers.url
+			FROM builds, build_servers, servers
+			WHERE builds.hash == ?
+			AND build_servers.build == builds.rowid
+			AND build_servers.server == servers.rowid
+			ORDER BY servers.rowid
+		`
+		rows, err := db.QueryContext(a.Context, query, build)
+		if err != nil {
+			return nil, fmt.Errorf("select build: %w", err)
+		}
+		for rows.Next() {
+			var server string
+			if err := rows.Scan(&buildID, &buildType, &server); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan build: %w", err)
+			}
+			servers = append(servers, server)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("select build: %w", err)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%w %s", ErrUnknownBuild, build)
+	}
+	server := servers[0]
+	if opts.Server != "" {
+		server = sanitizeBaseURL(opts.Server)
+		found := false
+		for _, s := range servers {
+			if s == server {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("build %s is not present on server %s", build, server)
+		}
+	}
+
+	// Exclude names that are already tracked as files, or were already probed.
+	skip := map[string]bool{}
+	{
+		query := `
+			SELECT filenames.name FROM files, filenames
+			WHERE files.filename == filenames.rowid
+			AND files.build == ?
+		`
+		if !opts.Reprobe {
+			query += `UNION SELECT name FROM probes WHERE build == ?`
+		}
+		rows, err := db.QueryContext(a.Context, query, buildID, buildID)
+		if err != nil {
+			return nil, fmt.Errorf("select known names: %w", err)
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan known name: %w", err)
+			}
+			skip[name] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("select known names: %w", err)
+		}
+	}
+
+	stats, err := a.FilenameStats(db, buildType)
+	if err != nil {
+		return nil, fmt.Errorf("get filename stats: %w", err)
+	}
+	rates := make(map[string]float64, len(stats))
+	for _, stat := range stats {
+		rates[stat.Name] = stat.probability()
+	}
+	for _, name := range names {
+		if name == "" || skip[name] {
+			continue
+		}
+		skip[name] = true
+		rate, ok := rates[name]
+		if !ok {
+			rate = 0.5
+		}
+		results = append(results, ProbeResult{Name: name, HitRate: rate})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].HitRate > results[j].HitRate
+	})
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	for i := range results {
+		go func(r *ProbeResult) {
+			defer wg.Done()
+			r.Status, _, _, r.Err = f.FetchContent(a.Context, buildFileURL(server, build, r.Name), nil, nil, nil)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return results, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	const insertProbe = `
+		INSERT INTO probes (build, name, status, time)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (build, name) DO
+		UPDATE SET status = excluded.status, time = excluded.time
+	`
+	const insertFile = `
+		INSERT OR IGNORE INTO filenames (name, tier) VALUES (?, ?);
+		INSERT OR IGNORE INTO files (build, filename)
+		VALUES (?, (SELECT rowid FROM filenames WHERE name == ?));
+	`
+	now := time.Now().Unix()
+	for _, r := range results {
+		if r.Err != nil {
+			// Errors do not indicate whether the file exists.
 			continue
 		}
-		var builds []Build
-		for _, token := range stream {
-			if job, ok := token.(*histlog.Job); ok {
-				builds = append(builds, Build{
-					Hash:    job.Hash,
-					Type:    job.Build,
-					Time:    job.Time.Unix(),
-					Version: job.Version.String(),
-				})
+		if _, err := tx.ExecContext(a.Context, insertProbe, buildID, r.Name, r.Status, now); err != nil {
+			return results, fmt.Errorf("record probe %s: %w", r.Name, err)
+		}
+		if opts.AddHits && r.Found() {
+			if _, err := tx.ExecContext(a.Context, insertFile, r.Name, TierManual, buildID, r.Name); err != nil {
+				return results, fmt.Errorf("add file %s: %w", r.Name, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return results, fmt.Errorf("commit transaction: %w", err)
+	}
+	return results, nil
+}
+
+// SelectedFile identifies a file selected for fetching, along with the server
+// from which it is fetched. Files are identified by name rather than by row, so
+// that a selection can be shared between databases.
+type SelectedFile struct {
+	Server string `json:"server"`
+	Build  string `json:"build"`
+	File   string `json:"file"`
+
+	// Row of the file in the database from which it was selected.
+	id int
+}
+
+// SelectFiles returns the files that would be fetched by FetchContent with the
+// given options, in the order they would be fetched. Of the servers on which a
+// file is present, the first is selected.
+func (a Action) SelectFiles(db *sql.DB, opts FetchOptions) (files []SelectedFile, err error) {
+	q := selectFiles().
+		Column("files.rowid").
+		Column("min(servers.rowid)").
+		Column("servers.url").
+		Column("builds.hash").
+		Column("filenames.name")
+	joinFilenames(joinServers(q))
+	opts.selection(q)
+	rows, err := a.querySelection(db, q.Select(`
+		GROUP BY files.rowid
+		ORDER BY files.rowid
+	`), q.Params()...)
+	if err != nil {
+		return nil, fmt.Errorf("select files: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var server int
+		var file SelectedFile
+		if err := rows.Scan(&file.id, &server, &file.Server, &file.Build, &file.File); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		files = append(files, file)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return files, nil
+}
+
+// ListFiles returns every file in the database that matches query, which may
+// refer to the variables of the content domain, ordered by row. Of the servers
+// on which a file is present, the first is selected.
+func (a Action) ListFiles(db *sql.DB, query filters.Query) (files []SelectedFile, err error) {
+	q := selectFiles().
+		Column("files.rowid AS id").
+		Column("min(servers.rowid)").
+		Column("servers.url AS _server").
+		Column("builds.hash AS _build").
+		Column("filenames.name AS _file")
+	joinFilenames(joinServers(q))
+	q.Where(query.Expr, query.Params...)
+	rows, err := a.querySelection(db, q.Select(`
+		GROUP BY files.rowid
+		ORDER BY files.rowid
+	`), q.Params()...)
+	if err != nil {
+		return nil, fmt.Errorf("list files: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var server int
+		var file SelectedFile
+		if err := rows.Scan(&file.id, &server, &file.Server, &file.Build, &file.File); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		files = append(files, file)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return files, nil
+}
+
+// ManifestEntry describes a file of the archive, along with its build, the
+// server on which the build is present with the lexicographically smallest URL,
+// and the headers and metadata of the file. Fields that are not known are nil.
+type ManifestEntry struct {
+	Server        string  `json:"server"`
+	Build         string  `json:"build"`
+	Type          string  `json:"type"`
+	Time          int64   `json:"time"`
+	Version       string  `json:"version"`
+	File          string  `json:"file"`
+	Progress      string  `json:"progress"`
+	Status        *int64  `json:"status,omitempty"`
+	ContentLength *int64  `json:"content_length,omitempty"`
+	LastModified  *int64  `json:"last_modified,omitempty"`
+	ContentType   *string `json:"content_type,omitempty"`
+	ETag          *string `json:"etag,omitempty"`
+	Size          *int64  `json:"size,omitempty"`
+	MD5           *string `json:"md5,omitempty"`
+	SHA256        *string `json:"sha256,omitempty"`
+}
+
+// ExportManifest calls fn with the entry of each file matching query. The query
+// has the variables of the content domain. If since is greater than zero, then
+// only files added or changed at or after since, a Unix timestamp, are
+// included. Entries are in exportOrder, and hashes are in lower case, so that
+// the same files produce the same entries regardless of the order in which they
+// were added.
+func (a Action) ExportManifest(db *sql.DB, query filters.Query, since int64, fn func(ManifestEntry) error) error {
+	q := selectFiles().
+		Column("files.rowid AS id").
+		Column("min(servers.url) AS server").
+		Column("servers.url AS _server").
+		Column("builds.hash AS _build").
+		Column("filenames.name AS _file")
+	joinFilenames(joinServers(q))
+	q.Where(query.Expr, query.Params...)
+	if since > 0 {
+		q.Where(changedSince, since)
+	}
+	rows, err := a.querySelection(db, `
+		SELECT
+			selected.server,
+			builds.hash,
+			builds.type,
+			builds.time,
+			builds.version,
+			filenames.name,
+			files.flags,
+			headers.status,
+			headers.content_length,
+			headers.last_modified,
+			headers.content_type,
+			headers.etag,
+			metadata.size,
+			lower(metadata.md5),
+			lower(metadata.sha256)
+		FROM (`+q.Select(`GROUP BY files.rowid`)+`) AS selected
+		JOIN files ON files.rowid == selected.id
+		JOIN builds ON builds.rowid == files.build
+		JOIN filenames ON filenames.rowid == files.filename
+		LEFT JOIN headers ON headers.file == files.rowid
+		LEFT JOIN metadata ON metadata.file == files.rowid
+		ORDER BY `+exportOrder+`
+	`, q.Params()...)
+	if err != nil {
+		return fmt.Errorf("select manifest: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ManifestEntry
+		var flags FileFlags
+		err := rows.Scan(
+			&e.Server, &e.Build, &e.Type, &e.Time, &e.Version, &e.File, &flags,
+			&e.Status, &e.ContentLength, &e.LastModified, &e.ContentType, &e.ETag,
+			&e.Size, &e.MD5, &e.SHA256,
+		)
+		if err != nil {
+			return fmt.Errorf("scan row: %w", err)
+		}
+		e.Progress = flags.Progress()
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("row error: %w", err)
+	}
+	return nil
+}
+
+// FileObject returns the hash and size of the object holding the content of the
+// file of the given name within a build, along with the content type with which
+// the file was served, if known. If the file does not exist or has no content,
+// then the error satisfies errors.Is(err, os.ErrNotExist).
+func (a Action) FileObject(e Executor, build, name string) (hash string, size int64, contentType string, err error) {
+	query := `
+		SELECT lower(metadata.md5), metadata.size, ifnull(headers.content_type, '')
+		FROM files
+		JOIN builds ON builds.rowid == files.build
+		JOIN filenames ON filenames.rowid == files.filename
+		JOIN metadata ON metadata.file == files.rowid
+		LEFT JOIN headers ON headers.file == files.rowid
+		WHERE builds.hash == ?
+		AND filenames.name == ?
+		AND ` + flagsSet("files.flags", HasContent) + `
+	`
+	rows, err := e.QueryContext(a.Context, query, build, name)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", 0, "", err
+		}
+		return "", 0, "", fmt.Errorf("file %s-%s: %w", build, name, os.ErrNotExist)
+	}
+	if err := rows.Scan(&hash, &size, &contentType); err != nil {
+		return "", 0, "", err
+	}
+	return hash, size, contentType, rows.Close()
+}
+
+// LoadSelection replaces the contents of the selected_files table with the
+// given files, to be fetched with the FromSelection option. Files that are not
+// present in the database on the given server are ignored. Returns the number
+// of files that were loaded.
+func (a Action) LoadSelection(db *sql.DB, files []SelectedFile) (n int, err error) {
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(a.Context, `DELETE FROM selected_files`); err != nil {
+		return 0, fmt.Errorf("clear selection: %w", err)
+	}
+	const query = `
+		INSERT OR IGNORE INTO selected_files (file, server)
+		SELECT files.rowid, servers.rowid
+		FROM files, builds, filenames, build_servers, servers
+		WHERE files.build == builds.rowid
+		AND files.filename == filenames.rowid
+		AND build_servers.build == builds.rowid
+		AND build_servers.server == servers.rowid
+		AND servers.url == ?
+		AND builds.hash == ?
+		AND filenames.name == ?
+	`
+	for _, file := range files {
+		result, err := tx.ExecContext(a.Context, query, sanitizeBaseURL(file.Server), file.Build, file.File)
+		if err != nil {
+			return 0, fmt.Errorf("select %s-%s: %w", file.Build, file.File, err)
+		}
+		if rows, err := result.RowsAffected(); err == nil {
+			n += int(rows)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return n, nil
+}
+
+// FileResult is the result of fetching a file, in a form that can be exchanged
+// between databases. Files are identified by name rather than by row.
+type FileResult struct {
+	// Server from which the file is available. When exported, the server of
+	// the build with the lexicographically smallest URL.
+	Server string `json:"server"`
+	// Hash of the build of the file.
+	Build string `json:"build"`
+	// Name of the file.
+	File string `json:"file"`
+	// Flags of the file.
+	Flags FileFlags `json:"flags"`
+	// Headers of the file, if any.
+	Headers *ResultHeaders `json:"headers,omitempty"`
+	// Provenance headers of the file, if any.
+	Fields map[string]string `json:"fields,omitempty"`
+	// Metadata of the file, if any.
+	Metadata *ResultMetadata `json:"metadata,omitempty"`
+}
+
+// ResultHeaders contains the headers of a FileResult.
+type ResultHeaders struct {
+	Status        int     `json:"status"`
+	ContentLength *int64  `json:"content_length,omitempty"`
+	LastModified  *int64  `json:"last_modified,omitempty"`
+	ContentType   *string `json:"content_type,omitempty"`
+	ETag          *string `json:"etag,omitempty"`
+}
+
+// ResultMetadata contains the metadata of a FileResult.
+type ResultMetadata struct {
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// exportOrder orders the files of an export by the time and hash of their build,
+// then by name, which does not depend on the order in which files were added.
+const exportOrder = `builds.time, builds.hash, filenames.name`
+
+// changedSince is a condition on files, selecting those added or changed at or
+// after a bound Unix timestamp.
+const changedSince = `files.rowid IN (SELECT file FROM file_changes WHERE time >= ?)`
+
+// exportSchema lists the tables and columns read by ExportBuilds and
+// ExportResults.
+var exportSchema = []struct {
+	Table   string
+	Columns []string
+}{
+	{"builds", []string{"hash", "type", "time", "version"}},
+	{"build_events", []string{"build", "time"}},
+	{"build_servers", []string{"build", "server"}},
+	{"servers", []string{"url"}},
+	{"filenames", []string{"name"}},
+	{"files", []string{"build", "filename", "flags"}},
+	{"headers", []string{"file", "status", "content_length", "last_modified", "content_type", "etag"}},
+	{"header_fields", []string{"file", "name", "value"}},
+	{"metadata", []string{"file", "size", "md5", "sha256"}},
+}
+
+// CheckExportSchema returns an error if the database lacks a table or column
+// read by ExportBuilds or ExportResults, such as a database created by an
+// earlier version that was never migrated. Unlike Init, the database is not
+// modified, so a read-only database can be checked.
+func (a Action) CheckExportSchema(e Executor) error {
+	for _, t := range exportSchema {
+		columns, err := a.tableColumns(e, a.tableSchema(e, t.Table), t.Table)
+		if err != nil {
+			return fmt.Errorf("read schema of %s: %w", t.Table, err)
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("schema too old: missing table %s", t.Table)
+		}
+		for _, column := range t.Columns {
+			if !containsString(columns, column) {
+				return fmt.Errorf("schema too old: missing column %s.%s", t.Table, column)
 			}
 		}
-		sort.Slice(builds, func(i, j int) bool {
-			return builds[i].Hash < builds[j].Hash
-		})
-		j := 0
-		for i := 1; i < len(builds); i++ {
-			if builds[j] != builds[i] {
-				j++
-				builds[j] = builds[i]
+	}
+	return nil
+}
+
+// ExportResults calls fn with the result of each checked file. If selected is
+// true, then only files in the selected_files table are included. If since is
+// greater than zero, then only files added or changed at or after since, a Unix
+// timestamp, are included. Results are in exportOrder, and hashes are in lower
+// case.
+func (a Action) ExportResults(db *sql.DB, selected bool, since int64, fn func(FileResult) error) error {
+	var cond string
+	var params []interface{}
+	if selected {
+		cond += "\nAND files.rowid IN (SELECT file FROM selected_files)"
+	}
+	if since > 0 {
+		cond += "\nAND " + changedSince
+		params = append(params, since)
+	}
+	query := `
+		SELECT
+			files.rowid,
+			min(servers.url),
+			builds.hash,
+			filenames.name,
+			files.flags,
+			headers.status,
+			headers.content_length,
+			headers.last_modified,
+			headers.content_type,
+			headers.etag,
+			metadata.size,
+			lower(metadata.md5),
+			lower(metadata.sha256)
+		FROM files
+		JOIN builds ON builds.rowid == files.build
+		JOIN filenames ON filenames.rowid == files.filename
+		JOIN build_servers ON build_servers.build == files.build
+		JOIN servers ON servers.rowid == build_servers.server
+		LEFT JOIN headers ON headers.file == files.rowid
+		LEFT JOIN metadata ON metadata.file == files.rowid
+		WHERE files.flags != 0 -- Unchecked
+		%s
+		GROUP BY files.rowid
+		ORDER BY ` + exportOrder + `
+	`
+	// The fields are of the same files as the results, in the same order.
+	fieldsQuery := `
+		SELECT header_fields.file, header_fields.name, header_fields.value
+		FROM header_fields
+		JOIN files ON files.rowid == header_fields.file
+		JOIN builds ON builds.rowid == files.build
+		JOIN filenames ON filenames.rowid == files.filename
+		WHERE files.flags != 0 -- Unchecked
+		AND EXISTS (
+			SELECT 1 FROM build_servers, servers
+			WHERE build_servers.build == files.build
+			AND servers.rowid == build_servers.server
+		)
+		%s
+		ORDER BY ` + exportOrder + `
+	`
+	rows, err := db.QueryContext(a.Context, fmt.Sprintf(query, cond), params...)
+	if err != nil {
+		return fmt.Errorf("select results: %w", err)
+	}
+	defer rows.Close()
+	fields, err := db.QueryContext(a.Context, fmt.Sprintf(fieldsQuery, cond), params...)
+	if err != nil {
+		return fmt.Errorf("select header fields: %w", err)
+	}
+	defer fields.Close()
+
+	// Both queries list the same files in the same order, so fields are merged
+	// by walking them alongside the files.
+	var field struct {
+		file  int
+		name  string
+		value string
+	}
+	hasField := fields.Next()
+	if hasField {
+		if err := fields.Scan(&field.file, &field.name, &field.value); err != nil {
+			return fmt.Errorf("scan header field: %w", err)
+		}
+	}
+
+	for rows.Next() {
+		var id int
+		var r FileResult
+		var status sql.NullInt64
+		var h ResultHeaders
+		var size sql.NullInt64
+		var md5, sha sql.NullString
+		err := rows.Scan(
+			&id,
+			&r.Server, &r.Build, &r.File, &r.Flags,
+			&status, &h.ContentLength, &h.LastModified, &h.ContentType, &h.ETag,
+			&size, &md5, &sha,
+		)
+		if err != nil {
+			return fmt.Errorf("scan result: %w", err)
+		}
+		if status.Valid {
+			h.Status = int(status.Int64)
+			r.Headers = &h
+		}
+		if size.Valid && md5.Valid {
+			r.Metadata = &ResultMetadata{Size: size.Int64, MD5: md5.String, SHA256: sha.String}
+		}
+		for hasField && field.file == id {
+			if r.Fields == nil {
+				r.Fields = map[string]string{}
+			}
+			r.Fields[field.name] = field.value
+			if hasField = fields.Next(); hasField {
+				if err := fields.Scan(&field.file, &field.name, &field.value); err != nil {
+					return fmt.Errorf("scan header field: %w", err)
+				}
 			}
 		}
-		builds = builds[:j+1]
-		count := 0
-		for _, build := range builds {
-			if err := a.AddBuild(tx, server, build); err != nil {
-				if serr := (sqlite3.Error{}); errors.As(err, &serr) && serr.Code == sqlite3.ErrConstraint {
-					// Ignore constraint errors.
-					continue
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("select results: %w", err)
+	}
+	if err = fields.Err(); err != nil {
+		return fmt.Errorf("select header fields: %w", err)
+	}
+	return nil
+}
+
+// ImportStats contains the results of ImportResults.
+type ImportStats struct {
+	// Number of files that were updated.
+	Updated int
+	// Number of files that already had the imported data.
+	Unchanged int
+	// Number of files whose build or name is not in the database.
+	Unknown int
+}
+
+// resultFlags are the flags of a file that are transferred by ImportResults.
+const resultFlags = NotFound | Exists | HasHeaders | HasMetadata | HasContent
+
+// ImportResults merges the results of files fetched by another database. For
+// each result, hasContent reports whether the content of the file is present
+// locally, having been verified against the metadata of the result.
+//
+// Data already present locally is kept. Headers and metadata are added to files
+// that lack them. A result indicating that a file was not found is applied
+// only to Unchecked files, while a result indicating that a file exists clears
+// the NotFound flag.
+func (a Action) ImportResults(db *sql.DB, results []FileResult, hasContent func(FileResult) bool) (stats ImportStats, err error) {
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return stats, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const insertFile = `
+		INSERT OR IGNORE INTO files (build, filename)
+		SELECT builds.rowid, filenames.rowid FROM builds, filenames
+		WHERE builds.hash == ? AND filenames.name == ?
+	`
+	const selectFile = `
+		SELECT files.rowid, files.flags FROM files, builds, filenames
+		WHERE files.build == builds.rowid
+		AND files.filename == filenames.rowid
+		AND builds.hash == ?
+		AND filenames.name == ?
+	`
+	const updateHeaders = `
+		INSERT INTO headers(file, status, content_length, last_modified, content_type, etag, etag_format)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (file) DO
+		UPDATE SET
+			status = excluded.status,
+			content_length = excluded.content_length,
+			last_modified = excluded.last_modified,
+			content_type = excluded.content_type,
+			etag = excluded.etag,
+			etag_format = excluded.etag_format
+	`
+	const updateField = `
+		INSERT INTO header_fields(file, name, value)
+		VALUES (?, ?, ?)
+		ON CONFLICT (file, name) DO
+		UPDATE SET value = excluded.value
+	`
+	for _, r := range results {
+		if _, err := tx.ExecContext(a.Context, insertFile, r.Build, r.File); err != nil {
+			return stats, fmt.Errorf("add file %s-%s: %w", r.Build, r.File, err)
+		}
+		var id int
+		var local FileFlags
+		rows, err := tx.QueryContext(a.Context, selectFile, r.Build, r.File)
+		if err != nil {
+			return stats, fmt.Errorf("select file %s-%s: %w", r.Build, r.File, err)
+		}
+		found := rows.Next()
+		if found {
+			err = rows.Scan(&id, &local)
+		}
+		rows.Close()
+		if err != nil {
+			return stats, fmt.Errorf("scan file %s-%s: %w", r.Build, r.File, err)
+		}
+		if !found {
+			stats.Unknown++
+			continue
+		}
+
+		remote := r.Flags & resultFlags
+		if r.Headers == nil {
+			remote &^= HasHeaders
+		}
+		if r.Metadata == nil {
+			remote &^= HasMetadata
+		}
+		if remote&HasContent != 0 && (r.Metadata == nil || !hasContent(r)) {
+			remote &^= HasContent
+		}
+
+		flags := local
+		switch {
+		case remote&Exists != 0 && remote&NotFound == 0:
+			flags = (flags | remote) &^ NotFound
+		case remote&NotFound != 0 && local == Unchecked:
+			flags = remote &^ (HasMetadata | HasContent)
+		}
+		if flags == local {
+			stats.Unchanged++
+			continue
+		}
+
+		if flags&HasHeaders != 0 && local&HasHeaders == 0 {
+			h := r.Headers
+			var format sql.NullString
+			if h.ETag != nil {
+				format = etagFormat(*h.ETag)
+			}
+			if _, err := tx.ExecContext(a.Context, updateHeaders, id, h.Status, h.ContentLength, h.LastModified, h.ContentType, h.ETag, format); err != nil {
+				return stats, fmt.Errorf("update headers %s-%s: %w", r.Build, r.File, err)
+			}
+			for name, value := range r.Fields {
+				if _, err := tx.ExecContext(a.Context, updateField, id, name, value); err != nil {
+					return stats, fmt.Errorf("update header field %s-%s: %w", r.Build, r.File, err)
 				}
-				tx.Rollback()
-				return fmt.Errorf("add build %s: %w", build.Hash, err)
 			}
-			count++
 		}
-		if err := tx.Commit(); err != nil {
-			log.Printf("commit tx: %s", err)
+		if flags&HasMetadata != 0 && local&HasMetadata == 0 {
+			sha := sql.NullString{String: r.Metadata.SHA256, Valid: r.Metadata.SHA256 != ""}
+			if _, err := tx.ExecContext(a.Context, upsertMetadata, id, r.Metadata.Size, r.Metadata.MD5, sha, nil); err != nil {
+				return stats, fmt.Errorf("update metadata %s-%s: %w", r.Build, r.File, err)
+			}
+		}
+		if _, err := tx.ExecContext(a.Context, `UPDATE files SET flags = ? WHERE rowid = ?`, int(flags), id); err != nil {
+			return stats, fmt.Errorf("update file %s-%s: %w", r.Build, r.File, err)
+		}
+		stats.Updated++
+	}
+	if err := tx.Commit(); err != nil {
+		return stats, fmt.Errorf("commit transaction: %w", err)
+	}
+	return stats, nil
+}
+
+// RecentObjects is the number of most recent metadata rows checked by
+// CheckRecentObjects when no rows have been checked before.
+const RecentObjects = 1024
+
+// CheckRecentObjects compares the size of each object added since the last
+// check with the size recorded in its metadata. This catches objects that were
+// truncated or lost, such as by a crash, before they are served or mirrored.
+// Only the file info of objects is read, so the check is cheap.
+//
+// If store is not nil, then an object that is not in objpath is looked up in
+// store, to which it may have been moved.
+//
+// For a damaged object, the object is removed, and the HasContent flag is
+// unset from each file referring to it, so that the content is fetched again.
+// Returns the number of objects that were checked, and the hashes of damaged
+// objects.
+func (a Action) CheckRecentObjects(db *sql.DB, objpath string, store objects.Storage) (checked int, damaged []string, err error) {
+	if objpath == "" {
+		return 0, nil, nil
+	}
+	const stateName = "objects_checked"
+	var since int64
+	err = db.QueryRowContext(a.Context, `SELECT value FROM state WHERE name == ?`, stateName).Scan(&since)
+	if err == sql.ErrNoRows {
+		since, err = a.queryInt(db, `SELECT ifnull(max(rowid), 0) FROM metadata`)
+		since -= RecentObjects
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("get last checked object: %w", err)
+	}
+
+	const query = `
+		SELECT metadata.rowid, metadata.size, metadata.md5
+		FROM metadata, files
+		WHERE metadata.file == files.rowid
+		AND files.flags & 16 != 0 -- HasContent
+		AND metadata.rowid > ?
+		ORDER BY metadata.rowid
+	`
+	rows, err := db.QueryContext(a.Context, query, since)
+	if err != nil {
+		return 0, nil, fmt.Errorf("select recent objects: %w", err)
+	}
+	last := since
+	bad := map[string]bool{}
+	for rows.Next() {
+		var size int64
+		var hash string
+		if err := rows.Scan(&last, &size, &hash); err != nil {
+			rows.Close()
+			return 0, nil, fmt.Errorf("scan object: %w", err)
+		}
+		checked++
+		if bad[hash] {
 			continue
 		}
-		log.Printf("add %d new builds from %s", count, server)
+		if stat := objects.Stat(objpath, hash); stat != nil {
+			if stat.Size() == size {
+				continue
+			}
+		} else if store != nil {
+			n, err := store.Stat(a.Context, hash)
+			if err == nil && n == size {
+				continue
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				rows.Close()
+				return 0, nil, fmt.Errorf("stat object %s: %w", hash, err)
+			}
+		}
+		bad[hash] = true
+		damaged = append(damaged, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("select recent objects: %w", err)
+	}
+
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := a.unflagObjects(tx, damaged); err != nil {
+		return 0, nil, err
+	}
+	const mark = `
+		INSERT INTO state (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value
+	`
+	if _, err := tx.ExecContext(a.Context, mark, stateName, last); err != nil {
+		return 0, nil, fmt.Errorf("set last checked object: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("commit transaction: %w", err)
+	}
+	// Objects are removed only once the files no longer refer to them.
+	for _, hash := range damaged {
+		objects.Remove(objpath, hash)
+		if store != nil {
+			if err := store.Remove(a.Context, hash); err != nil {
+				log.Printf("remove object %s from storage: %s", hash, err)
+			}
+		}
+	}
+	return checked, damaged, nil
+}
+
+// StoreObjects moves the committed objects of objpath to store. Damaged objects
+// are left in objpath, to be found by a check.
+func (a Action) StoreObjects(objpath string, store objects.Storage) error {
+	n, size, damaged, err := objects.Offload(a.Context, objpath, store)
+	for _, hash := range damaged {
+		log.Printf("object %s is damaged; not moved to storage", hash)
+	}
+	if err != nil {
+		return fmt.Errorf("move objects to storage: %w", err)
+	}
+	if n > 0 {
+		log.Printf("moved %d objects (%s) to storage", n, formatSize(size))
 	}
 	return nil
 }
 
-// GenerateFiles inserts into a database combinations of build hashes and file
-// names that aren't already present. Files are added with the Unchecked flags.
-func (a Action) GenerateFiles(e Executor) (newRows int, err error) {
-	// Insert into files all combinations of builds and filenames that aren't
-	// already in files. Slower: Cut `OR IGNORE` and append `EXCEPT SELECT
-	// build, filename FROM files`.
-	const query = `
-		INSERT OR IGNORE INTO files (build, filename)
-		SELECT builds.rowid, filenames.rowid FROM filenames, builds
+// unflagObjects unsets the HasContent flag from each file whose metadata refers
+// to one of the given object hashes, so that their content is fetched again.
+func (a Action) unflagObjects(e Executor, hashes []string) error {
+	const unflag = `
+		UPDATE files SET flags = flags & ~16 -- HasContent
+		WHERE rowid IN (SELECT file FROM metadata WHERE md5 == ?)
 	`
-	result, err := e.ExecContext(a.Context, query)
+	for _, hash := range hashes {
+		if _, err := e.ExecContext(a.Context, unflag, hash); err != nil {
+			return fmt.Errorf("unflag object %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// ContentObjects returns the hash and size of each object referred to by the
+// metadata of a file that has content. If the metadata of several files with
+// the same hash disagree on the size, then the largest size is returned.
+func (a Action) ContentObjects(db *sql.DB) (sizes map[string]int64, err error) {
+	rows, err := db.QueryContext(a.Context, `
+		SELECT metadata.md5, max(metadata.size)
+		FROM metadata, files
+		WHERE metadata.file == files.rowid
+		AND `+flagsSet("files.flags", HasContent)+`
+		GROUP BY metadata.md5
+	`)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("select content objects: %w", err)
+	}
+	defer rows.Close()
+	sizes = map[string]int64{}
+	for rows.Next() {
+		var hash string
+		var size int64
+		if err := rows.Scan(&hash, &size); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		sizes[hash] = size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return sizes, nil
+}
+
+// ReferencedObjects returns the set of hashes of objects referred to by the
+// database: by the metadata of any file, whether or not it has content, by
+// deploy files, by decoded copies and the objects they were decoded from, and
+// by fetched assets.
+func (a Action) ReferencedObjects(db *sql.DB) (hashes map[string]bool, err error) {
+	rows, err := db.QueryContext(a.Context, `
+		SELECT md5 FROM metadata
+		UNION SELECT md5 FROM deploy_files
+		UNION SELECT md5 FROM decoded_objects
+		UNION SELECT decoded FROM decoded_objects
+		UNION SELECT md5 FROM assets WHERE md5 IS NOT NULL
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("select referenced objects: %w", err)
+	}
+	defer rows.Close()
+	hashes = map[string]bool{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		hashes[strings.ToLower(hash)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return hashes, nil
+}
+
+// UnhashedObjects returns the hash of each object referred to by the metadata of
+// a file that has content, but whose SHA-256 hash is not known. Hashes are
+// sorted.
+func (a Action) UnhashedObjects(db *sql.DB) (hashes []string, err error) {
+	rows, err := db.QueryContext(a.Context, `
+		SELECT DISTINCT metadata.md5
+		FROM metadata, files
+		WHERE metadata.file == files.rowid
+		AND metadata.sha256 IS NULL
+		AND `+flagsSet("files.flags", HasContent)+`
+		ORDER BY metadata.md5
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("select unhashed objects: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		hashes = append(hashes, hash)
 	}
-	if result != nil {
-		rows, _ := result.RowsAffected()
-		newRows = int(rows)
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
 	}
-	return newRows, err
+	return hashes, nil
 }
 
-const DefaultBatchSize = 256
+// SetObjectSHA256 sets the SHA-256 hash of the metadata of each file whose MD5
+// hash is md5, where the SHA-256 hash is not already known.
+func (a Action) SetObjectSHA256(e Executor, md5, sha string) error {
+	const query = `UPDATE metadata SET sha256 = ? WHERE md5 == ? AND sha256 IS NULL`
+	if _, err := e.ExecContext(a.Context, query, sha, md5); err != nil {
+		return fmt.Errorf("set sha256 of %s: %w", md5, err)
+	}
+	return nil
+}
 
-func getHeader(headers http.Header, key string, typ int) interface{} {
-	v := headers.Get(key)
-	if v == "" {
-		return nil
+// SetStoredSize sets the stored size of the metadata of each file whose MD5 hash
+// is md5, given the info of the object as returned by objects.Stat. The stored
+// size is unset if the object is not compressed, or if info is nil.
+func (a Action) SetStoredSize(e Executor, md5 string, info os.FileInfo) error {
+	var stored sql.NullInt64
+	if info != nil && objects.IsCompressed(info) {
+		stored = sql.NullInt64{Int64: objects.StoredSize(info), Valid: true}
 	}
-	switch typ {
-	case 0:
-		return v
-	case 1:
-		n, err := strconv.ParseInt(v, 10, 63)
-		if err != nil {
-			return nil
-		}
-		return n
-	case 2:
-		t, err := time.Parse(time.RFC1123, v)
-		if err != nil {
-			return nil
-		}
-		return t.Unix()
+	const query = `UPDATE metadata SET stored_size = ? WHERE md5 == ?`
+	if _, err := e.ExecContext(a.Context, query, stored, md5); err != nil {
+		return fmt.Errorf("set stored size of %s: %w", md5, err)
 	}
 	return nil
 }
 
-func isDir(path string) error {
-	if stat, err := os.Lstat(path); os.IsNotExist(err) {
+// UnflagObjects unsets the HasContent flag from each file whose metadata refers
+// to one of the given object hashes, so that a later fetch downloads their
+// content again. The objects themselves are not touched.
+func (a Action) UnflagObjects(db *sql.DB, hashes []string) error {
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := a.unflagObjects(tx, hashes); err != nil {
 		return err
-	} else if !stat.IsDir() {
-		return fmt.Errorf("%s: not a directory", path)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
 	}
 	return nil
 }
 
-type reqEntry struct {
-	id     int
-	flags  int
-	server string
-	build  string
-	file   string
+// ContentlessObjects returns the hash and size of each object referred to by the
+// metadata of a file that has no content. If the metadata of several files with
+// the same hash disagree on the size, then the largest size is returned.
+func (a Action) ContentlessObjects(db *sql.DB) (sizes map[string]int64, err error) {
+	rows, err := db.QueryContext(a.Context, `
+		SELECT metadata.md5, max(metadata.size)
+		FROM metadata, files
+		WHERE metadata.file == files.rowid
+		AND `+flagsSet("files.flags", HasMetadata)+`
+		AND `+flagsUnset("files.flags", HasContent)+`
+		GROUP BY metadata.md5
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("select contentless objects: %w", err)
+	}
+	defer rows.Close()
+	sizes = map[string]int64{}
+	for rows.Next() {
+		var hash string
+		var size int64
+		if err := rows.Scan(&hash, &size); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		sizes[hash] = size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return sizes, nil
 }
 
-// Combination of extra queries to make.
-const (
-	qHeaders      = 1 << iota // Upsert all headers.
-	qHeaderStatus             // Upsert just the status header.
-	qMetadata                 // Upsert metadata.
-)
-
-type respEntry struct {
-	err error
-
-	id      int
-	flags   FileFlags
-	qAction int
-
-	// headers
-	respStatus    int
-	contentLength sql.NullInt64
-	lastModified  sql.NullInt64
-	contentType   sql.NullString
-	etag          sql.NullString
-
-	// metadata
-	hash string
-	size int64
+// FlagObject sets the HasContent flag of each file with metadata that refers to
+// the object of the given MD5 hash, and sets the SHA-256 hash of the metadata
+// where it is not already known.
+func (a Action) FlagObject(e Executor, md5, sha string) error {
+	const flag = `
+		UPDATE files SET flags = flags | 16 -- HasContent
+		WHERE flags & 8 != 0 -- HasMetadata
+		AND rowid IN (SELECT file FROM metadata WHERE md5 == ?)
+	`
+	if _, err := e.ExecContext(a.Context, flag, md5); err != nil {
+		return fmt.Errorf("flag object %s: %w", md5, err)
+	}
+	return a.SetObjectSHA256(e, md5, sha)
 }
 
-func runFetchContentWorker(ctx context.Context, wg *sync.WaitGroup, f *fetch.Fetcher, objpath string, req *reqEntry, entry *respEntry) {
-	defer wg.Done()
-	*entry = respEntry{}
-	object := objects.NewWriter(objpath)
-	var hashes *fetch.HashStore
-	if objpath != "" {
-		hashes = &fetch.HashStore{}
+// ReconcileJournal resolves the objects that remain in the journal of objpath
+// after a run was interrupted, then finalizes the journal. Returns the hashes of
+// objects that no file with content refers to, which were written without their
+// metadata being committed.
+//
+// Uncommitted objects are not removed, because other archives may share
+// objpath and refer to them. An object is only placed once it is complete, so
+// it is reused when its file is fetched again, and is otherwise removed by the
+// gc command, which checks every archive of the objects path.
+//
+// Must not be called while another process is fetching into objpath.
+func (a Action) ReconcileJournal(db *sql.DB, objpath string) (uncommitted []string, err error) {
+	if objpath == "" {
+		return nil, nil
 	}
-	respStatus, headers, err := f.FetchContent(ctx, buildFileURL(req.server, req.build, req.file), objpath, hashes, object.AsWriter())
+	entries, err := objects.ReadJournal(objpath)
 	if err != nil {
-		*entry = respEntry{err: fmt.Errorf("fetch content: %w", err)}
-		return
+		return nil, fmt.Errorf("read journal: %w", err)
 	}
-	entry.id = req.id
-	entry.flags = FileFlags(req.flags)
-	entry.respStatus = respStatus
-	skipped := false
-	if 200 <= respStatus && respStatus < 300 {
-		entry.flags |= Exists | HasHeaders
-		entry.flags &^= NotFound
-		entry.qAction |= qHeaders
-		if v, err := strconv.ParseInt(headers.Get("content-length"), 10, 64); err == nil {
-			entry.contentLength.Valid = true
-			entry.contentLength.Int64 = v
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM metadata, files
+			WHERE metadata.file == files.rowid
+			AND metadata.md5 == ?
+			AND metadata.size == ?
+			AND ` + flagsSet("files.flags", HasContent) + `
+		)
+	`
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[entry.Hash] {
+			continue
 		}
-		if v, err := time.Parse(time.RFC1123, headers.Get("last-modified")); err == nil {
-			entry.lastModified.Valid = true
-			entry.lastModified.Int64 = v.Unix()
+		seen[entry.Hash] = true
+		var committed bool
+		if err := db.QueryRowContext(a.Context, query, entry.Hash, entry.Size).Scan(&committed); err != nil {
+			return uncommitted, fmt.Errorf("reconcile object %s: %w", entry.Hash, err)
 		}
-		if v := headers.Get("content-type"); v != "" {
-			entry.contentType.Valid = true
-			entry.contentType.String = v
+		if !committed && objects.Exists(objpath, entry.Hash) {
+			uncommitted = append(uncommitted, entry.Hash)
 		}
-		if v := headers.Get("etag"); v != "" {
-			entry.etag.Valid = true
-			entry.etag.String = v
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	journal, err := objects.OpenJournal(objpath)
+	if err != nil {
+		return uncommitted, fmt.Errorf("open journal: %w", err)
+	}
+	defer journal.Close()
+	if err := journal.Finalize(); err != nil {
+		return uncommitted, fmt.Errorf("finalize journal: %w", err)
+	}
+	return uncommitted, nil
+}
+
+// DefaultDeployFiles are the files at constant locations that are fetched when
+// none are configured. These are the bootstrappers that install the client,
+// which are replaced without a new build.
+var DefaultDeployFiles = []string{
+	"RobloxPlayerLauncher.exe",
+	"RobloxStudioLauncherBeta.exe",
+	"Roblox.dmg",
+	"RobloxStudio.dmg",
+}
+
+// DeployFileResult is the result of fetching a file at a constant location.
+type DeployFileResult struct {
+	Server string
+	Name   string
+	Status int
+	Hash   string
+	Size   int64
+	// Whether the content was not previously seen at the location.
+	New bool
+	// Hash of the decoded copy of the content, if any.
+	Decoded string
+	Err     error
+}
+
+// FetchDeployFiles downloads each of the given files from each enabled server
+// in the database into objpath. A version of a file is a distinct object, and
+// each version is recorded in the deploy_files table, along with when it was
+// first and last fetched. A file that could not be fetched is reported in its
+// result, and does not stop the remaining files.
+//
+// If decode is true, then the content of each file that is compressed with
+// gzip is also written decoded as another object, if it is text, and the two
+// objects are linked in the decoded_objects table.
+func (a Action) FetchDeployFiles(db *sql.DB, f *fetch.Fetcher, objpath string, names []string, decode, compress bool) (results []DeployFileResult, err error) {
+	if err := isDir(objpath); err != nil {
+		return nil, err
+	}
+	type server struct {
+		id  int
+		url string
+	}
+	var servers []server
+	rows, err := db.QueryContext(a.Context, `SELECT rowid, url FROM servers WHERE NOT disabled ORDER BY rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("get servers: %w", err)
+	}
+	for rows.Next() {
+		var s server
+		if err := rows.Scan(&s.id, &s.url); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan server: %w", err)
 		}
-		if object != nil {
-			var size int64
-			var hash string
-			if stat := objects.Stat(objpath, objects.HashFromETag(entry.etag.String)); stat != nil {
-				// File exists. The object was not written to, so reuse metadata
-				// from the file.
-				size = stat.Size()
-				hash = strings.ToLower(stat.Name())
-				object.Remove()
-				skipped = true
-			} else {
-				if entry.contentLength.Valid {
-					object.ExpectSize(entry.contentLength.Int64)
+		servers = append(servers, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get servers: %w", err)
+	}
+
+	const exists = `SELECT EXISTS (SELECT 1 FROM deploy_files WHERE server == ? AND name == ? AND md5 == ?)`
+	const upsert = `
+		INSERT INTO deploy_files (server, name, md5, size, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (server, name, md5) DO
+		UPDATE SET last_seen = excluded.last_seen
+	`
+	for _, s := range servers {
+		for _, name := range names {
+			r := DeployFileResult{Server: s.url, Name: name}
+			var headers http.Header
+			r.Status, headers, r.Hash, r.Size, r.Err = a.fetchObject(f, objpath, buildFileURL(s.url, "", name), compress)
+			if r.Err == nil && r.Hash != "" {
+				if err := db.QueryRowContext(a.Context, exists, s.id, name, r.Hash).Scan(&r.New); err != nil {
+					return results, fmt.Errorf("check %s: %w", name, err)
 				}
-				if size, hash, err = object.Close(); err != nil {
-					*entry = respEntry{err: fmt.Errorf("close object %s-%s: %w", req.build, req.file, err)}
-					return
+				now := time.Now().Unix()
+				if _, err := db.ExecContext(a.Context, upsert, s.id, name, r.Hash, r.Size, now, now); err != nil {
+					return results, fmt.Errorf("record %s: %w", name, err)
+				}
+				r.New = !r.New
+				if decode && isGzipped(name, headers) {
+					var derr error
+					if r.Decoded, derr = a.decodeObject(db, objpath, r.Hash, compress); derr != nil {
+						r.Err = fmt.Errorf("decode: %w", derr)
+					}
 				}
 			}
-			entry.flags |= HasMetadata | HasContent
-			entry.qAction |= qMetadata
-			entry.hash = hash
-			entry.size = size
+			results = append(results, r)
 		}
-	} else {
+	}
+	return results, nil
+}
+
+// decodeObject returns the hash of the decoded copy of the object of hash,
+// writing and recording the copy if it does not exist. Returns an empty hash if
+// the object has no decoded copy, because it is not gzipped text. If compress
+// is true, then the copy is written as a compressed object.
+func (a Action) decodeObject(db *sql.DB, objpath, hash string, compress bool) (decoded string, err error) {
+	var known sql.NullString
+	err = db.QueryRowContext(a.Context, `SELECT decoded FROM decoded_objects WHERE md5 == ?`, hash).Scan(&known)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if known.Valid && objects.Exists(objpath, known.String) {
+		return known.String, nil
+	}
+	decoded, size, contentType, err := decodeText(objpath, hash, compress)
+	if err != nil || decoded == "" {
+		return "", err
+	}
+	const query = `
+		INSERT INTO decoded_objects (md5, decoded, size, content_type)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (md5) DO
+		UPDATE SET decoded = excluded.decoded, size = excluded.size, content_type = excluded.content_type
+	`
+	if _, err := db.ExecContext(a.Context, query, hash, decoded, size, contentType); err != nil {
+		return "", fmt.Errorf("record %s: %w", decoded, err)
+	}
+	return decoded, nil
+}
+
+// fetchObject downloads the content at url into objpath. Returns an empty hash
+// if the file was not found. The headers of the response are returned for any
+// status.
+func (a Action) fetchObject(f *fetch.Fetcher, objpath, url string, compress bool) (status int, headers http.Header, hash string, size int64, err error) {
+	object := objects.NewWriter(objpath)
+	object.UseCompression(compress)
+	stored := func(hash string) bool { return objects.Exists(objpath, hash) }
+	status, headers, _, err = f.FetchContent(a.Context, url, stored, nil, object)
+	if err != nil {
 		object.Remove()
-		entry.flags |= NotFound
-		// 403 is expected if the file is not found. Most file combinations will
-		// be this, and the status is already indicated by the NotFound flag, so
-		// avoid adding to headers table to save space.
-		if respStatus != 403 {
-			// Log unexpected status in headers for manual review.
-			entry.flags |= HasHeaders
-			entry.qAction |= qHeaderStatus
-		}
+		return status, headers, "", 0, err
 	}
-	if object != nil {
-		var skip string
-		if skipped {
-			skip = "S"
-		}
-		log.Printf("fetch %-9s %32s %1s from %s-%s (%d)", entry.flags.Progress(), entry.hash, skip, req.build, req.file, req.id)
-		return
+	if status < 200 || status >= 300 {
+		object.Remove()
+		return status, headers, "", 0, nil
 	}
-	log.Printf("fetch %-9s from %s-%s (%d)", entry.flags.Progress(), req.build, req.file, req.id)
+	if stat := objects.Stat(objpath, f.ContentHash(headers)); stat != nil {
+		// The object already exists, and was not downloaded.
+		object.Remove()
+		return status, headers, strings.ToLower(stat.Name()), stat.Size(), nil
+	}
+	if v, err := strconv.ParseInt(headers.Get("content-length"), 10, 64); err == nil {
+		object.ExpectSize(v)
+	}
+	if size, hash, err = object.Close(); err != nil {
+		object.Remove()
+		return status, headers, "", 0, fmt.Errorf("close object: %w", err)
+	}
+	return status, headers, hash, size, nil
 }
 
-type Stats map[int]int
+// Package is an archived zip file that may refer to assets.
+type Package struct {
+	File  int
+	Build string
+	Name  string
+	Hash  string
+}
 
-func (stats Stats) String() string {
-	list := make([]int, 0, len(stats))
-	for s := range stats {
-		if s != 0 {
-			list = append(list, s)
-		}
+// FindPackages returns the zip files with content that have not yet been
+// scanned for references to assets.
+func (a Action) FindPackages(e Executor) (packages []Package, err error) {
+	query := `
+		SELECT files.rowid, builds.hash, filenames.name, metadata.md5
+		FROM files, builds, filenames, metadata
+		WHERE files.build == builds.rowid
+		AND files.filename == filenames.rowid
+		AND metadata.file == files.rowid
+		AND filenames.name LIKE '%.zip'
+		AND ` + flagsSet("files.flags", HasContent) + `
+		AND files.rowid NOT IN (SELECT file FROM scanned_packages)
+		ORDER BY files.rowid
+	`
+	rows, err := e.QueryContext(a.Context, query)
+	if err != nil {
+		return nil, err
 	}
-	sort.Ints(list)
-	var b strings.Builder
-	for _, s := range list {
-		fmt.Fprintf(&b, "status %d returned by %d files\n", s, stats[s])
+	defer rows.Close()
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.File, &p.Build, &p.Name, &p.Hash); err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
 	}
-	return b.String()
+	return packages, rows.Err()
 }
 
-// FetchContent scans files and downloads their content. If objects is not empty
-// then the entire file is downloaded to that directory. Otherwise, just the
-// headers are retrieved and stored in the database.
-//
-// When downloading file content, the only files considers are Unchecked files,
-// and files that have neither the NotFound flag nor the HasContent. A hit
-// writes the file to objects, adds the file's headers to the database, sets the
-// Exists, HasHeaders, HasMetadata, and HasContent flags, and unsets the
-// NotFound flag. A miss sets NotFound flag.
-//
-// When just retrieving headers, only Unchecked files are considered. A hit adds
-// the file's headers to the database, sets the Exists and HasHeaders flags, and
-// unsets the NotFound flag. A miss sets the NotFound flag.
-//
-// If recheck is true, then files with the NotFound flag set are also included.
-//
-// The batchSize argument specifies how many files are processed before
-// committing to the database. A value of 0 or less uses DefaultBatchSize.
-func (a Action) FetchContent(db *sql.DB, f *fetch.Fetcher, objpath string, q filters.Query, recheck bool, batchSize int, stats Stats) error {
-	if batchSize <= 0 {
-		batchSize = DefaultBatchSize
+// AddAssetRefs records the references to assets found within a package, and
+// marks the package as scanned. Returns the number of assets that were not
+// previously known.
+func (a Action) AddAssetRefs(db *sql.DB, file int, refs []assets.Ref) (added int, err error) {
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
 	}
-	var query = `
-		WITH temp AS (
-			SELECT
-				files.rowid AS id,
-				files.flags AS flags,
-				servers.url AS _server,
-				builds.hash AS _build,
-				filenames.name AS _file
-			FROM files, servers, builds, filenames, build_servers
-			WHERE files.build == builds.rowid
-			AND files.filename == filenames.rowid
-			AND files.build == build_servers.build
-			AND build_servers.server == servers.rowid
-			AND (
-				files.flags == 0 -- Select Unchecked files.
-				%s
-			)
-			%s
-			LIMIT ?
-		) SELECT * FROM temp
-		-- Collapse duplicates caused by build being available from multiple
-		-- servers. Note: this really slows down the query.
-		GROUP BY _build, _file
+	defer tx.Rollback()
+	const insertAsset = `INSERT OR IGNORE INTO assets (hash) VALUES (?)`
+	const insertRef = `
+		INSERT OR IGNORE INTO asset_refs (asset, file, entry)
+		VALUES ((SELECT rowid FROM assets WHERE hash == ?), ?, ?)
 	`
-	var params []interface{}
-	var queryFlags string
-	if recheck {
-		// Include files that were not found.
-		queryFlags += ` OR files.flags & (0) != 0` // NotFound
-	}
-	if objpath != "" {
-		if err := isDir(objpath); err != nil {
-			return err
+	for _, ref := range refs {
+		result, err := tx.ExecContext(a.Context, insertAsset, ref.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("add asset %s: %w", ref.Hash, err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			added += int(n)
+		}
+		if _, err := tx.ExecContext(a.Context, insertRef, ref.Hash, file, ref.Entry); err != nil {
+			return 0, fmt.Errorf("add reference to %s: %w", ref.Hash, err)
 		}
-		// Include files that were found and do not have content.
-		queryFlags += ` OR files.flags & (17) == 0` // !NotFound && !HasContent
 	}
-	stmt, err := db.Prepare(fmt.Sprintf(query, queryFlags, q.Expr))
-	if err != nil {
-		return fmt.Errorf("select files: %w", err)
+	if _, err := tx.ExecContext(a.Context, `INSERT OR IGNORE INTO scanned_packages (file) VALUES (?)`, file); err != nil {
+		return 0, fmt.Errorf("mark package: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
 	}
-	params = append(params, q.Params...)
-	params = append(params, batchSize)
+	return added, nil
+}
 
-	reqs := make([]reqEntry, 0, batchSize)
-	resps := make([]respEntry, 0, batchSize)
-	wg := sync.WaitGroup{}
+// FetchAssets downloads each unchecked asset into objpath. The location of an
+// asset is given by each of templates in turn, as formatted by assets.URL,
+// until the asset is found. The response status of the last attempt is
+// recorded, so that an asset that was not found is not fetched again. The
+// status of each asset is counted in stats.
+func (a Action) FetchAssets(db *sql.DB, f *fetch.Fetcher, objpath string, compress bool, templates []string, stats Stats) error {
+	if err := isDir(objpath); err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return fmt.Errorf("no asset servers")
+	}
+	type result struct {
+		hash   string
+		status int
+		md5    string
+		size   int64
+		err    error
+	}
+	const update = `UPDATE assets SET status = ?, md5 = ?, size = ?, time = ? WHERE hash == ?`
+	var results []result
 	for {
-		// TODO: Retain duplicate hashes; when a server fails, try the next
-		// server. Requires maintaining a map of successful hashes for the
-		// duration of the transaction. The map only needs to be as large as
-		// rate; successful hashes will not be pulled out of the database again.
-
-		rows, err := stmt.QueryContext(a.Context, params...)
+		rows, err := db.QueryContext(a.Context, `SELECT hash FROM assets WHERE status IS NULL ORDER BY rowid LIMIT ?`, f.Workers())
 		if err != nil {
-			return fmt.Errorf("select files: %w", err)
+			return fmt.Errorf("select assets: %w", err)
 		}
-		reqs = reqs[:0]
+		results = results[:0]
 		for rows.Next() {
-			i := len(reqs)
-			reqs = append(reqs, reqEntry{})
-			err := rows.Scan(
-				&reqs[i].id,
-				&reqs[i].flags,
-				&reqs[i].server,
-				&reqs[i].build,
-				&reqs[i].file,
-			)
-			if err != nil {
+			var r result
+			if err := rows.Scan(&r.hash); err != nil {
 				rows.Close()
-				return fmt.Errorf("scan row: %w", err)
+				return fmt.Errorf("scan asset: %w", err)
 			}
+			results = append(results, r)
 		}
-		if err = rows.Close(); err != nil {
-			return fmt.Errorf("finish rows: %w", err)
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("select assets: %w", err)
 		}
-		if err = rows.Err(); err != nil {
-			return fmt.Errorf("row error: %w", err)
-		}
-		if len(reqs) == 0 {
-			break
+		if len(results) == 0 {
+			return nil
 		}
-
-		resps = resps[:len(reqs)]
-		wg.Add(len(reqs))
-		for i := range reqs {
-			go runFetchContentWorker(a.Context, &wg, f, objpath, &reqs[i], &resps[i])
+		var wg sync.WaitGroup
+		wg.Add(len(results))
+		for i := range results {
+			go func(r *result) {
+				defer wg.Done()
+				for _, template := range templates {
+					r.status, _, r.md5, r.size, r.err = a.fetchObject(f, objpath, assets.URL(template, r.hash), compress)
+					if r.err != nil || r.md5 != "" {
+						break
+					}
+				}
+			}(&results[i])
 		}
-		log.Printf("fetching %d files...", len(reqs))
 		wg.Wait()
-
-		// TODO: fetching is suboptimal because all downloads in the current
-		// transaction must complete before the next set of transactions can
-		// begin. Downloads from subsequent transactions should start while the
-		// downloads from the current transaction are still working.
-		//
-		// SOLUTION: select a larger number of files, but continue to commit
-		// them at the usual rate. The GROUP BY clause makes many results slow
-		// to retrieve, so that should be resolved first.
-
-		tx, err := db.BeginTx(a.Context, nil)
-		if err != nil {
-			return fmt.Errorf("begin transaction: %w", err)
-		}
-		log.Printf("committing %d files...", len(reqs))
-		for i, entry := range resps {
-			if stats != nil {
-				stats[entry.respStatus]++
-			}
-			if entry.err != nil {
-				return entry.err
-			}
-			query := `UPDATE files SET flags = ? WHERE rowid = ?`
-			params := []interface{}{int(entry.flags), entry.id}
-			if entry.qAction&qHeaders != 0 {
-				query += `;
-					INSERT INTO headers(
-						file,
-						status,
-						content_length,
-						last_modified,
-						content_type,
-						etag
-					)
-					VALUES (?, ?, ?, ?, ?, ?)
-					ON CONFLICT (file) DO
-					UPDATE SET
-						status = ?,
-						content_length = ?,
-						last_modified = ?,
-						content_type = ?,
-						etag = ?
-				`
-				params = append(params,
-					entry.id,
-					entry.respStatus,
-					entry.contentLength,
-					entry.lastModified,
-					entry.contentType,
-					entry.etag,
-
-					entry.respStatus,
-					entry.contentLength,
-					entry.lastModified,
-					entry.contentType,
-					entry.etag,
-				)
-			} else if entry.qAction&qHeaderStatus != 0 {
-				query += `;
-					INSERT INTO headers(file, status)
-					VALUES (?, ?)
-					ON CONFLICT (file) DO
-					UPDATE SET status = ?
-				`
-				params = append(params,
-					entry.id, entry.respStatus,
-					entry.respStatus,
-				)
-			}
-			if entry.qAction&qMetadata != 0 {
-				query += `;
-					INSERT INTO metadata(file, size, md5)
-					VALUES (?, ?, ?)
-					ON CONFLICT (file) DO
-					UPDATE SET size = ?, md5 = ?
-				`
-				params = append(params,
-					entry.id, entry.size, entry.hash,
-					entry.size, entry.hash,
-				)
-			}
-			if _, err = tx.ExecContext(a.Context, query, params...); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("update file %s-%s: %w", reqs[i].build, reqs[i].file, err)
-			}
+		if err := a.Context.Err(); err != nil {
+			return err
 		}
-		if err = tx.Commit(); err != nil {
-			return fmt.Errorf("commit transaction: %w", err)
+		now := time.Now().Unix()
+		for _, r := range results {
+			if r.err != nil {
+				// Leave unchecked, so that it is fetched again by a later
+				// run. Abort to avoid retrying the same assets.
+				return fmt.Errorf("fetch asset %s: %w", r.hash, r.err)
+			}
+			stats[r.status]++
+			var md5 sql.NullString
+			var size sql.NullInt64
+			if r.md5 != "" {
+				md5 = sql.NullString{String: r.md5, Valid: true}
+				size = sql.NullInt64{Int64: r.size, Valid: true}
+			}
+			if _, err := db.ExecContext(a.Context, update, r.status, md5, size, now, r.hash); err != nil {
+				return fmt.Errorf("update asset %s: %w", r.hash, err)
+			}
 		}
-		log.Printf("committed %d files", len(reqs))
 	}
-	return nil
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/anaminus/rbxark/fetch"
+	"github.com/anaminus/rbxark/objects"
+)
+
+// writeObject writes content as an object to objpath, returning its hash.
+func writeObject(t *testing.T, objpath, content string) string {
+	t.Helper()
+	w := objects.NewWriter(objpath)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("write object: %s", err)
+	}
+	_, hash, err := w.Close()
+	if err != nil {
+		t.Fatalf("close object: %s", err)
+	}
+	return hash
+}
+
+// statHook is a Storage that contains no objects, and calls fn when an object
+// is looked up.
+type statHook struct {
+	objects.Storage
+	fn func(hash string)
+}
+
+func (s statHook) Stat(ctx context.Context, hash string) (int64, error) {
+	s.fn(hash)
+	return 0, errors.New("not found")
+}
+
+// A response with no content must produce the empty object, unless the
+// download was skipped because the object named by the hash of the response
+// already exists.
+func TestFetchContentEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the object named by the ETag exists before the request, or
+		// is placed after it was looked up, but before the content is
+		// received.
+		existing, racing bool
+		reused           bool
+	}{
+		{name: "no object"},
+		{name: "existing object", existing: true, reused: true},
+		{name: "object placed while fetching", racing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objpath, err := ioutil.TempDir("", "rbxark")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(objpath)
+
+			// The object named by the ETag is written to a separate path, so
+			// that its hash is known before it is placed.
+			otherpath, err := ioutil.TempDir("", "rbxark")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(otherpath)
+			etag := writeObject(t, otherpath, "content")
+			if tt.existing {
+				writeObject(t, objpath, "content")
+			}
+
+			opts := &FetchOptions{ObjectsPath: objpath}
+			placed := make(chan struct{})
+			if tt.racing {
+				opts.Storage = statHook{fn: func(hash string) {
+					writeObject(t, objpath, "content")
+					close(placed)
+				}}
+			} else {
+				close(placed)
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"`+etag+`"`)
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-placed
+			}))
+			defer server.Close()
+
+			f := fetch.NewFetcher(server.Client(), 1, -1)
+			req := &reqEntry{id: 1, server: server.URL, build: "version-0", file: "file"}
+			var entry respEntry
+			var wg sync.WaitGroup
+			wg.Add(1)
+			runFetchContentWorker(context.Background(), &wg, f, opts, req, &entry)
+			if entry.err != nil {
+				t.Fatalf("unexpected error: %s", entry.err)
+			}
+
+			hash, size := objects.EmptyHash, int64(0)
+			if tt.reused {
+				hash, size = etag, int64(len("content"))
+			}
+			if entry.hash != hash || entry.size != size {
+				t.Errorf("expected object %s (%d), got %s (%d)", hash, size, entry.hash, entry.size)
+			}
+			if entry.reused != tt.reused {
+				t.Errorf("expected reused %t, got %t", tt.reused, entry.reused)
+			}
+			if !tt.reused && objects.Stat(objpath, objects.EmptyHash) == nil {
+				t.Errorf("expected empty object")
+			}
+			if stat := objects.Stat(objpath, etag); stat != nil && stat.Size() != int64(len("content")) {
+				t.Errorf("object %s replaced", etag)
+			}
+		})
+	}
+}
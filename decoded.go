@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/anaminus/rbxark/objects"
+)
+
+// gzipTypes are the content types with which content compressed with gzip is
+// served.
+var gzipTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+}
+
+// isGzipped returns whether the content of a file of the given name, served
+// with the given headers, appears to be compressed with gzip. The content
+// itself is checked when it is decoded.
+func isGzipped(name string, headers http.Header) bool {
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		return true
+	}
+	if strings.EqualFold(headers.Get("content-encoding"), "gzip") {
+		return true
+	}
+	typ, _, _ := mime.ParseMediaType(headers.Get("content-type"))
+	return containsString(gzipTypes, typ)
+}
+
+// decodeText decompresses the object of hash within objpath, writing the
+// decoded content as another object if it is text, which is compressed with
+// zstd if compress is true. The content type of the
+// decoded content is sniffed from its first bytes. Returns an empty hash if the
+// object is not compressed with gzip, or if the decoded content is not text.
+func decodeText(objpath, hash string, compress bool) (decoded string, size int64, contentType string, err error) {
+	f, err := objects.Open(objpath, hash)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(bufio.NewReader(f))
+	switch err {
+	case gzip.ErrHeader, io.EOF, io.ErrUnexpectedEOF:
+		// Too short or malformed to be gzip.
+		return "", 0, "", nil
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer z.Close()
+
+	// Only as many bytes as are considered by DetectContentType are needed to
+	// sniff the content.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(z, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, "", err
+	}
+	head = head[:n]
+	contentType = http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, "text/") {
+		return "", 0, "", nil
+	}
+
+	object := objects.NewWriter(objpath)
+	object.UseCompression(compress)
+	if _, err := object.Write(head); err != nil {
+		object.Remove()
+		return "", 0, "", err
+	}
+	if _, err := io.Copy(object, z); err != nil {
+		object.Remove()
+		return "", 0, "", fmt.Errorf("decompress: %w", err)
+	}
+	if size, decoded, err = object.Close(); err != nil {
+		object.Remove()
+		return "", 0, "", fmt.Errorf("close object: %w", err)
+	}
+	return decoded, size, contentType, nil
+}
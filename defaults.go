@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// FlagDefaultsAll is the key of the flags section of a config that applies to
+// every command.
+const FlagDefaultsAll = "*"
+
+// defaultsConfigPath returns the path to the config from which the default
+// flags of a command are read: the config given by --config, the config of the
+// first archive of the workspace, or the config of the database given as the
+// first argument. Returns an empty string if there is no such config.
+func defaultsConfigPath(args []string) string {
+	switch {
+	case FlagOptions.Config != "":
+		return rootPath(FlagOptions.Config)
+	case FlagOptions.Workspace != "":
+		ws, err := LoadWorkspace(FlagOptions.Workspace)
+		if err != nil || len(ws.Archives) == 0 {
+			return ""
+		}
+		return ws.Archives[0].Config
+	case len(args) > 0:
+		return rootPath(args[0] + ".json")
+	}
+	return ""
+}
+
+// ApplyFlagDefaults sets the options of the active command that were not given
+// on the command line to the values in the flags section of the config. Values
+// under the name of the command take precedence over those under
+// FlagDefaultsAll. A missing config is not an error, because not every command
+// operates on an archive.
+func ApplyFlagDefaults(command flags.Commander, args []string) error {
+	path := defaultsConfigPath(args)
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open config: %w", err)
+	}
+	var config struct {
+		Flags map[string]map[string]json.RawMessage `json:"flags"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		// Reported when the command loads the config.
+		return nil
+	}
+	if len(config.Flags) == 0 {
+		return nil
+	}
+
+	active := FlagParser.Command
+	for active.Active != nil {
+		active = active.Active
+	}
+	fields := optionFields(reflect.ValueOf(command))
+	apply := func(section string, values map[string]json.RawMessage, strict bool) error {
+		for name, value := range values {
+			field, ok := fields[name]
+			opt := active.FindOptionByLongName(name)
+			if !ok || opt == nil {
+				if strict {
+					return fmt.Errorf("flags.%s: unknown flag %q", section, name)
+				}
+				continue
+			}
+			if opt.IsSet() && !opt.IsSetDefault() {
+				// Given on the command line.
+				continue
+			}
+			if err := json.Unmarshal(value, field.Addr().Interface()); err != nil {
+				return fmt.Errorf("flags.%s.%s: %w", section, name, err)
+			}
+		}
+		return nil
+	}
+	// Global defaults apply only to the commands that have the flag.
+	if err := apply(FlagDefaultsAll, config.Flags[FlagDefaultsAll], false); err != nil {
+		return err
+	}
+	if err := apply(active.Name, config.Flags[active.Name], true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// optionFields returns the fields of the struct pointed to by v that are
+// options, mapped by long name. Fields of embedded structs are included.
+func optionFields(v reflect.Value) map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return fields
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fields
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if field.Anonymous {
+			for name, f := range optionFields(v.Field(i).Addr()) {
+				fields[name] = f
+			}
+			continue
+		}
+		if name := strings.TrimSpace(field.Tag.Get("long")); name != "" {
+			fields[name] = v.Field(i)
+		}
+	}
+	return fields
+}
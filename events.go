@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/anaminus/rbxark/server"
+)
+
+// progressEvents publishes the progress of a command as server-sent events. A
+// nil value publishes nothing.
+type progressEvents struct {
+	hub *server.Hub
+}
+
+// serveEvents begins serving events at the /events path of the given address.
+// Returns nil if addr is empty.
+func serveEvents(addr string) (*progressEvents, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	events := &progressEvents{hub: &server.Hub{}}
+	mux := http.NewServeMux()
+	mux.Handle("/events", events.hub)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("serve events: %s", err)
+		}
+	}()
+	log.Printf("serving events at http://%s/events", ln.Addr())
+	return events, nil
+}
+
+// progress returns a function that publishes the fetch progress of an archive
+// as "progress" events.
+func (e *progressEvents) progress(ar *Archive) func(Progress) {
+	if e == nil {
+		return nil
+	}
+	return func(p Progress) {
+		event := struct {
+			Archive string `json:"archive"`
+			Progress
+		}{ar.Name, p}
+		if err := e.hub.Publish("progress", event); err != nil {
+			log.Println(err)
+		}
+	}
+}
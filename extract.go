@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/anaminus/rbxark/fetch"
+	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/pkgman"
+	"github.com/anaminus/rbxark/safepath"
+)
+
+// DefaultPackageDirs maps the names of the zip packages listed by a manifest to
+// the directories, relative to the root of an install, into which they are
+// unpacked, as laid out by the bootstrappers of Studio and the player. An empty
+// directory is the root. The package_dirs of a config are merged over these.
+var DefaultPackageDirs = map[string]string{
+	"ApplicationConfig.zip":             "ApplicationConfig",
+	"BuiltInPlugins.zip":                "BuiltInPlugins",
+	"BuiltInStandalonePlugins.zip":      "BuiltInStandalonePlugins",
+	"Libraries.zip":                     "",
+	"LibrariesQt5.zip":                  "",
+	"Plugins.zip":                       "Plugins",
+	"Qml.zip":                           "Qml",
+	"RobloxApp.zip":                     "",
+	"RobloxStudio.zip":                  "",
+	"StudioFonts.zip":                   "StudioFonts",
+	"WebView2RuntimeInstaller.zip":      "WebView2RuntimeInstaller",
+	"content-api-docs.zip":              "content/api_docs",
+	"content-avatar.zip":                "content/avatar",
+	"content-configs.zip":               "content/configs",
+	"content-fonts.zip":                 "content/fonts",
+	"content-models.zip":                "content/models",
+	"content-platform-dictionaries.zip": "PlatformContent/pc/shared_compression_dictionaries",
+	"content-platform-fonts.zip":        "PlatformContent/pc/fonts",
+	"content-qt_translations.zip":       "content/qt_translations",
+	"content-sky.zip":                   "content/sky",
+	"content-sounds.zip":                "content/sounds",
+	"content-studio_svg_textures.zip":   "content/studio_svg_textures",
+	"content-terrain.zip":               "PlatformContent/pc/terrain",
+	"content-textures2.zip":             "content/textures",
+	"content-textures3.zip":             "PlatformContent/pc/textures",
+	"extracontent-luapackages.zip":      "ExtraContent/LuaPackages",
+	"extracontent-models.zip":           "ExtraContent/models",
+	"extracontent-places.zip":           "ExtraContent/places",
+	"extracontent-scripts.zip":          "ExtraContent/scripts",
+	"extracontent-textures.zip":         "ExtraContent/textures",
+	"extracontent-translations.zip":     "ExtraContent/translations",
+	"redist.zip":                        "",
+	"shaders.zip":                       "shaders",
+	"ssl.zip":                           "ssl",
+}
+
+// appSettingsName is the name of the file, written by bootstrappers rather than
+// listed by a manifest, that locates the content directory of an install.
+const appSettingsName = "AppSettings.xml"
+
+// appSettings is the content of the AppSettings.xml file.
+const appSettings = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\r\n" +
+	"<Settings>\r\n" +
+	"\t<ContentFolder>content</ContentFolder>\r\n" +
+	"\t<BaseUrl>http://www.roblox.com</BaseUrl>\r\n" +
+	"</Settings>\r\n"
+
+// packageDirs returns DefaultPackageDirs merged with the package directories of
+// config. The directories of config are validated, because they are joined with
+// the root of an install.
+func packageDirs(config *Config) (dirs map[string]string, err error) {
+	dirs = make(map[string]string, len(DefaultPackageDirs)+len(config.PackageDirs))
+	for name, dir := range DefaultPackageDirs {
+		dirs[name] = dir
+	}
+	for name, dir := range config.PackageDirs {
+		if dir != "" {
+			if dir, err = safepath.Clean(dir); err != nil {
+				return nil, fmt.Errorf("package_dirs: %s: %w", name, err)
+			}
+		}
+		dirs[name] = dir
+	}
+	return dirs, nil
+}
+
+// Extractor writes the packages of a build to a directory.
+type Extractor struct {
+	Context context.Context
+	// Directory to which packages are written.
+	Root string
+	// Where objects are looked up: the objects path, then the object storage,
+	// if not nil.
+	ObjectsPath string
+	Storage     objects.Storage
+	// If not nil, then packages that are not archived are downloaded from
+	// the first of Servers that has them.
+	Fetcher *fetch.Fetcher
+	Servers []string
+	// Hash of the build.
+	Build string
+	// Directory into which each zip package is unpacked.
+	Dirs map[string]string
+
+	// Package that wrote each path, so that packages whose files overlap are
+	// reported rather than overwriting each other.
+	written map[string]string
+}
+
+// Open returns the content of the object of hash, which is the content of the
+// file of the given name. The content is read from the objects path, from the
+// object storage, or is downloaded, in that order. The returned File must be
+// closed.
+func (x *Extractor) Open(name, hash string) (objects.File, error) {
+	hash = strings.ToLower(hash)
+	if !objects.IsHash(hash) {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	if f, err := objects.OpenFile(x.ObjectsPath, hash); err == nil {
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if x.Storage != nil {
+		if r, err := x.Storage.Get(x.Context, hash); err == nil {
+			defer r.Close()
+			return tempContent(hash, func(w io.Writer) error {
+				_, err := io.Copy(w, r)
+				return err
+			})
+		}
+	}
+	if x.Fetcher == nil {
+		return nil, fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+	}
+	var errs []string
+	for _, server := range x.Servers {
+		f, err := tempContent(hash, func(w io.Writer) error {
+			status, _, _, err := x.Fetcher.FetchContent(x.Context, buildFileURL(server, x.Build, name), nil, nil, w)
+			if err == nil && (status < 200 || status >= 300) {
+				err = fmt.Errorf("status %d", status)
+			}
+			return err
+		})
+		if err == nil {
+			return f, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", server, err))
+	}
+	return nil, fmt.Errorf("download %s: %s", name, strings.Join(errs, "; "))
+}
+
+// tempContent returns a temporary file holding the content written by write,
+// which is verified against hash.
+func tempContent(hash string, write func(w io.Writer) error) (objects.File, error) {
+	file, err := ioutil.TempFile("", "rbxark-extract-*")
+	if err != nil {
+		return nil, err
+	}
+	f := objects.TempFile{File: file}
+	digest := md5.New()
+	if err := write(io.MultiWriter(file, digest)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != hash {
+		f.Close()
+		return nil, fmt.Errorf("content has hash %s, expected %s", sum, hash)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Extract writes a package listed by the manifest of the build. A zip package
+// with a known directory is unpacked into the directory. Any other package is
+// written as a file at the root. Returns the number of files written, and
+// whether the package was unpacked.
+//
+// A file left by a previous extraction is replaced. A file already written by
+// another package of the build is an error.
+func (x *Extractor) Extract(entry pkgman.Entry) (files int, unpacked bool, err error) {
+	if _, err := safepath.Clean(entry.Name); err != nil {
+		return 0, false, err
+	}
+	f, err := x.Open(entry.Name, entry.Hash)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	dir, ok := x.Dirs[entry.Name]
+	if !ok {
+		out, err := x.create(entry.Name, entry.Name)
+		if err != nil {
+			return 0, false, err
+		}
+		_, err = io.Copy(out, f)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return 1, false, nil
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, true, err
+	}
+	files, err = x.unzip(entry.Name, dir, f, size)
+	return files, true, err
+}
+
+// create creates the file at name under the root, to be written by the given
+// package.
+func (x *Extractor) create(pkg, name string) (*os.File, error) {
+	key, err := safepath.Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if other, ok := x.written[key]; ok {
+		return nil, fmt.Errorf("%s already written by package %s", key, other)
+	}
+	f, err := safepath.Replace(x.Root, name)
+	if err != nil {
+		return nil, err
+	}
+	if x.written == nil {
+		x.written = map[string]string{}
+	}
+	x.written[key] = pkg
+	return f, nil
+}
+
+// unzip writes the entries of the zip file r of the given package, having the
+// given size, into the directory dir under the root. Entry names are untrusted,
+// and are validated by safepath. Returns the number of files written.
+func (x *Extractor) unzip(pkg, dir string, r io.ReaderAt, size int64) (files int, err error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, fmt.Errorf("open zip: %w", err)
+	}
+	for _, f := range z.File {
+		name, err := safepath.ZipEntry(f)
+		if err != nil {
+			return files, err
+		}
+		name = path.Join(dir, name)
+		if f.FileInfo().IsDir() {
+			if err := safepath.CheckLinks(x.Root, name); err != nil {
+				return files, err
+			}
+			p, err := safepath.Join(x.Root, name)
+			if err != nil {
+				return files, err
+			}
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if err := x.unzipFile(pkg, name, f); err != nil {
+			return files, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		files++
+	}
+	return files, nil
+}
+
+// unzipFile writes the content of the zip entry f of the given package to the
+// file at name under the root.
+func (x *Extractor) unzipFile(pkg, name string, f *zip.File) error {
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := x.create(pkg, name)
+	if err != nil {
+		return err
+	}
+	// The checksum of the entry is verified by the reader at EOF.
+	_, err = io.Copy(out, src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anaminus/rbxark/pkgman"
+)
+
+// zipContent returns a zip file holding the given files.
+func zipContent(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestExtractReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbxark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objpath := filepath.Join(dir, "objects")
+	if err := os.Mkdir(objpath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	app := pkgman.Entry{
+		Name: "RobloxApp.zip",
+		Hash: writeObject(t, objpath, zipContent(t, map[string]string{"RobloxApp.exe": "app"})),
+	}
+	libs := pkgman.Entry{
+		Name: "Libraries.zip",
+		Hash: writeObject(t, objpath, zipContent(t, map[string]string{"RobloxApp.exe": "libraries"})),
+	}
+	root := filepath.Join(dir, "out")
+
+	// A second extraction replaces the files of the first.
+	for i := 0; i < 2; i++ {
+		x := &Extractor{Root: root, ObjectsPath: objpath, Dirs: DefaultPackageDirs}
+		if _, _, err := x.Extract(app); err != nil {
+			t.Fatalf("extraction %d: %s", i, err)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "RobloxApp.exe")); err != nil || string(b) != "app" {
+		t.Errorf("expected extracted content %q, got %q (%v)", "app", b, err)
+	}
+
+	// A file written by two packages of the same extraction is reported.
+	x := &Extractor{Root: root, ObjectsPath: objpath, Dirs: DefaultPackageDirs}
+	if _, _, err := x.Extract(app); err != nil {
+		t.Fatalf("extract %s: %s", app.Name, err)
+	}
+	_, _, err = x.Extract(libs)
+	if err == nil || !strings.Contains(err.Error(), "already written by package "+app.Name) {
+		t.Errorf("expected collision with %s, got %v", app.Name, err)
+	}
+}
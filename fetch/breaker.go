@@ -0,0 +1,116 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is wrapped by the error returned for a request to a host whose
+// circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitError is returned for a request that was not made because the circuit
+// of its host is open.
+type CircuitError struct {
+	Host  string
+	Until time.Time
+}
+
+func (err *CircuitError) Error() string {
+	return fmt.Sprintf("%s: circuit open until %s", err.Host, err.Until.Format(time.RFC3339))
+}
+
+func (err *CircuitError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// breaker is a circuit breaker per host. After a number of consecutive
+// failures of requests to a host, the circuit of the host is opened, and
+// requests to the host fail immediately until a cooldown has passed. The next
+// request is then made, and a success closes the circuit, while a failure opens
+// it again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	until    time.Time
+}
+
+// allow returns an error if the circuit of the host is open.
+func (b *breaker) allow(host string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.hosts[host]
+	if !ok || c.until.IsZero() {
+		return nil
+	}
+	if time.Now().Before(c.until) {
+		return &CircuitError{Host: host, Until: c.until}
+	}
+	// Let a request through, and open the circuit again if it fails.
+	c.until = time.Time{}
+	c.failures = b.threshold - 1
+	return nil
+}
+
+// record counts the result of a request to the host. A failure is an error
+// other than cancellation, or a response indicating a server error or
+// throttling.
+func (b *breaker) record(req *http.Request, resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+	if err != nil && req.Context().Err() != nil {
+		// Canceled by the caller, not a failure of the host.
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	host := req.URL.Host
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.hosts[host]
+	if !failed {
+		if ok {
+			delete(b.hosts, host)
+		}
+		return
+	}
+	if !ok {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	if c.failures >= b.threshold && c.until.IsZero() {
+		c.until = time.Now().Add(b.cooldown)
+	}
+}
+
+// SetCircuitBreaker enables a circuit breaker for each host. After the given
+// number of consecutive failed requests to a host, further requests to the host
+// fail with a *CircuitError without being made, until the cooldown has passed,
+// while requests to other hosts continue. A request fails if it returns an
+// error, or a response with a 5xx or 429 status. A threshold of zero or less
+// disables the breaker. Must be called before requests are made.
+func (f *Fetcher) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		f.breaker = nil
+		return
+	}
+	f.breaker = &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     map[string]*circuit{},
+	}
+}
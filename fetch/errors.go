@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// StatusError is returned when a response has an unsuccessful status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("%s: status %s", err.URL, err.Status)
+}
+
+// Gone returns whether the status indicates that the resource no longer
+// exists.
+func (err *StatusError) Gone() bool {
+	return err.StatusCode == 404 || err.StatusCode == 410
+}
+
+// ErrorKind classifies the cause of a failed request.
+type ErrorKind int
+
+const (
+	OtherError ErrorKind = iota // Any other error.
+	DNSError                    // The host name could not be resolved.
+	TLSError                    // The TLS handshake or certificate verification failed.
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case DNSError:
+		return "dns"
+	case TLSError:
+		return "tls"
+	}
+	return "other"
+}
+
+// ClassifyError returns the kind of error returned by a request. DNS and TLS
+// errors indicate that a server as a whole is unreachable, rather than a
+// particular file being missing. Only a host name that does not exist is a DNS
+// error; a lookup that timed out or failed temporarily is an OtherError, so
+// that the request is retried.
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return OtherError
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return DNSError
+		}
+		return OtherError
+	}
+	var (
+		authErr x509.UnknownAuthorityError
+		certErr x509.CertificateInvalidError
+		hostErr x509.HostnameError
+	)
+	if errors.As(err, &authErr) || errors.As(err, &certErr) || errors.As(err, &hostErr) {
+		return TLSError
+	}
+	// Alerts and handshake failures are not exposed as distinct types.
+	if strings.Contains(err.Error(), "tls: ") {
+		return TLSError
+	}
+	return OtherError
+}
@@ -0,0 +1,33 @@
+package fetch
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind ErrorKind
+	}{
+		{"nil", nil, OtherError},
+		{"other", errors.New("connection reset"), OtherError},
+		{"not found", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, DNSError},
+		{"wrapped not found", &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}, DNSError},
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, OtherError},
+		{"temporary", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, OtherError},
+		{"lookup failed", &net.DNSError{Err: "status 502", Name: "example.com"}, OtherError},
+		{"unknown authority", fmt.Errorf("get: %w", x509.UnknownAuthorityError{}), TLSError},
+		{"handshake", errors.New("remote error: tls: handshake failure"), TLSError},
+	}
+	for _, tt := range tests {
+		if kind := ClassifyError(tt.err); kind != tt.kind {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.kind, kind)
+		}
+	}
+}
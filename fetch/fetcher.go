@@ -1,14 +1,16 @@
 package fetch
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/unitext"
 	"github.com/robloxapi/rbxdump/histlog"
 	"golang.org/x/time/rate"
 )
@@ -60,9 +62,54 @@ type Fetcher struct {
 	limiter *rate.Limiter
 	request chan job
 	workers int
+
+	// If per-host, then requests are sent to the pool of the host of the URL
+	// instead of request.
+	perHost bool
+	poolMu  sync.Mutex
+	pools   map[string]chan job
+
+	// Hosts whose requests are sent to their own pool, with their own number
+	// of workers and rate limit, regardless of perHost.
+	hostLimits map[string]hostLimit
+
+	// Sources of the hash of content, in order of priority.
+	hashSources []string
+
+	// If not nil, requests to failing hosts are suspended.
+	breaker *breaker
+
+	// If not nil, failed requests are retried.
+	retry *RetryPolicy
 }
 
 func NewFetcher(client *http.Client, workers int, rateLimit float64) *Fetcher {
+	state := newFetcher(client, workers, rateLimit)
+	state.request = make(chan job, state.workers)
+	for i := 0; i < state.workers; i++ {
+		go state.spawnWorker(state.client, state.request, state.limiter)
+	}
+	return state
+}
+
+// NewHostFetcher returns a Fetcher whose workers are bound to a host. The
+// given number of workers is started for each host when a request is first
+// made to it. The workers of a host share a dedicated transport that keeps
+// idle connections alive for each worker, so that connections are reused
+// rather than handshaken again when several hosts are fetched from at once.
+// The rate limit applies to all hosts combined.
+//
+// A dedicated transport is copied from the transport of client, which is either
+// an *http.Transport or the transport of a client returned by WithTLS. Other
+// transports are shared by every host.
+func NewHostFetcher(client *http.Client, workers int, rateLimit float64) *Fetcher {
+	state := newFetcher(client, workers, rateLimit)
+	state.perHost = true
+	state.pools = map[string]chan job{}
+	return state
+}
+
+func newFetcher(client *http.Client, workers int, rateLimit float64) *Fetcher {
 	if client == nil {
 		client = http.DefaultClient
 	}
@@ -70,53 +117,166 @@ func NewFetcher(client *http.Client, workers int, rateLimit float64) *Fetcher {
 	if workers <= 0 {
 		workers = 32
 	}
-	var rl rate.Limit
-	if rateLimit < 0 {
-		rl = rate.Inf
-	} else {
-		rl = rate.Limit(rateLimit)
-	}
-	state := Fetcher{
+	return &Fetcher{
 		client:  client,
-		limiter: rate.NewLimiter(rl, 1),
-		request: make(chan job, workers),
+		limiter: rate.NewLimiter(limit(rateLimit), 1),
 		workers: workers,
 	}
-	for i := 0; i < workers; i++ {
-		go state.spawnWorker()
+}
+
+// limit converts a number of requests per second to a rate limit. A negative
+// value means unlimited.
+func limit(rateLimit float64) rate.Limit {
+	if rateLimit < 0 {
+		return rate.Inf
 	}
-	return &state
+	return rate.Limit(rateLimit)
 }
 
+// Workers returns the number of workers. For a Fetcher returned by
+// NewHostFetcher, this is the number of workers of each host.
 func (f *Fetcher) Workers() int {
 	return f.workers
 }
 
-func (f *Fetcher) spawnWorker() {
-	for job := range f.request {
-		if err := f.limiter.Wait(job.req.Context()); err != nil {
+// SetRateLimit changes the number of allowed requests per second. A negative
+// value means unlimited. Safe to call while requests are being made. Hosts with
+// a rate limit of their own are unaffected.
+func (f *Fetcher) SetRateLimit(rateLimit float64) {
+	f.limiter.SetLimit(limit(rateLimit))
+}
+
+// HostLimit limits the requests made to a host.
+type HostLimit struct {
+	// Host of the URLs to which the limit applies.
+	Host string
+	// Allowed requests per second. If zero, the rate limit of the fetcher
+	// applies, shared with other hosts. A negative value means unlimited.
+	RateLimit float64
+	// Number of workers making requests to the host. If zero or less, the
+	// number of workers of the fetcher is used.
+	Workers int
+}
+
+type hostLimit struct {
+	workers int
+	limiter *rate.Limiter
+}
+
+// SetHostLimits gives each host of limits a pool of workers of its own, with
+// its own rate limit, so that some hosts can be fetched from harder than
+// others. Requests to other hosts are unaffected. Must be called before any
+// request is made.
+func (f *Fetcher) SetHostLimits(limits []HostLimit) {
+	f.hostLimits = make(map[string]hostLimit, len(limits))
+	for _, l := range limits {
+		h := hostLimit{workers: l.Workers}
+		if l.RateLimit != 0 {
+			h.limiter = rate.NewLimiter(limit(l.RateLimit), 1)
+		}
+		f.hostLimits[l.Host] = h
+	}
+}
+
+func (f *Fetcher) spawnWorker(client *http.Client, request <-chan job, limiter *rate.Limiter) {
+	for job := range request {
+		if err := f.breaker.allow(job.req.URL.Host); err != nil {
 			job.finish <- RequestResult{Resp: nil, Err: err}
 			continue
 		}
-		resp, err := f.client.Do(job.req)
+		if err := limiter.Wait(job.req.Context()); err != nil {
+			job.finish <- RequestResult{Resp: nil, Err: err}
+			continue
+		}
+		resp, err := client.Do(job.req)
+		f.breaker.record(job.req, resp, err)
 		job.finish <- RequestResult{Resp: resp, Err: err}
 	}
 }
 
+// queue returns the channel to which a request is sent, starting the workers
+// of the host of the request if needed.
+func (f *Fetcher) queue(req *http.Request) chan<- job {
+	host := req.URL.Host
+	hl, limited := f.hostLimits[host]
+	if !f.perHost && !limited {
+		return f.request
+	}
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	if request, ok := f.pools[host]; ok {
+		return request
+	}
+	workers, limiter := f.workers, f.limiter
+	if hl.workers > 0 {
+		workers = hl.workers
+	}
+	if hl.limiter != nil {
+		limiter = hl.limiter
+	}
+	client := *f.client
+	client.Transport = dedicatedTransport(client.Transport, host, workers)
+	request := make(chan job, workers)
+	for i := 0; i < workers; i++ {
+		go f.spawnWorker(&client, request, limiter)
+	}
+	if f.pools == nil {
+		f.pools = map[string]chan job{}
+	}
+	f.pools[host] = request
+	return request
+}
+
+// dedicatedTransport returns a copy of the transport used for the given host
+// by rt, which keeps alive up to the given number of idle connections per
+// host. If the transport cannot be copied, then it is returned as-is.
+func dedicatedTransport(rt http.RoundTripper, host string, idle int) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	switch t := rt.(type) {
+	case *http.Transport:
+		t = t.Clone()
+		t.MaxIdleConnsPerHost = idle
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < idle {
+			t.MaxIdleConns = idle
+		}
+		return t
+	case *hostTransport:
+		if h, ok := t.hosts[host]; ok {
+			return dedicatedTransport(h, host, idle)
+		}
+		return dedicatedTransport(t.fallback, host, idle)
+	}
+	return rt
+}
+
 // Client returns the underlying client used to make requests.
 func (f *Fetcher) Client() *http.Client {
 	return f.client
 }
 
-// Do makes an HTTP request through the fetchers's client and rate limiter.
+// Do makes an HTTP request through the fetchers's client and rate limiter. A
+// failed request is retried according to the retry policy of the fetcher.
 func (f *Fetcher) Do(req *http.Request) (resp *http.Response, err error) {
+	if f.retry != nil {
+		return f.doRetry(req)
+	}
+	return f.do(req)
+}
+
+// do makes one attempt of a request.
+func (f *Fetcher) do(req *http.Request) (resp *http.Response, err error) {
 	finish := make(chan RequestResult)
-	f.request <- job{req: req, finish: finish}
+	f.queue(req) <- job{req: req, finish: finish}
 	result := <-finish
 	return result.Resp, result.Err
 }
 
 // FetchDeployHistory retrieves and parses a history log from the given server.
+// A log encoded as UTF-16, or beginning with a byte order mark, is converted to
+// UTF-8 before being parsed. The log is parsed while it is read, so the
+// returned stream contains only the jobs of the log.
 func (f *Fetcher) FetchDeployHistory(ctx context.Context, url string) (stream histlog.Stream, err error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -127,54 +287,211 @@ func (f *Fetcher) FetchDeployHistory(ctx context.Context, url string) (stream hi
 		return nil, fmt.Errorf("%s: %w", url, err)
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("%s: status %s", url, resp.Status)
+		resp.Body.Close()
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(resp.Body)
-	resp.Body.Close()
+	defer resp.Body.Close()
+	stream, err = lexHistory(unitext.NewReader(resp.Body))
 	if err != nil {
 		return nil, fmt.Errorf("%s: read response: %w", url, err)
 	}
-	stream = histlog.Lex(buf.Bytes())
 	return stream, nil
 }
 
+// historyChunkSize is the number of bytes of a history log lexed at once. Some
+// logs are tens of megabytes, and many may be fetched concurrently, so a log
+// is lexed in chunks of whole lines rather than all at once.
+const historyChunkSize = 1 << 20
+
+// lexHistory lexes the history log read from r, returning only the jobs of the
+// log. A line longer than twice historyChunkSize is split, which may lose a job
+// on that line; the lines of a real log are much shorter.
+func lexHistory(r io.Reader) (stream histlog.Stream, err error) {
+	br := bufio.NewReader(r)
+	chunk := make([]byte, 0, historyChunkSize)
+	flush := func() {
+		for _, token := range histlog.Lex(chunk) {
+			if _, ok := token.(*histlog.Job); ok {
+				stream = append(stream, token)
+			}
+		}
+		chunk = chunk[:0]
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		chunk = append(chunk, line...)
+		switch err {
+		case nil:
+			if len(chunk) >= historyChunkSize {
+				flush()
+			}
+		case bufio.ErrBufferFull:
+			if len(chunk) >= 2*historyChunkSize {
+				flush()
+			}
+		case io.EOF:
+			flush()
+			return stream, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Location describes where the response to a request came from.
+type Location struct {
+	// URL of the final request, after following redirects.
+	URL string
+	// Number of redirects that were followed.
+	Redirects int
+}
+
+// responseLocation returns the location of a response.
+func responseLocation(resp *http.Response) (loc Location) {
+	loc.URL = resp.Request.URL.String()
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		loc.Redirects++
+	}
+	return loc
+}
+
 // FetchContent fetches information about a file from url. If w is not nil, the
 // content of the file is written to it. Otherwise, just the headers of the
-// response are returned.
-func (f *Fetcher) FetchContent(ctx context.Context, url string, objpath string, hashes *HashStore, w io.Writer) (status int, headers http.Header, err error) {
+// response are returned, along with the location of the response.
+//
+// If stored is not nil, it is called with the hash of the content from the
+// headers, if any. If it returns true, then the content is already stored, and
+// is not downloaded.
+func (f *Fetcher) FetchContent(ctx context.Context, url string, stored func(hash string) bool, hashes *HashStore, w io.Writer) (status int, headers http.Header, loc Location, err error) {
+	return f.FetchChanged(ctx, url, Validators{}, stored, hashes, w)
+}
+
+// Validators identify the version of the content at a URL that was received
+// previously. A zero field is not sent.
+type Validators struct {
+	// ETag of the previous response.
+	ETag string
+	// Last-Modified time of the previous response.
+	LastModified time.Time
+}
+
+// FetchChanged is like FetchContent, but the request is conditional on the
+// content differing from the version identified by v. If the content is
+// unchanged, then the server responds with status 304, and nothing is written
+// to w. A request with zero validators is not conditional.
+func (f *Fetcher) FetchChanged(ctx context.Context, url string, v Validators, stored func(hash string) bool, hashes *HashStore, w io.Writer) (status int, headers http.Header, loc Location, err error) {
 	method := "GET"
 	if w == nil {
 		method = "HEAD"
 	}
 	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		return 0, nil, fmt.Errorf("make request: %w", err)
+		return 0, nil, loc, fmt.Errorf("make request: %w", err)
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", v.LastModified.UTC().Format(http.TimeFormat))
 	}
 	resp, err := f.Do(req)
 	if err != nil {
-		return 0, nil, fmt.Errorf("do request: %w", err)
+		return 0, nil, loc, fmt.Errorf("do request: %w", err)
 	}
+	loc = responseLocation(resp)
 	if w == nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		resp.Body.Close()
-		return resp.StatusCode, resp.Header, nil
+		return resp.StatusCode, resp.Header, loc, nil
 	}
-	if hash := objects.HashFromETag(resp.Header.Get("etag")); hash != "" {
+	if hash := f.ContentHash(resp.Header); hash != "" {
 		if hashes.Check(hash) {
 			// A file with the same hash is already being downloaded; skip.
 			resp.Body.Close()
-			return resp.StatusCode, resp.Header, nil
+			return resp.StatusCode, resp.Header, loc, nil
+		}
+		if stored != nil && stored(hash) {
+			// The hash was found in the cache; download can be skipped.
+			resp.Body.Close()
+			return resp.StatusCode, resp.Header, loc, nil
 		}
-		if objpath != "" {
-			if objects.Exists(objpath, hash) {
-				// The hash was found in the cache; download can be skipped.
-				resp.Body.Close()
-				return resp.StatusCode, resp.Header, nil
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return 0, nil, loc, fmt.Errorf("%s: write file: %w", url, err)
+	}
+	return resp.StatusCode, resp.Header, loc, nil
+}
+
+// maxRedirects is the number of redirects followed before a request fails,
+// matching the default policy of http.Client.
+const maxRedirects = 10
+
+// RedirectPolicy returns a function suitable for http.Client.CheckRedirect. A
+// request to a URL beginning with any of the given prefixes does not follow
+// redirects; the redirect response is returned instead, so that a server that
+// redirects to an error page is not mistaken for serving the file.
+func RedirectPolicy(noRedirect []string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		original := via[0].URL.String()
+		for _, prefix := range noRedirect {
+			if strings.HasPrefix(original, prefix) {
+				return http.ErrUseLastResponse
 			}
 		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// FetchRange requests the content at url starting at offset, and writes it to
+// w. Used to resume a download that ended early. Returns an error if the server
+// does not respond with the requested range.
+func (f *Fetcher) FetchRange(ctx context.Context, url string, offset int64, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("make request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := f.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s: expected partial content, got status %d", url, resp.StatusCode)
+	}
+	if cr := resp.Header.Get("content-range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
+		return fmt.Errorf("%s: unexpected content range %q", url, cr)
 	}
 	if _, err = io.Copy(w, resp.Body); err != nil {
-		return 0, nil, fmt.Errorf("%s: write file: %w", url, err)
+		return fmt.Errorf("%s: write file: %w", url, err)
+	}
+	return nil
+}
+
+// FetchSpan requests length bytes of the content at url starting at offset.
+// Returns an error if the server does not respond with the requested range.
+func (f *Fetcher) FetchSpan(ctx context.Context, url string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("make request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := f.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%s: expected partial content, got status %d", url, resp.StatusCode)
+	}
+	if cr := resp.Header.Get("content-range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-%d/", offset, offset+length-1)) {
+		return nil, fmt.Errorf("%s: unexpected content range %q", url, cr)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, fmt.Errorf("%s: read span: %w", url, err)
 	}
-	return resp.StatusCode, resp.Header, nil
+	return b, nil
 }
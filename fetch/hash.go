@@ -0,0 +1,104 @@
+package fetch
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/anaminus/rbxark/objects"
+)
+
+// Sources of the MD5 hash of the content of a response, as conventions of
+// headers used by different server implementations.
+const (
+	// A strong ETag that is the hash, as sent by S3 and most CDNs.
+	HashETag = "etag"
+	// A weak ETag that has the form of the hash. A weak ETag only indicates
+	// semantically equivalent content, so the hash may not be of the exact
+	// content.
+	HashWeakETag = "weak-etag"
+	// The Content-MD5 header, containing the hash in base64.
+	HashContentMD5 = "content-md5"
+	// The md5 field of the x-goog-hash header, as sent by Google Cloud
+	// Storage, containing the hash in base64.
+	HashGoogHash = "x-goog-hash"
+)
+
+// DefaultHashSources is the priority of hash sources used when none are
+// configured.
+var DefaultHashSources = []string{HashETag, HashWeakETag}
+
+// CheckHashSources returns an error if any of the given sources is unknown.
+func CheckHashSources(sources []string) error {
+	for _, source := range sources {
+		switch source {
+		case HashETag, HashWeakETag, HashContentMD5, HashGoogHash:
+		default:
+			return fmt.Errorf("unknown hash source %q", source)
+		}
+	}
+	return nil
+}
+
+// ContentHash returns the MD5 hash of the content of a response, as indicated
+// by the given headers of the response. Each source is tried in order, and the
+// hash from the first source that provides one is returned. If sources is
+// empty, then DefaultHashSources is used. Returns an empty string if no source
+// provides a hash.
+func ContentHash(headers http.Header, sources []string) string {
+	if len(sources) == 0 {
+		sources = DefaultHashSources
+	}
+	for _, source := range sources {
+		var hash string
+		switch source {
+		case HashETag, HashWeakETag:
+			h, format := objects.ParseETag(headers.Get("etag"))
+			if format == objects.ETagMD5 && source == HashETag ||
+				format == objects.ETagWeak && source == HashWeakETag {
+				hash = h
+			}
+		case HashContentMD5:
+			hash = base64Hash(headers.Get("content-md5"))
+		case HashGoogHash:
+			for _, value := range headers[http.CanonicalHeaderKey("x-goog-hash")] {
+				for _, field := range strings.Split(value, ",") {
+					field = strings.TrimSpace(field)
+					if strings.HasPrefix(field, "md5=") {
+						hash = base64Hash(field[len("md5="):])
+					}
+				}
+			}
+		}
+		if hash != "" {
+			return hash
+		}
+	}
+	return ""
+}
+
+// base64Hash decodes a hash encoded in base64. Returns an empty string if the
+// value is not a valid hash.
+func base64Hash(value string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(b) != 16 {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// SetHashSources sets the priority of the sources from which the hash of the
+// content of a response is determined, for skipping downloads of content that
+// already exists. The sources must be valid according to CheckHashSources.
+// Must not be called while requests are being made.
+func (f *Fetcher) SetHashSources(sources []string) {
+	f.hashSources = sources
+}
+
+// ContentHash returns the MD5 hash of the content of a response with the given
+// headers, according to the hash sources of the fetcher.
+func (f *Fetcher) ContentHash(headers http.Header) string {
+	return ContentHash(headers, f.hashSources)
+}
@@ -0,0 +1,201 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Resolver resolves host names to addresses. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// DNSResolver returns a Resolver that queries the DNS server at the given
+// address, such as "1.1.1.1:53", instead of the system's configured servers.
+func DNSResolver(server string) Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// DoHResolver resolves host names with a DNS-over-HTTPS server that supports
+// the JSON API, such as "https://cloudflare-dns.com/dns-query". Results are
+// cached for the duration of their TTL.
+//
+// The host of the server is itself resolved by the system. Where the system's
+// DNS is unusable, the server should be specified by IP address.
+type DoHResolver struct {
+	// URL of the server.
+	URL string
+	// Client used to make queries. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohEntry
+}
+
+type dohEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dohResponse is the JSON format of a DNS-over-HTTPS response.
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		TTL  int    `json:"TTL"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// DNS record types.
+const (
+	typeA    = 1
+	typeAAAA = 28
+)
+
+// rcodeNXDomain is the response code indicating that a name does not exist.
+const rcodeNXDomain = 3
+
+// errNXDomain is returned by query when the server reports that a name does
+// not exist.
+var errNXDomain = errors.New("no such host")
+
+// query requests records of the given type for a host.
+func (r *DoHResolver) query(ctx context.Context, host string, typ int) (addrs []string, ttl int, err error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, 0, err
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", fmt.Sprint(typ))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, err
+	}
+	switch body.Status {
+	case 0:
+	case rcodeNXDomain:
+		return nil, 0, errNXDomain
+	default:
+		return nil, 0, fmt.Errorf("rcode %d", body.Status)
+	}
+	for _, answer := range body.Answer {
+		if answer.Type != typ {
+			// For example, a CNAME record that precedes the address.
+			continue
+		}
+		if net.ParseIP(answer.Data) == nil {
+			continue
+		}
+		addrs = append(addrs, answer.Data)
+		if ttl == 0 || answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// LookupHost implements Resolver. A name that does not exist, or that has no
+// addresses, is returned as a *net.DNSError with IsNotFound set. A failure to
+// query the server, or any other response of the server, is returned as an
+// ordinary error, since it does not indicate that the name does not exist.
+func (r *DoHResolver) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	r.mu.Lock()
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.addrs, nil
+	}
+	r.mu.Unlock()
+
+	ttl := 0
+	for _, typ := range []int{typeA, typeAAAA} {
+		a, t, err := r.query(ctx, host, typ)
+		if errors.Is(err, errNXDomain) {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, Server: r.URL, IsNotFound: true}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s on %s: %w", host, r.URL, err)
+		}
+		addrs = append(addrs, a...)
+		if len(a) > 0 && (ttl == 0 || t < ttl) {
+			ttl = t
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.URL, IsNotFound: true}
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = map[string]dohEntry{}
+	}
+	r.cache[host] = dohEntry{
+		addrs:   addrs,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// NewClient returns a client that resolves host names with the given resolver.
+// Each resolved address is tried in turn until a connection succeeds.
+func NewClient(resolver Resolver) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	return &http.Client{Transport: transport}
+}
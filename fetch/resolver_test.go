@@ -0,0 +1,93 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDoHResolver(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		addrs  []string
+		kind   ErrorKind
+		// Whether an error is expected.
+		err bool
+	}{
+		{
+			name:   "address",
+			status: http.StatusOK,
+			body:   `{"Status": 0, "Answer": [{"type": 5, "TTL": 60, "data": "cdn.example.com."}, {"type": TYPE, "TTL": 60, "data": "ADDR"}]}`,
+			addrs:  []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:   "nxdomain",
+			status: http.StatusOK,
+			body:   `{"Status": 3}`,
+			kind:   DNSError,
+			err:    true,
+		},
+		{
+			name:   "no answer",
+			status: http.StatusOK,
+			body:   `{"Status": 0}`,
+			kind:   DNSError,
+			err:    true,
+		},
+		{
+			name:   "servfail",
+			status: http.StatusOK,
+			body:   `{"Status": 2}`,
+			kind:   OtherError,
+			err:    true,
+		},
+		{
+			name:   "status",
+			status: http.StatusBadGateway,
+			kind:   OtherError,
+			err:    true,
+		},
+		{
+			name:   "malformed",
+			status: http.StatusOK,
+			body:   `<html>`,
+			kind:   OtherError,
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			body := tt.body
+			if r.URL.Query().Get("type") == "1" {
+				body = strings.NewReplacer("TYPE", "1", "ADDR", "192.0.2.1").Replace(body)
+			} else {
+				body = strings.NewReplacer("TYPE", "28", "ADDR", "2001:db8::1").Replace(body)
+			}
+			w.Write([]byte(body))
+		}))
+		r := &DoHResolver{URL: server.URL, Client: server.Client()}
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		server.Close()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			} else if kind := ClassifyError(err); kind != tt.kind {
+				t.Errorf("%s: expected %s error, got %s (%s)", tt.name, tt.kind, kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, tt.addrs) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.addrs, addrs)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes when and how a failed request is made again.
+type RetryPolicy struct {
+	// Total number of attempts of a request, including the first. A value of
+	// one or less disables retries.
+	Attempts int
+	// Delay before the first retry. Each following retry waits twice as long
+	// as the previous, up to Cap.
+	Base time.Duration
+	// Maximum delay before a retry.
+	Cap time.Duration
+	// Response statuses that cause a request to be retried.
+	Statuses []int
+	// Whether a request that fails with a network error is retried. DNS and
+	// TLS errors, which indicate that a server is unreachable as a whole, are
+	// never retried.
+	NetworkErrors bool
+}
+
+// DefaultRetryStatuses are the statuses retried when a policy lists none.
+var DefaultRetryStatuses = []int{429, 500, 502, 503, 504}
+
+// retryable returns whether the result of a request should be retried.
+func (p *RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if req.Context().Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return false
+		}
+		return p.NetworkErrors && ClassifyError(err) == OtherError
+	}
+	for _, status := range p.Statuses {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the time to wait before the given retry, counting from one. The
+// delay is jittered, so that requests failing together are not retried
+// together. A Retry-After header of resp, given in seconds, is honored up to
+// Cap.
+func (p *RetryPolicy) delay(retry int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			d := time.Duration(s) * time.Second
+			if p.Cap > 0 && d > p.Cap {
+				d = p.Cap
+			}
+			return d
+		}
+	}
+	d := p.Base
+	for i := 1; i < retry && (p.Cap <= 0 || d < p.Cap); i++ {
+		d *= 2
+	}
+	if p.Cap > 0 && d > p.Cap {
+		d = p.Cap
+	}
+	// Between half and all of the delay.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// SetRetryPolicy sets how requests made through Do are retried. Each attempt
+// passes through the circuit breaker and rate limiter, like any request. A
+// request with a body is retried only if its GetBody field is set. A nil
+// policy disables retries. Must be called before requests are made.
+func (f *Fetcher) SetRetryPolicy(p *RetryPolicy) {
+	if p != nil && p.Attempts <= 1 {
+		p = nil
+	}
+	if p != nil && len(p.Statuses) == 0 {
+		q := *p
+		q.Statuses = DefaultRetryStatuses
+		p = &q
+	}
+	f.retry = p
+}
+
+// doRetry makes a request, retrying it according to the retry policy.
+func (f *Fetcher) doRetry(req *http.Request) (resp *http.Response, err error) {
+	for attempt := 1; ; attempt++ {
+		resp, err = f.do(req)
+		if attempt >= f.retry.Attempts || !f.retry.retryable(req, resp, err) {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		wait := f.retry.delay(attempt, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// sleep waits for the given duration, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
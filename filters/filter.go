@@ -24,6 +24,10 @@ type ruleSet struct {
 	rules []ruleElement
 	// Allowed variable names.
 	vars map[string]struct{}
+	// Variables that are written as an SQL expression.
+	exprs map[string]string
+	// Named integer constants.
+	consts map[string]int64
 }
 
 // A single rule.
@@ -86,6 +90,36 @@ func (l *Filter) AllowVars(domain string, vars ...string) *Filter {
 	return l
 }
 
+// DefineVar allows a variable for the given domain, which is written as the
+// given SQL expression rather than an underscore-prefixed name. Non-word names
+// are skipped.
+func (l *Filter) DefineVar(domain, name, expr string) *Filter {
+	if !isWord(domain) || !isWord(name) {
+		return l
+	}
+	l.AllowVars(domain, name)
+	ruleSet := l.getRuleSet(domain)
+	if ruleSet.exprs == nil {
+		ruleSet.exprs = map[string]string{}
+	}
+	ruleSet.exprs[name] = expr
+	return l
+}
+
+// DefineConst defines a named integer constant for the given domain. Non-word
+// names are skipped.
+func (l *Filter) DefineConst(domain, name string, value int64) *Filter {
+	if !isWord(domain) || !isWord(name) {
+		return l
+	}
+	ruleSet := l.getRuleSet(domain)
+	if ruleSet.consts == nil {
+		ruleSet.consts = map[string]int64{}
+	}
+	ruleSet.consts[name] = value
+	return l
+}
+
 // Trims a string by skipping space characters.
 func skipSpace(s string) string {
 	return strings.TrimLeftFunc(s, unicode.IsSpace)
@@ -146,10 +180,17 @@ func (l *Filter) Append(rule string) (err error) {
 	return nil
 }
 
-func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{}, e ast.Expr) error {
+func asQuery(b *strings.Builder, q *Query, rs *ruleSet, e ast.Expr) error {
 	switch e := e.(type) {
 	case *ast.BinaryExpr:
-		if err := asQuery(b, args, vars, e.X); err != nil {
+		// Bitwise operators are enclosed in parentheses to retain the
+		// precedence of the Go expression. For example, & and | have equal
+		// precedence in SQLite.
+		bitwise := e.Op == token.AND || e.Op == token.OR || e.Op == token.AND_NOT
+		if bitwise {
+			b.WriteString("( ")
+		}
+		if err := asQuery(b, q, rs, e.X); err != nil {
 			return fmt.Errorf("left expr: %w", err)
 		}
 		switch e.Op {
@@ -161,6 +202,12 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 			b.WriteString("== ")
 		case token.NEQ:
 			b.WriteString("!= ")
+		case token.AND:
+			b.WriteString("& ")
+		case token.OR:
+			b.WriteString("| ")
+		case token.AND_NOT:
+			b.WriteString("& ~ ")
 		// case token.LSS:
 		// 	b.WriteString("< ")
 		// case token.GTR:
@@ -172,12 +219,15 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 		default:
 			return fmt.Errorf("unexpected operator %q", e.Op)
 		}
-		if err := asQuery(b, args, vars, e.Y); err != nil {
+		if err := asQuery(b, q, rs, e.Y); err != nil {
 			return fmt.Errorf("right expr: %w", err)
 		}
+		if bitwise {
+			b.WriteString(") ")
+		}
 	case *ast.ParenExpr:
 		b.WriteString("( ")
-		if err := asQuery(b, args, vars, e.X); err != nil {
+		if err := asQuery(b, q, rs, e.X); err != nil {
 			return fmt.Errorf("paren expr: %w", err)
 		}
 		b.WriteString(") ")
@@ -186,10 +236,12 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 		switch e.Op {
 		case token.NOT:
 			b.WriteString("NOT ")
+		case token.XOR:
+			b.WriteString("~ ")
 		default:
 			return fmt.Errorf("unexpected operator %q", e.Op)
 		}
-		if err := asQuery(b, args, vars, e.X); err != nil {
+		if err := asQuery(b, q, rs, e.X); err != nil {
 			return fmt.Errorf("unary expr: %w", err)
 		}
 	case *ast.Ident:
@@ -204,11 +256,26 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 			b.WriteString("NULL ")
 			return nil
 		}
-		if vars != nil {
-			if _, ok := vars[e.Name]; !ok {
+		if v, ok := rs.consts[e.Name]; ok {
+			b.WriteString(strconv.FormatInt(v, 10))
+			b.WriteByte(' ')
+			return nil
+		}
+		if rs.vars != nil {
+			if _, ok := rs.vars[e.Name]; !ok {
 				return fmt.Errorf("unexpected identifier %q", e.Name)
 			}
 		}
+		if q.Vars == nil {
+			q.Vars = map[string]bool{}
+		}
+		q.Vars[e.Name] = true
+		if expr, ok := rs.exprs[e.Name]; ok {
+			b.WriteString("( ")
+			b.WriteString(expr)
+			b.WriteString(" ) ")
+			return nil
+		}
 		b.WriteByte('_')
 		b.WriteString(e.Name)
 		b.WriteByte(' ')
@@ -220,7 +287,14 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 			if err != nil {
 				return fmt.Errorf("string literal: %w", err)
 			}
-			*args = append(*args, v)
+			q.Params = append(q.Params, v)
+			b.WriteString("? ")
+		case token.INT:
+			v, err := strconv.ParseInt(e.Value, 0, 64)
+			if err != nil {
+				return fmt.Errorf("integer literal: %w", err)
+			}
+			q.Params = append(q.Params, v)
 			b.WriteString("? ")
 		default:
 			return fmt.Errorf("unexpected literal %s", e.Value)
@@ -233,10 +307,11 @@ func asQuery(b *strings.Builder, args *[]interface{}, vars map[string]struct{},
 // expression. Literals are replaced with parameters, and returned as arguments
 // to be passed to the query executor.
 //
-// The expression is prefixed with the AND operator. If the rule set contains no
-// rules, then the expression is empty.
+// The expression is enclosed in parentheses. If the rule set contains no rules,
+// then the expression is empty.
 //
-// Variables are prefixed with an underscore.
+// Variables are prefixed with an underscore, unless defined with an expression
+// by DefineVar. Constants are replaced with their values.
 func (l *Filter) AsQuery(domain string) (query Query, err error) {
 	if l.domains != nil {
 		if _, ok := l.domains[domain]; !ok {
@@ -248,7 +323,7 @@ func (l *Filter) AsQuery(domain string) (query Query, err error) {
 		return query, nil
 	}
 	var b strings.Builder
-	b.WriteString("AND ( ")
+	b.WriteString("( ")
 	for i := 1; i < len(ruleSet.rules); i++ {
 		if ruleSet.rules[i].Exclude {
 			b.WriteString("( ")
@@ -266,7 +341,7 @@ func (l *Filter) AsQuery(domain string) (query Query, err error) {
 			b.WriteString("NOT ")
 		}
 		b.WriteString("( ")
-		if err := asQuery(&b, &query.Params, ruleSet.vars, rule.Expr); err != nil {
+		if err := asQuery(&b, &query, ruleSet, rule.Expr); err != nil {
 			return Query{}, fmt.Errorf("item %s[%d]: %w", domain, i, err)
 		}
 		b.WriteString(") ")
@@ -282,4 +357,6 @@ type Query struct {
 	Expr string
 	// Values of parameters to be passed to the query.
 	Params []interface{}
+	// Variables referred to by the expression, without the underscore prefix.
+	Vars map[string]bool
 }
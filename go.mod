@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/anaminus/but v0.2.0
 	github.com/jessevdk/go-flags v1.4.0
+	github.com/klauspost/compress v1.11.13
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/robloxapi/rbxdump v0.2.0-alpha0
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
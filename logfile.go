@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a file that is appended to, and rotated once it would exceed
+// a maximum size.
+type rotatingFile struct {
+	path string
+	// Size at which the file is rotated. If zero or less, the file is not
+	// rotated.
+	maxSize int64
+	// Number of rotated files to keep.
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func (l *rotatingFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = stat.Size()
+	return nil
+}
+
+// backup returns the path of the ith rotated file, or the current file if i is
+// zero.
+func (l *rotatingFile) backup(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// full returns whether writing n bytes to the file would exceed its maximum
+// size.
+func (l *rotatingFile) full(n int) bool {
+	return l.maxSize > 0 && l.size > 0 && l.size+int64(n) > l.maxSize
+}
+
+// rotate moves the current file to a numbered backup, shifting existing
+// backups up and discarding the oldest, then opens a new file. If the file
+// cannot be moved, then writing continues to the current file.
+func (l *rotatingFile) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	var err error
+	if n := l.backups; n > 0 {
+		os.Remove(l.backup(n))
+		for i := n - 1; i >= 0; i-- {
+			if e := os.Rename(l.backup(i), l.backup(i+1)); e != nil && !os.IsNotExist(e) && err == nil {
+				err = e
+			}
+		}
+	} else {
+		err = os.Truncate(l.path, 0)
+	}
+	if e := l.open(); e != nil {
+		return e
+	}
+	return err
+}
+
+// write writes b to the open file.
+func (l *rotatingFile) write(b []byte) (n int, err error) {
+	n, err = l.file.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the file, if open.
+func (l *rotatingFile) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// logOutput is the output of the standard logger. Because the logger is
+// configured before flags are parsed, the log file is opened on the first
+// write, and output goes to stderr if no log file was specified.
+type logOutput struct {
+	mu     sync.Mutex
+	opened bool
+	rotatingFile
+}
+
+func (l *logOutput) Write(b []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.opened {
+		l.opened = true
+		if FlagOptions.LogFile != "" {
+			l.rotatingFile = rotatingFile{
+				path:    FlagOptions.LogFile,
+				maxSize: FlagOptions.LogMaxSize,
+				backups: FlagOptions.LogBackups,
+			}
+			if err := l.open(); err != nil {
+				fmt.Fprintf(os.Stderr, "open log file: %s\n", err)
+			}
+		}
+	}
+	if l.file == nil {
+		return os.Stderr.Write(b)
+	}
+	if l.full(len(b)) {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate log file: %s\n", err)
+		}
+		if l.file == nil {
+			return os.Stderr.Write(b)
+		}
+	}
+	return l.write(b)
+}
@@ -2,66 +2,334 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/anaminus/rbxark/fetch"
 	"github.com/anaminus/rbxark/filters"
+	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/s3"
 	"github.com/jessevdk/go-flags"
+	"github.com/mattn/go-sqlite3"
 )
 
 var Main, CancelMain = context.WithCancel(context.Background())
 
 var FlagOptions struct {
-	Config string `short:"c" long:"config" description:"Path to configuration file. Defaults to the database file path appended with '.json'."`
+	Config    string `short:"c" long:"config" description:"Path to configuration file. Defaults to the database file path appended with '.json'."`
+	Workspace string `short:"w" long:"workspace" description:"Path to a workspace file. Commands operate on each archive listed in the workspace instead of a single database given as an argument."`
+
+	LogFile    string `long:"log-file" description:"Write log output to the given file instead of stderr."`
+	LogMaxSize int64  `long:"log-max-size" default:"10485760" description:"Size in bytes at which the log file is rotated. Zero disables rotation."`
+	LogBackups int    `long:"log-backups" default:"3" description:"Number of rotated log files to keep."`
+
+	ProfileCPU string `long:"profile-cpu" description:"Write a CPU profile of the command to the given file."`
+	ProfileMem string `long:"profile-mem" description:"Write a memory profile to the given file once the command finishes."`
+
+	Root      string `long:"root" description:"Directory against which relative paths of databases, workspaces, and configs are resolved, instead of the working directory."`
+	Immutable bool   `long:"immutable" description:"Open databases as immutable, such as on a read-only file system. Commands that modify a database fail."`
 }
 var FlagParser = flags.NewParser(&FlagOptions, flags.Default)
 
 func init() {
 	log.SetFlags(0)
+	log.SetOutput(&logOutput{})
+}
+
+// OpenDatabase opens the database at the given path. If secondary is not empty,
+// then the database at that path is attached to each connection as the
+// secondary database.
+//
+// If the --immutable flag is set, then the databases are opened as immutable.
+// SQLite does not lock an immutable database or create a journal next to it,
+// so it can be read from a read-only file system. The schema must already be
+// up to date, because it cannot be migrated.
+//
+// A database whose path has the CompressedExt extension is decompressed to a
+// cache, and the copy is opened as immutable.
+func OpenDatabase(path, secondary string) (db *sql.DB, err error) {
+	if path, err = openPath(path); err != nil {
+		return nil, err
+	}
+	if secondary != "" {
+		if secondary, err = openPath(secondary); err != nil {
+			return nil, err
+		}
+	}
+	return sql.Open(sqliteDriver(secondary), path)
+}
+
+// OpenReadOnlyDatabase opens the database at path, and the secondary database
+// if not empty, such that neither can be modified, such as a database that
+// belongs to another operator. A database that does not exist is an error
+// rather than being created. The database must not be initialized with Init.
+func OpenReadOnlyDatabase(path, secondary string) (db *sql.DB, err error) {
+	if path, err = readOnlyPath(path); err != nil {
+		return nil, err
+	}
+	if secondary != "" {
+		if secondary, err = readOnlyPath(secondary); err != nil {
+			return nil, err
+		}
+	}
+	return sql.Open(sqliteDriver(secondary), path)
+}
+
+// readOnlyPath returns the name by which the database at path is opened as
+// read-only.
+func readOnlyPath(path string) (string, error) {
+	if strings.HasSuffix(path, CompressedExt) || FlagOptions.Immutable {
+		return openPath(path)
+	}
+	return sqliteURI(path, "mode=ro"), nil
+}
+
+// openPath returns the name by which the database at path is opened.
+func openPath(path string) (string, error) {
+	if strings.HasSuffix(path, CompressedExt) {
+		path, err := decompressedDatabase(path)
+		if err != nil {
+			return "", err
+		}
+		return sqliteURI(path, "immutable=1"), nil
+	}
+	if FlagOptions.Immutable {
+		return sqliteURI(path, "immutable=1"), nil
+	}
+	return path, nil
 }
 
-// Gets a database path from a list of arguments and opens the database. Returns
-// the database and the directory of the database.
-func OpenDatabase(args []string) (db *sql.DB, dir string, err error) {
-	if len(args) == 0 {
-		return nil, "", fmt.Errorf("expected database file")
+// sqliteURI returns a URI filename of an SQLite database at the given path,
+// with the given query.
+func sqliteURI(path, query string) string {
+	path = filepath.ToSlash(path)
+	if filepath.VolumeName(path) != "" {
+		// A Windows drive must follow an empty authority.
+		path = "///" + path
 	}
-	if db, err = sql.Open("sqlite3", args[0]); err != nil {
-		return nil, "", err
+	path = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	return "file:" + path + "?" + query
+}
+
+var sqliteDrivers struct {
+	sync.Mutex
+	names map[string]string
+}
+
+// sqliteDriver returns the name of a driver that attaches the given secondary
+// database to each new connection. Attachments apply per connection, so they
+// must be made by a connect hook rather than by a single statement.
+func sqliteDriver(secondary string) string {
+	if secondary == "" {
+		return "sqlite3"
+	}
+	sqliteDrivers.Lock()
+	defer sqliteDrivers.Unlock()
+	if name, ok := sqliteDrivers.names[secondary]; ok {
+		return name
+	}
+	if sqliteDrivers.names == nil {
+		sqliteDrivers.names = map[string]string{}
+	}
+	name := fmt.Sprintf("sqlite3_rbxark_%d", len(sqliteDrivers.names))
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(`ATTACH DATABASE ? AS `+SecondarySchema, []driver.Value{secondary})
+			return err
+		},
+	})
+	sqliteDrivers.names[secondary] = name
+	return name
+}
+
+// rootPath returns path resolved against the --root directory. A path that is
+// absolute, or empty, is returned as-is, as is any path if the flag is not set.
+func rootPath(path string) string {
+	if FlagOptions.Root == "" || path == "" || filepath.IsAbs(path) {
+		return path
 	}
-	return db, args[0] + ".json", nil
+	return filepath.Join(FlagOptions.Root, path)
 }
 
 func LoadConfig(path string) (config *Config, err error) {
 	if FlagOptions.Config != "" {
-		path = FlagOptions.Config
+		path = rootPath(FlagOptions.Config)
 	}
-	f, err := os.Open(path)
+	return loadConfigFile(path)
+}
+
+// loadConfigFile loads the config at path, regardless of --config, such as the
+// config of a database other than those operated on.
+func loadConfigFile(path string) (config *Config, err error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("open config: %w", err)
 	}
-	config = &Config{}
-	err = json.NewDecoder(f).Decode(config)
-	f.Close()
-	if err != nil {
+	sum := sha256.Sum256(b)
+	config = &Config{path: path, hash: hex.EncodeToString(sum[:])}
+	if err := json.Unmarshal(b, config); err != nil {
 		if serr := (*json.SyntaxError)(nil); errors.As(err, &serr) {
 			return nil, fmt.Errorf("decode config: offset %d: %w", serr.Offset, serr)
 		}
 		return nil, fmt.Errorf("decode config: %w", err)
 	}
+	if config.HeadersOnly && config.ObjectsPath != "" {
+		return nil, fmt.Errorf("headers_only: objects path must be unset")
+	}
+	if config.CompressObjects && config.ObjectsIndex {
+		// Compressing an existing object changes its modification time,
+		// which the index would report as damage.
+		return nil, fmt.Errorf("compress_objects: objects_index must be unset")
+	}
 	if config.ObjectsPath != "" && !filepath.IsAbs(config.ObjectsPath) {
 		// Path is relative to config file.
 		config.ObjectsPath = filepath.Join(filepath.Dir(path), config.ObjectsPath)
 	}
+	for i, c := range config.Channels {
+		if !containsString(config.Servers, c.Server) {
+			return nil, fmt.Errorf("channels[%d]: server %q is not configured", i, c.Server)
+		}
+	}
+	if err := checkStorage(config); err != nil {
+		return nil, fmt.Errorf("object_storage: %w", err)
+	}
+	if config.SecondaryDatabase != "" && !filepath.IsAbs(config.SecondaryDatabase) {
+		// Path is relative to config file.
+		config.SecondaryDatabase = filepath.Join(filepath.Dir(path), config.SecondaryDatabase)
+	}
+	if config.RunHistory != "" && !filepath.IsAbs(config.RunHistory) {
+		// Path is relative to config file.
+		config.RunHistory = filepath.Join(filepath.Dir(path), config.RunHistory)
+	}
+	if config.Serve.AccessLog != "" && !filepath.IsAbs(config.Serve.AccessLog) {
+		// Path is relative to config file.
+		config.Serve.AccessLog = filepath.Join(filepath.Dir(path), config.Serve.AccessLog)
+	}
+	if err := fetch.CheckHashSources(config.HashHeaders); err != nil {
+		return nil, fmt.Errorf("hash_headers: %w", err)
+	}
+	hosts := map[string]bool{}
+	for i, t := range config.HostLimits {
+		u, err := url.Parse(t.Server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("host_limits[%d]: malformed server %q", i, t.Server)
+		}
+		if hosts[u.Host] {
+			return nil, fmt.Errorf("host_limits[%d]: host %s: multiple limits", i, u.Host)
+		}
+		hosts[u.Host] = true
+	}
+	for i := range config.TLS {
+		for j, ca := range config.TLS[i].CA {
+			if !filepath.IsAbs(ca) {
+				// Path is relative to config file.
+				config.TLS[i].CA[j] = filepath.Join(filepath.Dir(path), ca)
+			}
+		}
+	}
 	return config, nil
 }
 
+// checkStorage validates the object storage of config, resolving the path of a
+// directory relative to the config file.
+func checkStorage(config *Config) error {
+	st := &config.ObjectStorage
+	if st.Type == "" {
+		return nil
+	}
+	if config.ObjectsPath == "" {
+		return fmt.Errorf("objects path required")
+	}
+	if config.ObjectsIndex {
+		// Objects leave the objects path, so the index would refer to
+		// objects that are no longer present.
+		return fmt.Errorf("objects_index is not supported")
+	}
+	switch st.Type {
+	case "dir":
+		if st.Path == "" {
+			return fmt.Errorf("path required")
+		}
+		if !filepath.IsAbs(st.Path) {
+			// Path is relative to config file.
+			st.Path = filepath.Join(filepath.Dir(config.path), st.Path)
+		}
+		if filepath.Clean(st.Path) == filepath.Clean(config.ObjectsPath) {
+			return fmt.Errorf("path must differ from objects path")
+		}
+	case "s3", "gcs":
+		if st.Bucket == "" {
+			return fmt.Errorf("bucket required")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", st.Type)
+	}
+	return nil
+}
+
+// OpenStorage returns the storage to which the objects of an archive are moved.
+// Returns nil if the archive has no object storage.
+func OpenStorage(config *Config) (objects.Storage, error) {
+	st := config.ObjectStorage
+	switch st.Type {
+	case "":
+		return nil, nil
+	case "dir":
+		if err := isDir(st.Path); err != nil {
+			return nil, fmt.Errorf("object storage: %w", err)
+		}
+		return objects.Dir(st.Path), nil
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	var doer s3.Doer = client
+	if client == nil {
+		doer = http.DefaultClient
+	}
+	creds := &s3.Credentials{
+		AccessKey: st.AccessKey,
+		SecretKey: st.SecretKey,
+		Region:    st.Region,
+	}
+	if creds.AccessKey == "" {
+		creds = s3.EnvCredentials(st.Region)
+	}
+	var bucket *objects.Bucket
+	if st.Type == "gcs" {
+		bucket = objects.GCSBucket(doer, st.Bucket, creds)
+	} else {
+		bucket = &objects.Bucket{Uploader: s3.Uploader{
+			Client: doer,
+			Bucket: st.Bucket,
+			Creds:  creds,
+		}}
+	}
+	bucket.PartSize = st.PartSize << 20
+	if config.Retry.Attempts > 1 {
+		bucket.Retries = config.Retry.Attempts - 1
+	}
+	return bucket, nil
+}
+
 func LoadFilter(list []string, typ string) (query filters.Query, err error) {
 	filter := &filters.Filter{}
 	filter.AllowDomains(
@@ -78,6 +346,14 @@ func LoadFilter(list []string, typ string) (query filters.Query, err error) {
 		"build",
 		"file",
 	)
+	for _, domain := range []string{"headers", "content"} {
+		filter.DefineVar(domain, "flags", "files.flags")
+		filter.DefineVar(domain, "progress", progressExpr("files.flags"))
+		filter.DefineVar(domain, "channel", channelExpr("build_servers.server"))
+		for name, flag := range fileFlagNames {
+			filter.DefineConst(domain, name, int64(flag))
+		}
+	}
 	for i, f := range list {
 		if err := filter.Append(f); err != nil {
 			return filters.Query{}, fmt.Errorf("load filters: filter[%d]: %w", i, err)
@@ -89,15 +365,174 @@ func LoadFilter(list []string, typ string) (query filters.Query, err error) {
 	return query, nil
 }
 
+// reload is set when the process is asked to reload its configuration.
+var reload int32
+
+// ReloadRequested returns whether a reload of the configuration was requested
+// since the last call.
+func ReloadRequested() bool {
+	return atomic.SwapInt32(&reload, 0) != 0
+}
+
+// CheckObjects checks the objects added to an archive since the last check for
+// damage, such as truncation caused by a crash. Done on startup by commands
+// that read or write objects.
+func CheckObjects(action Action, ar *Archive, config *Config) error {
+	store, err := OpenStorage(config)
+	if err != nil {
+		return err
+	}
+	checked, damaged, err := action.CheckRecentObjects(ar.DB, config.ObjectsPath, store)
+	if err != nil {
+		return fmt.Errorf("check objects: %w", err)
+	}
+	for _, hash := range damaged {
+		log.Printf("object %s is damaged; removed to be fetched again", hash)
+	}
+	if len(damaged) > 0 {
+		log.Printf("%d of %d recent objects were damaged", len(damaged), checked)
+	}
+	return nil
+}
+
+// ErrHeadersOnly indicates that an operation requires content, which is not
+// archived by a headers-only archive.
+var ErrHeadersOnly = errors.New("archive is headers-only")
+
+// RequireObjects returns an error if the archive has no objects path. Done by
+// commands that read or write objects.
+func RequireObjects(config *Config) error {
+	switch {
+	case config.HeadersOnly:
+		return fmt.Errorf("%w: content is not archived", ErrHeadersOnly)
+	case config.ObjectsPath == "":
+		return fmt.Errorf("objects path required")
+	}
+	return nil
+}
+
+// NewClient returns the HTTP client used for fetching, according to the config.
+// Returns nil if the default client is to be used.
+func NewClient(config *Config) (client *http.Client, err error) {
+	switch r := config.Resolver; {
+	case r.Address != "" && r.DoH != "":
+		return nil, fmt.Errorf("resolver: address and doh are mutually exclusive")
+	case r.Address != "":
+		client = fetch.NewClient(fetch.DNSResolver(r.Address))
+	case r.DoH != "":
+		client = fetch.NewClient(&fetch.DoHResolver{URL: r.DoH})
+	}
+	if len(config.NoRedirectServers) > 0 {
+		if client == nil {
+			client = &http.Client{}
+		}
+		servers := make([]string, len(config.NoRedirectServers))
+		for i, server := range config.NoRedirectServers {
+			servers[i] = sanitizeBaseURL(server) + "/"
+		}
+		client.CheckRedirect = fetch.RedirectPolicy(servers)
+	}
+	if len(config.TLS) > 0 {
+		policies := make([]fetch.TLSPolicy, len(config.TLS))
+		for i, t := range config.TLS {
+			u, err := url.Parse(t.Server)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("tls: malformed server %q", t.Server)
+			}
+			policies[i] = fetch.TLSPolicy{
+				Host:     u.Host,
+				CAFiles:  t.CA,
+				Pins:     t.Pins,
+				Insecure: t.Insecure,
+			}
+		}
+		if client, err = fetch.WithTLS(client, policies); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	return client, nil
+}
+
+// NewFetcher returns the fetcher used for fetching, according to the config,
+// with the given client, number of workers, and rate limit.
+func NewFetcher(config *Config, client *http.Client, workers int, rateLimit float64) *fetch.Fetcher {
+	var f *fetch.Fetcher
+	if config.PerHostWorkers {
+		f = fetch.NewHostFetcher(client, workers, rateLimit)
+	} else {
+		f = fetch.NewFetcher(client, workers, rateLimit)
+	}
+	f.SetHashSources(config.HashHeaders)
+	if len(config.HostLimits) > 0 {
+		limits := make([]fetch.HostLimit, len(config.HostLimits))
+		for i, t := range config.HostLimits {
+			// Validated by LoadConfig.
+			u, _ := url.Parse(t.Server)
+			limits[i] = fetch.HostLimit{
+				Host:      u.Host,
+				RateLimit: t.RateLimit,
+				Workers:   t.Workers,
+			}
+		}
+		f.SetHostLimits(limits)
+	}
+	cooldown := config.CircuitBreaker.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+	f.SetCircuitBreaker(config.CircuitBreaker.Failures, time.Duration(cooldown*float64(time.Second)))
+	base := config.Retry.Base
+	if base <= 0 {
+		base = DefaultRetryBase
+	}
+	limit := config.Retry.Cap
+	if limit <= 0 {
+		limit = DefaultRetryCap
+	}
+	f.SetRetryPolicy(&fetch.RetryPolicy{
+		Attempts:      config.Retry.Attempts,
+		Base:          time.Duration(base * float64(time.Second)),
+		Cap:           time.Duration(limit * float64(time.Second)),
+		Statuses:      config.Retry.Statuses,
+		NetworkErrors: config.Retry.NetworkErrors,
+	})
+	return f
+}
+
+// DefaultCircuitCooldown is the number of seconds for which requests to a
+// failing host are suspended, if not configured.
+const DefaultCircuitCooldown = 60
+
+// DefaultRetryBase and DefaultRetryCap are the number of seconds waited before
+// the first retry of a request, and at most before any retry, if not
+// configured.
+const (
+	DefaultRetryBase = 1
+	DefaultRetryCap  = 30
+)
+
 func MonitorSignals(cancel context.CancelFunc) {
 	go func() {
+		// On Windows, closing the console, logging off, and shutting down
+		// are delivered as SIGTERM.
 		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		reloadSig := make(chan os.Signal, 1)
+		if len(reloadSignals) > 0 {
+			signal.Notify(reloadSig, reloadSignals...)
+		}
 		for {
 			select {
 			case <-sig:
+				Notify("STOPPING=1")
 				cancel()
+				// Restore default behavior, so that a second signal
+				// terminates immediately.
+				signal.Stop(sig)
 				return
+			case <-reloadSig:
+				log.Println("reload requested")
+				atomic.StoreInt32(&reload, 1)
 			}
 		}
 	}()
@@ -123,5 +558,31 @@ func (tags OptionTags) AddTo(cmd *flags.Command, err error) (*flags.Command, err
 
 func main() {
 	MonitorSignals(CancelMain)
+	FlagParser.CommandHandler = func(command flags.Commander, args []string) error {
+		if FlagOptions.Root != "" {
+			// Paths of databases, workspaces, and configs resolve against the
+			// root with rootPath. The working directory is unchanged, so that
+			// other paths given as arguments, such as output files, remain
+			// relative to it. The root is made absolute so that a resolved
+			// path is not resolved again.
+			root, err := filepath.Abs(FlagOptions.Root)
+			if err == nil {
+				err = isDir(root)
+			}
+			if err != nil {
+				return fmt.Errorf("root: %w", err)
+			}
+			FlagOptions.Root = root
+		}
+		stop, err := startProfiles()
+		if err != nil {
+			return err
+		}
+		defer stop()
+		if err := ApplyFlagDefaults(command, args); err != nil {
+			return err
+		}
+		return command.Execute(args)
+	}
 	FlagParser.Parse()
 }
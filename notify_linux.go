@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// Notify sends a state notification, such as "READY=1", to the service manager
+// through the socket given by the NOTIFY_SOCKET environment variable, as with
+// sd_notify. Does nothing if the variable is unset.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// Abstract namespace.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Notify sends a state notification to the service manager. Service manager
+// notifications are supported only on Linux, so this does nothing.
+func Notify(state string) error {
+	return nil
+}
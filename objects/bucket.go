@@ -0,0 +1,139 @@
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anaminus/rbxark/s3"
+)
+
+// Key returns the key of the object of a given hash within a bucket, which has
+// the layout of an objects path. Returns an empty string if the hash is
+// invalid.
+//
+//     hash: d41d8cd98f00b204e9800998ecf8427e
+//     key:  d4/d41d8cd98f00b204e9800998ecf8427e
+func Key(hash string) string {
+	if !IsHash(hash) {
+		return ""
+	}
+	return hash[:2] + "/" + hash
+}
+
+// GCSEndpoint is the endpoint of the XML API of Google Cloud Storage, which is
+// compatible with S3 when requests are signed with an HMAC key.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// Bucket is a Storage located in an S3-compatible bucket, having the layout of
+// an objects path. Objects are uploaded by the embedded Uploader, which also
+// holds the client, location, and credentials used for every other request.
+type Bucket struct {
+	s3.Uploader
+}
+
+// GCSBucket returns a Bucket located in the Google Cloud Storage bucket of the
+// given name. Requests must be signed with an HMAC key of the bucket, given as
+// the access and secret keys of creds.
+func GCSBucket(client s3.Doer, name string, creds *s3.Credentials) *Bucket {
+	if creds != nil && creds.Region == "" {
+		c := *creds
+		c.Region = "auto"
+		creds = &c
+	}
+	return &Bucket{s3.Uploader{
+		Client: client,
+		Bucket: GCSEndpoint + "/" + name,
+		Creds:  creds,
+	}}
+}
+
+// Put implements Storage. The content is read once to be verified before being
+// uploaded.
+func (b *Bucket) Put(ctx context.Context, hash string, r io.ReaderAt, size int64) error {
+	key := Key(hash)
+	if key == "" {
+		return errInvalidHash(hash)
+	}
+	if n, err := b.Stat(ctx, hash); err == nil && n == size {
+		return nil
+	}
+	sum, err := digestAt(r, size)
+	if err != nil {
+		return fmt.Errorf("put object %s: %w", hash, err)
+	}
+	if sum != hash {
+		return fmt.Errorf("put object %s: %w: content has hash %s", hash, ErrDamaged, sum)
+	}
+	if err := b.Upload(ctx, key, r, size); err != nil {
+		return fmt.Errorf("put object %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Get implements Storage.
+func (b *Bucket) Get(ctx context.Context, hash string) (io.ReadCloser, error) {
+	key := Key(hash)
+	if key == "" {
+		return nil, errInvalidHash(hash)
+	}
+	return s3.Get(ctx, b.Client, b.Bucket, key, b.Creds)
+}
+
+// Exists implements Storage.
+func (b *Bucket) Exists(ctx context.Context, hash string) (bool, error) {
+	_, err := b.Stat(ctx, hash)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat implements Storage.
+func (b *Bucket) Stat(ctx context.Context, hash string) (size int64, err error) {
+	key := Key(hash)
+	if key == "" {
+		return 0, errInvalidHash(hash)
+	}
+	object, err := s3.Head(ctx, b.Client, b.Bucket, key, b.Creds)
+	if err != nil {
+		return 0, err
+	}
+	return object.Size, nil
+}
+
+// List implements Storage. The bucket is listed once for each prefix
+// directory, so objects are visited in order of hash. Keys that are not of an
+// object are skipped.
+func (b *Bucket) List(ctx context.Context, fn func(hash string, size int64) error) error {
+	for i := 0; i < 256; i++ {
+		prefix := fmt.Sprintf("%02x/", i)
+		err := s3.List(ctx, b.Client, b.Bucket, prefix, b.Creds, func(object s3.Object) error {
+			hash := strings.TrimPrefix(object.Key, prefix)
+			if Key(hash) != object.Key {
+				return nil
+			}
+			return fn(hash, object.Size)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove implements Storage.
+func (b *Bucket) Remove(ctx context.Context, hash string) error {
+	key := Key(hash)
+	if key == "" {
+		return errInvalidHash(hash)
+	}
+	err := s3.Delete(ctx, b.Client, b.Bucket, key, b.Creds)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+package objects
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressedExt is the extension of the file of an object that is compressed
+// with zstd. A compressed object is located where the object would otherwise
+// be, with the extension appended to its name.
+//
+//     hash: d41d8cd98f00b204e9800998ecf8427e
+//     path: objects/d4/d41d8cd98f00b204e9800998ecf8427e.zst
+//
+// Objects are named by the hash of their decompressed content, so an object
+// may be stored in either form. The file of a compressed object ends with a
+// skippable frame holding the size of the content, so that the size is known
+// without decompressing the object. Decoders ignore the frame, so the file can
+// be decompressed by any zstd tool.
+const CompressedExt = ".zst"
+
+// Constants of the frame holding the size of the content of a compressed
+// object: a skippable frame header, followed by the size as an unsigned 64-bit
+// little-endian integer.
+const (
+	sizeFrameMagic = 0x184D2A5A
+	sizeFrameData  = 8
+	sizeFrameLen   = 8 + sizeFrameData
+)
+
+// CompressedPath returns the file path for the compressed object of a given
+// hash. Returns an empty string if the hash is invalid or if objpath is empty.
+func CompressedPath(objpath, hash string) string {
+	if path := Path(objpath, hash); path != "" {
+		return path + CompressedExt
+	}
+	return ""
+}
+
+// compressedInfo describes the file of a compressed object. Name returns the
+// hash of the object, and Size returns the size of its content.
+type compressedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (info compressedInfo) Name() string {
+	return strings.TrimSuffix(info.FileInfo.Name(), CompressedExt)
+}
+
+func (info compressedInfo) Size() int64 {
+	return info.size
+}
+
+// IsCompressed returns whether the object described by info, as returned by
+// Stat or passed by Walk, is compressed.
+func IsCompressed(info os.FileInfo) bool {
+	_, ok := info.(compressedInfo)
+	return ok
+}
+
+// StoredSize returns the size of the file of the object described by info, as
+// returned by Stat or passed by Walk. For a compressed object, this is the
+// compressed size, while info.Size is the size of the content.
+func StoredSize(info os.FileInfo) int64 {
+	if c, ok := info.(compressedInfo); ok {
+		return c.FileInfo.Size()
+	}
+	return info.Size()
+}
+
+// statCompressed returns the file info of the compressed object at path.
+func statCompressed(path string) (os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := readSizeFrame(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return compressedInfo{FileInfo: stat, size: size}, nil
+}
+
+// readSizeFrame returns the size of the content of a compressed object, read
+// from the frame at the end of its file of the given size.
+func readSizeFrame(f io.ReaderAt, stored int64) (int64, error) {
+	if stored < sizeFrameLen {
+		return 0, errors.New("missing size frame")
+	}
+	var b [sizeFrameLen]byte
+	if _, err := f.ReadAt(b[:], stored-sizeFrameLen); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(b[0:]) != sizeFrameMagic ||
+		binary.LittleEndian.Uint32(b[4:]) != sizeFrameData {
+		return 0, errors.New("missing size frame")
+	}
+	return int64(binary.LittleEndian.Uint64(b[8:])), nil
+}
+
+// writeSizeFrame writes the frame holding the size of the content of a
+// compressed object.
+func writeSizeFrame(w io.Writer, size int64) error {
+	var b [sizeFrameLen]byte
+	binary.LittleEndian.PutUint32(b[0:], sizeFrameMagic)
+	binary.LittleEndian.PutUint32(b[4:], sizeFrameData)
+	binary.LittleEndian.PutUint64(b[8:], uint64(size))
+	_, err := w.Write(b[:])
+	return err
+}
+
+// newEncoder returns an encoder that compresses content written to it into w.
+// Each encoder compresses on the calling goroutine, because objects are
+// already written concurrently.
+func newEncoder(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// countWriter counts the bytes written to a writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressor reads the content of a compressed object.
+type decompressor struct {
+	*zstd.Decoder
+	file *os.File
+}
+
+func (d decompressor) Close() error {
+	d.Decoder.Close()
+	return d.file.Close()
+}
+
+// Open opens the content of the object of a given hash for reading. The content
+// of a compressed object is decompressed as it is read. An uncompressed object
+// is returned as an *os.File. If the object does not exist in either form, then
+// the error satisfies os.IsNotExist.
+func Open(objpath, hash string) (io.ReadCloser, error) {
+	path := Path(objpath, hash)
+	if path == "" {
+		return nil, &os.PathError{Op: "open", Path: hash, Err: os.ErrNotExist}
+	}
+	f, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	if f, err = os.Open(path + CompressedExt); err != nil {
+		return nil, err
+	}
+	d, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return decompressor{Decoder: d, file: f}, nil
+}
+
+// File is the content of an object that can be read at any offset.
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+// TempFile is a temporary file that is removed when closed.
+type TempFile struct {
+	*os.File
+}
+
+// Close closes and removes the file.
+func (f TempFile) Close() error {
+	err := f.File.Close()
+	if rerr := os.Remove(f.File.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// OpenFile opens the content of the object of a given hash as a File. An
+// uncompressed object is returned as an *os.File. A compressed object is
+// decompressed into a temporary file within objpath, which is removed when the
+// File is closed. If the object does not exist in either form, then the error
+// satisfies os.IsNotExist.
+func OpenFile(objpath, hash string) (File, error) {
+	r, err := Open(objpath, hash)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := r.(*os.File); ok {
+		return f, nil
+	}
+	defer r.Close()
+	file, err := ioutil.TempFile(objpath, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(file, r); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		TempFile{file}.Close()
+		return nil, fmt.Errorf("decompress object %s: %w", hash, err)
+	}
+	return TempFile{file}, nil
+}
+
+// Remove removes the object of a given hash, in either form. Removing an object
+// that does not exist is not an error.
+func Remove(objpath, hash string) error {
+	path := Path(objpath, hash)
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + CompressedExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Compress replaces the uncompressed object of a given hash with a compressed
+// object. The content is verified against the hash while it is compressed, and
+// the uncompressed object is removed only once the compressed object is in
+// place. Returns the size of the compressed object.
+//
+// If the content does not match the hash, then the object is left as it is,
+// and the error wraps ErrDamaged.
+func Compress(objpath, hash string) (stored int64, err error) {
+	path := Path(objpath, hash)
+	if path == "" {
+		return 0, errInvalidHash(hash)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	file, err := ioutil.TempFile(objpath, tempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	count := &countWriter{w: file}
+	digest := md5.New()
+	var size int64
+	enc, err := newEncoder(count)
+	if err == nil {
+		size, err = io.Copy(io.MultiWriter(enc, digest), src)
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = writeSizeFrame(count, size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); err == nil && sum != hash {
+		err = fmt.Errorf("%w: content has hash %s", ErrDamaged, sum)
+	}
+	if err == nil {
+		err = move(file.Name(), path+CompressedExt)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, fmt.Errorf("compress object %s: %w", hash, err)
+	}
+	src.Close()
+	if err := os.Remove(path); err != nil {
+		return 0, fmt.Errorf("compress object %s: %w", hash, err)
+	}
+	return count.n, nil
+}
+
+// compressedName returns the hash of the compressed object of a file name
+// within a prefix directory, or an empty string if the name is not of a
+// compressed object.
+func compressedName(name string) string {
+	if hash := strings.TrimSuffix(name, CompressedExt); hash != name && IsHash(hash) {
+		return hash
+	}
+	return ""
+}
+
+// statEntry returns the file info of the object of an entry of a prefix
+// directory, as passed by Walk.
+func statEntry(dirpath string, entry os.FileInfo) (os.FileInfo, error) {
+	if compressedName(entry.Name()) == "" {
+		return entry, nil
+	}
+	return statCompressed(filepath.Join(dirpath, entry.Name()))
+}
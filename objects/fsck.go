@@ -0,0 +1,189 @@
+package objects
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix is the prefix of the names of temporary files written by Writer.
+const tempPrefix = ".unresolved_rbxark_object_"
+
+// Problem describes an inconsistency in the layout of an objects path.
+type Problem struct {
+	// Path of the file or directory with the problem.
+	Path string
+	// Kind of problem:
+	//
+	//     misplaced   An object that is not in its prefix directory, or whose
+	//                 name is not lower case.
+	//     conflict    A misplaced object whose correct location is occupied by
+	//                 an object of a different size.
+	//     duplicate   A compressed object that is also stored uncompressed.
+	//     empty       A prefix directory without entries.
+	//     permission  A file or directory that the owner cannot access.
+	//     temporary   A temporary file left by an interrupted write.
+	//     unknown     An entry that is not part of the layout.
+	Kind string
+	// Description of the problem.
+	Detail string
+	// Whether the problem was repaired.
+	Repaired bool
+	// Error that occurred while repairing, if any.
+	Err error
+}
+
+// Fsck checks the layout of an objects path. Each object must be a regular
+// file, named by its lower case hash, within the directory named by the first
+// two characters of the hash. The name of a compressed object is followed by
+// CompressedExt, and an object must not be stored in both forms. Each problem
+// found is passed to report.
+//
+// If repair is true, then misplaced objects are moved to their correct
+// location, empty prefix directories are removed, duplicate compressed objects
+// are removed, and missing owner permissions are added. Other problems are only
+// reported. Temporary files are
+// not removed, because they may belong to a write in progress.
+func Fsck(objpath string, repair bool, report func(Problem)) error {
+	entries, err := ioutil.ReadDir(objpath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(objpath, entry.Name())
+		switch name := entry.Name(); {
+		case entry.IsDir() && isPrefix(name):
+			if err := fsckPrefix(objpath, name, entry, repair, report); err != nil {
+				return err
+			}
+		case name == JournalName && entry.Mode().IsRegular():
+			fsckMode(path, entry, repair, report)
+		case strings.HasPrefix(name, tempPrefix):
+			report(Problem{Path: path, Kind: "temporary", Detail: "temporary file"})
+		case IsHash(strings.ToLower(name)) && entry.Mode().IsRegular():
+			fsckMisplaced(path, Path(objpath, strings.ToLower(name)), entry, repair, report)
+		default:
+			report(Problem{Path: path, Kind: "unknown", Detail: "not part of the layout"})
+		}
+	}
+	return nil
+}
+
+// isPrefix returns whether name is a valid prefix directory name.
+func isPrefix(name string) bool {
+	return len(name) == 2 && IsHash(name+"000000000000000000000000000000")
+}
+
+// fsckPrefix checks the entries of a prefix directory.
+func fsckPrefix(objpath, prefix string, info os.FileInfo, repair bool, report func(Problem)) error {
+	dirpath := filepath.Join(objpath, prefix)
+	fsckMode(dirpath, info, repair, report)
+	entries, err := ioutil.ReadDir(dirpath)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		p := Problem{Path: dirpath, Kind: "empty", Detail: "empty prefix directory"}
+		if repair {
+			p.Err = os.Remove(dirpath)
+			p.Repaired = p.Err == nil
+		}
+		report(p)
+		return nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dirpath, entry.Name())
+		switch name := entry.Name(); {
+		case name == IndexName && entry.Mode().IsRegular():
+			fsckMode(path, entry, repair, report)
+		case strings.HasPrefix(name, tempPrefix):
+			report(Problem{Path: path, Kind: "temporary", Detail: "temporary file"})
+		case IsHash(strings.ToLower(name)) && entry.Mode().IsRegular():
+			hash := strings.ToLower(name)
+			if name == hash && hash[:2] == prefix {
+				fsckMode(path, entry, repair, report)
+				continue
+			}
+			fsckMisplaced(path, Path(objpath, hash), entry, repair, report)
+		case compressedName(strings.ToLower(name)) != "" && entry.Mode().IsRegular():
+			hash := compressedName(strings.ToLower(name))
+			if name != hash+CompressedExt || hash[:2] != prefix {
+				fsckMisplaced(path, CompressedPath(objpath, hash), entry, repair, report)
+				continue
+			}
+			fsckMode(path, entry, repair, report)
+			if _, err := os.Lstat(Path(objpath, hash)); err == nil {
+				// The uncompressed object is kept, because it was not
+				// necessarily replaced by a complete compression.
+				p := Problem{Path: path, Kind: "duplicate", Detail: "object is also stored uncompressed"}
+				if repair {
+					p.Err = os.Remove(path)
+					p.Repaired = p.Err == nil
+				}
+				report(p)
+			}
+		default:
+			report(Problem{Path: path, Kind: "unknown", Detail: "not part of the layout"})
+		}
+	}
+	if repair {
+		// Remove the directory if every entry was moved out of it. Fails
+		// harmlessly if the directory is not empty.
+		os.Remove(dirpath)
+	}
+	return nil
+}
+
+// fsckMisplaced reports, and optionally moves to target, an object at path that
+// belongs at target.
+func fsckMisplaced(path, target string, info os.FileInfo, repair bool, report func(Problem)) {
+	p := Problem{Path: path, Kind: "misplaced", Detail: "belongs at " + target}
+	if stat, err := os.Lstat(target); err == nil && !os.SameFile(stat, info) {
+		if stat.Size() != info.Size() {
+			// Which of the two is correct cannot be known without reading
+			// them, so both are left for inspection.
+			p.Kind = "conflict"
+			p.Detail = "belongs at " + target + ", which has a different size"
+			report(p)
+			return
+		}
+		// Duplicate of a placed object.
+		if repair {
+			p.Err = os.Remove(path)
+			p.Repaired = p.Err == nil
+		}
+		report(p)
+		return
+	}
+	// The target may be the same file when only the case of the name differs,
+	// on a case-insensitive file system. Renaming corrects the case.
+	if repair {
+		p.Err = os.MkdirAll(filepath.Dir(target), 0755)
+		if p.Err == nil {
+			p.Err = move(path, target)
+		}
+		p.Repaired = p.Err == nil
+	}
+	report(p)
+}
+
+// fsckMode reports, and optionally adds, missing owner permissions of a file
+// or directory. The owner must be able to read files, and to list and modify
+// directories.
+func fsckMode(path string, info os.FileInfo, repair bool, report func(Problem)) {
+	want := os.FileMode(0400)
+	if info.IsDir() {
+		want = 0700
+	}
+	perm := info.Mode().Perm()
+	if perm&want == want {
+		return
+	}
+	p := Problem{Path: path, Kind: "permission", Detail: "mode " + perm.String() + " lacks owner access"}
+	if repair {
+		p.Err = os.Chmod(path, perm|want)
+		p.Repaired = p.Err == nil
+	}
+	report(p)
+}
@@ -1,11 +1,18 @@
 package objects
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// EmptyHash is the hash of empty content.
+const EmptyHash = "d41d8cd98f00b204e9800998ecf8427e"
+
 // IsHash returns whether the given string is a valid hash.
 func IsHash(s string) bool {
 	if len(s) != 32 {
@@ -19,8 +26,9 @@ func IsHash(s string) bool {
 	return true
 }
 
-// Exists returns whether an object for a given hash exists in an object path.
-// The hash must be lower case. Returns false if objpath is empty.
+// Exists returns whether an object for a given hash exists in an object path,
+// in either form. The hash must be lower case. Returns false if objpath is
+// empty.
 func Exists(objpath, hash string) bool {
 	if objpath == "" {
 		return false
@@ -28,12 +36,18 @@ func Exists(objpath, hash string) bool {
 	if !IsHash(hash) {
 		return false
 	}
-	_, err := os.Lstat(filepath.Join(objpath, hash[:2], hash))
+	path := filepath.Join(objpath, hash[:2], hash)
+	if _, err := os.Lstat(path); err == nil {
+		return true
+	}
+	_, err := os.Lstat(path + CompressedExt)
 	return err == nil
 }
 
 // Stat returns the file info for the object of a given hash. Returns nil if the
-// object does not exist or if objpath is empty.
+// object does not exist or if objpath is empty. For a compressed object, the
+// name of the info is the hash, and the size is the size of the content, as for
+// an uncompressed object.
 func Stat(objpath, hash string) os.FileInfo {
 	if objpath == "" {
 		return nil
@@ -41,12 +55,48 @@ func Stat(objpath, hash string) os.FileInfo {
 	if !IsHash(hash) {
 		return nil
 	}
-	if stat, err := os.Lstat(filepath.Join(objpath, hash[:2], hash)); err == nil {
+	path := filepath.Join(objpath, hash[:2], hash)
+	if stat, err := os.Lstat(path); err == nil {
+		return stat
+	}
+	if stat, err := statCompressed(path + CompressedExt); err == nil {
 		return stat
 	}
 	return nil
 }
 
+// Verify returns whether the content of the object of a given hash matches
+// the hash.
+func Verify(objpath, hash string) (bool, error) {
+	f, err := Open(objpath, hash)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	digest := md5.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(digest.Sum(nil)) == hash, nil
+}
+
+// SHA256 returns the SHA-256 hash of the content of the object of a given
+// hash, as a lowercase hex string. Also returns whether the content matches the
+// hash, which is checked while the content is read.
+func SHA256(objpath, hash string) (sum string, valid bool, err error) {
+	f, err := Open(objpath, hash)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	digest := md5.New()
+	sha := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(digest, sha), f); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(digest.Sum(nil)) == hash, nil
+}
+
 // Path returns the file path for the object of a given hash. Returns an empty
 // string if the hash is invalid or if objpath is empty.
 func Path(objpath, hash string) string {
@@ -59,17 +109,65 @@ func Path(objpath, hash string) string {
 	return filepath.Join(objpath, hash[:2], hash)
 }
 
-// HashFromETag attempts to convert an ETag to a valid hash. Returns an empty
-// string if the hash could not be converted.
-func HashFromETag(etag string) string {
+// ETagFormat describes how the ETag of a response relates to its content.
+type ETagFormat string
+
+const (
+	// The ETag is the MD5 hash of the content.
+	ETagMD5 ETagFormat = "md5"
+	// The ETag is weak, and has the form of an MD5 hash. A weak ETag only
+	// indicates that content is semantically equivalent, so the hash may not
+	// be of the exact content.
+	ETagWeak ETagFormat = "weak"
+	// The ETag is of an S3 multipart upload, having the form "hash-N", where
+	// hash is the MD5 hash of the concatenated MD5 hashes of N parts. It is not
+	// the hash of the content.
+	ETagMultipart ETagFormat = "multipart"
+	// The ETag has no recognized relation to the content.
+	ETagOpaque ETagFormat = "opaque"
+)
+
+// ParseETag returns the format of an ETag, along with the hash it contains, if
+// any. The hash of a multipart ETag is not returned, because it is not the
+// hash of the content. Returns an empty format if etag is empty.
+func ParseETag(etag string) (hash string, format ETagFormat) {
+	if etag == "" {
+		return "", ""
+	}
 	etag = strings.ToLower(etag)
-	etag = strings.TrimPrefix(etag, "w/")
+	if strings.HasPrefix(etag, "w/") {
+		if etag = strings.Trim(etag[2:], "\""); IsHash(etag) {
+			return etag, ETagWeak
+		}
+		return "", ETagOpaque
+	}
 	etag = strings.Trim(etag, "\"")
-	if i := strings.Index(etag, "-"); i >= 0 {
-		etag = etag[:i]
+	if IsHash(etag) {
+		return etag, ETagMD5
 	}
-	if !IsHash(etag) {
-		return ""
+	if i := strings.Index(etag, "-"); i >= 0 && IsHash(etag[:i]) && isDigits(etag[i+1:]) {
+		return "", ETagMultipart
 	}
-	return etag
+	return "", ETagOpaque
+}
+
+// isDigits returns whether s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// HashFromETag attempts to convert an ETag to a valid hash. Returns an empty
+// string if the ETag does not contain the hash of the content, such as the
+// ETag of a multipart upload.
+func HashFromETag(etag string) string {
+	hash, _ := ParseETag(etag)
+	return hash
 }
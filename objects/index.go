@@ -0,0 +1,261 @@
+package objects
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IndexName is the name of the index file within each prefix directory of an
+// objects path. An index records the size, modification time, and SHA-256
+// hash of each object in its directory, so that the consistency of objects
+// can be checked without reading their content.
+//
+// Each line of an index describes one object, as space-separated fields:
+//
+//     <hash> <size> <mtime> <sha256>
+//
+// where mtime is in Unix seconds. Entries are only appended; a later entry for
+// a hash replaces an earlier one.
+const IndexName = "index"
+
+// IndexEntry describes an object recorded in an index.
+type IndexEntry struct {
+	Hash    string
+	Size    int64
+	ModTime int64
+	SHA256  string
+}
+
+func (e IndexEntry) String() string {
+	return fmt.Sprintf("%s %d %d %s", e.Hash, e.Size, e.ModTime, e.SHA256)
+}
+
+func parseIndexEntry(line string) (e IndexEntry, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return e, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	e.Hash = fields[0]
+	if !IsHash(e.Hash) {
+		return e, fmt.Errorf("invalid hash %q", e.Hash)
+	}
+	if e.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return e, fmt.Errorf("invalid size: %w", err)
+	}
+	if e.ModTime, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return e, fmt.Errorf("invalid mtime: %w", err)
+	}
+	e.SHA256 = fields[3]
+	return e, nil
+}
+
+// indexLock serializes appends to index files, which are written by concurrent
+// writers.
+var indexLock sync.Mutex
+
+// AppendIndex appends an entry to the index of the prefix directory of the
+// entry's hash.
+func AppendIndex(objpath string, entry IndexEntry) error {
+	if !IsHash(entry.Hash) {
+		return fmt.Errorf("invalid hash %q", entry.Hash)
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	path := filepath.Join(objpath, entry.Hash[:2], IndexName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Unindex removes the entries of the given hashes from the indexes of their
+// prefix directories, such as after the objects were removed. Each affected
+// index is rewritten in place of the original, without malformed lines, and an
+// index left with no entries is removed. A directory without an index is
+// skipped.
+func Unindex(objpath string, hashes []string) error {
+	byPrefix := map[string]map[string]bool{}
+	for _, hash := range hashes {
+		if !IsHash(hash) {
+			continue
+		}
+		prefix := hash[:2]
+		if byPrefix[prefix] == nil {
+			byPrefix[prefix] = map[string]bool{}
+		}
+		byPrefix[prefix][hash] = true
+	}
+	prefixes := make([]string, 0, len(byPrefix))
+	for prefix := range byPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	for _, prefix := range prefixes {
+		if err := unindexPrefix(objpath, prefix, byPrefix[prefix]); err != nil {
+			return fmt.Errorf("%s/%s: %w", prefix, IndexName, err)
+		}
+	}
+	return nil
+}
+
+// unindexPrefix rewrites the index of a prefix directory without the entries of
+// the given hashes. Must be called while holding indexLock.
+func unindexPrefix(objpath, prefix string, hashes map[string]bool) error {
+	path := filepath.Join(objpath, prefix, IndexName)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	// Malformed lines are dropped by the rewrite.
+	entries, err := ReadIndex(objpath, prefix)
+	if entries == nil {
+		return err
+	}
+	for hash := range hashes {
+		delete(entries, hash)
+	}
+	if len(entries) == 0 {
+		return os.Remove(path)
+	}
+	keep := make([]string, 0, len(entries))
+	for hash := range entries {
+		keep = append(keep, hash)
+	}
+	sort.Strings(keep)
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, hash := range keep {
+		fmt.Fprintln(w, entries[hash])
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// ReadIndex reads the index of a prefix directory, such as "d4". An empty map
+// is returned if the directory has no index. Malformed lines, such as a partial
+// line left by an interrupted append, are skipped, and the first is reported as
+// an error along with the remaining entries.
+func ReadIndex(objpath, prefix string) (entries map[string]IndexEntry, err error) {
+	entries = map[string]IndexEntry{}
+	f, err := os.Open(filepath.Join(objpath, prefix, IndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		entry, e := parseIndexEntry(s.Text())
+		if e != nil {
+			if err == nil {
+				err = fmt.Errorf("%s/%s: line %d: %w", prefix, IndexName, line, e)
+			}
+			continue
+		}
+		entries[entry.Hash] = entry
+	}
+	if e := s.Err(); e != nil && err == nil {
+		err = e
+	}
+	return entries, err
+}
+
+var (
+	// ErrNotIndexed indicates that an object has no index entry.
+	ErrNotIndexed = errors.New("object not indexed")
+	// ErrMismatch indicates that an object does not match its index entry.
+	ErrMismatch = errors.New("object does not match index")
+)
+
+// Index provides cached access to the indexes of an objects path. It is safe
+// for concurrent use.
+type Index struct {
+	objpath string
+	mu      sync.Mutex
+	dirs    map[string]map[string]IndexEntry
+}
+
+// NewIndex returns an Index for the given objects path.
+func NewIndex(objpath string) *Index {
+	return &Index{objpath: objpath}
+}
+
+// Lookup returns the index entry of the given hash. Indexes are read once per
+// prefix directory, so entries appended after the first lookup in a directory
+// are not seen.
+func (x *Index) Lookup(hash string) (entry IndexEntry, ok bool, err error) {
+	if !IsHash(hash) {
+		return entry, false, nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prefix := hash[:2]
+	entries, loaded := x.dirs[prefix]
+	if !loaded {
+		// Entries are cached even if the index is partially malformed.
+		if entries, err = ReadIndex(x.objpath, prefix); entries == nil {
+			return entry, false, err
+		}
+		if x.dirs == nil {
+			x.dirs = map[string]map[string]IndexEntry{}
+		}
+		x.dirs[prefix] = entries
+	}
+	entry, ok = entries[hash]
+	return entry, ok, err
+}
+
+// Check compares the file info of an object with its index entry. Returns
+// ErrNotIndexed if the object has no entry, and an error wrapping ErrMismatch if
+// the size or modification time differs.
+func (x *Index) Check(hash string, stat os.FileInfo) error {
+	entry, ok, err := x.Lookup(hash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotIndexed
+	}
+	if stat.Size() != entry.Size {
+		return fmt.Errorf("%w: size %d, indexed %d", ErrMismatch, stat.Size(), entry.Size)
+	}
+	if mtime := stat.ModTime().Unix(); mtime != entry.ModTime {
+		return fmt.Errorf("%w: mtime %d, indexed %d", ErrMismatch, mtime, entry.ModTime)
+	}
+	return nil
+}
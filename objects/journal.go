@@ -0,0 +1,154 @@
+package objects
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalName is the name of the journal file within an objects path. The
+// journal records the intent to add each object before the object is moved
+// into place. Once the metadata of the objects has been committed to the
+// database, the journal is finalized by truncating it.
+//
+// Each line of the journal describes one object, as space-separated fields:
+//
+//     <hash> <size>
+//
+// Entries that remain in the journal on startup belong to objects whose
+// metadata may not have been committed, and must be reconciled with the
+// database.
+const JournalName = "journal"
+
+// JournalEntry describes an object recorded in a journal.
+type JournalEntry struct {
+	Hash string
+	Size int64
+}
+
+// Journal records objects written to an objects path. A Journal is safe for
+// concurrent use.
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenJournal opens the journal of the given objects path, creating it if it
+// does not exist.
+func OpenJournal(objpath string) (*Journal, error) {
+	file, err := os.OpenFile(filepath.Join(objpath, JournalName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file}, nil
+}
+
+// Intend records the intent to add an object. The entry is synced to disk
+// before returning.
+func (j *Journal) Intend(hash string, size int64) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := fmt.Fprintf(j.file, "%s %d\n", hash, size); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Finalize removes all entries from the journal. Must be called only after the
+// metadata of every recorded object has been committed.
+func (j *Journal) Finalize() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Release removes the entries of the given objects from the journal, keeping
+// the entries of other objects. Must be called only after the metadata of the
+// given objects has been committed. The remaining entries are rewritten in
+// place.
+func (j *Journal) Release(hashes []string) error {
+	if j == nil || len(hashes) == 0 {
+		return nil
+	}
+	released := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		released[hash] = true
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, info.Size())
+	if _, err := j.file.ReadAt(b, 0); err != nil && err != io.EOF {
+		return err
+	}
+	var kept []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if fields := strings.Fields(string(line)); len(fields) == 0 || released[fields[0]] {
+			continue
+		}
+		kept = append(kept, line...)
+	}
+	if len(kept) == len(b) {
+		return nil
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Write(kept); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal without finalizing it.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// ReadJournal returns the entries of the journal of the given objects path. A
+// journal that does not exist has no entries. Malformed lines, such as a line
+// cut off by a crash, are skipped.
+func ReadJournal(objpath string) (entries []JournalEntry, err error) {
+	f, err := os.Open(filepath.Join(objpath, JournalName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !IsHash(fields[0]) {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, JournalEntry{Hash: fields[0], Size: size})
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package objects
+
+import (
+	"os"
+)
+
+// rename moves a file from oldpath to newpath.
+func rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
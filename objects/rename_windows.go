@@ -0,0 +1,49 @@
+package objects
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Errors returned while another process, such as a virus scanner or a search
+// indexer, holds a file open.
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// Number of times a rename is attempted, and the delay before the first retry.
+// The delay doubles with each retry.
+const (
+	renameAttempts = 6
+	renameDelay    = 50 * time.Millisecond
+)
+
+// rename moves a file from oldpath to newpath. A rename that fails because the
+// file is temporarily held open by another process is retried.
+func rename(oldpath, newpath string) (err error) {
+	delay := renameDelay
+	for i := 0; i < renameAttempts; i++ {
+		if err = os.Rename(oldpath, newpath); !isSharingError(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+func isSharingError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case errorAccessDenied, errorSharingViolation, errorLockViolation:
+		return true
+	}
+	return false
+}
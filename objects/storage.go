@@ -0,0 +1,197 @@
+package objects
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Storage holds objects by hash. Methods that refer to the object of a hash that
+// does not exist return an error that satisfies errors.Is(err,
+// os.ErrNotExist). A Storage is safe for concurrent use.
+type Storage interface {
+	// Put stores size bytes read from r as the object of hash. Content that
+	// does not match the hash is refused with an error wrapping ErrDamaged.
+	// An object that already exists with the same size is kept.
+	Put(ctx context.Context, hash string, r io.ReaderAt, size int64) error
+	// Get returns the content of the object of hash, which must be closed by
+	// the caller.
+	Get(ctx context.Context, hash string) (io.ReadCloser, error)
+	// Exists returns whether the object of hash exists.
+	Exists(ctx context.Context, hash string) (bool, error)
+	// Stat returns the size of the object of hash.
+	Stat(ctx context.Context, hash string) (size int64, err error)
+	// List calls fn for each object, stopping at the first error returned by
+	// fn.
+	List(ctx context.Context, fn func(hash string, size int64) error) error
+	// Remove removes the object of hash. Removing an object that does not
+	// exist is not an error.
+	Remove(ctx context.Context, hash string) error
+}
+
+// ErrDamaged indicates that content does not match the hash under which it
+// would be stored.
+var ErrDamaged = errors.New("content does not match hash")
+
+// errInvalidHash is returned by a Storage for a malformed hash.
+func errInvalidHash(hash string) error {
+	return fmt.Errorf("invalid hash %q", hash)
+}
+
+// Dir is a Storage located in a directory of the file system, having the layout
+// of an objects path.
+type Dir string
+
+// Put implements Storage. The content is written to a temporary file, and is
+// moved into place only if it matches the hash.
+func (d Dir) Put(ctx context.Context, hash string, r io.ReaderAt, size int64) error {
+	path := Path(string(d), hash)
+	if path == "" {
+		return errInvalidHash(hash)
+	}
+	if stat, err := os.Lstat(path); err == nil && stat.Size() == size {
+		return nil
+	}
+	file, err := ioutil.TempFile(string(d), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	digest := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, digest), io.NewSectionReader(r, 0, size))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("expected %d bytes, got %d", size, n)
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); err == nil && sum != hash {
+		err = fmt.Errorf("%w: content has hash %s", ErrDamaged, sum)
+	}
+	if err == nil {
+		if err = os.Mkdir(filepath.Dir(path), 0755); os.IsExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = move(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("put object %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Get implements Storage.
+func (d Dir) Get(ctx context.Context, hash string) (io.ReadCloser, error) {
+	path := Path(string(d), hash)
+	if path == "" {
+		return nil, errInvalidHash(hash)
+	}
+	return os.Open(path)
+}
+
+// Exists implements Storage.
+func (d Dir) Exists(ctx context.Context, hash string) (bool, error) {
+	return Exists(string(d), hash), nil
+}
+
+// Stat implements Storage.
+func (d Dir) Stat(ctx context.Context, hash string) (size int64, err error) {
+	path := Path(string(d), hash)
+	if path == "" {
+		return 0, errInvalidHash(hash)
+	}
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// List implements Storage. Objects are visited in order of hash.
+func (d Dir) List(ctx context.Context, fn func(hash string, size int64) error) error {
+	return Walk(string(d), func(hash string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(hash, info.Size())
+	})
+}
+
+// Remove implements Storage.
+func (d Dir) Remove(ctx context.Context, hash string) error {
+	path := Path(string(d), hash)
+	if path == "" {
+		return errInvalidHash(hash)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Offload moves each object of an objects path to dst, removing the object from
+// the objects path once it has been stored. Objects recorded in the journal of
+// the objects path are not moved, because their metadata may not have been
+// committed. Returns the number and total size of the moved objects.
+//
+// If dst refuses an object because it does not match its hash, then the object
+// is left in place, and its hash is included in damaged. Offloading stops at
+// any other error.
+func Offload(ctx context.Context, objpath string, dst Storage) (n int, size int64, damaged []string, err error) {
+	entries, err := ReadJournal(objpath)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("read journal: %w", err)
+	}
+	pending := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		pending[entry.Hash] = true
+	}
+	err = Walk(objpath, func(hash string, info os.FileInfo) error {
+		if pending[hash] {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := OpenFile(objpath, hash)
+		if err != nil {
+			return err
+		}
+		err = dst.Put(ctx, hash, f, info.Size())
+		f.Close()
+		if errors.Is(err, ErrDamaged) {
+			damaged = append(damaged, hash)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := Remove(objpath, hash); err != nil {
+			return err
+		}
+		n++
+		size += info.Size()
+		return nil
+	})
+	return n, size, damaged, err
+}
+
+// digestAt returns the MD5 hash of size bytes of r, as a lowercase hex string.
+func digestAt(r io.ReaderAt, size int64) (string, error) {
+	digest := md5.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
@@ -0,0 +1,106 @@
+package objects
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Walk calls fn for each object of an objects path, in order of hash. Only
+// regular files named by their lower case hash within their prefix directory,
+// optionally followed by CompressedExt, are visited; other entries are skipped,
+// and are reported by Fsck instead. The info of a compressed object is as
+// returned by Stat. Walking stops at the first error returned by fn.
+func Walk(objpath string, fn func(hash string, info os.FileInfo) error) error {
+	dirs, err := ioutil.ReadDir(objpath)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		prefix := dir.Name()
+		if !dir.IsDir() || !isPrefix(prefix) {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(objpath, prefix))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			hash := entry.Name()
+			if c := compressedName(hash); c != "" {
+				hash = c
+			}
+			if !IsHash(hash) || hash[:2] != prefix || !entry.Mode().IsRegular() {
+				continue
+			}
+			info, err := statEntry(filepath.Join(objpath, prefix), entry)
+			if err != nil {
+				return err
+			}
+			if err := fn(hash, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WalkTemporary calls fn with the path of each temporary file of an objects
+// path, such as those left by an interrupted write. Temporary files are looked
+// for in the objects path and in each prefix directory. Walking stops at the
+// first error returned by fn.
+func WalkTemporary(objpath string, fn func(path string, info os.FileInfo) error) error {
+	visit := func(dirpath string, entries []os.FileInfo) error {
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), tempPrefix) || !entry.Mode().IsRegular() {
+				continue
+			}
+			if err := fn(filepath.Join(dirpath, entry.Name()), entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dirs, err := ioutil.ReadDir(objpath)
+	if err != nil {
+		return err
+	}
+	if err := visit(objpath, dirs); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !isPrefix(dir.Name()) {
+			continue
+		}
+		dirpath := filepath.Join(objpath, dir.Name())
+		entries, err := ioutil.ReadDir(dirpath)
+		if err != nil {
+			return err
+		}
+		if err := visit(dirpath, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves a file at path within an objects path to the same location
+// relative to dir, creating directories as needed. The file may be an object,
+// in either form, or a temporary file. An existing file at the destination is
+// replaced.
+func Quarantine(objpath, path, dir string) error {
+	rel, err := filepath.Rel(objpath, path)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s: not within objects path", path)
+	}
+	target := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return move(path, target)
+}
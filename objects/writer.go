@@ -2,13 +2,18 @@ package objects
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // Writer writes an object.
@@ -18,6 +23,23 @@ type Writer struct {
 	digest  hash.Hash
 	size    int64
 	expsize int64
+
+	// SHA-256 hash of the content, computed alongside the MD5 hash.
+	sha    hash.Hash
+	sha256 string
+
+	// Whether the object is added to the index of its directory.
+	index bool
+
+	// If compress is true, then content is compressed by enc into stored,
+	// which wraps the file.
+	compress bool
+	enc      *zstd.Encoder
+	stored   *countWriter
+
+	// If not nil, the object is recorded in the journal before being moved
+	// into place.
+	journal *Journal
 }
 
 // NewWriter returns a new Writer. If objpath is empty, then nil is returned.
@@ -30,6 +52,7 @@ func NewWriter(objpath string) *Writer {
 	return &Writer{
 		objpath: objpath,
 		digest:  md5.New(),
+		sha:     sha256.New(),
 		expsize: -1,
 	}
 }
@@ -48,17 +71,36 @@ func (w *Writer) AsWriter() io.Writer {
 // writer is closed.
 func (w *Writer) Write(b []byte) (n int, err error) {
 	if w.file == nil {
-		w.file, err = ioutil.TempFile(w.objpath, ".unresolved_rbxark_object_*")
+		w.file, err = ioutil.TempFile(w.objpath, tempPrefix+"*")
 		if err != nil {
 			return 0, err
 		}
+		if w.compress {
+			w.stored = &countWriter{w: w.file}
+			if w.enc, err = newEncoder(w.stored); err != nil {
+				return 0, err
+			}
+		}
 	}
 	w.digest.Write(b)
-	n, err = w.file.Write(b)
+	w.sha.Write(b)
+	if w.enc != nil {
+		n, err = w.enc.Write(b)
+	} else {
+		n, err = w.file.Write(b)
+	}
 	w.size += int64(n)
 	return n, err
 }
 
+// closeFile closes the encoder, if any, and the temporary file.
+func (w *Writer) closeFile() error {
+	if w.enc != nil {
+		w.enc.Close()
+	}
+	return w.file.Close()
+}
+
 // Remove closes and removes the temporary file.
 func (w *Writer) Remove() error {
 	if w == nil {
@@ -67,12 +109,52 @@ func (w *Writer) Remove() error {
 	if w.file == nil {
 		return nil
 	}
-	if err := w.file.Close(); err != nil {
+	if err := w.closeFile(); err != nil {
 		return err
 	}
 	return os.Remove(w.file.Name())
 }
 
+// UseIndex sets whether the object is added to the index of its prefix
+// directory when the writer is closed. Must be called before the first call to
+// Write.
+func (w *Writer) UseIndex(enabled bool) {
+	w.index = enabled
+}
+
+// UseCompression sets whether the object is compressed with zstd, in which case
+// it is stored at CompressedPath rather than Path. Must be called before the
+// first call to Write.
+func (w *Writer) UseCompression(enabled bool) {
+	w.compress = enabled
+}
+
+// UseJournal sets the journal in which the object is recorded when the writer is
+// closed. A nil journal disables recording.
+func (w *Writer) UseJournal(j *Journal) {
+	w.journal = j
+}
+
+// SHA256 returns the SHA-256 hash of the written content, as a lowercase hex
+// string. Returns an empty string if the writer has not been closed.
+func (w *Writer) SHA256() string {
+	return w.sha256
+}
+
+// Size returns the number of bytes written so far.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// StoredSize returns the size of the compressed object, or -1 if the object is
+// not compressed, or if the writer has not been closed.
+func (w *Writer) StoredSize() int64 {
+	if w.stored == nil || w.enc != nil {
+		return -1
+	}
+	return w.stored.n
+}
+
 // ExpectSize sets the expected size of the file, which will be checked when the
 // file is closed.
 func (w *Writer) ExpectSize(size int64) {
@@ -80,7 +162,8 @@ func (w *Writer) ExpectSize(size int64) {
 }
 
 // Close finishes writing the file. A hash of the written content is computed,
-// and always returned. The size of the content is also always returned.
+// and always returned. The size of the content is also always returned. The
+// SHA-256 hash of the content is then available from SHA256.
 //
 // If successfully written, the file is moved to the objpath directory with the
 // hash as the file name. The file is located under a subdirectory that is named
@@ -90,6 +173,25 @@ func (w *Writer) ExpectSize(size int64) {
 //     hash: d41d8cd98f00b204e9800998ecf8427e
 //     path: objects/d4/d41d8cd98f00b204e9800998ecf8427e
 //
+// If the writer uses an index, then the object is added to the index of the
+// subdirectory. An object that already exists is not added again.
+//
+// If the writer uses a journal, then the object is recorded in the journal
+// before it is moved into place.
+//
+// If nothing was written, then the content is empty, and the object of
+// EmptyHash is stored.
+//
+// If the writer uses compression, then the content is compressed, and the file
+// is named with CompressedExt appended to the hash. An existing object of the
+// same hash is kept in either form.
+//
+// If an object of the same hash already exists with the same size, then it is
+// kept, and the temporary file is removed. An existing object with a different
+// size is damaged, and is replaced. If several writers race to place the same
+// object, then an error from one writer is ignored if the object was placed by
+// another.
+//
 // If an error occurs, the temporary file will persist. It can be removed with
 // Remove().
 func (w *Writer) Close() (size int64, hash string, err error) {
@@ -97,14 +199,30 @@ func (w *Writer) Close() (size int64, hash string, err error) {
 	w.digest.Sum(sum[16:16])
 	hex.Encode(sum[:], sum[16:])
 	hash = string(sum[:])
+	w.sha256 = hex.EncodeToString(w.sha.Sum(nil))
 	if w.expsize >= 0 && w.size != w.expsize {
 		if w.file != nil {
-			w.file.Close()
+			w.closeFile()
 		}
 		return w.size, hash, fmt.Errorf("expected %d bytes, got %d", w.expsize, w.size)
 	}
 	if w.file == nil {
-		return w.size, hash, nil
+		// Nothing was written, so the content is empty. The empty object is
+		// stored like any other, so that an empty file is archived.
+		if _, err = w.Write(nil); err != nil {
+			return w.size, hash, err
+		}
+	}
+	if w.enc != nil {
+		err = w.enc.Close()
+		w.enc = nil
+		if err == nil {
+			err = writeSizeFrame(w.stored, w.size)
+		}
+		if err != nil {
+			w.file.Close()
+			return w.size, hash, err
+		}
 	}
 	if err = w.file.Sync(); err != nil {
 		w.file.Close()
@@ -120,13 +238,90 @@ func (w *Writer) Close() (size int64, hash string, err error) {
 		}
 	}
 	filename := filepath.Join(dirpath, hash)
-	if _, err = os.Lstat(filename); err == nil {
-		// File already exists.
-		os.Remove(w.file.Name())
-		return w.size, hash, nil
+	if w.compress {
+		if stat := Stat(w.objpath, hash); stat != nil && stat.Size() == w.size {
+			// Object already exists in either form.
+			os.Remove(w.file.Name())
+			w.stored = nil
+			if IsCompressed(stat) {
+				w.stored = &countWriter{n: StoredSize(stat)}
+			}
+			return w.size, hash, nil
+		}
+		filename += CompressedExt
+	} else if stat, err := os.Lstat(filename); err == nil {
+		if stat.Size() == w.size {
+			// File already exists.
+			os.Remove(w.file.Name())
+			return w.size, hash, nil
+		}
+		// The existing object does not have the size of its content, so it
+		// is damaged. Because the name is the hash of the new content, the
+		// new content replaces it.
 	}
-	if err = os.Rename(w.file.Name(), filename); !os.IsNotExist(err) {
-		return w.size, hash, err
+	if err = w.journal.Intend(hash, w.size); err != nil {
+		return w.size, hash, fmt.Errorf("journal object: %w", err)
+	}
+	if err = move(w.file.Name(), filename); err != nil {
+		if stat := Stat(w.objpath, hash); stat != nil && stat.Size() == w.size {
+			// Another writer placed the same object first.
+			os.Remove(w.file.Name())
+			return w.size, hash, nil
+		}
+		return w.size, hash, fmt.Errorf("place object %s: %w", hash, err)
+	}
+	if w.index {
+		stat, err := os.Lstat(filename)
+		if err != nil {
+			return w.size, hash, err
+		}
+		err = AppendIndex(w.objpath, IndexEntry{
+			Hash:    hash,
+			Size:    w.size,
+			ModTime: stat.ModTime().Unix(),
+			SHA256:  w.sha256,
+		})
+		if err != nil {
+			return w.size, hash, fmt.Errorf("index object: %w", err)
+		}
 	}
 	return w.size, hash, nil
 }
+
+// renameFile is the rename used by move. It is replaced by tests to simulate
+// paths on different devices.
+var renameFile = rename
+
+// move moves a file from oldpath to newpath. If the paths are on different
+// devices, such as when a prefix directory is mounted separately, then the file
+// is copied to a temporary file next to newpath, which is then renamed.
+func move(oldpath, newpath string) error {
+	err := renameFile(oldpath, newpath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	src, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(newpath), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameFile(dst.Name(), newpath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	src.Close()
+	return os.Remove(oldpath)
+}
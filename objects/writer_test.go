@@ -0,0 +1,145 @@
+package objects
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+const testContent = "the content of an object"
+
+// checkObjects checks that objpath contains exactly the object of content,
+// which is valid, and no temporary files.
+func checkObjects(t *testing.T, objpath, content string) {
+	t.Helper()
+	sum := md5.Sum([]byte(content))
+	want := hex.EncodeToString(sum[:])
+	var hashes []string
+	err := Walk(objpath, func(hash string, info os.FileInfo) error {
+		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %s", err)
+	}
+	if len(hashes) != 1 || hashes[0] != want {
+		t.Errorf("expected object %s, got %v", want, hashes)
+	}
+	if ok, err := Verify(objpath, want); err != nil || !ok {
+		t.Errorf("object %s is not valid: %v", want, err)
+	}
+	err = WalkTemporary(objpath, func(path string, info os.FileInfo) error {
+		t.Errorf("temporary file remains: %s", path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk temporary: %s", err)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	sum := md5.Sum([]byte(testContent))
+	hash := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name     string
+		compress bool
+		// Called before the object is written.
+		setup func(t *testing.T, objpath string)
+		// If true, then renaming between directories fails as though they
+		// were on different devices.
+		crossDevice bool
+	}{
+		{name: "new"},
+		{name: "new compressed", compress: true},
+		{name: "damaged", setup: func(t *testing.T, objpath string) {
+			if err := os.Mkdir(filepath.Join(objpath, hash[:2]), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(Path(objpath, hash), []byte("damaged"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "cross-device", crossDevice: true},
+		{name: "cross-device compressed", compress: true, crossDevice: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objpath, err := ioutil.TempDir("", "objects")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(objpath)
+			if tt.setup != nil {
+				tt.setup(t, objpath)
+			}
+			crossed := 0
+			if tt.crossDevice {
+				renameFile = func(oldpath, newpath string) error {
+					if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+						crossed++
+						return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+					}
+					return rename(oldpath, newpath)
+				}
+				defer func() { renameFile = rename }()
+			}
+
+			w := NewWriter(objpath)
+			w.UseCompression(tt.compress)
+			if _, err := w.Write([]byte(testContent)); err != nil {
+				t.Fatalf("write: %s", err)
+			}
+			size, got, err := w.Close()
+			if err != nil {
+				t.Fatalf("close: %s", err)
+			}
+			if size != int64(len(testContent)) || got != hash {
+				t.Errorf("expected %s (%d), got %s (%d)", hash, len(testContent), got, size)
+			}
+			if tt.crossDevice && crossed == 0 {
+				t.Errorf("expected cross-device rename")
+			}
+			if stat := Stat(objpath, hash); stat == nil || IsCompressed(stat) != tt.compress {
+				t.Errorf("expected compressed %t", tt.compress)
+			}
+			checkObjects(t, objpath, testContent)
+		})
+	}
+}
+
+func TestWriterConcurrent(t *testing.T) {
+	const writers = 16
+	for _, compress := range []bool{false, true} {
+		objpath, err := ioutil.TempDir("", "objects")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(objpath)
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := NewWriter(objpath)
+				w.UseCompression(compress)
+				if _, errs[i] = w.Write([]byte(testContent)); errs[i] != nil {
+					return
+				}
+				_, _, errs[i] = w.Close()
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("compress %t: writer %d: %s", compress, i, err)
+			}
+		}
+		checkObjects(t, objpath, testContent)
+	}
+}
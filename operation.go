@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Operation describes the run of a command that creates rows, for recording
+// the provenance of the rows. The operation is inserted into the operations
+// table of a database when its first rows are recorded, so runs that create
+// nothing leave no trace.
+//
+// An Operation is bound to the first database in which it is recorded. Each
+// archive of a workspace must use its own Operation.
+type Operation struct {
+	// Command line of the run.
+	Command string
+	// Path to the config file that was used.
+	Config string
+	// SHA-256 hash of the content of the config file.
+	ConfigHash string
+
+	// Rowid of the operation, once inserted.
+	id int64
+}
+
+// NewOperation returns an Operation for the current command line, using the
+// given config.
+func NewOperation(config *Config) *Operation {
+	op := &Operation{Command: strings.Join(os.Args[1:], " ")}
+	if config != nil {
+		op.Config = config.path
+		op.ConfigHash = config.hash
+	}
+	return op
+}
+
+// insert inserts the operation into a database, if it has not already been
+// inserted.
+func (op *Operation) insert(a Action, e Executor) error {
+	if op.id != 0 {
+		return nil
+	}
+	const query = `INSERT INTO operations (time, command, config, config_hash) VALUES (?, ?, ?, ?)`
+	result, err := e.ExecContext(a.Context, query,
+		time.Now().Unix(),
+		op.Command,
+		sql.NullString{String: op.Config, Valid: op.Config != ""},
+		sql.NullString{String: op.ConfigHash, Valid: op.ConfigHash != ""},
+	)
+	if err != nil {
+		return err
+	}
+	op.id, err = result.LastInsertId()
+	return err
+}
+
+// track calls fn, then records the rows that fn added to each of the given
+// tables as created by the operation of a, if any. Rows are assumed to be
+// added with increasing rowids.
+func (a Action) track(e Executor, tables []string, fn func() error) error {
+	if a.Operation == nil {
+		return fn()
+	}
+	before := make([]int64, len(tables))
+	for i, table := range tables {
+		n, err := a.queryInt(e, `SELECT ifnull(max(rowid), 0) FROM `+table)
+		if err != nil {
+			return fmt.Errorf("track %s: %w", table, err)
+		}
+		before[i] = n
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	for i, table := range tables {
+		after, err := a.queryInt(e, `SELECT ifnull(max(rowid), 0) FROM `+table)
+		if err != nil {
+			return fmt.Errorf("track %s: %w", table, err)
+		}
+		if after <= before[i] {
+			continue
+		}
+		if err := a.Operation.insert(a, e); err != nil {
+			return fmt.Errorf("record operation: %w", err)
+		}
+		const query = `INSERT INTO operation_rows (operation, tbl, first, last) VALUES (?, ?, ?, ?)`
+		if _, err := e.ExecContext(a.Context, query, a.Operation.id, table, before[i]+1, after); err != nil {
+			return fmt.Errorf("record operation: %w", err)
+		}
+	}
+	return nil
+}
+
+// OperationTime returns the time of the operation of the given rowid, as a Unix
+// timestamp.
+func (a Action) OperationTime(e Executor, id int64) (int64, error) {
+	t, err := a.queryInt(e, `SELECT time FROM operations WHERE rowid == ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	if t == 0 {
+		return 0, fmt.Errorf("unknown operation %d", id)
+	}
+	return t, nil
+}
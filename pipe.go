@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Commands that read or write a file of JSON lines accept "-" as the path of
+// the file, meaning stdin or stdout, so that the output of one command can be
+// piped into another.
+const stdio = "-"
+
+// openInput opens the file at path for reading, or stdin if path is stdio.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdio {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// nopWriteCloser is a WriteCloser that does not close the underlying writer.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// createOutput creates the file at path for writing, or returns stdout if path
+// is stdio.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == stdio {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+// FoundFilename is a file name found outside of the database, written as one
+// JSON line by commands such as find-filenames, and read by merge-filenames.
+type FoundFilename struct {
+	Name string `json:"name"`
+	// Hashes of the builds that refer to the name, such as through their
+	// manifests.
+	Builds []string `json:"builds,omitempty"`
+}
+
+// readFoundFilenames reads file names from r as JSON lines.
+func readFoundFilenames(r io.Reader) (names []FoundFilename, err error) {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var name FoundFilename
+		if err := json.Unmarshal(s.Bytes(), &name); err != nil {
+			return nil, fmt.Errorf("decode file names: line %d: %w", line, err)
+		}
+		if name.Name == "" {
+			return nil, fmt.Errorf("decode file names: line %d: missing name", line)
+		}
+		names = append(names, name)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read file names: %w", err)
+	}
+	return names, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anaminus/rbxark/fetch"
+)
+
+// fetchAhead is the number of batches that are selected and downloading while
+// FetchContent waits on the batch that it commits next.
+const fetchAhead = 2
+
+// fetchBatch is a batch of files selected by a batchSelector, along with the
+// responses of the requests made for them.
+type fetchBatch struct {
+	reqs  []reqEntry
+	resps []respEntry
+	// Rows whose response is shared from another row.
+	shared [][2]int
+	// Number of requests made.
+	n int
+	// Done once every request of the batch is done.
+	wg sync.WaitGroup
+}
+
+// wait waits for the requests of the batch, then fills in the responses of rows
+// that share the response of another row.
+func (b *fetchBatch) wait() {
+	b.wg.Wait()
+	for _, pair := range b.shared {
+		b.resps[pair[0]] = b.resps[pair[1]].share(&b.reqs[pair[0]])
+	}
+}
+
+// batchSelector selects batches of files to be fetched by FetchContent, and
+// starts the requests of each batch, while earlier batches are committed.
+type batchSelector struct {
+	// Number of requests of batches that have not been committed. Accessed
+	// atomically, so it is first to be 64-bit aligned on 32-bit platforms.
+	fetching int64
+
+	a         Action
+	db        *sql.DB
+	f         *fetch.Fetcher
+	opts      *FetchOptions
+	stmt      *sql.Stmt
+	params    []interface{}
+	batchSize int
+
+	// Held while the database is used. SQLite allows only one writer, so
+	// selecting waits for committing rather than contending with it.
+	mu sync.Mutex
+	// Servers that are unreachable as a whole. Remaining files from these
+	// servers are skipped for the rest of the run. Guarded by mu.
+	deadServers map[string]bool
+
+	servers   *nameCache
+	filenames *nameCache
+	cursor    int
+	// Time spent selecting.
+	timing phaseTimes
+	// Error that stopped selecting, if any.
+	err error
+}
+
+// run sends batches to batches until no files remain, or ctx is done. batches
+// is closed when run returns, after which s.err is set.
+func (s *batchSelector) run(ctx context.Context, batches chan<- *fetchBatch) {
+	defer close(batches)
+	a := s.a
+	a.Context = ctx
+	for {
+		b, err := s.next(a)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if b == nil {
+			return
+		}
+		select {
+		case batches <- b:
+		case <-ctx.Done():
+			// The batch will not be committed, but its requests must
+			// finish before the run returns.
+			b.wg.Wait()
+			return
+		}
+	}
+}
+
+// next selects the next batch of files, and starts the request of each file.
+// Returns nil if no files remain.
+func (s *batchSelector) next(a Action) (b *fetchBatch, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	// TODO: Retain duplicate hashes; when a server fails, try the next
+	// server. Requires maintaining a map of successful hashes for the
+	// duration of the transaction. The map only needs to be as large as
+	// rate; successful hashes will not be pulled out of the database again.
+
+	params := append(s.params[:len(s.params):len(s.params)], s.cursor, s.batchSize)
+	rows, err := s.stmt.QueryContext(a.Context, params...)
+	if err != nil {
+		return nil, fmt.Errorf("select files: %w", err)
+	}
+	b = &fetchBatch{reqs: make([]reqEntry, 0, s.batchSize)}
+	// Server and filename of each request.
+	ids := make([][2]int, 0, s.batchSize)
+	for rows.Next() {
+		i := len(b.reqs)
+		b.reqs = append(b.reqs, reqEntry{})
+		ids = append(ids, [2]int{})
+		err := rows.Scan(
+			&b.reqs[i].id,
+			&b.reqs[i].flags,
+			&ids[i][0],
+			&b.reqs[i].build,
+			&ids[i][1],
+			&b.reqs[i].etag,
+			&b.reqs[i].lastModified,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, fmt.Errorf("finish rows: %w", err)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	if len(b.reqs) == 0 {
+		s.timing.add("select", start)
+		return nil, nil
+	}
+	reqs := b.reqs
+	for i := range reqs {
+		if reqs[i].server, err = s.servers.get(a, s.db, ids[i][0]); err != nil {
+			return nil, fmt.Errorf("get server: %w", err)
+		}
+		if reqs[i].file, err = s.filenames.get(a, s.db, ids[i][1]); err != nil {
+			return nil, fmt.Errorf("get filename: %w", err)
+		}
+	}
+	for _, req := range reqs {
+		if req.id > s.cursor {
+			s.cursor = req.id
+		}
+	}
+	if s.opts.Queue {
+		ids := make([]int, len(reqs))
+		for i, req := range reqs {
+			ids[i] = req.id
+		}
+		if err := a.setQueueState(s.db, QueueInFlight, nil, ids...); err != nil {
+			return nil, err
+		}
+	}
+	s.timing.add("select", start)
+
+	b.resps = make([]respEntry, len(reqs))
+	// Rows that resolve to the same URL, such as through servers that
+	// differ only in formatting, share a single request.
+	inflight := make(map[string]int, len(reqs))
+	for i := range reqs {
+		if s.deadServers[reqs[i].server] {
+			b.resps[i] = respEntry{skip: true}
+			continue
+		}
+		url := buildFileURL(reqs[i].server, reqs[i].build, reqs[i].file)
+		if v := reqs[i].validators(s.opts); v != (fetch.Validators{}) {
+			// A conditional response applies only to rows with the same
+			// validators.
+			url += fmt.Sprintf("\x00%s\x00%d", v.ETag, v.LastModified.Unix())
+		}
+		if j, ok := inflight[url]; ok {
+			b.shared = append(b.shared, [2]int{i, j})
+			continue
+		}
+		inflight[url] = i
+		b.n++
+		b.wg.Add(1)
+		go runFetchContentWorker(a.Context, &b.wg, s.f, s.opts, &reqs[i], &b.resps[i])
+	}
+	atomic.AddInt64(&s.fetching, int64(b.n))
+	if len(b.shared) > 0 {
+		log.Printf("fetching %d files, coalescing %d duplicate requests...", b.n, len(b.shared))
+	} else {
+		log.Printf("fetching %d files...", b.n)
+	}
+	return b, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anaminus/rbxark/fetch"
+)
+
+// pipelineFile is a row of the files selected by a pipelineDB.
+type pipelineFile struct {
+	id, server int
+	build      string
+	filename   int
+}
+
+// pipelineDB is a database driver that serves the queries of a batchSelector
+// from memory. Files selected by the batch query are those after the cursor
+// that are not committed, so a selector that fails to advance its cursor
+// selects uncommitted files again.
+type pipelineDB struct {
+	mu        sync.Mutex
+	servers   map[int]string
+	filenames map[int]string
+	files     []pipelineFile
+	committed map[int]bool
+}
+
+func (d *pipelineDB) commit(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.committed[id] = true
+}
+
+func (d *pipelineDB) Connect(context.Context) (driver.Conn, error) { return pipelineConn{d}, nil }
+func (d *pipelineDB) Driver() driver.Driver                        { return nil }
+
+type pipelineConn struct{ db *pipelineDB }
+
+func (c pipelineConn) Prepare(query string) (driver.Stmt, error) {
+	return pipelineStmt{db: c.db, query: query}, nil
+}
+func (c pipelineConn) Close() error              { return nil }
+func (c pipelineConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type pipelineStmt struct {
+	db    *pipelineDB
+	query string
+}
+
+func (s pipelineStmt) Close() error  { return nil }
+func (s pipelineStmt) NumInput() int { return -1 }
+func (s pipelineStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s pipelineStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var rows pipelineRows
+	names := func(m map[int]string) {
+		rows.columns = []string{"rowid", "name"}
+		for id, name := range m {
+			rows.values = append(rows.values, []driver.Value{int64(id), name})
+		}
+	}
+	switch {
+	case strings.Contains(s.query, "FROM servers"):
+		names(d.servers)
+	case strings.Contains(s.query, "FROM filenames"):
+		names(d.filenames)
+	default:
+		if len(args) < 2 {
+			return nil, errors.New("expected cursor and limit")
+		}
+		cursor, limit := args[len(args)-2].(int64), args[len(args)-1].(int64)
+		rows.columns = []string{"id", "flags", "server", "_build", "filename", "etag", "last_modified"}
+		for _, f := range d.files {
+			if int64(len(rows.values)) >= limit {
+				break
+			}
+			if int64(f.id) <= cursor || d.committed[f.id] {
+				continue
+			}
+			rows.values = append(rows.values, []driver.Value{
+				int64(f.id), int64(0), int64(f.server), f.build, int64(f.filename), nil, nil,
+			})
+		}
+	}
+	return &rows, nil
+}
+
+type pipelineRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *pipelineRows) Columns() []string { return r.columns }
+func (r *pipelineRows) Close() error      { return nil }
+func (r *pipelineRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// Rows that resolve to the same URL share a request only within a batch. When
+// such rows span a batch boundary, each must still be committed exactly once,
+// even though later batches are selected before earlier ones are committed.
+func TestBatchSelectorPipeline(t *testing.T) {
+	var requests sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := requests.LoadOrStore(r.URL.Path, new(int64))
+		atomic.AddInt64(n.(*int64), 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	d := &pipelineDB{
+		// Servers that differ only in formatting.
+		servers:   map[int]string{1: server.URL, 2: server.URL + "/"},
+		filenames: map[int]string{1: "a", 2: "b", 3: "c"},
+		files: []pipelineFile{
+			{id: 1, server: 1, build: "version-0", filename: 1},
+			{id: 2, server: 1, build: "version-0", filename: 2},
+			{id: 3, server: 1, build: "version-0", filename: 3},
+			// Duplicate of 3, in the next batch.
+			{id: 4, server: 2, build: "version-0", filename: 3},
+			{id: 5, server: 1, build: "version-1", filename: 1},
+			// Duplicate of 5, in the same batch.
+			{id: 6, server: 2, build: "version-1", filename: 1},
+			{id: 7, server: 1, build: "version-1", filename: 2},
+		},
+		committed: map[int]bool{},
+	}
+	db := sql.OpenDB(d)
+	defer db.Close()
+	stmt, err := db.Prepare(`SELECT files`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	ctx := context.Background()
+	sel := &batchSelector{
+		a:           Action{Context: ctx},
+		db:          db,
+		f:           fetch.NewFetcher(server.Client(), 1, -1),
+		opts:        &FetchOptions{},
+		stmt:        stmt,
+		batchSize:   3,
+		deadServers: map[string]bool{},
+		servers:     &nameCache{query: `SELECT rowid, url FROM servers`},
+		filenames:   &nameCache{query: `SELECT rowid, name FROM filenames`},
+	}
+	batches := make(chan *fetchBatch, fetchAhead-1)
+	go sel.run(ctx, batches)
+
+	committed := map[int]int{}
+	var sizes []int
+	shared := 0
+	for b := range batches {
+		b.wait()
+		sizes = append(sizes, len(b.reqs))
+		shared += len(b.shared)
+		sel.mu.Lock()
+		for i, resp := range b.resps {
+			id := b.reqs[i].id
+			if resp.err != nil || resp.skip {
+				t.Errorf("row %d: unexpected response (err %v, skip %t)", id, resp.err, resp.skip)
+				continue
+			}
+			if resp.id != id {
+				t.Errorf("row %d: response of row %d", id, resp.id)
+			}
+			committed[id]++
+			d.commit(id)
+		}
+		sel.mu.Unlock()
+		atomic.AddInt64(&sel.fetching, -int64(b.n))
+	}
+	if sel.err != nil {
+		t.Fatalf("select: %s", sel.err)
+	}
+
+	if want := []int{3, 3, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("expected batch sizes %v, got %v", want, sizes)
+	}
+	if shared != 1 {
+		t.Errorf("expected 1 shared row, got %d", shared)
+	}
+	for _, f := range d.files {
+		if n := committed[f.id]; n != 1 {
+			t.Errorf("row %d: expected to be committed once, got %d", f.id, n)
+		}
+	}
+	if n := atomic.LoadInt64(&sel.fetching); n != 0 {
+		t.Errorf("expected no requests fetching, got %d", n)
+	}
+	var paths []string
+	requests.Range(func(path, n interface{}) bool {
+		if path == "/version-1-a" && *n.(*int64) != 1 {
+			t.Errorf("%s: expected 1 coalesced request, got %d", path, *n.(*int64))
+		}
+		paths = append(paths, path.(string))
+		return true
+	})
+	sort.Strings(paths)
+	if want := []string{"/version-0-a", "/version-0-b", "/version-0-c", "/version-1-a", "/version-1-b"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected requests %v, got %v", want, paths)
+	}
+}
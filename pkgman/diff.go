@@ -0,0 +1,58 @@
+package pkgman
+
+import (
+	"sort"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"   // Entry is only in the new manifest.
+	Removed ChangeKind = "removed" // Entry is only in the old manifest.
+	Changed ChangeKind = "changed" // Entry is in both, with different content.
+)
+
+// Change describes how an entry differs between two manifests.
+type Change struct {
+	Kind ChangeKind
+	Name string
+	// Entry in the old manifest. Zero if Kind is Added.
+	Old Entry
+	// Entry in the new manifest. Zero if Kind is Removed.
+	New Entry
+}
+
+// Diff compares the entries of an old manifest, from, with those of a new
+// manifest, to, by name. Returns the entries that were added, removed, or
+// changed, sorted by name. An entry is changed if its hash or sizes differ. If
+// a name appears more than once in a manifest, then the last entry of the name
+// is used.
+func Diff(from, to []Entry) (changes []Change) {
+	oldEntries := make(map[string]Entry, len(from))
+	for _, entry := range from {
+		oldEntries[entry.Name] = entry
+	}
+	newEntries := make(map[string]Entry, len(to))
+	for _, entry := range to {
+		newEntries[entry.Name] = entry
+	}
+	for name, o := range oldEntries {
+		n, ok := newEntries[name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: Removed, Name: name, Old: o})
+		case o != n:
+			changes = append(changes, Change{Kind: Changed, Name: name, Old: o, New: n})
+		}
+	}
+	for name, n := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			changes = append(changes, Change{Kind: Added, Name: name, New: n})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
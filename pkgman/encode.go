@@ -0,0 +1,24 @@
+package pkgman
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+)
+
+// Version of the format written by Encode.
+const Version = "v0"
+
+// Encode writes entries to w in the manifest format. Lines are terminated by
+// CRLF.
+func Encode(w io.Writer, entries []Entry) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(Version + "\r\n")
+	for _, entry := range entries {
+		b.WriteString(entry.Name + "\r\n")
+		b.WriteString(entry.Hash + "\r\n")
+		b.WriteString(strconv.FormatInt(entry.PackedSize, 10) + "\r\n")
+		b.WriteString(strconv.FormatInt(entry.UnpackedSize, 10) + "\r\n")
+	}
+	return b.Flush()
+}
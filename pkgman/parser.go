@@ -3,56 +3,91 @@ package pkgman
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
+	"strings"
+
+	"github.com/anaminus/rbxark/unitext"
 )
 
 type Entry struct {
-	Name         string
-	Hash         string
-	PackedSize   int64
-	UnpackedSize int64
+	Name         string `json:"name"`
+	Hash         string `json:"hash"`
+	PackedSize   int64  `json:"packed_size"`
+	UnpackedSize int64  `json:"unpacked_size"`
+}
+
+// parseVersion parses the version header of a manifest, of the form "v"
+// followed by a number.
+func parseVersion(s string) (version int, err error) {
+	if !strings.HasPrefix(s, "v") {
+		return 0, fmt.Errorf("unexpected version %q", s)
+	}
+	if version, err = strconv.Atoi(s[1:]); err != nil || version < 0 {
+		return 0, fmt.Errorf("unexpected version %q", s)
+	}
+	return version, nil
 }
 
+// Decode parses the entries of a manifest. Every known version of the format
+// lists entries in the same layout of four lines each, so any version header is
+// accepted. Lines may end with CRLF, and blank lines before, between, and after
+// entries are ignored. A manifest encoded as UTF-16, or beginning with a byte
+// order mark, is converted to UTF-8 before being parsed.
 func Decode(r io.Reader) (entries []Entry, err error) {
-	s := bufio.NewScanner(r)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(unitext.Decode(b)))
 	s.Split(bufio.ScanLines)
-	if !s.Scan() {
-		return nil, s.Err()
+	line := 0
+	scan := func() bool {
+		line++
+		return s.Scan()
+	}
+	text := func() string {
+		return strings.TrimSpace(s.Text())
 	}
 
-	switch version := s.Text(); version {
-	case "v0":
-	default:
-		return nil, fmt.Errorf("unexpected version %q", version)
+	// Skip leading blank lines.
+	for {
+		if !scan() {
+			return nil, s.Err()
+		}
+		if text() != "" {
+			break
+		}
+	}
+	if _, err := parseVersion(text()); err != nil {
+		return nil, fmt.Errorf("line %d: %w", line, err)
 	}
 
-	// Parse v0.
-	line := 1
-	for s.Scan() {
-		line++
-		entry := Entry{Name: s.Text()}
+	for scan() {
+		if text() == "" {
+			continue
+		}
+		entry := Entry{Name: text()}
 
-		line++
-		if !s.Scan() {
+		if !scan() {
 			return nil, fmt.Errorf("line %d: expected hash", line)
 		}
-		entry.Hash = s.Text()
+		entry.Hash = text()
 
-		line++
-		if !s.Scan() {
+		if !scan() {
 			return nil, fmt.Errorf("line %d: expected packed size", line)
 		}
-		if entry.PackedSize, err = strconv.ParseInt(s.Text(), 10, 64); err != nil {
+		if entry.PackedSize, err = strconv.ParseInt(text(), 10, 64); err != nil {
 			return nil, fmt.Errorf("line %d: parse packed size: %w", line, err)
 		}
 
-		line++
-		if !s.Scan() {
+		if !scan() {
 			return nil, fmt.Errorf("line %d: expected unpacked size", line)
 		}
-		if entry.UnpackedSize, err = strconv.ParseInt(s.Text(), 10, 64); err != nil {
+		if entry.UnpackedSize, err = strconv.ParseInt(text(), 10, 64); err != nil {
 			return nil, fmt.Errorf("line %d: parse unpacked size: %w", line, err)
 		}
 		entries = append(entries, entry)
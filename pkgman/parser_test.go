@@ -0,0 +1,55 @@
+package pkgman
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testEntries = []Entry{
+	{Name: "RobloxApp.zip", Hash: "5d36c2b6d3b0f0f1e3b1a9d0b5a4c3e2", PackedSize: 28473991, UnpackedSize: 68882292},
+	{Name: "content-fonts.zip", Hash: "0a1b2c3d4e5f60718293a4b5c6d7e8f9", PackedSize: 5182335, UnpackedSize: 5203264},
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		file    string
+		entries []Entry
+		// If not empty, then an error containing this is expected.
+		err string
+	}{
+		{file: "v0.txt", entries: testEntries},
+		{file: "v1.txt", entries: testEntries},
+		{file: "crlf.txt", entries: testEntries},
+		{file: "blank-lines.txt", entries: testEntries},
+		{file: "utf16.txt", entries: testEntries},
+		{file: "empty.txt"},
+		{file: "truncated-hash.txt", err: "line 7: expected hash"},
+		{file: "truncated-size.txt", err: "line 9: expected unpacked size"},
+		{file: "bad-size.txt", err: "line 4: parse packed size"},
+		{file: "bad-version.txt", err: "line 1: unexpected version"},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := Decode(f)
+		f.Close()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.file, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, tt.entries) {
+			t.Errorf("%s: expected %v, got %v", tt.file, tt.entries, entries)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// startProfiles starts the profiles requested by the profiling flags. The
+// returned function stops the profiles and writes them to their files.
+func startProfiles() (stop func(), err error) {
+	var cpu *os.File
+	if FlagOptions.ProfileCPU != "" {
+		if cpu, err = os.Create(FlagOptions.ProfileCPU); err != nil {
+			return nil, fmt.Errorf("create CPU profile: %w", err)
+		}
+		if err = pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, fmt.Errorf("start CPU profile: %w", err)
+		}
+	}
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				log.Printf("write CPU profile: %s", err)
+			}
+		}
+		if FlagOptions.ProfileMem != "" {
+			if err := writeHeapProfile(FlagOptions.ProfileMem); err != nil {
+				log.Printf("write memory profile: %s", err)
+			}
+		}
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Include all garbage collected up to this point.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// phaseTimes accumulates the time spent in each phase of an operation.
+type phaseTimes struct {
+	phases []string
+	times  map[string]time.Duration
+}
+
+// add adds the time since start to the given phase, returning the current
+// time, so that consecutive phases can be chained.
+func (t *phaseTimes) add(phase string, start time.Time) time.Time {
+	now := time.Now()
+	if t.times == nil {
+		t.times = map[string]time.Duration{}
+	}
+	if _, ok := t.times[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.times[phase] += now.Sub(start)
+	return now
+}
+
+// merge adds the times of each phase of u to t.
+func (t *phaseTimes) merge(u *phaseTimes) {
+	if t.times == nil {
+		t.times = map[string]time.Duration{}
+	}
+	for _, phase := range u.phases {
+		if _, ok := t.times[phase]; !ok {
+			t.phases = append(t.phases, phase)
+		}
+		t.times[phase] += u.times[phase]
+	}
+}
+
+// String returns the time of each phase, in the order the phases were first
+// added.
+func (t *phaseTimes) String() string {
+	s := make([]string, len(t.phases))
+	for i, phase := range t.phases {
+		s[i] = fmt.Sprintf("%s %s", phase, t.times[phase].Round(time.Millisecond))
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selectQuery builds the dynamic parts of a SELECT statement. Each condition
+// is wrapped in parentheses and joined with AND, so that a condition cannot
+// change the meaning of another. Parameters are kept alongside the conditions
+// that use them.
+type selectQuery struct {
+	columns []string
+	tables  []string
+	conds   []string
+	params  []interface{}
+	// Number of placeholders bound by the caller.
+	bound int
+}
+
+// Column adds a result column.
+func (q *selectQuery) Column(expr string) *selectQuery {
+	q.columns = append(q.columns, expr)
+	return q
+}
+
+// From adds a table, unless the table was already added.
+func (q *selectQuery) From(table string) *selectQuery {
+	for _, t := range q.tables {
+		if t == table {
+			return q
+		}
+	}
+	q.tables = append(q.tables, table)
+	return q
+}
+
+// Where adds a condition. The number of parameters must match the number of
+// placeholders in cond; a mismatch is a programming error, and panics. An empty
+// cond is ignored.
+func (q *selectQuery) Where(cond string, params ...interface{}) *selectQuery {
+	if strings.TrimSpace(cond) == "" {
+		return q
+	}
+	if n := strings.Count(cond, "?"); n != len(params) {
+		panic(fmt.Sprintf("condition has %d placeholders, but %d parameters", n, len(params)))
+	}
+	if len(params) > 0 && q.bound > 0 {
+		panic("condition with parameters follows bound condition")
+	}
+	q.conds = append(q.conds, cond)
+	q.params = append(q.params, params...)
+	return q
+}
+
+// WhereBound adds a condition whose parameters are bound by the caller when the
+// statement is executed, following Params. This allows a statement to be
+// prepared once and executed with varying values. Conditions with parameters
+// cannot be added after a bound condition.
+func (q *selectQuery) WhereBound(cond string) *selectQuery {
+	if strings.TrimSpace(cond) == "" {
+		return q
+	}
+	q.conds = append(q.conds, cond)
+	q.bound += strings.Count(cond, "?")
+	return q
+}
+
+// Params returns the parameters of the conditions, in order.
+func (q *selectQuery) Params() []interface{} {
+	return q.params
+}
+
+// String returns the statement. The columns, tables and conditions are each
+// written on their own line.
+func (q *selectQuery) String() string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	if len(q.columns) == 0 {
+		b.WriteString("*")
+	}
+	b.WriteString(strings.Join(q.columns, ", "))
+	b.WriteString("\nFROM ")
+	b.WriteString(strings.Join(q.tables, ", "))
+	for i, cond := range q.conds {
+		if i == 0 {
+			b.WriteString("\nWHERE (")
+		} else {
+			b.WriteString("\nAND (")
+		}
+		b.WriteString(cond)
+		b.WriteString(")")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Select returns the statement followed by tail, which may contain clauses
+// such as ORDER BY and LIMIT. Placeholders within tail are bound by the caller,
+// following Params and the parameters of bound conditions.
+func (q *selectQuery) Select(tail string) string {
+	return q.String() + tail
+}
+
+// anyOf returns a condition that is satisfied when any of the given conditions
+// are satisfied.
+func anyOf(conds ...string) string {
+	return "(" + strings.Join(conds, ") OR (") + ")"
+}
+
+// flagsSet returns a condition that is satisfied when any of the flags in mask
+// are set on column.
+func flagsSet(column string, mask FileFlags) string {
+	return fmt.Sprintf("%s & %d != 0", column, mask)
+}
+
+// flagsUnset returns a condition that is satisfied when none of the flags in
+// mask are set on column.
+func flagsUnset(column string, mask FileFlags) string {
+	return fmt.Sprintf("%s & %d == 0", column, mask)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anaminus/rbxark/filters"
+)
+
+// normalize collapses each run of whitespace in a statement to a single space,
+// so that statements can be compared regardless of formatting.
+func normalize(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func checkQuery(t *testing.T, name, query string, params []interface{}, wantQuery string, wantParams []interface{}) {
+	t.Helper()
+	if got, want := normalize(query), normalize(wantQuery); got != want {
+		t.Errorf("%s: unexpected query:\ngot:  %s\nwant: %s", name, got, want)
+	}
+	if len(params) == 0 && len(wantParams) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Errorf("%s: expected params %v, got %v", name, wantParams, params)
+	}
+}
+
+func TestSelectQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  *selectQuery
+		tail   string
+		want   string
+		params []interface{}
+	}{
+		{
+			name:  "empty",
+			query: &selectQuery{},
+			want:  "SELECT *\nFROM \n",
+		},
+		{
+			name:  "columns",
+			query: (&selectQuery{}).Column("a").Column("b AS c").From("t"),
+			want:  "SELECT a, b AS c\nFROM t\n",
+		},
+		{
+			name:  "duplicate table",
+			query: (&selectQuery{}).From("t").From("u").From("t"),
+			want:  "SELECT *\nFROM t, u\n",
+		},
+		{
+			name:   "conditions",
+			query:  (&selectQuery{}).From("t").Where("a == ?", 1).Where("b == ? OR c == ?", "x", "y"),
+			want:   "SELECT *\nFROM t\nWHERE (a == ?)\nAND (b == ? OR c == ?)\n",
+			params: []interface{}{1, "x", "y"},
+		},
+		{
+			name:  "empty condition",
+			query: (&selectQuery{}).From("t").Where("").Where(" \t").WhereBound(""),
+			want:  "SELECT *\nFROM t\n",
+		},
+		{
+			name:   "bound",
+			query:  (&selectQuery{}).From("t").Where("a == ?", 1).WhereBound("b > ?"),
+			tail:   "LIMIT ?",
+			want:   "SELECT *\nFROM t\nWHERE (a == ?)\nAND (b > ?)\nLIMIT ?",
+			params: []interface{}{1},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.query.Select(tt.tail)
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+		if !reflect.DeepEqual(tt.query.Params(), tt.params) {
+			t.Errorf("%s: expected params %v, got %v", tt.name, tt.params, tt.query.Params())
+		}
+	}
+}
+
+func TestSelectQueryPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(q *selectQuery)
+	}{
+		{"missing parameter", func(q *selectQuery) { q.Where("a == ? AND b == ?", 1) }},
+		{"extra parameter", func(q *selectQuery) { q.Where("a == ?", 1, 2) }},
+		{"parameter without placeholder", func(q *selectQuery) { q.Where("a", 1) }},
+		{"parameter after bound", func(q *selectQuery) { q.WhereBound("a > ?").Where("b == ?", 1) }},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", tt.name)
+				}
+			}()
+			tt.fn((&selectQuery{}).From("t"))
+		}()
+	}
+}
+
+func TestConditions(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{anyOf("a"), "(a)"},
+		{anyOf("a", "b OR c"), "(a) OR (b OR c)"},
+		{flagsSet("files.flags", NotFound), "files.flags & 1 != 0"},
+		{flagsSet("f.flags", Exists|HasContent), "f.flags & 18 != 0"},
+		{flagsUnset("files.flags", NotFound|HasContent), "files.flags & 17 == 0"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, tt.got)
+		}
+	}
+}
+
+const selectFilesSQL = `
+	SELECT * FROM files, builds, build_servers
+	WHERE (files.build == builds.rowid)
+	AND (files.build == build_servers.build)
+`
+
+const enabledSQL = `
+	AND (build_servers.server NOT IN (SELECT rowid FROM servers WHERE disabled))
+	AND (files.filename NOT IN (SELECT rowid FROM filenames WHERE tier == 3))
+`
+
+const variantSQL = `EXISTS (
+	SELECT 1 FROM filename_aliases AS a, filename_aliases AS b, files AS f
+	WHERE a.filename == files.filename
+	AND b.grp == a.grp
+	AND f.filename == b.filename
+	AND f.build == files.build
+	AND f.rowid != files.rowid
+	AND f.flags & 16 != 0
+)`
+
+func TestSelection(t *testing.T) {
+	query := filters.Query{Expr: "_build == ?", Params: []interface{}{"version-0"}}
+	tests := []struct {
+		name   string
+		opts   FetchOptions
+		want   string
+		params []interface{}
+	}{
+		{
+			name: "headers",
+			want: enabledSQL + `AND ((files.flags == 0))`,
+		},
+		{
+			name: "recheck",
+			opts: FetchOptions{Recheck: true},
+			want: enabledSQL + `AND ((files.flags == 0) OR (files.flags & 1 != 0))`,
+		},
+		{
+			name:   "content",
+			opts:   FetchOptions{ObjectsPath: "objects", Query: query},
+			params: query.Params,
+			want: enabledSQL + `
+				AND ((files.flags == 0) OR (files.flags & 17 == 0))
+				AND (_build == ?)
+				AND (NOT ` + variantSQL + `)`,
+		},
+		{
+			name: "all variants",
+			opts: FetchOptions{ObjectsPath: "objects", AllVariants: true},
+			want: enabledSQL + `AND ((files.flags == 0) OR (files.flags & 17 == 0))`,
+		},
+		{
+			name: "revalidate",
+			opts: FetchOptions{ObjectsPath: "objects", Revalidate: true},
+			want: enabledSQL + `
+				AND ((files.flags == 0) OR (files.flags & 17 == 0) OR (files.flags & 7 == 6))
+				AND ((files.flags & 16 != 0) OR (NOT ` + variantSQL + `))`,
+		},
+		{
+			name:   "no content",
+			opts:   FetchOptions{ObjectsPath: "objects", NoContent: true, Query: query},
+			params: query.Params,
+			want:   enabledSQL + `AND (files.flags == 14) AND (_build == ?)`,
+		},
+		{
+			name: "deprecated",
+			opts: FetchOptions{deprecated: true},
+			want: enabledSQL + `
+				AND (build_servers.server IN (SELECT server FROM deprecated_servers))
+				AND ((files.flags == 0))`,
+		},
+		{
+			name:   "exclude servers",
+			opts:   FetchOptions{ExcludeServers: []string{"https://example.com/a/", "https://example.com/b"}},
+			params: []interface{}{"https://example.com/a", "https://example.com/b"},
+			want: `AND (build_servers.server NOT IN (SELECT rowid FROM servers WHERE rtrim(url, '/') IN (?,?)))
+				` + enabledSQL + `AND ((files.flags == 0))`,
+		},
+		{
+			name: "selection",
+			opts: FetchOptions{FromSelection: true, Recheck: true, Query: query},
+			want: `AND (EXISTS (
+				SELECT 1 FROM selected_files
+				WHERE selected_files.file == files.rowid
+				AND selected_files.server == build_servers.server
+			))`,
+		},
+		{
+			name: "queue",
+			opts: FetchOptions{Queue: true, ObjectsPath: "objects"},
+			want: `
+				AND (EXISTS (
+					SELECT 1 FROM fetch_queue
+					WHERE fetch_queue.file == files.rowid
+					AND fetch_queue.server == build_servers.server
+					AND fetch_queue.state == 0
+				))
+				AND (NOT ` + variantSQL + `)`,
+		},
+	}
+	for _, tt := range tests {
+		q := selectFiles()
+		tt.opts.selection(q)
+		checkQuery(t, tt.name, q.String(), q.Params(), selectFilesSQL+tt.want, tt.params)
+	}
+}
+
+func TestBatchQuery(t *testing.T) {
+	const columns = `SELECT files.rowid AS id, files.flags AS flags,
+		build_servers.server AS server, builds.hash AS _build,
+		files.filename AS filename`
+	tests := []struct {
+		name   string
+		opts   FetchOptions
+		want   string
+		params []interface{}
+	}{
+		{
+			name: "headers",
+			want: columns + `, NULL AS etag, NULL AS last_modified
+				FROM files, builds, build_servers
+				WHERE (files.build == builds.rowid)
+				AND (files.build == build_servers.build)
+			` + enabledSQL + `
+				AND ((files.flags == 0))
+				AND (files.rowid > ?)`,
+		},
+		{
+			name: "revalidate",
+			opts: FetchOptions{Revalidate: true},
+			want: columns + `,
+				(SELECT etag FROM headers WHERE headers.file == files.rowid) AS etag,
+				(SELECT last_modified FROM headers WHERE headers.file == files.rowid) AS last_modified
+				FROM files, builds, build_servers
+				WHERE (files.build == builds.rowid)
+				AND (files.build == build_servers.build)
+			` + enabledSQL + `
+				AND ((files.flags == 0) OR (files.flags & 7 == 6))
+				AND (files.rowid > ?)`,
+		},
+		{
+			name: "filter",
+			opts: FetchOptions{Query: filters.Query{
+				Expr:   "_server == ? AND _file == ?",
+				Params: []interface{}{"https://example.com", "file"},
+				Vars:   map[string]bool{"server": true, "file": true},
+			}},
+			params: []interface{}{"https://example.com", "file"},
+			want: columns + `, NULL AS etag, NULL AS last_modified,
+				servers.url AS _server, filenames.name AS _file
+				FROM files, builds, build_servers, servers, filenames
+				WHERE (files.build == builds.rowid)
+				AND (files.build == build_servers.build)
+				AND (build_servers.server == servers.rowid)
+				AND (files.filename == filenames.rowid)
+			` + enabledSQL + `
+				AND ((files.flags == 0))
+				AND (_server == ? AND _file == ?)
+				AND (files.rowid > ?)`,
+		},
+	}
+	for _, tt := range tests {
+		query, params := tt.opts.batchQuery()
+		want := `WITH temp AS (` + tt.want + `
+			ORDER BY files.rowid
+			LIMIT ?
+			) SELECT id, flags, server, _build, filename, etag, last_modified FROM temp
+			-- Collapse duplicates caused by build being available from multiple
+			-- servers.
+			GROUP BY id
+		`
+		checkQuery(t, tt.name, query, params, want, tt.params)
+	}
+}
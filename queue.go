@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// QueueState is the state of a file in the fetch_queue table.
+type QueueState int
+
+const (
+	QueuePending  QueueState = iota // Not yet fetched.
+	QueueInFlight                   // Being fetched by a batch that has not been committed.
+	QueueDone                       // Fetched and committed.
+	QueueFailed                     // Fetched with an error.
+)
+
+func (s QueueState) String() string {
+	switch s {
+	case QueuePending:
+		return "pending"
+	case QueueInFlight:
+		return "in-flight"
+	case QueueDone:
+		return "done"
+	case QueueFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("QueueState(%d)", int(s))
+}
+
+// QueueCounts is the number of files in the fetch queue in each state.
+type QueueCounts map[QueueState]int
+
+// Total returns the number of files in the queue.
+func (c QueueCounts) Total() (n int) {
+	for _, v := range c {
+		n += v
+	}
+	return n
+}
+
+func (c QueueCounts) String() string {
+	return fmt.Sprintf("%d pending, %d in-flight, %d done, %d failed",
+		c[QueuePending], c[QueueInFlight], c[QueueDone], c[QueueFailed])
+}
+
+// QueueCounts returns the number of files in the fetch queue in each state.
+func (a Action) QueueCounts(e Executor) (counts QueueCounts, err error) {
+	rows, err := e.QueryContext(a.Context, `SELECT state, count(*) FROM fetch_queue GROUP BY state`)
+	if err != nil {
+		return nil, fmt.Errorf("count queue: %w", err)
+	}
+	defer rows.Close()
+	counts = QueueCounts{}
+	for rows.Next() {
+		var state QueueState
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		counts[state] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row error: %w", err)
+	}
+	return counts, nil
+}
+
+// FillQueue replaces the contents of the fetch queue with the files that would
+// be fetched by FetchContent with the given options, along with the server
+// from which each is fetched. The files are added as pending. Returns the
+// number of files queued.
+func (a Action) FillQueue(db *sql.DB, opts FetchOptions) (n int, err error) {
+	opts.Queue = false
+	q := selectFiles().
+		Column("files.rowid AS id").
+		Column("min(build_servers.server) AS server").
+		Column("builds.hash AS _build")
+	if opts.Query.Vars["server"] {
+		joinServers(q).Column("servers.url AS _server")
+	}
+	if opts.Query.Vars["file"] {
+		joinFilenames(q).Column("filenames.name AS _file")
+	}
+	opts.selection(q)
+	query := `
+		INSERT INTO fetch_queue (file, server, state, time)
+		SELECT id, server, ?, ? FROM (` + q.Select(`GROUP BY files.rowid`) + `)
+	`
+	params := append([]interface{}{QueuePending, time.Now().Unix()}, q.Params()...)
+
+	stmt, err := statements.Prepare(a.Context, db, query)
+	if err != nil {
+		return 0, fmt.Errorf("fill queue: %w", err)
+	}
+	tx, err := db.BeginTx(a.Context, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(a.Context, `DELETE FROM fetch_queue`); err != nil {
+		return 0, fmt.Errorf("clear queue: %w", err)
+	}
+	result, err := tx.StmtContext(a.Context, stmt).ExecContext(a.Context, params...)
+	if err != nil {
+		return 0, fmt.Errorf("fill queue: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil {
+		n = int(rows)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return n, nil
+}
+
+// RecoverQueue returns the files of the fetch queue that were in flight, such
+// as when a run was interrupted before committing a batch, to the pending
+// state. Returns the number of files recovered.
+func (a Action) RecoverQueue(e Executor) (n int, err error) {
+	result, err := e.ExecContext(a.Context,
+		`UPDATE fetch_queue SET state = ?, time = ? WHERE state == ?`,
+		QueuePending, time.Now().Unix(), QueueInFlight,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("recover queue: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return int(rows), nil
+}
+
+// setQueueState sets the state of the given files in the fetch queue. If err is
+// not nil, then its message is recorded.
+func (a Action) setQueueState(e Executor, state QueueState, err error, ids ...int) error {
+	var msg sql.NullString
+	if err != nil {
+		msg = sql.NullString{String: err.Error(), Valid: true}
+	}
+	const query = `UPDATE fetch_queue SET state = ?, time = ?, error = ? WHERE file == ?`
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if _, err := e.ExecContext(a.Context, query, state, now, msg, id); err != nil {
+			return fmt.Errorf("set queue state of %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// SettleQueue marks as done each pending file of the fetch queue for which
+// another variant of the same build has content. Such files are not fetched
+// unless AllVariants is set, so they would otherwise remain pending after a
+// queue has been fetched. Returns the number of files settled.
+func (a Action) SettleQueue(e Executor) (n int, err error) {
+	result, err := e.ExecContext(a.Context, `
+		UPDATE fetch_queue SET state = ?, time = ?
+		WHERE state == ?
+		AND file IN (SELECT files.rowid FROM files WHERE `+variantHasContent("files")+`)
+	`, QueueDone, time.Now().Unix(), QueuePending)
+	if err != nil {
+		return 0, fmt.Errorf("settle queue: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return int(rows), nil
+}
+
+// prepareQueue sets opts to fetch from the fetch queue of an archive. Files left
+// in flight are recovered. If no files are pending, the queue is first filled
+// according to opts.
+func prepareQueue(action Action, ar *Archive, opts *FetchOptions) error {
+	recovered, err := action.RecoverQueue(ar.DB)
+	if err != nil {
+		return err
+	}
+	if recovered > 0 {
+		log.Printf("%s: recovered %d in-flight files", ar.Name, recovered)
+	}
+	counts, err := action.QueueCounts(ar.DB)
+	if err != nil {
+		return err
+	}
+	if counts[QueuePending] > 0 {
+		log.Printf("%s: resuming queue: %s", ar.Name, counts)
+	} else {
+		n, err := action.FillQueue(ar.DB, *opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: queued %d files", ar.Name, n)
+	}
+	opts.FromSelection = false
+	opts.Queue = true
+	return nil
+}
+
+// finishQueue settles the fetch queue of an archive after a run, and reports
+// its state.
+func finishQueue(action Action, ar *Archive, opts FetchOptions) error {
+	if opts.ObjectsPath != "" && !opts.AllVariants {
+		if _, err := action.SettleQueue(ar.DB); err != nil {
+			return err
+		}
+	}
+	counts, err := action.QueueCounts(ar.DB)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: queue: %s", ar.Name, counts)
+	return nil
+}
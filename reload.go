@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/anaminus/rbxark/fetch"
+)
+
+// reloadFetch returns a function to be called between the batches of a fetch.
+// When a reload was requested, the config of the archive is loaded again and
+// applied to the fetch in progress: the rate limit of the fetcher is updated,
+// and new servers and file names are merged and their files generated, so that
+// they are picked up by the remainder of the run. Filters and other options
+// take effect on the next run.
+//
+// A config that fails to load is logged, and the fetch continues with the
+// previous config.
+func reloadFetch(action Action, ar *Archive, fetcher *fetch.Fetcher) func() error {
+	return func() error {
+		if !ReloadRequested() {
+			return nil
+		}
+		Notify("RELOADING=1")
+		defer Notify("READY=1")
+
+		config, err := LoadConfig(ar.ConfigPath)
+		if err != nil {
+			log.Printf("reload: %s", err)
+			return nil
+		}
+		fetcher.SetRateLimit(config.RateLimit)
+
+		action := action
+		action.Operation = NewOperation(config)
+
+		newServers, err := mergeServers(action, ar.DB, config)
+		if err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+		newNames, _, err := mergeFilenames(action, ar.DB, config)
+		if err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+		newFiles, err := action.GenerateFiles(ar.DB, daysAgo(config.RecentBuildDays))
+		if err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+		log.Printf("reloaded config: merged %d new servers, %d new file names, %d new files", newServers, newNames, newFiles)
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anaminus/but"
+	"github.com/anaminus/rbxark/objects"
+)
+
+// A results bundle is a directory containing the results of fetched files,
+// exchanged between operators that fetch disjoint parts of an archive. It
+// contains a results file, listing one FileResult per line as JSON, and an
+// objects directory, with the same layout as an objects path, containing the
+// content of the files.
+const (
+	bundleResults = "results.jsonl"
+	bundleObjects = "objects"
+)
+
+// readResults reads the results file of a bundle.
+func readResults(dir string) (results []FileResult, err error) {
+	f, err := os.Open(filepath.Join(dir, bundleResults))
+	if err != nil {
+		return nil, fmt.Errorf("open results: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var r FileResult
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("decode results: line %d: %w", line, err)
+		}
+		results = append(results, r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read results: %w", err)
+	}
+	return results, nil
+}
+
+// copyResultObjects copies the object of each result with content from src to
+// dst, returning the hashes of the objects that were copied and verified. An
+// object that fails to copy is reported, and its results are left without
+// content.
+func copyResultObjects(dst, src string, results []FileResult) (verified map[string]bool) {
+	verified = map[string]bool{}
+	for _, r := range results {
+		if r.Flags&HasContent == 0 || r.Metadata == nil || verified[r.Metadata.MD5] {
+			continue
+		}
+		if err := copyObject(dst, src, r.Metadata.MD5, r.Metadata.Size); err != nil {
+			but.IfError(fmt.Errorf("%s-%s: %w", r.Build, r.File, err))
+			continue
+		}
+		verified[r.Metadata.MD5] = true
+	}
+	return verified
+}
+
+// copyObject copies the object of the given hash from one objects path to
+// another. The copied content is verified against the hash and size, and is
+// written uncompressed. Does nothing if the object already exists in dst.
+func copyObject(dst, src, hash string, size int64) error {
+	if objects.Exists(dst, hash) {
+		return nil
+	}
+	f, err := objects.Open(src, hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := objects.NewWriter(dst)
+	w.ExpectSize(size)
+	digest := md5.New()
+	if _, err := io.Copy(io.MultiWriter(w, digest), f); err != nil {
+		w.Remove()
+		return err
+	}
+	// The content is verified before the object is placed, so that content
+	// that does not match never replaces or removes another object.
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != hash {
+		w.Remove()
+		return fmt.Errorf("expected hash %s, got %s", hash, sum)
+	}
+	if _, _, err := w.Close(); err != nil {
+		w.Remove()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anaminus/rbxark/objects"
+)
+
+// An object of a bundle whose content does not match its hash must not affect
+// the object that the content does match.
+func TestCopyObjectMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbxark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst, src := filepath.Join(dir, "dst"), filepath.Join(dir, "src")
+	for _, path := range []string{dst, src} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existing := writeObject(t, dst, "content")
+
+	// The bundle claims that the content is that of another object.
+	claimed := writeObject(t, src, "other content")
+	if err := os.Remove(objects.Path(src, claimed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(objects.Path(src, claimed), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyObject(dst, src, claimed, int64(len("content"))); err == nil {
+		t.Errorf("expected hash mismatch")
+	}
+	if objects.Exists(dst, claimed) {
+		t.Errorf("object %s copied with mismatched content", claimed)
+	}
+	if ok, err := objects.Verify(dst, existing); !ok || err != nil {
+		t.Errorf("existing object %s: expected to be kept (valid %t, err %v)", existing, ok, err)
+	}
+	// Nothing is left behind by the failed copy.
+	if err := objects.WalkTemporary(dst, func(path string, info os.FileInfo) error {
+		t.Errorf("temporary file left: %s", path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A run history file contains the statistics of each run of a fetch command
+// over an archive as JSON lines, each encoding one RunRecord. Records are
+// appended as runs end, so the file grows over the life of the archive.
+
+// RunRecord is the statistics of one run of a fetch command over an archive.
+type RunRecord struct {
+	// Name of the command.
+	Command string `json:"command"`
+	// When the run started, as a Unix timestamp.
+	Start int64 `json:"start"`
+	// Number of seconds taken by the run.
+	Duration float64 `json:"duration"`
+	// Number of batches fetched.
+	Batches int `json:"batches"`
+	// Number of files committed.
+	Committed int `json:"committed"`
+	// Number of files that failed.
+	Failed int `json:"failed"`
+	// Number of bytes of content downloaded.
+	Bytes int64 `json:"bytes"`
+	// Number of files whose content was reused from an existing object.
+	Reused int `json:"reused"`
+	// Number of files that returned each status.
+	Statuses map[int]int `json:"statuses,omitempty"`
+	// Number of seconds spent in each phase of the run.
+	Phases map[string]float64 `json:"phases,omitempty"`
+	// The error that stopped the run, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Hits returns the number of files that returned a successful status.
+func (r RunRecord) Hits() (n int) {
+	for status, count := range r.Statuses {
+		if 200 <= status && status < 300 {
+			n += count
+		}
+	}
+	return n
+}
+
+// runRecorder records a run of a fetch command. The methods of a nil
+// *runRecorder do nothing.
+type runRecorder struct {
+	path   string
+	record RunRecord
+	start  time.Time
+	// Statuses counted before the run began.
+	before Stats
+	// Totals of each pass of FetchContent that is done, and the progress of
+	// the current pass.
+	done    Progress
+	current Progress
+	timing  phaseTimes
+}
+
+// startRun begins recording a run of the given command. stats are the statuses
+// that will be counted by the run, which may already hold the counts of
+// previous runs. Returns nil if the config has no run history.
+func startRun(command string, config *Config, stats Stats) *runRecorder {
+	if config.RunHistory == "" {
+		return nil
+	}
+	r := &runRecorder{
+		path:   config.RunHistory,
+		start:  time.Now(),
+		before: make(Stats, len(stats)),
+	}
+	r.record.Command = command
+	for status, n := range stats {
+		r.before[status] = n
+	}
+	return r
+}
+
+// progress returns a function that records the progress of the run, then
+// passes the progress to next, if not nil.
+func (r *runRecorder) progress(next func(Progress)) func(Progress) {
+	if r == nil {
+		return next
+	}
+	return func(p Progress) {
+		if p.Phase == "done" {
+			// FetchContent may make more than one pass, each counting from
+			// zero.
+			r.done.Batch += p.Batch
+			r.done.Committed += p.Committed
+			r.done.Failed += p.Failed
+			r.done.Bytes += p.Bytes
+			r.done.Reused += p.Reused
+			r.current = Progress{}
+		} else {
+			r.current = p
+		}
+		if next != nil {
+			next(p)
+		}
+	}
+}
+
+// Timing returns the phase times to which the run adds, or nil.
+func (r *runRecorder) Timing() *phaseTimes {
+	if r == nil {
+		return nil
+	}
+	return &r.timing
+}
+
+// finish appends the record of the run to the run history. stats are the
+// statuses counted by the run, and runErr is the error that stopped it, if any.
+func (r *runRecorder) finish(stats Stats, runErr error) error {
+	if r == nil {
+		return nil
+	}
+	rec := r.record
+	rec.Start = r.start.Unix()
+	rec.Duration = time.Since(r.start).Seconds()
+	rec.Batches = r.done.Batch + r.current.Batch
+	rec.Committed = r.done.Committed + r.current.Committed
+	rec.Failed = r.done.Failed + r.current.Failed
+	rec.Bytes = r.done.Bytes + r.current.Bytes
+	rec.Reused = r.done.Reused + r.current.Reused
+	for status, n := range stats {
+		if n -= r.before[status]; n > 0 {
+			if rec.Statuses == nil {
+				rec.Statuses = map[int]int{}
+			}
+			rec.Statuses[status] = n
+		}
+	}
+	for _, phase := range r.timing.phases {
+		if rec.Phases == nil {
+			rec.Phases = map[string]float64{}
+		}
+		rec.Phases[phase] = r.timing.times[phase].Seconds()
+	}
+	if runErr != nil {
+		rec.Error = runErr.Error()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readRunHistory reads the records of a run history file. Returns no records
+// if the file does not exist.
+func readRunHistory(path string) (records []RunRecord, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open run history: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec RunRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("decode run history: line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read run history: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Doer makes HTTP requests.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Object describes an object in a bucket listing.
+type Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []Object `xml:"Contents"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// List enumerates the objects of a bucket whose keys begin with prefix, calling
+// fn for each object. bucket is the URL of the bucket, in either path or
+// virtual-hosted style. Keys that contain a "/" after the prefix are not
+// included. Requests are signed with creds, which may be nil to make anonymous
+// requests.
+func List(ctx context.Context, client Doer, bucket, prefix string, creds *Credentials, fn func(Object) error) error {
+	base, err := url.Parse(strings.TrimRight(bucket, "/") + "/")
+	if err != nil {
+		return fmt.Errorf("parse bucket: %w", err)
+	}
+	var token string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := *base
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		creds.Sign(req, EmptyPayloadHash, time.Now())
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("list %s: %w", bucket, err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return fmt.Errorf("list %s: status %s", bucket, resp.Status)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("list %s: decode: %w", bucket, err)
+		}
+		for _, object := range result.Contents {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
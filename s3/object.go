@@ -0,0 +1,103 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// objectURL returns the URL of key within bucket, with the given query.
+func objectURL(bucket, key string, query url.Values) (string, error) {
+	base, err := url.Parse(strings.TrimRight(bucket, "/") + "/")
+	if err != nil {
+		return "", fmt.Errorf("parse bucket: %w", err)
+	}
+	ref := &url.URL{Path: key}
+	v := base.ResolveReference(ref)
+	v.RawQuery = query.Encode()
+	return v.String(), nil
+}
+
+// request makes an unbodied request for key within bucket. A response with a
+// 404 status returns an error that satisfies errors.Is(err, os.ErrNotExist).
+// Any other unsuccessful status also returns an error. The body of the
+// response must be closed by the caller.
+func request(ctx context.Context, client Doer, method, bucket, key string, creds *Credentials) (*http.Response, error) {
+	target, err := objectURL(bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	creds.Sign(req, EmptyPayloadHash, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, key, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s %s: %w", method, key, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("%s %s: status %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// responseObject returns the description of the object of key from the
+// headers of a response.
+func responseObject(key string, resp *http.Response) (object Object, err error) {
+	object.Key = key
+	object.ETag = resp.Header.Get("ETag")
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		object.LastModified = t
+	}
+	if object.Size = resp.ContentLength; object.Size < 0 {
+		return object, fmt.Errorf("%s: unknown content length", key)
+	}
+	return object, nil
+}
+
+// Head returns a description of the object of key within bucket. If the
+// object does not exist, then the error satisfies errors.Is(err,
+// os.ErrNotExist). creds may be nil to make an anonymous request.
+func Head(ctx context.Context, client Doer, bucket, key string, creds *Credentials) (Object, error) {
+	resp, err := request(ctx, client, "HEAD", bucket, key, creds)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	return responseObject(key, resp)
+}
+
+// Get returns the content of the object of key within bucket, which must be
+// closed by the caller. If the object does not exist, then the error satisfies
+// errors.Is(err, os.ErrNotExist). creds may be nil to make an anonymous
+// request.
+func Get(ctx context.Context, client Doer, bucket, key string, creds *Credentials) (io.ReadCloser, error) {
+	resp, err := request(ctx, client, "GET", bucket, key, creds)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object of key from bucket. Removing an object that does
+// not exist is not an error. creds may be nil to make an anonymous request.
+func Delete(ctx context.Context, client Doer, bucket, key string, creds *Credentials) error {
+	resp, err := request(ctx, client, "DELETE", bucket, key, creds)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
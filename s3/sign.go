@@ -0,0 +1,153 @@
+// The s3 package implements a minimal client for S3-compatible object storage.
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EmptyPayloadHash is the SHA-256 hash of an empty request body.
+const EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// UnsignedPayload may be used as the payload hash of a request whose body is
+// not included in the signature.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Credentials are used to sign requests with AWS Signature Version 4.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Region of the bucket. Defaults to "us-east-1".
+	Region string
+}
+
+// EnvCredentials returns credentials read from the standard AWS environment
+// variables. Returns nil if no access key is set.
+func EnvCredentials(region string) *Credentials {
+	c := &Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Region:       region,
+	}
+	if c.AccessKey == "" {
+		return nil
+	}
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_REGION")
+	}
+	return c
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// escape encodes a string according to RFC 3986, as required by the canonical
+// request.
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// Sign signs a request. payloadHash is the hex-encoded SHA-256 hash of the
+// request body, or UnsignedPayload. If c is nil, the request is left unsigned.
+func (c *Credentials) Sign(req *http.Request, payloadHash string, now time.Time) {
+	if c == nil {
+		return
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	// Canonical headers.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "host" || !strings.HasPrefix(key, "x-amz-") && key != "content-type" && key != "content-md5" && key != "range" {
+			continue
+		}
+		headers[key] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name)
+		canonHeaders.WriteByte(':')
+		canonHeaders.WriteString(headers[name])
+		canonHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query.
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, escape(key)+"="+escape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonRequest)
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,278 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinPartSize is the smallest size of a part of a multipart upload, other than
+// the last part.
+const MinPartSize = 5 << 20
+
+// DefaultPartSize is the size of the parts of a multipart upload when the
+// Uploader does not specify one.
+const DefaultPartSize = 16 << 20
+
+// Uploader uploads objects to a bucket. Objects larger than one part are
+// uploaded in parts with a multipart upload, which is resumed by a later
+// upload of the same key if interrupted. Each part is sent with its MD5 hash,
+// and is signed with its SHA-256 hash, so that the bucket rejects a part that
+// was corrupted in transit.
+type Uploader struct {
+	// Client used to make requests.
+	Client Doer
+	// URL of the bucket, in either path or virtual-hosted style.
+	Bucket string
+	// Credentials used to sign requests. May be nil to make anonymous
+	// requests.
+	Creds *Credentials
+	// Size of each part. Defaults to DefaultPartSize, and is at least
+	// MinPartSize.
+	PartSize int64
+	// Number of times a failed request is retried before the upload fails.
+	Retries int
+}
+
+// Part describes an uploaded part of a multipart upload.
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type listUploadsResult struct {
+	Uploads []struct {
+		Key      string `xml:"Key"`
+		UploadID string `xml:"UploadId"`
+	} `xml:"Upload"`
+}
+
+type listPartsResult struct {
+	Parts                []Part `xml:"Part"`
+	IsTruncated          bool   `xml:"IsTruncated"`
+	NextPartNumberMarker int    `xml:"NextPartNumberMarker"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []Part   `xml:"Part"`
+}
+
+// errorResult is the body of a failed request, which may be returned with a
+// successful status by CompleteMultipartUpload.
+type errorResult struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (u *Uploader) partSize() int64 {
+	switch {
+	case u.PartSize <= 0:
+		return DefaultPartSize
+	case u.PartSize < MinPartSize:
+		return MinPartSize
+	}
+	return u.PartSize
+}
+
+// url returns the URL of key within the bucket, with the given query.
+func (u *Uploader) url(key string, query url.Values) (string, error) {
+	return objectURL(u.Bucket, key, query)
+}
+
+// do makes a request, retrying it if it fails. The body is signed with its
+// SHA-256 hash, and sent with its MD5 hash. If v is not nil, then the body of a
+// successful response is decoded into it as XML.
+func (u *Uploader) do(ctx context.Context, method, key string, query url.Values, body []byte, v interface{}) (resp *http.Response, err error) {
+	target, err := u.url(key, query)
+	if err != nil {
+		return nil, err
+	}
+	sha := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sha[:])
+	sum := md5.Sum(body)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(1<<uint(attempt-1)) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		resp, err = u.try(ctx, method, target, body, payloadHash, contentMD5, v)
+		if err == nil || attempt >= u.Retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			// The request was refused rather than interrupted.
+			return resp, err
+		}
+	}
+}
+
+func (u *Uploader) try(ctx context.Context, method, target string, body []byte, payloadHash, contentMD5 string, v interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-MD5", contentMD5)
+	}
+	u.Creds.Sign(req, payloadHash, time.Now())
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, fmt.Errorf("%s %s: status %s", method, req.URL.Path, resp.Status)
+	}
+	if v == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, fmt.Errorf("%s %s: %w", method, req.URL.Path, err)
+	}
+	var e errorResult
+	if xml.Unmarshal(b, &e) == nil && e.XMLName.Local == "Error" {
+		return resp, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, e.Code, e.Message)
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return resp, fmt.Errorf("%s %s: decode: %w", method, req.URL.Path, err)
+	}
+	return resp, nil
+}
+
+// Upload uploads size bytes of r as the object of the given key. An object no
+// larger than one part is uploaded with a single request. Otherwise, an
+// unfinished multipart upload of the key is resumed if one exists, and parts
+// that were already uploaded with the same content are not uploaded again.
+func (u *Uploader) Upload(ctx context.Context, key string, r io.ReaderAt, size int64) error {
+	partSize := u.partSize()
+	if size <= partSize {
+		body := make([]byte, size)
+		if _, err := r.ReadAt(body, 0); err != nil && err != io.EOF {
+			return err
+		}
+		_, err := u.do(ctx, "PUT", key, nil, body, nil)
+		return err
+	}
+
+	uploadID, err := u.findUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	uploaded := map[int]Part{}
+	if uploadID != "" {
+		parts, err := u.listParts(ctx, key, uploadID)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			uploaded[part.PartNumber] = part
+		}
+	} else {
+		var result initiateResult
+		if _, err := u.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+			return fmt.Errorf("initiate upload: %w", err)
+		}
+		uploadID = result.UploadID
+	}
+
+	var complete completeUpload
+	buf := make([]byte, partSize)
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+partSize {
+		n := partSize
+		if size-offset < n {
+			n = size - offset
+		}
+		body := buf[:n]
+		if _, err := r.ReadAt(body, offset); err != nil && err != io.EOF {
+			return err
+		}
+		sum := md5.Sum(body)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if part, ok := uploaded[number]; !ok || part.Size != n || !strings.EqualFold(part.ETag, etag) {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(number)},
+				"uploadId":   {uploadID},
+			}
+			resp, err := u.do(ctx, "PUT", key, query, body, nil)
+			if err != nil {
+				return fmt.Errorf("upload part %d: %w", number, err)
+			}
+			if v := resp.Header.Get("ETag"); v != "" && !strings.EqualFold(v, etag) {
+				return fmt.Errorf("upload part %d: expected ETag %s, got %s", number, etag, v)
+			}
+		}
+		complete.Parts = append(complete.Parts, Part{PartNumber: number, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	var result struct{}
+	if _, err := u.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, body, &result); err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	return nil
+}
+
+// findUpload returns the ID of an unfinished multipart upload of key, or an
+// empty string if there is none.
+func (u *Uploader) findUpload(ctx context.Context, key string) (string, error) {
+	var result listUploadsResult
+	query := url.Values{"uploads": {""}, "prefix": {key}}
+	if _, err := u.do(ctx, "GET", "", query, nil, &result); err != nil {
+		return "", fmt.Errorf("list uploads: %w", err)
+	}
+	for _, upload := range result.Uploads {
+		if upload.Key == key {
+			return upload.UploadID, nil
+		}
+	}
+	return "", nil
+}
+
+// listParts returns the uploaded parts of a multipart upload.
+func (u *Uploader) listParts(ctx context.Context, key, uploadID string) (parts []Part, err error) {
+	marker := 0
+	for {
+		var result listPartsResult
+		query := url.Values{"uploadId": {uploadID}}
+		if marker > 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		if _, err := u.do(ctx, "GET", key, query, nil, &result); err != nil {
+			return nil, fmt.Errorf("list parts: %w", err)
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
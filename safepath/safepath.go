@@ -0,0 +1,142 @@
+// The safepath package validates paths taken from archived content, such as
+// the names of zip entries and the files listed by manifests, before they are
+// used to write files under a local directory. Such paths are untrusted: a
+// path that is absolute, that refers to a parent directory, or that passes
+// through a symbolic link could otherwise write outside of the directory.
+package safepath
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafe indicates that a path would refer to a location outside of the
+// directory under which it is located.
+var ErrUnsafe = errors.New("unsafe path")
+
+// unsafe returns an error wrapping ErrUnsafe for path p.
+func unsafe(p, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrUnsafe, p, reason)
+}
+
+// Clean returns the cleaned form of an untrusted relative path, with elements
+// separated by slashes. Backslashes are also treated as separators, as used by
+// zip files created on Windows.
+//
+// An error wrapping ErrUnsafe is returned if the path is empty, is absolute,
+// has a volume name, contains a NUL byte, or has a ".." element.
+func Clean(p string) (string, error) {
+	if p == "" {
+		return "", unsafe(p, "empty")
+	}
+	if strings.IndexByte(p, 0) >= 0 {
+		return "", unsafe(p, "contains NUL")
+	}
+	s := strings.ReplaceAll(p, `\`, "/")
+	if strings.HasPrefix(s, "/") {
+		return "", unsafe(p, "absolute")
+	}
+	if len(s) >= 2 && s[1] == ':' {
+		return "", unsafe(p, "has volume name")
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if elem == ".." {
+			return "", unsafe(p, "refers to parent")
+		}
+	}
+	s = path.Clean(s)
+	if s == "." {
+		return "", unsafe(p, "empty")
+	}
+	return s, nil
+}
+
+// Join returns the path of root joined with an untrusted relative path, which
+// is validated by Clean. The result is in the form of the operating system.
+func Join(root, p string) (string, error) {
+	s, err := Clean(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(s)), nil
+}
+
+// ZipEntry returns the cleaned name of an entry of a zip file. An error wrapping
+// ErrUnsafe is returned if the entry is a symbolic link, or if the name is
+// rejected by Clean. The names of directory entries are returned without their
+// trailing slash.
+func ZipEntry(f *zip.File) (string, error) {
+	if f.Mode()&os.ModeSymlink != 0 {
+		return "", unsafe(f.Name, "is symbolic link")
+	}
+	return Clean(f.Name)
+}
+
+// CheckLinks returns an error wrapping ErrUnsafe if any existing element of an
+// untrusted relative path, located under root, is a symbolic link. Elements
+// that do not exist are not checked, so the path can be checked before its
+// directories are created. This prevents a link written by a previous
+// extraction from redirecting a later write outside of root.
+func CheckLinks(root, p string) error {
+	s, err := Clean(p)
+	if err != nil {
+		return err
+	}
+	dir := root
+	for _, elem := range strings.Split(s, "/") {
+		dir = filepath.Join(dir, elem)
+		stat, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return unsafe(p, "passes through symbolic link")
+		}
+	}
+	return nil
+}
+
+// Create creates a file at an untrusted relative path under root, along with
+// its parent directories. The path is validated by Clean and CheckLinks, and an
+// existing file is not replaced, so that content cannot be written outside of
+// root.
+func Create(root, p string) (*os.File, error) {
+	if err := CheckLinks(root, p); err != nil {
+		return nil, err
+	}
+	name, err := Join(root, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// Replace is like Create, but an existing regular file at the path is removed
+// first, such as a file written by a previous extraction. An existing file of
+// any other kind, such as a directory, is not replaced.
+func Replace(root, p string) (*os.File, error) {
+	if err := CheckLinks(root, p); err != nil {
+		return nil, err
+	}
+	name, err := Join(root, p)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := os.Lstat(name); err == nil && stat.Mode().IsRegular() {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return Create(root, p)
+}
@@ -0,0 +1,252 @@
+package safepath
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		// Whether the path is rejected.
+		unsafe bool
+	}{
+		{path: "a", want: "a"},
+		{path: "a/b/c", want: "a/b/c"},
+		{path: "./a//b/", want: "a/b"},
+		{path: "a/./b", want: "a/b"},
+		{path: `a\b\c`, want: "a/b/c"},
+		{path: "a..b/..c", want: "a..b/..c"},
+		{path: "", unsafe: true},
+		{path: ".", unsafe: true},
+		{path: "./", unsafe: true},
+		{path: "..", unsafe: true},
+		{path: "../a", unsafe: true},
+		{path: "a/../b", unsafe: true},
+		{path: "a/..", unsafe: true},
+		{path: `a\..\..\b`, unsafe: true},
+		{path: "/a", unsafe: true},
+		{path: "/", unsafe: true},
+		{path: `\a`, unsafe: true},
+		{path: `\\server\share\a`, unsafe: true},
+		{path: "C:a", unsafe: true},
+		{path: `C:\a`, unsafe: true},
+		{path: "c:/a", unsafe: true},
+		{path: "a\x00b", unsafe: true},
+		{path: "a/\x00", unsafe: true},
+	}
+	for _, tt := range tests {
+		got, err := Clean(tt.path)
+		if tt.unsafe {
+			if !errors.Is(err, ErrUnsafe) {
+				t.Errorf("%q: expected ErrUnsafe, got %q, %v", tt.path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %q, got %q, %v", tt.path, tt.want, got, err)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	root := filepath.Join("root", "dir")
+	got, err := Join(root, `a\b/c`)
+	if want := filepath.Join(root, "a", "b", "c"); err != nil || got != want {
+		t.Errorf("expected %q, got %q, %v", want, got, err)
+	}
+	if _, err := Join(root, "../a"); !errors.Is(err, ErrUnsafe) {
+		t.Errorf("expected ErrUnsafe, got %v", err)
+	}
+}
+
+func TestZipEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   os.FileMode
+		want   string
+		unsafe bool
+	}{
+		{name: "a/b", mode: 0644, want: "a/b"},
+		{name: "a/dir/", mode: os.ModeDir | 0755, want: "a/dir"},
+		{name: "exec", mode: 0755, want: "exec"},
+		{name: "setuid", mode: os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777, want: "setuid"},
+		{name: "link", mode: os.ModeSymlink | 0777, unsafe: true},
+		{name: "a/link", mode: os.ModeSymlink, unsafe: true},
+		{name: "../a", mode: 0644, unsafe: true},
+		{name: "/a", mode: 0644, unsafe: true},
+		{name: `C:\a`, mode: 0644, unsafe: true},
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, tt := range tests {
+		fh := &zip.FileHeader{Name: tt.name}
+		fh.SetMode(tt.mode)
+		if _, err := zw.CreateHeader(fh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range zr.File {
+		tt := tests[i]
+		got, err := ZipEntry(f)
+		if tt.unsafe {
+			if !errors.Is(err, ErrUnsafe) {
+				t.Errorf("%q: expected ErrUnsafe, got %q, %v", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %q, got %q, %v", tt.name, tt.want, got, err)
+		}
+	}
+}
+
+// tempDirs returns a directory to be used as a root, and a directory outside of
+// the root. The returned function removes both.
+func tempDirs(t *testing.T) (root, outside string, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "safepath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, outside = filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return root, outside, func() { os.RemoveAll(dir) }
+}
+
+// symlink creates a symbolic link, skipping the test if links are not
+// supported.
+func symlink(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Skipf("symbolic links not supported: %s", err)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	root, outside, remove := tempDirs(t)
+	defer remove()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, outside, filepath.Join(root, "a", "link"))
+	symlink(t, filepath.Join(outside, "file"), filepath.Join(root, "a", "file"))
+
+	tests := []struct {
+		path   string
+		unsafe bool
+	}{
+		{path: "a"},
+		{path: "a/b"},
+		{path: "a/b/missing/c"},
+		{path: "missing/link/c"},
+		{path: "a/link", unsafe: true},
+		{path: "a/link/c", unsafe: true},
+		{path: `a\link\c`, unsafe: true},
+		{path: "a/file", unsafe: true},
+		{path: "a/../a/b", unsafe: true},
+	}
+	for _, tt := range tests {
+		err := CheckLinks(root, tt.path)
+		if tt.unsafe {
+			if !errors.Is(err, ErrUnsafe) {
+				t.Errorf("%q: expected ErrUnsafe, got %v", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.path, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	root, outside, remove := tempDirs(t)
+	defer remove()
+
+	f, err := Create(root, "a/b/c")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	f.Close()
+	if stat, err := os.Stat(filepath.Join(root, "a", "b", "c")); err != nil || !stat.Mode().IsRegular() {
+		t.Errorf("expected regular file: %v", err)
+	}
+	if _, err := Create(root, "a/b/c"); !os.IsExist(err) {
+		t.Errorf("expected existing file to be kept, got %v", err)
+	}
+
+	symlink(t, outside, filepath.Join(root, "link"))
+	for _, p := range []string{"link/c", "link/d/e", "../outside/c", "/c"} {
+		if f, err := Create(root, p); !errors.Is(err, ErrUnsafe) {
+			if f != nil {
+				f.Close()
+			}
+			t.Errorf("%q: expected ErrUnsafe, got %v", p, err)
+		}
+	}
+	entries, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("file written outside of root: %s", entry.Name())
+	}
+}
+
+func TestReplace(t *testing.T) {
+	root, outside, remove := tempDirs(t)
+	defer remove()
+
+	for i, content := range []string{"first", "second"} {
+		f, err := Replace(root, "a/b")
+		if err != nil {
+			t.Fatalf("replace %d: %s", i, err)
+		}
+		f.WriteString(content)
+		f.Close()
+		if b, err := ioutil.ReadFile(filepath.Join(root, "a", "b")); err != nil || string(b) != content {
+			t.Errorf("replace %d: expected content %q, got %q (%v)", i, content, b, err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := Replace(root, "dir"); err == nil {
+		f.Close()
+		t.Errorf("expected directory to be kept")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(outside, "c"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, outside, filepath.Join(root, "link"))
+	if f, err := Replace(root, "link/c"); !errors.Is(err, ErrUnsafe) {
+		if f != nil {
+			f.Close()
+		}
+		t.Errorf("expected ErrUnsafe, got %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(outside, "c")); err != nil || string(b) != "outside" {
+		t.Errorf("file outside of root replaced: %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// A selection file contains a list of files as JSON lines, each encoding one
+// SelectedFile.
+
+// writeSelection writes files to w in the selection file format.
+func writeSelection(w io.Writer, files []SelectedFile) error {
+	enc := json.NewEncoder(w)
+	for _, file := range files {
+		if err := enc.Encode(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSelection reads the files of a selection file, or of stdin if path is
+// stdio.
+func readSelection(path string) (files []SelectedFile, err error) {
+	f, err := openInput(path)
+	if err != nil {
+		return nil, fmt.Errorf("open selection: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var file SelectedFile
+		if err := json.Unmarshal(s.Bytes(), &file); err != nil {
+			return nil, fmt.Errorf("decode selection: line %d: %w", line, err)
+		}
+		files = append(files, file)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read selection: %w", err)
+	}
+	return files, nil
+}
+
+// shard returns which of n shards a selected file belongs to. The result
+// depends only on the row of the file, so a file remains in the same shard as
+// the selection changes.
+func (file SelectedFile) shard(n int) int {
+	h := fnv.New32a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(file.id))
+	h.Write(b[:])
+	return int(h.Sum32() % uint32(n))
+}
+
+// SelectionFlags contains options shared by commands that fetch a selection of
+// files.
+type SelectionFlags struct {
+	SaveSelection string `long:"save-selection"`
+	FromSelection string `long:"from-selection"`
+}
+
+// selectionTags describes the options of SelectionFlags.
+var selectionTags = OptionTags{
+	"save-selection": &flags.Option{
+		Description: "Write the selected files to the given file instead of fetching them. If '-', the files are written to stdout.",
+	},
+	"from-selection": &flags.Option{
+		Description: "Fetch the files listed in the given selection file, regardless of flags and filters. If '-', the files are read from stdin.",
+	},
+}
+
+// selectionRun manages the selection files of a fetch command across each
+// archive.
+type selectionRun struct {
+	flags *SelectionFlags
+	save  io.WriteCloser
+	files []SelectedFile
+}
+
+// openSelection prepares the selection files given by flags.
+func openSelection(flags *SelectionFlags) (run *selectionRun, err error) {
+	if flags.SaveSelection != "" && flags.FromSelection != "" {
+		return nil, fmt.Errorf("--save-selection and --from-selection are mutually exclusive")
+	}
+	run = &selectionRun{flags: flags}
+	if flags.FromSelection != "" {
+		if run.files, err = readSelection(flags.FromSelection); err != nil {
+			return nil, err
+		}
+	}
+	if flags.SaveSelection != "" {
+		if run.save, err = createOutput(flags.SaveSelection); err != nil {
+			return nil, fmt.Errorf("create selection: %w", err)
+		}
+	}
+	return run, nil
+}
+
+// Close closes the saved selection file.
+func (run *selectionRun) Close() error {
+	if run.save == nil {
+		return nil
+	}
+	return run.save.Close()
+}
+
+// apply prepares an archive for fetching according to the selection flags.
+// Returns true if files were saved, in which case the files must not be
+// fetched.
+func (run *selectionRun) apply(action Action, ar *Archive, opts *FetchOptions) (saved bool, err error) {
+	switch {
+	case run.save != nil:
+		files, err := action.SelectFiles(ar.DB, *opts)
+		if err != nil {
+			return false, err
+		}
+		w := bufio.NewWriter(run.save)
+		if err := writeSelection(w, files); err != nil {
+			return false, fmt.Errorf("write selection: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return false, fmt.Errorf("write selection: %w", err)
+		}
+		log.Printf("saved %d selected files", len(files))
+		return true, nil
+	case run.flags.FromSelection != "":
+		n, err := action.LoadSelection(ar.DB, run.files)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("loaded %d of %d selected files", n, len(run.files))
+		opts.FromSelection = true
+	}
+	return false, nil
+}
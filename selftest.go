@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anaminus/rbxark/pkgman"
+)
+
+// synthFile is a file of a synthetic build.
+type synthFile struct {
+	content []byte
+	// If the file is a zip package, the content of each of its entries.
+	entries map[string][]byte
+}
+
+// md5 returns the MD5 hash of the content of the file.
+func (f synthFile) md5() string {
+	sum := md5.Sum(f.content)
+	return hex.EncodeToString(sum[:])
+}
+
+// synthBuild is a build of a synthetic deployment.
+type synthBuild struct {
+	Hash    string
+	Type    string
+	Time    time.Time
+	Version synthVersion
+	Files   map[string]synthFile
+}
+
+// synthVersion is the version of a synthetic build.
+type synthVersion [4]int
+
+func (v synthVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+}
+
+// synthDeployment is a deployment server with synthetic builds, served over
+// HTTP as a real server would serve them.
+type synthDeployment struct {
+	Builds  []synthBuild
+	history []byte
+	// Time used as the modification time of every file.
+	modTime time.Time
+}
+
+// synthMissing is a file name that no synthetic build has.
+const synthMissing = "RobloxMissing.zip"
+
+// newSynthDeployment returns a deployment with a Studio build and a player
+// build. The builds share a package, so that the content of one file is reused
+// for the other.
+func newSynthDeployment() *synthDeployment {
+	fonts := synthZip(map[string][]byte{
+		"fonts/arial.ttf":  []byte("synthetic font"),
+		"fonts/README.txt": []byte("synthetic fonts package\r\n"),
+	})
+	d := &synthDeployment{
+		modTime: time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC),
+		Builds: []synthBuild{
+			{
+				Hash:    "version-5e1f7e57b0000001",
+				Type:    "Studio64",
+				Time:    time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC),
+				Version: synthVersion{0, 460, 0, 4600001},
+				Files: map[string]synthFile{
+					"RobloxStudio.zip": synthZip(map[string][]byte{
+						"RobloxStudioBeta.exe": []byte("synthetic studio"),
+						"Qt5Core.dll":          []byte("synthetic library"),
+					}),
+					"content-fonts.zip": fonts,
+				},
+			},
+			{
+				Hash:    "version-5e1f7e57b0000002",
+				Type:    "WindowsPlayer",
+				Time:    time.Date(2021, 1, 3, 9, 30, 0, 0, time.UTC),
+				Version: synthVersion{0, 460, 0, 4600002},
+				Files: map[string]synthFile{
+					"RobloxApp.zip": synthZip(map[string][]byte{
+						"RobloxPlayerBeta.exe": []byte("synthetic player"),
+					}),
+					"content-fonts.zip": fonts,
+				},
+			},
+		},
+	}
+	var history bytes.Buffer
+	for i := range d.Builds {
+		b := &d.Builds[i]
+		b.Files[DefaultManifestFiles[0]] = synthManifest(b.Files)
+		fmt.Fprintf(&history, "New %s %s at %s, file version: %d, %d, %d, %d...Done!\r\n",
+			b.Type, b.Hash, b.Time.Format("1/2/2006 3:04:05 PM"),
+			b.Version[0], b.Version[1], b.Version[2], b.Version[3],
+		)
+	}
+	d.history = history.Bytes()
+	return d
+}
+
+// synthZip returns a zip package of the given entries.
+func synthZip(entries map[string][]byte) synthFile {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for _, name := range names {
+		w, err := z.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		w.Write(entries[name])
+	}
+	if err := z.Close(); err != nil {
+		panic(err)
+	}
+	return synthFile{content: b.Bytes(), entries: entries}
+}
+
+// synthManifest returns an rbxPkgManifest listing the given packages.
+func synthManifest(packages map[string]synthFile) synthFile {
+	var entries []pkgman.Entry
+	for name, f := range packages {
+		var unpacked int64
+		for _, content := range f.entries {
+			unpacked += int64(len(content))
+		}
+		entries = append(entries, pkgman.Entry{
+			Name:         name,
+			Hash:         f.md5(),
+			PackedSize:   int64(len(f.content)),
+			UnpackedSize: unpacked,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	var b bytes.Buffer
+	pkgman.Encode(&b, entries)
+	return synthFile{content: b.Bytes()}
+}
+
+// FileNames returns the names of the files of every build, along with
+// synthMissing, sorted.
+func (d *synthDeployment) FileNames() []string {
+	names := []string{synthMissing}
+	for _, b := range d.Builds {
+		for name := range b.Files {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// file returns the file of a URL path of the form "/<build>-<name>".
+func (d *synthDeployment) file(path string) (f synthFile, ok bool) {
+	path = strings.TrimPrefix(path, "/")
+	for _, b := range d.Builds {
+		if strings.HasPrefix(path, b.Hash+"-") {
+			f, ok = b.Files[strings.TrimPrefix(path, b.Hash+"-")]
+			return f, ok
+		}
+	}
+	return f, false
+}
+
+// ServeHTTP implements http.Handler. Files that do not exist are answered with
+// a 403 status, as by the deployment buckets.
+func (d *synthDeployment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var content []byte
+	if r.URL.Path == "/DeployHistory.txt" {
+		content = d.history
+	} else if f, ok := d.file(r.URL.Path); ok {
+		content = f.content
+		w.Header().Set("ETag", `"`+f.md5()+`"`)
+	} else {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", d.modTime, bytes.NewReader(content))
+}
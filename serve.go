@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anaminus/rbxark/filters"
+	"github.com/anaminus/rbxark/objects"
+	"github.com/anaminus/rbxark/server"
+)
+
+// servedArchive is an archive answered by serve.
+type servedArchive struct {
+	*Archive
+	config *Config
+	// Object storage of the archive, or nil.
+	store objects.Storage
+}
+
+// object returns the content of an object of the archive, looking first in the
+// objects path, then in the object storage. If the archive does not have the
+// object, then the error satisfies errors.Is(err, os.ErrNotExist).
+func (ar *servedArchive) object(ctx context.Context, hash string) (*server.Content, error) {
+	if stat := objects.Stat(ar.config.ObjectsPath, hash); stat != nil {
+		// A compressed object is decompressed as it is served.
+		if r, err := objects.Open(ar.config.ObjectsPath, hash); err == nil {
+			return &server.Content{ReadCloser: r, Size: stat.Size(), Hash: hash}, nil
+		}
+	}
+	if ar.store == nil {
+		return nil, fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+	}
+	size, err := ar.store.Stat(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ar.store.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &server.Content{ReadCloser: r, Size: size, Hash: hash}, nil
+}
+
+// peerHeader is set on the requests that a federation makes to its peers. A
+// request with the header is answered only from the archives of a federation,
+// so that peers configured with each other do not forward a request between
+// them indefinitely.
+const peerHeader = "Rbxark-Peer"
+
+// peerKey is the context key marking a request made by a peer.
+type peerKey struct{}
+
+// federation answers the requests of serve from several archives, and from the
+// APIs of peers. Builds and files are those of every archive. The content of an
+// object is looked up first in the archive that refers to it, then in each
+// other archive, then in each peer. Content served from somewhere other than
+// the archive that refers to it is a cross-archive hit, which is logged and
+// counted by where it was found.
+type federation struct {
+	archives []*servedArchive
+	// Base URLs of peer APIs.
+	peers  []string
+	client *http.Client
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+// API returns the API answering requests from the federation.
+func (f *federation) API() *server.API {
+	return &server.API{
+		Builds: f.builds,
+		Files:  f.files,
+		File:   f.file,
+		Object: func(ctx context.Context, hash string) (*server.Content, error) {
+			return f.object(ctx, nil, hash, "")
+		},
+	}
+}
+
+// Handler returns a handler that answers requests with next, marking those made
+// by a peer.
+func (f *federation) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(peerHeader) != "" {
+			r = r.WithContext(context.WithValue(r.Context(), peerKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *federation) builds(ctx context.Context) (interface{}, error) {
+	var set buildSet
+	for _, ar := range f.archives {
+		builds, err := Action{Context: ctx}.ExportBuilds(ar.DB, 0)
+		if err != nil {
+			return nil, err
+		}
+		set.add(builds)
+	}
+	return set.sorted(), nil
+}
+
+func (f *federation) files(ctx context.Context, q server.FileQuery, fn func(interface{}) error) error {
+	action := Action{Context: ctx}
+	var query filters.Query
+	if q.Build != "" {
+		query = filters.Query{Expr: "builds.hash == ?", Params: []interface{}{q.Build}}
+	} else {
+		var rules []string
+		if q.Where != "" {
+			rules = []string{"exclude content", "include content : " + q.Where}
+		}
+		var err error
+		if query, err = LoadFilter(rules, "content"); err != nil {
+			return fmt.Errorf("%w: where: %s", server.ErrBadRequest, err)
+		}
+	}
+	since, err := parseSince(q.Since)
+	if err != nil {
+		return fmt.Errorf("%w: since: %s", server.ErrBadRequest, err)
+	}
+	for _, ar := range f.archives {
+		t, err := since.resolve(action, ar.DB)
+		if err != nil {
+			return fmt.Errorf("%w: %s", server.ErrBadRequest, err)
+		}
+		err = action.ExportManifest(ar.DB, query, t, func(e ManifestEntry) error {
+			return fn(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file returns the content of a file from the first archive that has the file.
+func (f *federation) file(ctx context.Context, build, name string) (*server.Content, error) {
+	for _, ar := range f.archives {
+		hash, _, contentType, err := Action{Context: ctx}.FileObject(ar.DB, build, name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return f.object(ctx, ar, hash, contentType)
+	}
+	return nil, fmt.Errorf("file %s-%s: %w", build, name, os.ErrNotExist)
+}
+
+// object returns the content of an object with the given content type. home is
+// the archive that refers to the object, or nil if no archive in particular
+// does. An archive or peer that fails is skipped, but its error is returned if
+// no other has the object.
+func (f *federation) object(ctx context.Context, home *servedArchive, hash, contentType string) (*server.Content, error) {
+	hash = strings.ToLower(hash)
+	if !objects.IsHash(hash) {
+		return nil, fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+	}
+	var firstErr error
+	found := func(content *server.Content, err error) bool {
+		if err == nil {
+			content.Type = contentType
+			return true
+		}
+		if firstErr == nil && !errors.Is(err, os.ErrNotExist) {
+			firstErr = err
+		}
+		return false
+	}
+	archives := f.archives
+	if home != nil {
+		archives = append([]*servedArchive{home}, archives...)
+	}
+	for i, ar := range archives {
+		if i > 0 && ar == home {
+			continue
+		}
+		if content, err := ar.object(ctx, hash); found(content, err) {
+			if home != nil && ar != home {
+				f.hit(home, ar.Name, hash)
+			}
+			return content, nil
+		}
+	}
+	if ctx.Value(peerKey{}) == nil {
+		for _, peer := range f.peers {
+			if content, err := f.peerObject(ctx, peer, hash); found(content, err) {
+				f.hit(home, peer, hash)
+				return content, nil
+			}
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+}
+
+// peerObject returns the content of an object from a peer. Because a peer is
+// not trusted, the content is downloaded to a temporary file and verified
+// before it is served.
+func (f *federation) peerObject(ctx context.Context, peer, hash string) (*server.Content, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peer+"/objects/"+hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, "1")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("object %s on %s: %w", hash, peer, os.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("object %s on %s: %s", hash, peer, resp.Status)
+	}
+
+	file, err := ioutil.TempFile("", "rbxark-peer-*")
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, digest), resp.Body)
+	if err == nil {
+		if sum := hex.EncodeToString(digest.Sum(nil)); sum != hash {
+			err = fmt.Errorf("expected hash %s, got %s", hash, sum)
+		} else {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		objects.TempFile{File: file}.Close()
+		return nil, fmt.Errorf("object %s on %s: %w", hash, peer, err)
+	}
+	return &server.Content{ReadCloser: objects.TempFile{File: file}, Size: size, Hash: hash}, nil
+}
+
+// hit records an object served from source rather than from home.
+func (f *federation) hit(home *servedArchive, source, hash string) {
+	f.mu.Lock()
+	if f.hits == nil {
+		f.hits = map[string]int{}
+	}
+	f.hits[source]++
+	f.mu.Unlock()
+	if home != nil {
+		log.Printf("object %s of %s served from %s", hash, home.Name, source)
+	} else {
+		log.Printf("object %s served from %s", hash, source)
+	}
+}
+
+// logHits logs the number of cross-archive hits served from each archive or
+// peer, if any.
+func (f *federation) logHits() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sources := make([]string, 0, len(f.hits))
+	for source := range f.hits {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		log.Printf("served %d cross-archive hits from %s", f.hits[source], source)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anaminus/rbxark/objects"
+)
+
+// writeServedObject writes content as an object of objpath, returning its hash.
+func writeServedObject(t *testing.T, objpath, content string) string {
+	sum := md5.Sum([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	path := objects.Path(objpath, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestFederationObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbxark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &servedArchive{Archive: &Archive{Name: "a"}, config: &Config{ObjectsPath: filepath.Join(dir, "a")}}
+	b := &servedArchive{Archive: &Archive{Name: "b"}, config: &Config{ObjectsPath: filepath.Join(dir, "b")}}
+	inA := writeServedObject(t, a.config.ObjectsPath, "held by a")
+	inB := writeServedObject(t, b.config.ObjectsPath, "held by b")
+
+	// The peer holds one object, and claims another with the wrong content.
+	onPeer := md5.Sum([]byte("held by peer"))
+	damaged := md5.Sum([]byte("damaged"))
+	var peerHeaders []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerHeaders = append(peerHeaders, r.Header.Get(peerHeader))
+		switch strings.TrimPrefix(r.URL.Path, "/objects/") {
+		case hex.EncodeToString(onPeer[:]):
+			w.Write([]byte("held by peer"))
+		case hex.EncodeToString(damaged[:]):
+			w.Write([]byte("not the content"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer peer.Close()
+
+	f := &federation{
+		archives: []*servedArchive{a, b},
+		peers:    []string{peer.URL},
+		client:   peer.Client(),
+	}
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		home    *servedArchive
+		hash    string
+		content string
+		// Error expected, if not empty.
+		err string
+	}{
+		{"home", context.Background(), a, inA, "held by a", ""},
+		{"other archive", context.Background(), a, inB, "held by b", ""},
+		{"no home", context.Background(), nil, inB, "held by b", ""},
+		{"peer", context.Background(), b, hex.EncodeToString(onPeer[:]), "held by peer", ""},
+		{"damaged", context.Background(), a, hex.EncodeToString(damaged[:]), "", "expected hash"},
+		{"missing", context.Background(), a, strings.Repeat("0", 32), "", "not exist"},
+		{"from peer", context.WithValue(context.Background(), peerKey{}, true), a, hex.EncodeToString(onPeer[:]), "", "not exist"},
+	}
+	for _, tt := range tests {
+		content, err := f.object(tt.ctx, tt.home, tt.hash, "text/plain")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+			}
+			if tt.err == "not exist" && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s: expected os.ErrNotExist, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(content)
+		content.Close()
+		if err != nil {
+			t.Errorf("%s: read: %s", tt.name, err)
+		}
+		if string(b) != tt.content || content.Size != int64(len(tt.content)) || content.Type != "text/plain" {
+			t.Errorf("%s: expected %q, got %q (size %d, type %q)", tt.name, tt.content, b, content.Size, content.Type)
+		}
+	}
+
+	if want := map[string]int{"b": 1, peer.URL: 1}; !reflect.DeepEqual(f.hits, want) {
+		t.Errorf("expected hits %v, got %v", want, f.hits)
+	}
+	for _, h := range peerHeaders {
+		if h == "" {
+			t.Errorf("expected %s header on requests to peers", peerHeader)
+		}
+	}
+	// Content from peers is not left behind.
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "rbxark-peer-*")); len(matches) > 0 {
+		t.Errorf("expected no temporary files, got %v", matches)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Access is a request answered by a handler, as recorded by LogAccess.
+type Access struct {
+	// When the request was received, as a Unix timestamp.
+	Time int64 `json:"time"`
+	// Address of the client, as returned by ClientAddr.
+	Client string `json:"client"`
+	Method string `json:"method"`
+	// Path of the request, without its query.
+	Path string `json:"path"`
+	// Build and name of the file whose content was requested, if any.
+	Build string `json:"build,omitempty"`
+	File  string `json:"file,omitempty"`
+	// Hash of the content that was served, if any, read from its ETag.
+	Object string `json:"object,omitempty"`
+	// Status with which the request was answered.
+	Status int `json:"status"`
+	// Number of bytes of the body of the response.
+	Bytes int64 `json:"bytes"`
+	// Number of seconds taken to answer the request.
+	Duration float64 `json:"duration"`
+}
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (n int, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// LogAccess returns a handler that answers requests with next, then calls fn
+// with each answered request. The address of a client is read from header as
+// with Limits.ClientHeader.
+func LogAccess(next http.Handler, header string, fn func(Access)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		a := Access{
+			Time:     start.Unix(),
+			Client:   ClientAddr(r, header),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   aw.status,
+			Bytes:    aw.bytes,
+			Duration: time.Since(start).Seconds(),
+		}
+		if a.Status == 0 {
+			a.Status = http.StatusOK
+		}
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(path) >= 4 && path[0] == "builds" && path[2] == "files" {
+			a.Build = path[1]
+			a.File = strings.Join(path[3:], "/")
+		}
+		if etag, err := strconv.Unquote(w.Header().Get("ETag")); err == nil {
+			a.Object = etag
+		}
+		fn(a)
+	})
+}
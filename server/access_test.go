@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readCloser is content that can be sought.
+type readCloser struct{ *strings.Reader }
+
+func (readCloser) Close() error { return nil }
+
+func TestLogAccess(t *testing.T) {
+	content := func(ctx context.Context, hash string) (*Content, error) {
+		if hash != "0123" {
+			return nil, fmt.Errorf("object %s: %w", hash, os.ErrNotExist)
+		}
+		return &Content{ReadCloser: readCloser{strings.NewReader("content")}, Size: 7, Hash: hash}, nil
+	}
+	api := &API{
+		File: func(ctx context.Context, build, file string) (*Content, error) {
+			return content(ctx, "0123")
+		},
+		Object: content,
+	}
+	var accesses []Access
+	h := LogAccess(api, "X-Forwarded-For", func(a Access) { accesses = append(accesses, a) })
+
+	tests := []struct {
+		method, target string
+		header         string
+		want           Access
+	}{
+		{"GET", "/builds/version-0/files/a/b.zip", "", Access{Client: "192.0.2.1", Build: "version-0", File: "a/b.zip", Object: "0123", Status: 200, Bytes: 7}},
+		{"GET", "/objects/0123", "198.51.100.1", Access{Client: "198.51.100.1", Object: "0123", Status: 200, Bytes: 7}},
+		{"HEAD", "/objects/0123", "", Access{Client: "192.0.2.1", Object: "0123", Status: 200}},
+		{"GET", "/objects/4567", "", Access{Client: "192.0.2.1", Status: 404, Bytes: int64(len("not found\n"))}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if tt.header != "" {
+			r.Header.Set("X-Forwarded-For", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+	if len(accesses) != len(tests) {
+		t.Fatalf("expected %d accesses, got %d", len(tests), len(accesses))
+	}
+	for i, tt := range tests {
+		a := accesses[i]
+		if a.Time == 0 || a.Duration < 0 {
+			t.Errorf("%s %s: expected time and duration, got %d, %f", tt.method, tt.target, a.Time, a.Duration)
+		}
+		a.Time, a.Duration = 0, 0
+		tt.want.Method = tt.method
+		tt.want.Path = tt.target
+		if a != tt.want {
+			t.Errorf("%s %s: expected %+v, got %+v", tt.method, tt.target, tt.want, a)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadRequest indicates that the parameters of a request are invalid, such as
+// a malformed filter expression. It is answered with a 400 status.
+var ErrBadRequest = errors.New("bad request")
+
+// Content is the content of an object served by an API.
+type Content struct {
+	// Content of the object. If it implements io.ReadSeeker, then ranges of
+	// the content may be requested.
+	io.ReadCloser
+	// Size of the content.
+	Size int64
+	// Hash of the content, used as its ETag.
+	Hash string
+	// Content type of the content. If empty, then the type is sniffed.
+	Type string
+}
+
+// FileQuery selects the files listed by an API.
+type FileQuery struct {
+	// Hash of the build of the files, if not empty.
+	Build string
+	// Filter expression that files must match, if not empty.
+	Where string
+	// Value of the since parameter, selecting files added or changed since a
+	// given time, if not empty.
+	Since string
+}
+
+// API is a read-only HTTP API of an archive. Each function answers the requests
+// of an endpoint:
+//
+//     GET /builds                         Builds, as a JSON array.
+//     GET /builds/<build>/files           Files of a build, as JSON lines.
+//     GET /builds/<build>/files/<file>    Content of a file of a build.
+//     GET /files?where=<expr>&since=<t>   Files matching a filter, as JSON lines.
+//     GET /objects/<hash>                 Content of an object.
+//
+// A function may return an error that satisfies errors.Is(err, os.ErrNotExist)
+// to answer with a 404 status, or one wrapping ErrBadRequest to answer with a
+// 400 status. Any other error is answered with a 500 status.
+type API struct {
+	// Builds returns the builds of the archive.
+	Builds func(ctx context.Context) (interface{}, error)
+	// Files calls fn with each file selected by query, stopping at the first
+	// error returned by fn.
+	Files func(ctx context.Context, query FileQuery, fn func(file interface{}) error) error
+	// File returns the content of the file of a build.
+	File func(ctx context.Context, build, file string) (*Content, error)
+	// Object returns the content of the object of hash.
+	Object func(ctx context.Context, hash string) (*Content, error)
+}
+
+// ServeHTTP implements http.Handler.
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var err error
+	switch {
+	case len(path) == 1 && path[0] == "builds":
+		err = api.serveBuilds(w, r)
+	case len(path) == 3 && path[0] == "builds" && path[2] == "files":
+		err = api.serveFiles(w, r, FileQuery{Build: path[1]})
+	case len(path) >= 4 && path[0] == "builds" && path[2] == "files":
+		err = api.serveContent(w, r, false, func(ctx context.Context) (*Content, error) {
+			return api.File(ctx, path[1], strings.Join(path[3:], "/"))
+		})
+	case len(path) == 1 && path[0] == "files":
+		q := r.URL.Query()
+		err = api.serveFiles(w, r, FileQuery{Where: q.Get("where"), Since: q.Get("since")})
+	case len(path) == 2 && path[0] == "objects":
+		err = api.serveContent(w, r, true, func(ctx context.Context) (*Content, error) {
+			return api.Object(ctx, path[1])
+		})
+	default:
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// writeError answers a request with the status corresponding to err.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, ErrBadRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (api *API) serveBuilds(w http.ResponseWriter, r *http.Request) error {
+	builds, err := api.Builds(r.Context())
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(builds)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+	return nil
+}
+
+// serveFiles streams the files selected by query as JSON lines. Because the
+// status is sent with the first file, an error after the first file cannot be
+// reported in the status, and ends the response early instead.
+func (api *API) serveFiles(w http.ResponseWriter, r *http.Request, query FileQuery) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	wrote := false
+	err := api.Files(r.Context(), query, func(file interface{}) error {
+		wrote = true
+		return enc.Encode(file)
+	})
+	if wrote {
+		return nil
+	}
+	return err
+}
+
+// serveContent serves the content returned by get. If immutable is true, then
+// the content is located by its hash, and may be cached indefinitely.
+func (api *API) serveContent(w http.ResponseWriter, r *http.Request, immutable bool, get func(ctx context.Context) (*Content, error)) error {
+	content, err := get(r.Context())
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	h := w.Header()
+	if content.Hash != "" {
+		h.Set("ETag", strconv.Quote(content.Hash))
+	}
+	if content.Type != "" {
+		h.Set("Content-Type", content.Type)
+	}
+	if immutable {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if rs, ok := content.ReadCloser.(io.ReadSeeker); ok {
+		// Content is validated by its ETag rather than a modification time.
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return nil
+	}
+	h.Set("Content-Length", strconv.FormatInt(content.Size, 10))
+	if r.Method == "HEAD" {
+		return nil
+	}
+	// As with files, an error while copying cannot be reported in the status.
+	io.Copy(w, content)
+	return nil
+}
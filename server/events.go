@@ -0,0 +1,121 @@
+// The server package implements HTTP handlers for exposing an archive.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeepAlive is the interval at which a comment is sent to idle event streams,
+// preventing intermediate proxies from closing the connection.
+const KeepAlive = 15 * time.Second
+
+// Hub broadcasts events to any number of subscribers as server-sent events.
+// The zero value is ready to use.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+	// Most recent message of each type, sent to new subscribers so that they
+	// do not have to wait for the next event to display the current state.
+	last  map[string][]byte
+	order []string
+}
+
+// Publish sends an event of the given type to all subscribers. data is encoded
+// as JSON.
+//
+// Publish does not block. A subscriber that is not keeping up misses events.
+func (h *Hub) Publish(typ string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode %s event: %w", typ, err)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "event: %s\n", typ)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		fmt.Fprintf(&msg, "data: %s\n", line)
+	}
+	msg.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last == nil {
+		h.last = map[string][]byte{}
+	}
+	if _, ok := h.last[typ]; !ok {
+		h.order = append(h.order, typ)
+	}
+	h.last[typ] = msg.Bytes()
+	for ch := range h.subs {
+		select {
+		case ch <- msg.Bytes():
+		default:
+		}
+	}
+	return nil
+}
+
+func (h *Hub) subscribe() (ch chan []byte, recent [][]byte) {
+	ch = make(chan []byte, 64)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = map[chan []byte]struct{}{}
+	}
+	h.subs[ch] = struct{}{}
+	for _, typ := range h.order {
+		recent = append(recent, h.last[typ])
+	}
+	return ch, recent
+}
+
+func (h *Hub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+// ServeHTTP streams events to the client until the request is canceled.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, recent := h.subscribe()
+	defer h.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, msg := range recent {
+		if _, err := w.Write(msg); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
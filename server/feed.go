@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Feed is an Atom feed.
+type Feed struct {
+	// Permanent, universally unique identifier of the feed, as an IRI.
+	ID string
+	// Human-readable title of the feed.
+	Title string
+	// URL at which the feed is published, if any.
+	Link string
+	// Entries of the feed, most recent first. The feed is considered updated
+	// when its most recent entry was.
+	Entries []FeedEntry
+}
+
+// FeedEntry is an entry of an Atom feed.
+type FeedEntry struct {
+	// Permanent, universally unique identifier of the entry, as an IRI.
+	ID      string
+	Title   string
+	Summary string
+	// URL of the resource described by the entry, if any.
+	Link    string
+	Updated time.Time
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated string    `xml:"updated"`
+	Link    *atomLink `xml:"link,omitempty"`
+	Summary string    `xml:"summary,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    *atomLink   `xml:"link,omitempty"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func atomHref(rel, href string) *atomLink {
+	if href == "" {
+		return nil
+	}
+	return &atomLink{Rel: rel, Href: href}
+}
+
+// Encode writes the feed to w as an Atom document.
+func (f *Feed) Encode(w io.Writer) error {
+	feed := atomFeed{
+		ID:     f.ID,
+		Title:  f.Title,
+		Link:   atomHref("self", f.Link),
+		Author: "rbxark",
+	}
+	// A feed must have an update time, even when it has no entries.
+	updated := time.Unix(0, 0)
+	for _, entry := range f.Entries {
+		if entry.Updated.After(updated) {
+			updated = entry.Updated
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      entry.ID,
+			Title:   entry.Title,
+			Updated: atomTime(entry.Updated),
+			Link:    atomHref("", entry.Link),
+			Summary: entry.Summary,
+		})
+	}
+	feed.Updated = atomTime(updated)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// FeedHandler returns a handler that serves the feed returned by get, which is
+// called for each request.
+func FeedHandler(get func() (*Feed, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feed, err := get()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		feed.Encode(w)
+	})
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits protects a handler from clients that would saturate it, such as when
+// an archive is served as a public mirror. The zero value imposes no limits.
+type Limits struct {
+	// Requests per second allowed from each client. If zero or less, requests
+	// are not rate limited.
+	RateLimit float64
+	// Number of requests that a client may make at once before RateLimit
+	// applies. At least 1.
+	Burst int
+	// Number of requests answered at once, across all clients. If zero, the
+	// number is not limited.
+	MaxStreams int
+	// Number of requests answered at once for each client. If zero, the
+	// number is not limited.
+	MaxClientStreams int
+	// Maximum length of the path and query of a request. If zero, the length
+	// is not limited.
+	MaxURLLength int
+	// Name of a header, such as X-Forwarded-For, from which the address of a
+	// client is read, for a handler behind a trusted reverse proxy. The last
+	// address of the header is used. If empty, or the header is absent, the
+	// remote address of the connection is used.
+	ClientHeader string
+}
+
+// clientIdle is how long a client must be idle before its state is forgotten.
+const clientIdle = time.Minute
+
+// limitClient is the state of a client of a limiter.
+type limitClient struct {
+	limiter *rate.Limiter
+	streams int
+	last    time.Time
+}
+
+// limiter is the handler returned by Limits.Handler.
+type limiter struct {
+	Limits
+	next    http.Handler
+	streams chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*limitClient
+	swept   time.Time
+}
+
+// Handler returns a handler that applies the limits to requests before passing
+// them to next. Because the API only reads, a request with a body is refused
+// with a 413 status. A URL that is too long is refused with a 414 status. A
+// client that exceeds its rate or its number of streams is refused with a 429
+// status, and a request that exceeds the number of streams of all clients is
+// refused with a 503 status.
+func (l Limits) Handler(next http.Handler) http.Handler {
+	h := &limiter{
+		Limits:  l,
+		next:    next,
+		clients: map[string]*limitClient{},
+	}
+	if h.Burst < 1 {
+		h.Burst = 1
+	}
+	if l.MaxStreams > 0 {
+		h.streams = make(chan struct{}, l.MaxStreams)
+	}
+	return h
+}
+
+// ClientAddr returns the address of the client of a request, read from the
+// given header if not empty, as with Limits.ClientHeader.
+func ClientAddr(r *http.Request, header string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			addrs := strings.Split(v, ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (h *limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+		http.Error(w, "request body not allowed", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if h.MaxURLLength > 0 && len(r.URL.RequestURI()) > h.MaxURLLength {
+		http.Error(w, "request URL too long", http.StatusRequestURITooLong)
+		return
+	}
+
+	addr := ClientAddr(r, h.ClientHeader)
+	client, status := h.acquire(addr)
+	if status != 0 {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer h.release(client)
+	if h.streams != nil {
+		select {
+		case h.streams <- struct{}{}:
+			defer func() { <-h.streams }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests being answered", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// acquire admits a request of the client at addr, returning the state of the
+// client. If the request is refused, then the status with which it is answered
+// is returned instead.
+func (h *limiter) acquire(addr string) (client *limitClient, status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if now.Sub(h.swept) >= clientIdle {
+		// A client idle for long enough has the same state as a new one, so
+		// it is forgotten, keeping the number of clients bounded.
+		for a, c := range h.clients {
+			if c.streams == 0 && now.Sub(c.last) >= clientIdle {
+				delete(h.clients, a)
+			}
+		}
+		h.swept = now
+	}
+	client, ok := h.clients[addr]
+	if !ok {
+		client = &limitClient{}
+		if h.RateLimit > 0 {
+			client.limiter = rate.NewLimiter(rate.Limit(h.RateLimit), h.Burst)
+		}
+		h.clients[addr] = client
+	}
+	client.last = now
+	if client.limiter != nil && !client.limiter.Allow() {
+		return nil, http.StatusTooManyRequests
+	}
+	if h.MaxClientStreams > 0 && client.streams >= h.MaxClientStreams {
+		return nil, http.StatusTooManyRequests
+	}
+	client.streams++
+	return client, 0
+}
+
+// release ends a request admitted by acquire.
+func (h *limiter) release(client *limitClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client.streams--
+	client.last = time.Now()
+}
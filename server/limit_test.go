@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// request makes a request to h from the client at addr, returning the status
+// of the response.
+func request(h http.Handler, addr, target string, header http.Header) int {
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = addr + ":1234"
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestLimitsRequest(t *testing.T) {
+	h := Limits{MaxURLLength: 32}.Handler(okHandler)
+
+	if status := request(h, "192.0.2.1", "/objects/0123", nil); status != http.StatusOK {
+		t.Errorf("short URL: expected status 200, got %d", status)
+	}
+	if status := request(h, "192.0.2.1", "/files?where="+strings.Repeat("x", 32), nil); status != http.StatusRequestURITooLong {
+		t.Errorf("long URL: expected status 414, got %d", status)
+	}
+
+	r := httptest.NewRequest("GET", "/builds", strings.NewReader("body"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body: expected status 413, got %d", w.Code)
+	}
+}
+
+func TestLimitsRate(t *testing.T) {
+	h := Limits{RateLimit: 0.001, Burst: 2, ClientHeader: "X-Forwarded-For"}.Handler(okHandler)
+	tests := []struct {
+		name   string
+		addr   string
+		header http.Header
+		status int
+	}{
+		{"first", "192.0.2.1", nil, http.StatusOK},
+		{"burst", "192.0.2.1", nil, http.StatusOK},
+		{"exceeded", "192.0.2.1", nil, http.StatusTooManyRequests},
+		{"other client", "192.0.2.2", nil, http.StatusOK},
+		{"proxied client", "192.0.2.1", http.Header{"X-Forwarded-For": {"198.51.100.1, 192.0.2.3"}}, http.StatusOK},
+		{"proxied client again", "192.0.2.2", http.Header{"X-Forwarded-For": {"192.0.2.3"}}, http.StatusOK},
+		{"proxied client exceeded", "192.0.2.4", http.Header{"X-Forwarded-For": {"192.0.2.3"}}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if status := request(h, tt.addr, "/builds", tt.header); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, status)
+		}
+	}
+}
+
+func TestLimitsStreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// Status of a second request from the same client, and from another
+		// client, while the first request is being answered.
+		same, other int
+	}{
+		{"unlimited", Limits{}, http.StatusOK, http.StatusOK},
+		{"client", Limits{MaxClientStreams: 1}, http.StatusTooManyRequests, http.StatusOK},
+		{"total", Limits{MaxStreams: 1}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		h := tt.limits.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				close(started)
+				<-release
+			}
+		}))
+		done := make(chan int)
+		go func() { done <- request(h, "192.0.2.1", "/block", nil) }()
+		<-started
+		if status := request(h, "192.0.2.1", "/builds", nil); status != tt.same {
+			t.Errorf("%s: same client: expected status %d, got %d", tt.name, tt.same, status)
+		}
+		if status := request(h, "192.0.2.2", "/builds", nil); status != tt.other {
+			t.Errorf("%s: other client: expected status %d, got %d", tt.name, tt.other, status)
+		}
+		close(release)
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("%s: first request: expected status 200, got %d", tt.name, status)
+		}
+		// Streams are released once answered.
+		if status := request(h, "192.0.2.1", "/builds", nil); status != http.StatusOK {
+			t.Errorf("%s: after release: expected status 200, got %d", tt.name, status)
+		}
+	}
+}
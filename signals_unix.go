@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that request a reload of the configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
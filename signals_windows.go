@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// Signals that request a reload of the configuration. Windows has no
+// equivalent of SIGHUP.
+var reloadSignals []os.Signal
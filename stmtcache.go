@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// stmtCache holds the statements prepared for each database, by query. The
+// query of a statement that selects files contains the expression of its
+// filter, while the values of the filter are bound as parameters, so the same
+// statement is reused by each batch and each command of the process that
+// selects files with the same filter.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[*sql.DB]map[string]*sql.Stmt
+}
+
+// statements is the statement cache of the process.
+var statements stmtCache
+
+// Prepare returns the statement of query prepared for db. The statement is
+// prepared with ctx the first time it is requested, and cached thereafter. The
+// returned statement belongs to the cache, and must not be closed by the
+// caller.
+func (c *stmtCache) Prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[db][query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = map[*sql.DB]map[string]*sql.Stmt{}
+	}
+	if c.stmts[db] == nil {
+		c.stmts[db] = map[string]*sql.Stmt{}
+	}
+	c.stmts[db][query] = stmt
+	return stmt, nil
+}
+
+// Forget closes and removes the statements prepared for db. Must be called
+// before db is closed.
+func (c *stmtCache) Forget(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stmt := range c.stmts[db] {
+		stmt.Close()
+	}
+	delete(c.stmts, db)
+}
+
+// querySelection runs query, which selects files according to a filter, with
+// a statement from the statement cache.
+func (a Action) querySelection(db *sql.DB, query string, params ...interface{}) (*sql.Rows, error) {
+	stmt, err := statements.Prepare(a.Context, db, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(a.Context, params...)
+}
@@ -0,0 +1,170 @@
+// The unitext package normalizes the encoding of text files to UTF-8.
+//
+// Some archived text files, such as deploy histories and manifests, are
+// encoded as UTF-16, or begin with a byte order mark. Decode converts such
+// content to UTF-8 without a byte order mark, so that it can be parsed as
+// plain text.
+package unitext
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Byte order marks.
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// Encoding is an encoding of text detected by Detect.
+type Encoding int
+
+const (
+	UTF8    Encoding = iota // UTF-8, or an unrecognized encoding.
+	UTF16LE                 // UTF-16, little-endian.
+	UTF16BE                 // UTF-16, big-endian.
+)
+
+// Detect returns the encoding of b, and the length of its byte order mark, if
+// any. Without a byte order mark, text is detected as UTF-16 if its first
+// character is an ASCII character followed or preceded by a zero byte.
+func Detect(b []byte) (enc Encoding, bom int) {
+	switch {
+	case bytes.HasPrefix(b, bomUTF8):
+		return UTF8, len(bomUTF8)
+	case bytes.HasPrefix(b, bomUTF16LE):
+		return UTF16LE, len(bomUTF16LE)
+	case bytes.HasPrefix(b, bomUTF16BE):
+		return UTF16BE, len(bomUTF16BE)
+	case len(b) >= 2 && b[0] != 0 && b[0] < utf8.RuneSelf && b[1] == 0:
+		return UTF16LE, 0
+	case len(b) >= 2 && b[0] == 0 && b[1] != 0 && b[1] < utf8.RuneSelf:
+		return UTF16BE, 0
+	}
+	return UTF8, 0
+}
+
+// Decode returns b converted to UTF-8, with any byte order mark removed. Text
+// that is already UTF-8 is returned as a subslice of b. A trailing odd byte of
+// UTF-16 text is dropped, and invalid surrogates are replaced with U+FFFD.
+func Decode(b []byte) []byte {
+	enc, bom := Detect(b)
+	b = b[bom:]
+	if enc == UTF8 {
+		return b
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		lo, hi := b[2*i], b[2*i+1]
+		if enc == UTF16BE {
+			lo, hi = hi, lo
+		}
+		units[i] = uint16(lo) | uint16(hi)<<8
+	}
+	runes := utf16.Decode(units)
+	out := make([]byte, 0, len(runes))
+	var buf [utf8.UTFMax]byte
+	for _, r := range runes {
+		n := utf8.EncodeRune(buf[:], r)
+		out = append(out, buf[:n]...)
+	}
+	return out
+}
+
+// NewReader returns a reader that converts the text read from r to UTF-8, as
+// Decode does, without holding all of the text in memory.
+func NewReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(bomUTF8))
+	enc, bom := Detect(head)
+	br.Discard(bom)
+	if enc == UTF8 {
+		return br
+	}
+	return &utf16Reader{r: br, be: enc == UTF16BE}
+}
+
+// utf16Reader converts UTF-16 text to UTF-8.
+type utf16Reader struct {
+	r  *bufio.Reader
+	be bool
+	// A unit that was read after an unpaired high surrogate.
+	pending    rune
+	hasPending bool
+	// Converted text that has not been read.
+	out []byte
+	buf []byte
+	err error
+}
+
+// unit reads the next code unit. A trailing odd byte is dropped.
+func (u *utf16Reader) unit() (rune, error) {
+	if u.hasPending {
+		u.hasPending = false
+		return u.pending, nil
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(u.r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	lo, hi := b[0], b[1]
+	if u.be {
+		lo, hi = hi, lo
+	}
+	return rune(lo) | rune(hi)<<8, nil
+}
+
+// fill converts a run of text into buf.
+func (u *utf16Reader) fill() {
+	u.buf = u.buf[:0]
+	var enc [utf8.UTFMax]byte
+	for len(u.buf) < 4096 {
+		r, err := u.unit()
+		if err != nil {
+			u.err = err
+			break
+		}
+		switch {
+		case 0xD800 <= r && r < 0xDC00:
+			r2, err := u.unit()
+			switch {
+			case err != nil:
+				u.err = err
+				r = utf8.RuneError
+			case 0xDC00 <= r2 && r2 < 0xE000:
+				r = utf16.DecodeRune(r, r2)
+			default:
+				u.pending, u.hasPending = r2, true
+				r = utf8.RuneError
+			}
+		case 0xDC00 <= r && r < 0xE000:
+			r = utf8.RuneError
+		}
+		n := utf8.EncodeRune(enc[:], r)
+		u.buf = append(u.buf, enc[:n]...)
+		if u.err != nil {
+			break
+		}
+	}
+	u.out = u.buf
+}
+
+func (u *utf16Reader) Read(p []byte) (n int, err error) {
+	for len(u.out) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		u.fill()
+	}
+	n = copy(p, u.out)
+	u.out = u.out[n:]
+	return n, nil
+}
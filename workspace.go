@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Workspace describes a number of archives that are operated on within a
+// single invocation. For example, an archive may be sharded into several
+// databases split by year or platform.
+type Workspace struct {
+	// List of archives in the workspace.
+	Archives []WorkspaceArchive `json:"archives"`
+}
+
+// WorkspaceArchive describes a single archive within a workspace.
+type WorkspaceArchive struct {
+	// Name used to identify the archive in output. Defaults to the database
+	// path.
+	Name string `json:"name"`
+	// Path to the database file. Relative paths are relative to the workspace
+	// file.
+	Database string `json:"database"`
+	// Path to the config file. Relative paths are relative to the workspace
+	// file. Defaults to the database file path appended with '.json'.
+	Config string `json:"config"`
+	// URLs of the servers owned by the archive. Builds and files from a
+	// server owned by an archive are fetched only into that archive. A server
+	// owned by no archive is fetched into each archive that has it.
+	Servers []string `json:"servers"`
+}
+
+// LoadWorkspace reads a workspace file. A relative path is resolved against the
+// --root directory.
+func LoadWorkspace(path string) (ws *Workspace, err error) {
+	path = rootPath(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open workspace: %w", err)
+	}
+	ws = &Workspace{}
+	err = json.NewDecoder(f).Decode(ws)
+	f.Close()
+	if err != nil {
+		if serr := (*json.SyntaxError)(nil); errors.As(err, &serr) {
+			return nil, fmt.Errorf("decode workspace: offset %d: %w", serr.Offset, serr)
+		}
+		return nil, fmt.Errorf("decode workspace: %w", err)
+	}
+	dir := filepath.Dir(path)
+	owners := map[string]int{}
+	for i, ar := range ws.Archives {
+		if ar.Database == "" {
+			return nil, fmt.Errorf("decode workspace: archive[%d]: expected database", i)
+		}
+		for _, server := range ar.Servers {
+			server = sanitizeBaseURL(server)
+			if j, ok := owners[server]; ok && j != i {
+				return nil, fmt.Errorf("decode workspace: archive[%d]: server %s is owned by archive[%d]", i, server, j)
+			}
+			owners[server] = i
+		}
+		if !filepath.IsAbs(ar.Database) {
+			ar.Database = filepath.Join(dir, ar.Database)
+		}
+		if ar.Config == "" {
+			ar.Config = ar.Database + ".json"
+		} else if !filepath.IsAbs(ar.Config) {
+			ar.Config = filepath.Join(dir, ar.Config)
+		}
+		if ar.Name == "" {
+			ar.Name = ar.Database
+		}
+		ws.Archives[i] = ar
+	}
+	return ws, nil
+}
+
+// Archive is an opened database along with the location of its config file.
+type Archive struct {
+	// Name identifying the archive.
+	Name string
+	// The opened database.
+	DB *sql.DB
+	// Path to the config file of the database.
+	ConfigPath string
+	// URLs of servers owned by other archives of the workspace, whose builds
+	// and files are not fetched into this archive.
+	Foreign []string
+}
+
+// Archives is a list of opened archives.
+type Archives []*Archive
+
+// Close closes the database of the archive, along with the statements cached
+// for it.
+func (ar *Archive) Close() error {
+	statements.Forget(ar.DB)
+	return ar.DB.Close()
+}
+
+// Close closes the database of each archive.
+func (archives Archives) Close() (err error) {
+	for _, ar := range archives {
+		if e := ar.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Each calls fn for each archive, stopping at the first error. When there is
+// more than one archive, the name of each archive is logged before fn is
+// called. Commands that produce results for the whole workspace, such as
+// stats, accumulate them within fn, and display them once Each returns.
+func (archives Archives) Each(fn func(ar *Archive) error) error {
+	for _, ar := range archives {
+		if len(archives) > 1 {
+			log.Printf("archive %s", ar.Name)
+		}
+		if err := fn(ar); err != nil {
+			if len(archives) > 1 {
+				return fmt.Errorf("archive %s: %w", ar.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenArchives opens the archives to be operated on by a command. If a
+// workspace was specified, then each archive in the workspace is opened, and
+// args is returned as-is. Otherwise, the first argument is the path to a single
+// database, and the remaining arguments are returned.
+//
+// The --config flag overrides the config of a single archive, so it is
+// rejected if the workspace has more than one archive.
+func OpenArchives(args []string) (archives Archives, rest []string, err error) {
+	var list []WorkspaceArchive
+	if FlagOptions.Workspace != "" {
+		ws, err := LoadWorkspace(FlagOptions.Workspace)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ws.Archives) == 0 {
+			return nil, nil, fmt.Errorf("workspace has no archives")
+		}
+		if len(ws.Archives) > 1 && FlagOptions.Config != "" {
+			return nil, nil, fmt.Errorf("--config cannot be used with a workspace of %d archives", len(ws.Archives))
+		}
+		list = ws.Archives
+		rest = args
+	} else {
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("expected database file")
+		}
+		list = []WorkspaceArchive{{
+			Name:     args[0],
+			Database: rootPath(args[0]),
+			Config:   rootPath(args[0] + ".json"),
+		}}
+		rest = args[1:]
+	}
+	for i, info := range list {
+		ar, err := openArchive(info)
+		if err != nil {
+			archives.Close()
+			return nil, nil, err
+		}
+		for j, other := range list {
+			if j != i {
+				ar.Foreign = append(ar.Foreign, other.Servers...)
+			}
+		}
+		archives = append(archives, ar)
+	}
+	return archives, rest, nil
+}
+
+// openArchive opens the database of an archive.
+func openArchive(info WorkspaceArchive) (*Archive, error) {
+	// The config is needed to locate the secondary database. A config that
+	// fails to load is ignored here; commands that require the config will
+	// report the error when loading it.
+	var secondary string
+	if config, err := LoadConfig(info.Config); err == nil {
+		secondary = config.SecondaryDatabase
+	}
+	db, err := OpenDatabase(info.Database, secondary)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", info.Name, err)
+	}
+	ar := &Archive{
+		Name:       info.Name,
+		DB:         db,
+		ConfigPath: info.Config,
+	}
+	return ar, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeWorkspace writes a workspace file to a temporary directory, returning
+// its path. The returned function removes the directory.
+func writeWorkspace(t *testing.T, content string) (path string, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rbxark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "ark.workspace.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadWorkspaceOwners(t *testing.T) {
+	path, remove := writeWorkspace(t, `{"archives": [
+		{"database": "a.db", "servers": ["https://example.com/a"]},
+		{"database": "b.db", "servers": ["https://example.com/a/"]}
+	]}`)
+	defer remove()
+	_, err := LoadWorkspace(path)
+	if err == nil || !strings.Contains(err.Error(), "owned by archive[0]") {
+		t.Errorf("expected owner conflict, got %v", err)
+	}
+}
+
+func TestOpenArchivesWorkspace(t *testing.T) {
+	path, remove := writeWorkspace(t, `{"archives": [
+		{"name": "a", "database": "a.db", "servers": ["https://example.com/a"]},
+		{"name": "b", "database": "b.db", "servers": ["https://example.com/b", "https://example.com/c"]},
+		{"name": "c", "database": "c.db"}
+	]}`)
+	defer remove()
+	defer func(workspace, config string) {
+		FlagOptions.Workspace, FlagOptions.Config = workspace, config
+	}(FlagOptions.Workspace, FlagOptions.Config)
+	FlagOptions.Workspace = path
+
+	archives, _, err := OpenArchives(nil)
+	if err != nil {
+		t.Fatalf("open archives: %s", err)
+	}
+	defer archives.Close()
+	foreign := map[string][]string{
+		"a": {"https://example.com/b", "https://example.com/c"},
+		"b": {"https://example.com/a"},
+		"c": {"https://example.com/a", "https://example.com/b", "https://example.com/c"},
+	}
+	for _, ar := range archives {
+		if !reflect.DeepEqual(ar.Foreign, foreign[ar.Name]) {
+			t.Errorf("archive %s: expected foreign servers %v, got %v", ar.Name, foreign[ar.Name], ar.Foreign)
+		}
+	}
+
+	FlagOptions.Config = "ark.json"
+	if archives, _, err := OpenArchives(nil); err == nil {
+		archives.Close()
+		t.Errorf("expected --config to be rejected")
+	}
+}